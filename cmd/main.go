@@ -1,10 +1,15 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	cli "github.com/urfave/cli/v2"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
+	"strings"
+	"time"
 
 	relay "github.com/Ehco1996/ehco/internal/relay"
 )
@@ -15,6 +20,28 @@ var RemoteAddr string
 var TransportType string
 var ConfigPath string
 var PprofPort string
+var StartupTimeout time.Duration
+var MetricsAddr string
+var OtelEndpoint string
+var OtelSampleRate float64
+var MaxConcurrentHandshakes int
+var MaxConns int
+var BufferSize int
+var StatsAddr string
+var LogLevel string
+var LogFormat string
+var LogFile string
+var LogMaxSizeMB int
+var LogMaxBackups int
+var ReloadDrainTimeout time.Duration
+var ReloadToken string
+var ShutdownTimeout time.Duration
+var DashboardUser string
+var DashboardPassword string
+var APIToken string
+var TrafficFile string
+var TrafficSaveInterval time.Duration
+var ConfigSyncInterval time.Duration
 
 func main() {
 	app := cli.NewApp()
@@ -54,18 +81,181 @@ func main() {
 		},
 		&cli.StringFlag{
 			Name:        "c,config",
-			Usage:       "配置文件地址",
+			Usage:       "配置文件地址 .yaml/.yml按yaml解析 其他的按json",
 			Destination: &ConfigPath,
 		},
+		&cli.DurationFlag{
+			Name:        "config_sync_interval",
+			Usage:       "config是http(s)地址时多久重新拉一次 有变化时和reload一样生效 0表示只在启动时拉",
+			EnvVars:     []string{"EHCO_CONFIG_SYNC_INTERVAL"},
+			Destination: &ConfigSyncInterval,
+		},
 		&cli.StringFlag{
 			Name:        "pport",
 			Usage:       "pprof监听端口",
 			EnvVars:     []string{"EHCO_PPROF_PORT"},
 			Destination: &PprofPort,
 		},
+		&cli.DurationFlag{
+			Name:        "startup_timeout",
+			Usage:       "所有监听启动的超时时间 0表示不限制",
+			EnvVars:     []string{"EHCO_STARTUP_TIMEOUT"},
+			Destination: &StartupTimeout,
+		},
+		&cli.StringFlag{
+			Name:        "metrics_addr",
+			Aliases:     []string{"metrics-addr"},
+			Usage:       "prometheus metrics监听地址",
+			EnvVars:     []string{"EHCO_METRICS_ADDR"},
+			Destination: &MetricsAddr,
+		},
+		&cli.StringFlag{
+			Name:        "otel_endpoint",
+			Usage:       "opentelemetry otlp grpc地址 为空时不开启tracing",
+			EnvVars:     []string{"EHCO_OTEL_ENDPOINT"},
+			Destination: &OtelEndpoint,
+		},
+		&cli.Float64Flag{
+			Name:        "otel_sample_rate",
+			Value:       1,
+			Usage:       "tracing的采样率 0到1之间",
+			EnvVars:     []string{"EHCO_OTEL_SAMPLE_RATE"},
+			Destination: &OtelSampleRate,
+		},
+		&cli.IntFlag{
+			Name:        "max_concurrent_handshakes",
+			Usage:       "同时进行的tls/ws/smux握手数量上限 0表示不限制",
+			EnvVars:     []string{"EHCO_MAX_CONCURRENT_HANDSHAKES"},
+			Destination: &MaxConcurrentHandshakes,
+		},
+		&cli.IntFlag{
+			Name:        "max_conns",
+			Usage:       "所有relay加起来同时处理的连接数上限 超过时新的连接直接关掉 0表示不限制",
+			EnvVars:     []string{"EHCO_MAX_CONNS"},
+			Destination: &MaxConns,
+		},
+		&cli.IntFlag{
+			Name:        "buffer_size",
+			Value:       relay.BufferSize,
+			Usage:       "每个连接每个方向copy使用的buffer大小 单位字节",
+			EnvVars:     []string{"EHCO_BUFFER_SIZE"},
+			Destination: &BufferSize,
+		},
+		&cli.StringFlag{
+			Name:        "stats_addr",
+			Usage:       "json格式的/health和/stats监听地址 为空时不启动",
+			EnvVars:     []string{"EHCO_STATS_ADDR"},
+			Destination: &StatsAddr,
+		},
+		&cli.StringFlag{
+			Name:        "log_level",
+			Value:       "info",
+			Usage:       "日志级别 debug/info/warn/error",
+			EnvVars:     []string{"EHCO_LOG_LEVEL"},
+			Destination: &LogLevel,
+		},
+		&cli.StringFlag{
+			Name:        "log_format",
+			Value:       relay.LogFormat_Console,
+			Usage:       "日志格式 console/json",
+			EnvVars:     []string{"EHCO_LOG_FORMAT"},
+			Destination: &LogFormat,
+		},
+		&cli.StringFlag{
+			Name:        "log_file",
+			Usage:       "日志写到这个文件 为空时写到stderr",
+			EnvVars:     []string{"EHCO_LOG_FILE"},
+			Destination: &LogFile,
+		},
+		&cli.IntFlag{
+			Name:        "log_max_size_mb",
+			Value:       100,
+			Usage:       "日志文件超过这个大小之后切分 0表示不切分",
+			EnvVars:     []string{"EHCO_LOG_MAX_SIZE_MB"},
+			Destination: &LogMaxSizeMB,
+		},
+		&cli.IntFlag{
+			Name:        "log_max_backups",
+			Value:       5,
+			Usage:       "最多保留多少个切分出来的旧日志文件",
+			EnvVars:     []string{"EHCO_LOG_MAX_BACKUPS"},
+			Destination: &LogMaxBackups,
+		},
+		&cli.DurationFlag{
+			Name:        "reload_drain_timeout",
+			Value:       30 * time.Second,
+			Usage:       "SIGHUP reload配置时 等待被删掉的relay上的连接转发完的最长时间",
+			EnvVars:     []string{"EHCO_RELOAD_DRAIN_TIMEOUT"},
+			Destination: &ReloadDrainTimeout,
+		},
+		&cli.StringFlag{
+			Name:        "reload_token",
+			Usage:       "stats_addr上POST /reload时X-Auth-Token需要的值 为空时不开启/reload",
+			EnvVars:     []string{"EHCO_RELOAD_TOKEN"},
+			Destination: &ReloadToken,
+		},
+		&cli.DurationFlag{
+			Name:        "shutdown_timeout",
+			Value:       30 * time.Second,
+			Usage:       "收到SIGTERM/SIGINT之后 等待已有连接转发完的最长时间",
+			EnvVars:     []string{"EHCO_SHUTDOWN_TIMEOUT"},
+			Destination: &ShutdownTimeout,
+		},
+		&cli.StringFlag{
+			Name:        "dashboard_user",
+			Value:       "admin",
+			Usage:       "stats_addr上/dashboard/的basic auth用户名",
+			EnvVars:     []string{"EHCO_DASHBOARD_USER"},
+			Destination: &DashboardUser,
+		},
+		&cli.StringFlag{
+			Name:        "dashboard_password",
+			Usage:       "stats_addr上/dashboard/的basic auth密码 为空时不开启dashboard",
+			EnvVars:     []string{"EHCO_DASHBOARD_PASSWORD"},
+			Destination: &DashboardPassword,
+		},
+		&cli.StringFlag{
+			Name:        "api_token",
+			Usage:       "stats_addr上/api/v1/rules管理relay时X-Auth-Token需要的值 为空时不开启",
+			EnvVars:     []string{"EHCO_API_TOKEN"},
+			Destination: &APIToken,
+		},
+		&cli.StringFlag{
+			Name:        "traffic_file",
+			Usage:       "每个relay的累计流量保存到这个json文件 重启之后接着算 为空时不保存",
+			EnvVars:     []string{"EHCO_TRAFFIC_FILE"},
+			Destination: &TrafficFile,
+		},
+		&cli.DurationFlag{
+			Name:        "traffic_save_interval",
+			Value:       time.Minute,
+			Usage:       "多久把累计流量写一次traffic_file 退出时也会写一次",
+			EnvVars:     []string{"EHCO_TRAFFIC_SAVE_INTERVAL"},
+			Destination: &TrafficSaveInterval,
+		},
+	}
+
+	app.Before = func(ctx *cli.Context) error {
+		return relay.InitLogger(LogLevel, LogFormat, relay.LogFile{
+			Path:       LogFile,
+			MaxSizeMB:  LogMaxSizeMB,
+			MaxBackups: LogMaxBackups,
+		})
 	}
 
 	app.Action = start
+	app.Commands = []*cli.Command{
+		{
+			Name:   "diagnose",
+			Usage:  "检查运行环境和配置 有失败项时返回非0",
+			Action: diagnose,
+		},
+		{
+			Name:   "gen-ws-path",
+			Usage:  "生成一个随机的ws_path",
+			Action: genWSPath,
+		},
+	}
 	err := app.Run(os.Args)
 	if err != nil {
 		relay.Logger.Fatal(err)
@@ -74,32 +264,69 @@ func main() {
 }
 
 func start(ctx *cli.Context) error {
-	ch := make(chan error)
-	if ConfigPath != "" {
-		config := relay.NewConfig(ConfigPath)
-		if err := config.LoadConfig(); err != nil {
-			relay.Logger.Fatal(err)
+	if OtelEndpoint != "" {
+		shutdown, err := relay.InitTracing(OtelEndpoint, OtelSampleRate)
+		if err != nil {
+			return err
 		}
+		defer shutdown(context.Background())
+	}
+	relay.SetMaxConcurrentHandshakes(MaxConcurrentHandshakes)
+	relay.SetMaxConns(MaxConns)
+	relay.SetBufferSize(BufferSize)
+
+	// 连接的流量统计要在relay开始转发之前打开
+	if StatsAddr != "" && DashboardPassword != "" {
+		relay.EnableLiveConns()
+	}
 
-		initTls := false
-		for _, cfg := range config.Configs {
-			if cfg.ListenType == relay.Listen_WSS ||
-				cfg.ListenType == relay.Listen_MWSS ||
-				cfg.TransportType == relay.Transport_WSS ||
-				cfg.TransportType == relay.Transport_MWSS && !initTls {
-				relay.InitTlsCfg()
-				initTls = true
+	if TrafficFile != "" {
+		store := &relay.FileTrafficStore{Path: TrafficFile}
+		if err := relay.RestoreTraffic(store); err != nil {
+			return err
+		}
+		stop := make(chan struct{})
+		go saveTrafficLoop(store, stop)
+		defer func() {
+			close(stop)
+			if err := relay.SaveTraffic(store); err != nil {
+				relay.Logger.Errorf("save traffic error: %s", err)
 			}
-			go serveRelay(cfg.Listen, cfg.ListenType, cfg.Remote, cfg.TransportType, ch)
+		}()
+	}
+
+	ch := make(chan error)
+	cfgs, err := loadRelayConfigs()
+	if err != nil {
+		relay.Logger.Fatal(err)
+	}
+	initTls(cfgs)
+	set := newRelaySet()
+	var relays []*relay.Relay
+	for _, cfg := range cfgs {
+		r := newRelay(cfg)
+		set.add(cfg, r)
+		relays = append(relays, r)
+	}
+	// 只有配置文件可以reload
+	if ConfigPath != "" {
+		go set.watchReload()
+		if isRemoteConfig(ConfigPath) && ConfigSyncInterval > 0 {
+			stop := make(chan struct{})
+			go set.watchRemoteConfig(ConfigSyncInterval, stop)
+			defer close(stop)
 		}
-	} else {
-		if ListenType == relay.Listen_WSS ||
-			ListenType == relay.Listen_MWSS ||
-			TransportType == relay.Transport_WSS ||
-			TransportType == relay.Transport_MWSS {
-			relay.InitTlsCfg()
+	}
+	go set.watchShutdown(ch)
+
+	// 被reload停掉的relay不会发送错误 不能让进程退出
+	for _, r := range relays {
+		r.Serve(ch)
+	}
+	if StartupTimeout > 0 {
+		if err := waitRelaysReady(relays, StartupTimeout, ch); err != nil {
+			return err
 		}
-		go serveRelay(LocalAddr, ListenType, RemoteAddr, TransportType, ch)
 	}
 
 	if PprofPort != "" {
@@ -110,13 +337,128 @@ func start(ctx *cli.Context) error {
 		}()
 	}
 
+	if MetricsAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.Handler())
+			relay.Logger.Infof("start metrics server at http://%s/metrics", MetricsAddr)
+			relay.Logger.Fatal(http.ListenAndServe(MetricsAddr, mux))
+		}()
+	}
+
+	if StatsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/", relay.NewStatsHandlerFunc(set.list))
+		if ConfigPath != "" && ReloadToken != "" {
+			mux.Handle("/reload", set.reloadHandler(ReloadToken))
+		}
+		if APIToken != "" {
+			mux.Handle("/api/v1/rules", set.rulesHandler(APIToken))
+			mux.Handle("/api/v1/traffic", trafficHandler(APIToken))
+			mux.Handle("/api/v1/quota", quotaHandler(APIToken))
+		}
+		if DashboardPassword != "" {
+			mux.Handle("/dashboard/", http.StripPrefix("/dashboard",
+				relay.NewDashboardHandler(set.list, DashboardUser, DashboardPassword)))
+		}
+		go func() {
+			relay.Logger.Infof("start stats server at http://%s/stats", StatsAddr)
+			relay.Logger.Fatal(http.ListenAndServe(StatsAddr, mux))
+		}()
+	}
+
 	return <-ch
 }
 
-func serveRelay(local, listenType, remote, transportType string, ch chan error) {
-	r, err := relay.NewRelay(local, listenType, remote, transportType)
+func loadRelayConfigs() ([]relay.RelayConfig, error) {
+	if ConfigPath != "" {
+		config := relay.NewConfig(ConfigPath)
+		if err := config.LoadConfig(); err != nil {
+			return nil, err
+		}
+		return config.Configs, nil
+	}
+	return []relay.RelayConfig{{
+		Listen:        LocalAddr,
+		ListenType:    ListenType,
+		Remote:        RemoteAddr,
+		TransportType: TransportType,
+	}}, nil
+}
+
+func initTls(cfgs []relay.RelayConfig) {
+	// reload时已经生成过的证书继续用
+	if relay.DefaultTLSConfig != nil {
+		return
+	}
+	for _, cfg := range cfgs {
+		// mwss的plain模式不需要证书
+		if cfg.ListenType == relay.Listen_WSS || cfg.ListenType == relay.Listen_GRPC || cfg.ListenType == relay.Listen_QUIC ||
+			(cfg.ListenType == relay.Listen_MWSS && !cfg.MWSSPlainListen) ||
+			cfg.TransportType == relay.Transport_WSS || cfg.TransportType == relay.Transport_GRPC || cfg.TransportType == relay.Transport_QUIC ||
+			(cfg.TransportType == relay.Transport_MWSS && !cfg.MWSSPlainTransport) {
+			relay.InitTlsCfg()
+			return
+		}
+	}
+}
+
+func diagnose(ctx *cli.Context) error {
+	cfgs, err := loadRelayConfigs()
+	if err != nil {
+		return err
+	}
+	initTls(cfgs)
+	failed := 0
+	for _, res := range relay.Diagnose(cfgs) {
+		fmt.Printf("[%s] %s: %s\n", res.Status, res.Name, res.Detail)
+		if res.Status == relay.DiagFail {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return cli.Exit(fmt.Sprintf("%d checks failed", failed), 1)
+	}
+	return nil
+}
+
+func genWSPath(ctx *cli.Context) error {
+	p, err := relay.RandomWSPath()
+	if err != nil {
+		return err
+	}
+	fmt.Println(p)
+	return nil
+}
+
+func newRelay(cfg relay.RelayConfig) *relay.Relay {
+	r, err := relay.NewRelayWithConfig(&cfg)
 	if err != nil {
 		relay.Logger.Fatal(err)
 	}
-	ch <- r.ListenAndServe()
+	return r
+}
+
+func waitRelaysReady(relays []*relay.Relay, timeout time.Duration, ch chan error) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for idx, r := range relays {
+		select {
+		case <-r.Ready():
+		case err := <-ch:
+			return err
+		case <-timer.C:
+			var failed []string
+			for _, r := range relays[idx:] {
+				select {
+				case <-r.Ready():
+				default:
+					failed = append(failed, r.Status().Listen)
+				}
+			}
+			return fmt.Errorf("relays not ready after %s: %s", timeout, strings.Join(failed, ", "))
+		}
+	}
+	relay.Logger.Infof("all %d relays are ready", len(relays))
+	return nil
 }
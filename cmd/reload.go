@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	relay "github.com/Ehco1996/ehco/internal/relay"
+)
+
+// relaySet 当前在跑的relay 按listen地址区分 reload时和新的配置做diff
+type relaySet struct {
+	// SIGHUP和/reload可能同时触发 一次只跑一个reload
+	reloadMu sync.Mutex
+
+	mu     sync.Mutex
+	listen []string
+	relays map[string]*relay.Relay
+	// 创建relay之前的原始配置 NewRelayWithConfig会填上默认值 不能拿它来比较
+	cfgs map[string]relay.RelayConfig
+}
+
+func newRelaySet() *relaySet {
+	return &relaySet{
+		relays: make(map[string]*relay.Relay),
+		cfgs:   make(map[string]relay.RelayConfig),
+	}
+}
+
+func (s *relaySet) add(cfg relay.RelayConfig, r *relay.Relay) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listen = append(s.listen, cfg.Listen)
+	s.relays[cfg.Listen] = r
+	s.cfgs[cfg.Listen] = cfg
+}
+
+// list 按配置文件里的顺序返回当前的relay
+func (s *relaySet) list() []*relay.Relay {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]*relay.Relay, 0, len(s.listen))
+	for _, l := range s.listen {
+		res = append(res, s.relays[l])
+	}
+	return res
+}
+
+// reload 重新读取配置文件 新增的relay开始监听 删掉的relay停止监听后等已有连接转发完
+// 配置有变化的relay按先删后增处理 没有变化的relay不动
+// 新的配置里有任何一个relay创建或者启动失败都会整体放弃 停掉的relay用原来的配置重新启动
+func (s *relaySet) reload() error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	cfgs, err := loadRelayConfigs()
+	if err != nil {
+		return err
+	}
+	// listen地址不会重复 LoadConfig已经检查过
+	newCfgs := make(map[string]relay.RelayConfig, len(cfgs))
+	listen := make([]string, 0, len(cfgs))
+	for _, cfg := range cfgs {
+		newCfgs[cfg.Listen] = cfg
+		listen = append(listen, cfg.Listen)
+	}
+
+	// reloadMu保证只有这里和api会修改relays 读的时候不用加mu
+	initTls(cfgs)
+	started := make(map[string]*relay.Relay)
+	for _, cfg := range cfgs {
+		if old, ok := s.cfgs[cfg.Listen]; ok && reflect.DeepEqual(old, cfg) {
+			continue
+		}
+		c := cfg
+		r, err := relay.NewRelayWithConfig(&c)
+		if err != nil {
+			for _, r := range started {
+				go shutdownRelay(r)
+			}
+			return fmt.Errorf("relay %s: %w", cfg.Listen, err)
+		}
+		started[cfg.Listen] = r
+	}
+
+	// 同一个listen地址不能同时bind 先让出listen地址 再启动新的relay
+	removed := make(map[string]*relay.Relay)
+	for l, r := range s.relays {
+		if _, ok := newCfgs[l]; ok && started[l] == nil {
+			continue
+		}
+		r.StopAccept()
+		removed[l] = r
+	}
+	if err := startRelays(started); err != nil {
+		s.restore(removed)
+		return err
+	}
+	for _, r := range removed {
+		go shutdownRelay(r)
+	}
+
+	s.mu.Lock()
+	for l := range removed {
+		delete(s.relays, l)
+	}
+	for l, r := range started {
+		s.relays[l] = r
+	}
+	s.listen = listen
+	s.cfgs = newCfgs
+	s.mu.Unlock()
+	// 定期同步远程配置时大部分时候没有变化
+	logf := relay.Logger.Infof
+	if len(removed) == 0 && len(started) == 0 {
+		logf = relay.Logger.Debugf
+	}
+	logf("reload config done, %d relays, %d stopped, %d started",
+		len(listen), len(removed), len(started))
+	return nil
+}
+
+// startRelays 依次启动relay 有一个没起来就把所有的都关掉
+func startRelays(relays map[string]*relay.Relay) error {
+	ready := make([]*relay.Relay, 0, len(relays))
+	var err error
+	for l, r := range relays {
+		if err != nil {
+			// 还没启动的只需要关掉transporter
+			go shutdownRelay(r)
+			continue
+		}
+		// 启动失败的relay startRelay自己会关掉
+		if err = startRelay(r, l); err == nil {
+			ready = append(ready, r)
+		}
+	}
+	if err != nil {
+		for _, r := range ready {
+			r.StopAccept()
+			go shutdownRelay(r)
+		}
+	}
+	return err
+}
+
+// restore 新的配置启动失败时用原来的配置重新创建停掉的relay 停掉的relay等已有连接转发完
+func (s *relaySet) restore(removed map[string]*relay.Relay) {
+	for l, old := range removed {
+		go shutdownRelay(old)
+		c := s.cfgs[l]
+		r, err := relay.NewRelayWithConfig(&c)
+		if err == nil {
+			err = startRelay(r, l)
+		}
+		if err != nil {
+			relay.Logger.Errorf("restore relay %s error: %s", l, err)
+			continue
+		}
+		s.mu.Lock()
+		s.relays[l] = r
+		s.mu.Unlock()
+	}
+}
+
+// watchReload 收到SIGHUP时reload配置
+func (s *relaySet) watchReload() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		relay.Logger.Infof("got SIGHUP, reload config %s", ConfigPath)
+		if err := s.reload(); err != nil {
+			relay.Logger.Errorf("reload config error, keep running relays: %s", err)
+		}
+	}
+}
+
+func isRemoteConfig(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// watchRemoteConfig 每interval重新拉一次远程配置直到stop关闭 拉取失败或者配置有错时在跑的relay不受影响
+func (s *relaySet) watchRemoteConfig(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := s.reload(); err != nil {
+				relay.Logger.Warnf("sync config from %s error, keep running relays: %s", ConfigPath, err)
+			}
+		}
+	}
+}
+
+// reloadHandler POST /reload 和SIGHUP一样reload配置 请求需要带上X-Auth-Token
+// reload失败时返回500 在跑的relay不受影响
+func (s *relaySet) reloadHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !checkToken(w, req, token) {
+			return
+		}
+		relay.Logger.Infof("got reload request from %s, reload config %s", req.RemoteAddr, ConfigPath)
+		if err := s.reload(); err != nil {
+			relay.Logger.Errorf("reload config error, keep running relays: %s", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte("ok"))
+	})
+}
+
+// checkToken 请求需要带上X-Auth-Token 不对时返回403
+func checkToken(w http.ResponseWriter, req *http.Request, token string) bool {
+	got := req.Header.Get(relay.AuthTokenHeader)
+	if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		relay.Logger.Warnf("%s %s from %s with wrong token", req.Method, req.URL.Path, req.RemoteAddr)
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
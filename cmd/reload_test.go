@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	relay "github.com/Ehco1996/ehco/internal/relay"
+)
+
+func rawRelayConfig(listen, remote string) relay.RelayConfig {
+	return relay.RelayConfig{
+		Listen:        listen,
+		ListenType:    relay.Listen_RAW,
+		Remote:        remote,
+		TransportType: relay.Transport_RAW,
+	}
+}
+
+func writeConfigFile(t *testing.T, path string, cfgs ...relay.RelayConfig) {
+	data, err := json.Marshal(relay.JsonConfig{Configs: cfgs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadBindFailureRestoresOldRelays(t *testing.T) {
+	a := startTagBackend(t, "a")
+	defer a.Close()
+	b := startTagBackend(t, "b")
+	defer b.Close()
+	occupied, err := net.Listen("tcp", "127.0.0.1:1307")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer occupied.Close()
+
+	path := filepath.Join(t.TempDir(), "config.json")
+	oldPath := ConfigPath
+	ConfigPath = path
+	defer func() { ConfigPath = oldPath }()
+
+	listen := "127.0.0.1:1306"
+	s := newRelaySet()
+	defer s.shutdown(t.Context())
+	writeConfigFile(t, path, rawRelayConfig(listen, a.Addr().String()))
+	if err := s.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if tag := readTag(t, listen); tag != "a" {
+		t.Fatalf("expect relayed to backend a, got %q", tag)
+	}
+
+	// 改了remote的relay已经让出listen地址 新加的relay bind失败之后要用原来的配置恢复
+	writeConfigFile(t, path,
+		rawRelayConfig(listen, b.Addr().String()),
+		rawRelayConfig(occupied.Addr().String(), b.Addr().String()))
+	if err := s.reload(); err == nil {
+		t.Fatal("expect reload error when bind failed")
+	}
+	if tag := readTag(t, listen); tag != "a" {
+		t.Fatalf("expect old relay restored to backend a, got %q", tag)
+	}
+	rules := s.rules()
+	if len(rules) != 1 || rules[0].Remote != a.Addr().String() {
+		t.Fatalf("expect old config kept, got %+v", rules)
+	}
+	if len(s.list()) != 1 {
+		t.Fatalf("expect 1 relay, got %d", len(s.list()))
+	}
+}
+
+// remoteConfigServer 返回当前设置的配置 code不是200时返回错误
+type remoteConfigServer struct {
+	mu    sync.Mutex
+	code  int
+	body  []byte
+	fetch int
+}
+
+func (rs *remoteConfigServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.fetch++
+	w.WriteHeader(rs.code)
+	w.Write(rs.body)
+}
+
+func (rs *remoteConfigServer) set(code int, body []byte) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.code = code
+	rs.body = body
+}
+
+// waitFetch 等远程配置再被拉取n次
+func (rs *remoteConfigServer) waitFetch(t *testing.T, n int) {
+	rs.mu.Lock()
+	want := rs.fetch + n
+	rs.mu.Unlock()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		rs.mu.Lock()
+		got := rs.fetch
+		rs.mu.Unlock()
+		if got >= want {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("remote config not fetched %d times", n)
+}
+
+func TestWatchRemoteConfig(t *testing.T) {
+	a := startTagBackend(t, "a")
+	defer a.Close()
+	b := startTagBackend(t, "b")
+	defer b.Close()
+
+	listen := "127.0.0.1:1308"
+	cfgA, _ := json.Marshal(relay.JsonConfig{Configs: []relay.RelayConfig{rawRelayConfig(listen, a.Addr().String())}})
+	cfgB, _ := json.Marshal(relay.JsonConfig{Configs: []relay.RelayConfig{rawRelayConfig(listen, b.Addr().String())}})
+	rs := &remoteConfigServer{code: http.StatusOK, body: cfgA}
+	srv := httptest.NewServer(rs)
+	defer srv.Close()
+
+	oldPath := ConfigPath
+	ConfigPath = srv.URL + "/config.json"
+	defer func() { ConfigPath = oldPath }()
+
+	s := newRelaySet()
+	defer s.shutdown(t.Context())
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.watchRemoteConfig(20*time.Millisecond, stop)
+		close(done)
+	}()
+
+	rs.waitFetch(t, 2)
+	relays := s.list()
+	if len(relays) != 1 {
+		t.Fatalf("expect 1 relay from remote config, got %d", len(relays))
+	}
+	if tag := readTag(t, listen); tag != "a" {
+		t.Fatalf("expect relayed to backend a, got %q", tag)
+	}
+
+	// 配置没有变化 拉取失败 配置解析失败时都不能动在跑的relay
+	for _, c := range []struct {
+		code int
+		body []byte
+	}{
+		{http.StatusOK, cfgA},
+		{http.StatusInternalServerError, nil},
+		{http.StatusOK, []byte("{")},
+	} {
+		rs.set(c.code, c.body)
+		rs.waitFetch(t, 2)
+		if got := s.list(); len(got) != 1 || got[0] != relays[0] {
+			t.Fatalf("%d %q: expect running relay kept", c.code, c.body)
+		}
+		if tag := readTag(t, listen); tag != "a" {
+			t.Fatalf("%d %q: expect relayed to backend a, got %q", c.code, c.body, tag)
+		}
+	}
+
+	rs.set(http.StatusOK, cfgB)
+	rs.waitFetch(t, 2)
+	if rules := s.rules(); len(rules) != 1 || rules[0].Remote != b.Addr().String() {
+		t.Fatalf("expect remote config applied, got %+v", rules)
+	}
+	if tag := readTag(t, listen); tag != "b" {
+		t.Fatalf("expect relayed to backend b, got %q", tag)
+	}
+
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watchRemoteConfig not stopped")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	relay "github.com/Ehco1996/ehco/internal/relay"
+)
+
+// 新的relay最多等这么久bind成功 api添加和reload都用
+var ruleStartTimeout = 5 * time.Second
+
+var (
+	errRuleExists   = errors.New("relay with the same listen already exists")
+	errRuleNotFound = errors.New("relay not found")
+)
+
+// rules 按添加的顺序返回当前relay的原始配置
+func (s *relaySet) rules() []relay.RelayConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]relay.RelayConfig, 0, len(s.listen))
+	for _, l := range s.listen {
+		res = append(res, s.cfgs[l])
+	}
+	return res
+}
+
+// addRule 创建relay并等它开始监听 bind失败时不会加进去
+func (s *relaySet) addRule(cfg relay.RelayConfig) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	if cfg.Listen == "" {
+		return fmt.Errorf("listen is required")
+	}
+	s.mu.Lock()
+	_, ok := s.relays[cfg.Listen]
+	s.mu.Unlock()
+	if ok {
+		return errRuleExists
+	}
+	initTls([]relay.RelayConfig{cfg})
+	c := cfg
+	r, err := relay.NewRelayWithConfig(&c)
+	if err != nil {
+		return err
+	}
+	if err := startRelay(r, cfg.Listen); err != nil {
+		return err
+	}
+	s.add(cfg, r)
+	relay.Logger.Infof("add relay %s by api", cfg.Listen)
+	return nil
+}
+
+// startRelay 启动relay并等它开始监听 启动失败或者超时的话把它关掉
+func startRelay(r *relay.Relay, listen string) error {
+	errc := make(chan error, 1)
+	go func() {
+		// 启动之后出错只打日志 不能让整个进程退出
+		err := r.ListenAndServe()
+		if err != nil {
+			relay.Logger.Errorf("serve error: %s", err)
+		}
+		errc <- err
+	}()
+	var err error
+	select {
+	case <-r.Ready():
+		return nil
+	case err = <-errc:
+		if err == nil {
+			err = fmt.Errorf("relay %s stopped before ready", listen)
+		}
+	case <-time.After(ruleStartTimeout):
+		err = fmt.Errorf("relay %s not ready after %s", listen, ruleStartTimeout)
+	}
+	// 可能已经有listener bind成功了 先让出listen地址 transporter在Shutdown里关掉
+	r.StopAccept()
+	go shutdownRelay(r)
+	return err
+}
+
+// shutdownRelay 停止监听 已有的连接最多等reload_drain_timeout 之后关掉transporter
+func shutdownRelay(r *relay.Relay) {
+	ctx, cancel := context.WithTimeout(context.Background(), ReloadDrainTimeout)
+	defer cancel()
+	r.Shutdown(ctx)
+}
+
+// removeRule 停止监听 已有的连接最多等reload_drain_timeout
+func (s *relaySet) removeRule(listen string) error {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.mu.Lock()
+	r, ok := s.relays[listen]
+	if ok {
+		delete(s.relays, listen)
+		delete(s.cfgs, listen)
+		for i, l := range s.listen {
+			if l == listen {
+				s.listen = append(s.listen[:i:i], s.listen[i+1:]...)
+				break
+			}
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		return errRuleNotFound
+	}
+	r.StopAccept()
+	go shutdownRelay(r)
+	relay.Logger.Infof("remove relay %s by api", listen)
+	return nil
+}
+
+// rulesHandler /api/v1/rules GET列出所有relay POST添加一个 DELETE ?listen=删除一个
+// 请求需要带上X-Auth-Token 配置文件reload之后以配置文件为准 api添加的relay会被删掉
+func (s *relaySet) rulesHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !checkToken(w, req, token) {
+			return
+		}
+		switch req.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(s.rules())
+		case http.MethodPost:
+			var cfg relay.RelayConfig
+			if err := json.NewDecoder(req.Body).Decode(&cfg); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := s.addRule(cfg); err != nil {
+				code := http.StatusBadRequest
+				if err == errRuleExists {
+					code = http.StatusConflict
+				}
+				http.Error(w, err.Error(), code)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(cfg)
+		case http.MethodDelete:
+			if err := s.removeRule(req.URL.Query().Get("listen")); err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			w.Write([]byte("ok"))
+		default:
+			w.Header().Set("Allow", "GET, POST, DELETE")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// trafficHandler GET /api/v1/traffic 每个relay的累计流量 开启traffic_file时包括重启之前的
+func trafficHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !checkToken(w, req, token) {
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(relay.TrafficSnapshot())
+	})
+}
+
+// quotaRequest quota_bytes不为nil时修改限额 reset为true时从现在开始重新算
+type quotaRequest struct {
+	Listen     string `json:"listen"`
+	QuotaBytes *int64 `json:"quota_bytes"`
+	Reset      bool   `json:"reset"`
+}
+
+// quotaHandler GET /api/v1/quota 所有设置了限额的relay和用掉的流量 POST调整限额或者重置
+// 调整的限额在relay重新创建之后恢复成配置里的值
+func quotaHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !checkToken(w, req, token) {
+			return
+		}
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var qr quotaRequest
+			if err := json.NewDecoder(req.Body).Decode(&qr); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if qr.Listen == "" || (qr.QuotaBytes != nil && *qr.QuotaBytes < 0) {
+				http.Error(w, "listen is required and quota_bytes can not be negative", http.StatusBadRequest)
+				return
+			}
+			if qr.QuotaBytes != nil {
+				relay.SetQuota(qr.Listen, *qr.QuotaBytes)
+			}
+			if qr.Reset {
+				relay.ResetQuota(qr.Listen)
+			}
+			relay.Logger.Infof("update quota of relay %s by api", qr.Listen)
+		default:
+			w.Header().Set("Allow", "GET, POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(relay.QuotaSnapshot())
+	})
+}
+
+// saveTrafficLoop 每traffic_save_interval保存一次累计流量
+func saveTrafficLoop(store relay.TrafficStore, stop <-chan struct{}) {
+	ticker := time.NewTicker(TrafficSaveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := relay.SaveTraffic(store); err != nil {
+				relay.Logger.Errorf("save traffic error: %s", err)
+			}
+		}
+	}
+}
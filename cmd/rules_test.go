@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	relay "github.com/Ehco1996/ehco/internal/relay"
+)
+
+// startTagBackend 每个连接先写tag 之后原样返回收到的数据 用来区分流量转发到了哪个后端
+func startTagBackend(t *testing.T, tag string) net.Listener {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.Write([]byte(tag))
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return backend
+}
+
+// readTag 连上listen读出后端写的tag
+func readTag(t *testing.T, listen string) string {
+	c, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
+
+func doRulesRequest(t *testing.T, h http.Handler, method, target, token, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set(relay.AuthTokenHeader, token)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestRulesHandler(t *testing.T) {
+	backend := startTagBackend(t, "a")
+	defer backend.Close()
+
+	s := newRelaySet()
+	h := s.rulesHandler("token")
+	listen := "127.0.0.1:1304"
+	body := `{"listen":"` + listen + `","listen_type":"raw","remote":"` +
+		backend.Addr().String() + `","transport_type":"raw"}`
+
+	if w := doRulesRequest(t, h, http.MethodPost, "/api/v1/rules", "wrong", body); w.Code != http.StatusForbidden {
+		t.Fatalf("expect 403 with wrong token, got %d", w.Code)
+	}
+	if len(s.list()) != 0 {
+		t.Fatal("expect no relay added with wrong token")
+	}
+
+	if w := doRulesRequest(t, h, http.MethodPost, "/api/v1/rules", "token", body); w.Code != http.StatusCreated {
+		t.Fatalf("expect 201, got %d: %s", w.Code, w.Body)
+	}
+	if tag := readTag(t, listen); tag != "a" {
+		t.Fatalf("expect relayed to backend a, got %q", tag)
+	}
+
+	w := doRulesRequest(t, h, http.MethodGet, "/api/v1/rules", "token", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expect 200, got %d", w.Code)
+	}
+	var rules []relay.RelayConfig
+	if err := json.NewDecoder(w.Body).Decode(&rules); err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 1 || rules[0].Listen != listen {
+		t.Fatalf("expect rule %s listed, got %+v", listen, rules)
+	}
+
+	if w := doRulesRequest(t, h, http.MethodPost, "/api/v1/rules", "token", body); w.Code != http.StatusConflict {
+		t.Fatalf("expect 409 with duplicate listen, got %d", w.Code)
+	}
+
+	if w := doRulesRequest(t, h, http.MethodDelete, "/api/v1/rules?listen="+listen, "token", ""); w.Code != http.StatusOK {
+		t.Fatalf("expect 200, got %d: %s", w.Code, w.Body)
+	}
+	if len(s.list()) != 0 {
+		t.Fatal("expect relay removed")
+	}
+	if c, err := net.DialTimeout("tcp", listen, time.Second); err == nil {
+		c.Close()
+		t.Fatal("expect listen closed after delete")
+	}
+	if w := doRulesRequest(t, h, http.MethodDelete, "/api/v1/rules?listen="+listen, "token", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("expect 404 deleting again, got %d", w.Code)
+	}
+}
+
+func TestAddRuleBindFailure(t *testing.T) {
+	occupied, err := net.Listen("tcp", "127.0.0.1:1305")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer occupied.Close()
+
+	s := newRelaySet()
+	h := s.rulesHandler("token")
+	body := `{"listen":"127.0.0.1:1305","listen_type":"raw","remote":"127.0.0.1:1","transport_type":"raw"}`
+	if w := doRulesRequest(t, h, http.MethodPost, "/api/v1/rules", "token", body); w.Code != http.StatusBadRequest {
+		t.Fatalf("expect 400 when bind failed, got %d", w.Code)
+	}
+	if len(s.list()) != 0 {
+		t.Fatal("expect relay not added when bind failed")
+	}
+}
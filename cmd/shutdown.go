@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	relay "github.com/Ehco1996/ehco/internal/relay"
+)
+
+// shutdown 所有relay停止监听 等已有的连接转发完 ctx结束时剩下的连接直接关掉
+func (s *relaySet) shutdown(ctx context.Context) {
+	// 不让reload在停止的过程中再启动新的relay
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, r := range s.list() {
+		wg.Add(1)
+		go func(r *relay.Relay) {
+			defer wg.Done()
+			r.Shutdown(ctx)
+		}(r)
+	}
+	wg.Wait()
+}
+
+// watchShutdown 收到SIGTERM/SIGINT时优雅退出 再收到一次直接退出
+func (s *relaySet) watchShutdown(done chan<- error) {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	got := <-sig
+	relay.Logger.Infof("got %s, shutdown with timeout %s", got, ShutdownTimeout)
+	go func() {
+		got := <-sig
+		relay.Logger.Fatalf("got %s again, exit now", got)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	s.shutdown(ctx)
+	done <- nil
+}
@@ -0,0 +1,117 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var deniedConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "ehco",
+	Subsystem: "relay",
+	Name:      "denied_connections_total",
+	Help:      "connections rejected by allow_cidrs/deny_cidrs",
+}, []string{"relay"})
+
+func init() {
+	prometheus.MustRegister(deniedConnections)
+}
+
+// ipACL 先看deny 再看allow allow为空表示全部允许
+type ipACL struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		// 单个ip当成/32或者/128
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip: %s", cidr)
+			}
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func newIPACL(allow, deny []string) (*ipACL, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	a, err := parseCIDRs(allow)
+	if err != nil {
+		return nil, err
+	}
+	d, err := parseCIDRs(deny)
+	if err != nil {
+		return nil, err
+	}
+	return &ipACL{allow: a, deny: d}, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (acl *ipACL) allowed(ip net.IP) bool {
+	if acl == nil {
+		return true
+	}
+	if containsIP(acl.deny, ip) {
+		return false
+	}
+	return len(acl.allow) == 0 || containsIP(acl.allow, ip)
+}
+
+// allowAddr addr可以是net.Addr或者http.Request.RemoteAddr那样的host:port
+// 被拒绝的时候打日志并且计数
+func (r *Relay) allowAddr(addr interface{}) bool {
+	if r.acl == nil {
+		return true
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	case net.Addr:
+		ip = hostIP(a.String())
+	case string:
+		ip = hostIP(a)
+	}
+	if ip != nil && r.acl.allowed(ip) {
+		return true
+	}
+	Logger.Warnf("relay %s deny connection from %v", r.cfg.Listen, addr)
+	deniedConnections.WithLabelValues(r.cfg.Listen).Inc()
+	return false
+}
+
+func hostIP(hostport string) net.IP {
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	return net.ParseIP(host)
+}
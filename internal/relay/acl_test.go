@@ -0,0 +1,136 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := parseCIDRs([]string{"10.0.0.1", "2001:db8::1", "192.168.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 单个ip当成/32或者/128
+	for i, want := range []string{"10.0.0.1/32", "2001:db8::1/128", "192.168.0.0/16"} {
+		if nets[i].String() != want {
+			t.Fatalf("expect %s, got %s", want, nets[i])
+		}
+	}
+	for _, bad := range []string{"10.0.0", "10.0.0.0/33", "example.com"} {
+		if _, err := parseCIDRs([]string{bad}); err == nil {
+			t.Fatalf("expect %q rejected", bad)
+		}
+	}
+	if acl, err := newIPACL(nil, nil); acl != nil || err != nil {
+		t.Fatalf("expect no acl without cidrs, got %v %v", acl, err)
+	}
+}
+
+func TestIPACLAllowed(t *testing.T) {
+	acl, err := newIPACL([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.1.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ip, want := range map[string]bool{
+		"10.0.0.1":    true,
+		"2001:db8::5": true,
+		// deny优先于allow
+		"10.1.2.3": false,
+		// 不在allow里
+		"192.168.1.1": false,
+		"2001:db9::1": false,
+	} {
+		if got := acl.allowed(net.ParseIP(ip)); got != want {
+			t.Fatalf("%s: expect allowed=%v, got %v", ip, want, got)
+		}
+	}
+
+	// allow为空时只看deny
+	denyOnly, err := newIPACL(nil, []string{"10.1.2.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if denyOnly.allowed(net.ParseIP("10.1.2.3")) || !denyOnly.allowed(net.ParseIP("8.8.8.8")) {
+		t.Fatal("expect empty allow list to allow everything not denied")
+	}
+	var none *ipACL
+	if !none.allowed(net.ParseIP("8.8.8.8")) {
+		t.Fatal("expect nil acl to allow everything")
+	}
+}
+
+func TestAllowAddr(t *testing.T) {
+	acl, err := newIPACL([]string{"10.0.0.0/8"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &Relay{cfg: &RelayConfig{Listen: "acl-test"}, acl: acl}
+	denied := deniedConnections.WithLabelValues("acl-test")
+	for _, c := range []struct {
+		addr interface{}
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}, true},
+		{&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1}, true},
+		// http.Request.RemoteAddr
+		{"10.0.0.1:1234", true},
+		{"[2001:db8::1]:1234", false},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1}, false},
+		// 解析不出ip的拒绝
+		{"not-an-ip", false},
+	} {
+		before := testutil.ToFloat64(denied)
+		if got := r.allowAddr(c.addr); got != c.want {
+			t.Fatalf("%v: expect allowed=%v, got %v", c.addr, c.want, got)
+		}
+		wantInc := 0.0
+		if !c.want {
+			wantInc = 1
+		}
+		if inc := testutil.ToFloat64(denied) - before; inc != wantInc {
+			t.Fatalf("%v: expect denied counter +%v, got +%v", c.addr, wantInc, inc)
+		}
+	}
+}
+
+func TestDeniedClientClosed(t *testing.T) {
+	backend := startEchoBackend(t)
+	defer backend.Close()
+
+	listen := "127.0.0.1:1303"
+	r, err := NewRelayWithConfig(&RelayConfig{
+		Listen:        listen,
+		ListenType:    Listen_RAW,
+		Remote:        backend.Addr().String(),
+		TransportType: Transport_RAW,
+		DenyCIDRs:     []string{"127.0.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.ListenAndServe()
+	defer r.Shutdown(context.Background())
+	select {
+	case <-r.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay not ready")
+	}
+
+	c, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("ping"))
+	if n, err := c.Read(make([]byte, 4)); err == nil {
+		t.Fatalf("expect denied client closed, read %d bytes", n)
+	}
+	if n := testutil.ToFloat64(deniedConnections.WithLabelValues(listen)); n != 1 {
+		t.Fatalf("expect 1 denied connection, got %v", n)
+	}
+}
@@ -0,0 +1,56 @@
+package relay
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acme_cache_dir没有配置时证书和账号保存的目录
+var DefaultACMECacheDir = "ehco-acme"
+
+// newACMEManager 配置了acme_domains时用Let's Encrypt自动申请和续期证书
+// tls-alpn-01在wss/mwss/grpc的tls listener上直接完成 http-01需要80端口 见acme_http_listen
+func newACMEManager(cfg *RelayConfig) (*autocert.Manager, error) {
+	if len(cfg.ACMEDomains) == 0 {
+		if cfg.ACMEHTTPListen != "" {
+			return nil, fmt.Errorf("acme_http_listen requires acme_domains")
+		}
+		return nil, nil
+	}
+	if cfg.CertFile != "" {
+		return nil, fmt.Errorf("acme_domains can not be used with cert_file")
+	}
+	if cfg.MWSSPlainListen {
+		return nil, fmt.Errorf("acme_domains can not be used with mwss_plain_listen")
+	}
+	cacheDir := cfg.ACMECacheDir
+	if cacheDir == "" {
+		cacheDir = DefaultACMECacheDir
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.ACMEDomains...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      cfg.ACMEEmail,
+	}, nil
+}
+
+// runACMEHTTPServer http-01 challenge 其他请求和wss/mwss一样返回伪装页面
+// 出错只打日志 tls-alpn-01还可以继续用
+func (r *Relay) runACMEHTTPServer() {
+	server := &http.Server{
+		Addr:              r.cfg.ACMEHTTPListen,
+		Handler:           r.fakeIndex,
+		ReadHeaderTimeout: 30 * time.Second,
+		ReadTimeout:       time.Duration(r.cfg.HTTPReadTimeoutSec) * time.Second,
+		MaxHeaderBytes:    r.cfg.HTTPMaxHeaderBytes,
+	}
+	r.trackListener(server)
+	Logger.Infof("relay %s serve acme http-01 challenge at %s", r.cfg.Listen, r.cfg.ACMEHTTPListen)
+	if err := server.ListenAndServe(); err != nil && !r.isStopped() {
+		Logger.Errorf("relay %s acme http server error: %s", r.cfg.Listen, err)
+	}
+}
@@ -0,0 +1,32 @@
+package relay
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNewACMEManager(t *testing.T) {
+	m, err := newACMEManager(&RelayConfig{})
+	if err != nil || m != nil {
+		t.Fatalf("expect no acme manager without domains, got %v %v", m, err)
+	}
+	for _, cfg := range []*RelayConfig{
+		{ACMEHTTPListen: ":80"},
+		{ACMEDomains: []string{"example.com"}, CertFile: "cert.pem"},
+		{ACMEDomains: []string{"example.com"}, MWSSPlainListen: true},
+	} {
+		if _, err := newACMEManager(cfg); err == nil {
+			t.Fatalf("expect error for %+v", cfg)
+		}
+	}
+	m, err = newACMEManager(&RelayConfig{ACMEDomains: []string{"example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.HostPolicy(context.Background(), "example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.HostPolicy(context.Background(), "other.com"); err == nil {
+		t.Fatal("expect host not in acme_domains rejected")
+	}
+}
@@ -0,0 +1,136 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+const (
+	challengeNonceSize = 32
+	challengeOK        = 1
+	challengeFailed    = 0
+)
+
+var ErrChallengeFailed = errors.New("mwss challenge failed")
+
+func signNonce(nonce []byte, psk string) []byte {
+	mac := hmac.New(sha256.New, []byte(psk))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// clientChallenge 在session的第一个stream上回应server发来的nonce
+func clientChallenge(session *smux.Session, psk string) error {
+	stream, err := session.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	if err := stream.SetDeadline(time.Now().Add(WsDeadline)); err != nil {
+		return err
+	}
+
+	nonce := make([]byte, challengeNonceSize)
+	if _, err := io.ReadFull(stream, nonce); err != nil {
+		return err
+	}
+	if _, err := stream.Write(signNonce(nonce, psk)); err != nil {
+		return err
+	}
+	res := make([]byte, 1)
+	if _, err := io.ReadFull(stream, res); err != nil {
+		return err
+	}
+	if res[0] != challengeOK {
+		return ErrChallengeFailed
+	}
+	return nil
+}
+
+// serverChallenge 校验通过之前session不能用来转发
+func serverChallenge(session *smux.Session, psk string) error {
+	if err := session.SetDeadline(time.Now().Add(WsDeadline)); err != nil {
+		return err
+	}
+	stream, err := session.AcceptStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	if err := session.SetDeadline(time.Time{}); err != nil {
+		return err
+	}
+	if err := stream.SetDeadline(time.Now().Add(WsDeadline)); err != nil {
+		return err
+	}
+
+	nonce := make([]byte, challengeNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if _, err := stream.Write(nonce); err != nil {
+		return err
+	}
+	mac := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(stream, mac); err != nil {
+		return err
+	}
+	if !hmac.Equal(mac, signNonce(nonce, psk)) {
+		stream.Write([]byte{challengeFailed})
+		return ErrChallengeFailed
+	}
+	_, err = stream.Write([]byte{challengeOK})
+	return err
+}
+
+// ws升级时携带token的header 或者url query 有的CDN会去掉自定义header
+const (
+	AuthTokenHeader = "X-Auth-Token"
+	AuthTokenQuery  = "token"
+)
+
+// authTokenHeader 没有配置token时返回nil 和以前的请求保持一致
+func authTokenHeader(token string) http.Header {
+	if token == "" {
+		return nil
+	}
+	h := http.Header{}
+	h.Set(AuthTokenHeader, token)
+	return h
+}
+
+// withAuthTokenQuery 把token加到ws url的query里 token为空时原样返回
+func withAuthTokenQuery(addr, token string) (string, error) {
+	if token == "" {
+		return addr, nil
+	}
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set(AuthTokenQuery, token)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// checkAuthToken 没有配置token时总是放行 header和query里有一个对就行
+func checkAuthToken(r *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+	got := r.Header.Get(AuthTokenHeader)
+	if got == "" {
+		got = r.URL.Query().Get(AuthTokenQuery)
+	}
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
@@ -0,0 +1,92 @@
+package relay
+
+import (
+	"net"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/xtaci/smux"
+)
+
+func TestCheckAuthToken(t *testing.T) {
+	r := httptest.NewRequest("GET", "/tcp/", nil)
+	if !checkAuthToken(r, "") {
+		t.Fatal("expect no token configured always pass")
+	}
+	if checkAuthToken(r, "secret") {
+		t.Fatal("expect request without token rejected")
+	}
+	r.Header.Set(AuthTokenHeader, "secret")
+	if !checkAuthToken(r, "secret") {
+		t.Fatal("expect token in header accepted")
+	}
+
+	addr, err := withAuthTokenQuery("wss://example.com/tcp/", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "wss://example.com/tcp/?token=secret" {
+		t.Fatalf("unexpected url %s", addr)
+	}
+	if !checkAuthToken(httptest.NewRequest("GET", addr, nil), "secret") {
+		t.Fatal("expect token in query accepted")
+	}
+	if checkAuthToken(httptest.NewRequest("GET", "/tcp/?token=wrong", nil), "secret") {
+		t.Fatal("expect wrong token rejected")
+	}
+}
+
+func TestAuthTokenMismatchServeFakeIndex(t *testing.T) {
+	r, err := NewRelayWithConfig(&RelayConfig{
+		Listen:        "127.0.0.1:0",
+		ListenType:    Listen_WSS,
+		Remote:        "127.0.0.1:1",
+		TransportType: Transport_RAW,
+		AuthToken:     "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/tcp/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	w := httptest.NewRecorder()
+	r.handleWsToTcp(w, req)
+	if w.Code != 200 || w.Body.Len() == 0 {
+		t.Fatalf("expect fake index, got %d %q", w.Code, w.Body.String())
+	}
+}
+
+func TestSessionChallenge(t *testing.T) {
+	for _, c := range []struct {
+		clientPSK string
+		ok        bool
+	}{
+		{"secret", true},
+		{"wrong", false},
+	} {
+		c1, c2 := net.Pipe()
+		client, err := smux.Client(c1, smux.DefaultConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		server, err := smux.Server(c2, smux.DefaultConfig())
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverErr := make(chan error, 1)
+		go func() { serverErr <- serverChallenge(server, "secret") }()
+		clientErr := clientChallenge(client, c.clientPSK)
+		sErr := <-serverErr
+		client.Close()
+		server.Close()
+		if c.ok && (clientErr != nil || sErr != nil) {
+			t.Fatalf("psk %q: expect challenge passed, got client %v server %v", c.clientPSK, clientErr, sErr)
+		}
+		if !c.ok && (clientErr != ErrChallengeFailed || sErr != ErrChallengeFailed) {
+			t.Fatalf("psk %q: expect challenge failed, got client %v server %v", c.clientPSK, clientErr, sErr)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package relay
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerState_Closed   = "closed"
+	BreakerState_Open     = "open"
+	BreakerState_HalfOpen = "half_open"
+)
+
+var (
+	// circuit_breaker_window_sec和circuit_breaker_cooldown_sec没有配置时使用
+	DefaultCircuitBreakerWindow   = 60 * time.Second
+	DefaultCircuitBreakerCooldown = 30 * time.Second
+
+	ErrCircuitOpen = errors.New("backend circuit breaker open")
+)
+
+type breakerEntry struct {
+	state string
+	// 窗口内连续失败的次数和第一次失败的时间
+	failures    int
+	firstFailAt time.Time
+	openedAt    time.Time
+}
+
+// circuitBreaker 按后端地址熔断 window内连续失败threshold次之后open
+// open期间直接返回ErrCircuitOpen cooldown之后half open 只放一个连接去试探
+type circuitBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*breakerEntry
+}
+
+// newCircuitBreaker threshold不大于0时返回nil 表示不熔断
+func newCircuitBreaker(threshold int, window, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		return nil
+	}
+	if window <= 0 {
+		window = DefaultCircuitBreakerWindow
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultCircuitBreakerCooldown
+	}
+	return &circuitBreaker{
+		threshold: threshold,
+		window:    window,
+		cooldown:  cooldown,
+		now:       time.Now,
+		entries:   make(map[string]*breakerEntry),
+	}
+}
+
+// allow 返回nil时调用方必须在dial结束后调用success或failure
+func (b *circuitBreaker) allow(addr string) error {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.entries[addr]
+	if !ok {
+		return nil
+	}
+	switch e.state {
+	case BreakerState_Open:
+		if b.now().Sub(e.openedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		e.state = BreakerState_HalfOpen
+		Logger.Infof("[breaker] backend %s half open", addr)
+		return nil
+	case BreakerState_HalfOpen:
+		// 已经有一个连接在试探了
+		return ErrCircuitOpen
+	}
+	return nil
+}
+
+func (b *circuitBreaker) success(addr string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if e, ok := b.entries[addr]; ok {
+		if e.state != BreakerState_Closed {
+			Logger.Infof("[breaker] backend %s recovered", addr)
+		}
+		delete(b.entries, addr)
+	}
+}
+
+func (b *circuitBreaker) failure(addr string) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	e, ok := b.entries[addr]
+	if !ok {
+		e = &breakerEntry{state: BreakerState_Closed}
+		b.entries[addr] = e
+	}
+	if e.state == BreakerState_HalfOpen {
+		// 试探失败 重新开始cooldown
+		e.state, e.openedAt = BreakerState_Open, now
+		Logger.Warnf("[breaker] backend %s still failing, open again", addr)
+		return
+	}
+	if e.failures == 0 || now.Sub(e.firstFailAt) > b.window {
+		e.failures, e.firstFailAt = 0, now
+	}
+	e.failures++
+	if e.failures >= b.threshold {
+		e.state, e.openedAt, e.failures = BreakerState_Open, now, 0
+		Logger.Warnf("[breaker] backend %s open after %d failures, cooldown %s", addr, b.threshold, b.cooldown)
+	}
+}
+
+func (b *circuitBreaker) state(addr string) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if e, ok := b.entries[addr]; ok {
+		return e.state
+	}
+	return BreakerState_Closed
+}
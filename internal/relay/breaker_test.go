@@ -0,0 +1,70 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(0, 0)
+	b := newCircuitBreaker(3, time.Minute, 10*time.Second)
+	b.now = func() time.Time { return now }
+	addr := "127.0.0.1:1"
+
+	// 窗口外的失败不算连续失败
+	b.failure(addr)
+	b.failure(addr)
+	now = now.Add(2 * time.Minute)
+	b.failure(addr)
+	if err := b.allow(addr); err != nil {
+		t.Fatalf("should not trip across window: %s", err)
+	}
+	b.failure(addr)
+	b.failure(addr)
+	if b.state(addr) != BreakerState_Open || b.allow(addr) != ErrCircuitOpen {
+		t.Fatalf("should trip after 3 failures, got %s", b.state(addr))
+	}
+
+	// cooldown之后只放一个试探 试探失败重新open
+	now = now.Add(10 * time.Second)
+	if err := b.allow(addr); err != nil {
+		t.Fatalf("half open should allow one probe: %s", err)
+	}
+	if b.allow(addr) != ErrCircuitOpen {
+		t.Fatal("half open should only allow one probe")
+	}
+	b.failure(addr)
+	if b.state(addr) != BreakerState_Open || b.allow(addr) != ErrCircuitOpen {
+		t.Fatal("failed probe should open again")
+	}
+	now = now.Add(10 * time.Second)
+	if err := b.allow(addr); err != nil {
+		t.Fatal(err)
+	}
+	b.success(addr)
+	if b.state(addr) != BreakerState_Closed {
+		t.Fatalf("successful probe should close, got %s", b.state(addr))
+	}
+}
+
+func TestBackendPoolBreaker(t *testing.T) {
+	p, err := newBackendPool([]string{"a"}, LBPolicy_RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.breaker = newCircuitBreaker(2, time.Minute, time.Minute)
+	calls := 0
+	fail := func(string) error {
+		calls++
+		return errors.New("dial failed")
+	}
+	p.try(1, fail)
+	p.try(1, fail)
+	if _, err := p.try(1, fail); err != ErrCircuitOpen || calls != 2 {
+		t.Fatalf("tripped backend should fail fast, err %v calls %d", err, calls)
+	}
+	if s := p.breakerStates()["a"]; s != BreakerState_Open {
+		t.Fatalf("expect open state, got %s", s)
+	}
+}
@@ -1,19 +1,31 @@
 package relay
 
 import (
+	"errors"
 	"io"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
 )
 
-// 4KB
-const BUFFER_SIZE = 4 * 1024
+// 默认32KB 需要在relay启动前通过SetBufferSize修改
+var BufferSize = 32 * 1024
 
 // 全局pool
 var inboundBufferPool, outboundBufferPool *sync.Pool
 
 func init() {
-	inboundBufferPool = newBufferPool(BUFFER_SIZE)
-	outboundBufferPool = newBufferPool(BUFFER_SIZE)
+	SetBufferSize(BufferSize)
+}
+
+// SetBufferSize 修改copy使用的buffer大小 会重建全局pool
+func SetBufferSize(size int) {
+	BufferSize = size
+	inboundBufferPool = newBufferPool(size)
+	outboundBufferPool = newBufferPool(size)
 }
 
 func newBufferPool(size int) *sync.Pool {
@@ -29,32 +41,224 @@ func copyBuffer(dst io.Writer, src io.Reader, bufferPool *sync.Pool) error {
 	return err
 }
 
+// inflightLimiter 限制一个方向上已经读出但还没写出去的字节数
+type inflightLimiter struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	max     int
+	pending int
+	closed  bool
+}
+
+func newInflightLimiter(max int) *inflightLimiter {
+	l := &inflightLimiter{max: max}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire 在超过上限时阻塞读端, 返回false表示写端已经退出
+func (l *inflightLimiter) acquire(n int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// pending为0时总是放行 防止单次读超过上限时死锁
+	for !l.closed && l.pending > 0 && l.pending+n > l.max {
+		l.cond.Wait()
+	}
+	if l.closed {
+		return false
+	}
+	l.pending += n
+	return true
+}
+
+func (l *inflightLimiter) release(n int) {
+	l.mu.Lock()
+	l.pending -= n
+	l.mu.Unlock()
+	l.cond.Signal()
+}
+
+func (l *inflightLimiter) close() {
+	l.mu.Lock()
+	l.closed = true
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
+// inflightCopy 读写分离的copy, 慢的一端来不及写出时最多缓存maxInflight字节
+func inflightCopy(dst io.Writer, src io.Reader, bufferPool *sync.Pool, maxInflight int) error {
+	limiter := newInflightLimiter(maxInflight)
+	bufCh := make(chan []byte, maxInflight/BufferSize+1)
+	writeErrCh := make(chan error, 1)
+
+	go func() {
+		var werr error
+		for b := range bufCh {
+			if werr == nil {
+				if _, werr = dst.Write(b); werr != nil {
+					// 唤醒可能阻塞的读端
+					limiter.close()
+				}
+			}
+			limiter.release(len(b))
+			bufferPool.Put(b[:cap(b)])
+		}
+		writeErrCh <- werr
+	}()
+
+	var rerr error
+	for {
+		buf := bufferPool.Get().([]byte)
+		n, err := src.Read(buf)
+		if n > 0 {
+			if !limiter.acquire(n) {
+				bufferPool.Put(buf)
+				break
+			}
+			bufCh <- buf[:n]
+		} else {
+			bufferPool.Put(buf)
+		}
+		if err != nil {
+			rerr = err
+			break
+		}
+	}
+	close(bufCh)
+	werr := <-writeErrCh
+	if werr != nil {
+		return werr
+	}
+	return rerr
+}
+
+// errHalfClosed 一个方向读到EOF 并且已经把EOF通过CloseWrite传给了对端
+var errHalfClosed = errors.New("half closed")
+
+// errHalfCloseUnsupported 包装的conn底下不支持CloseWrite
+var errHalfCloseUnsupported = errors.New("half close unsupported")
+
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite 关闭w的写端 w不支持半关闭时返回false
+func closeWrite(w io.Writer) bool {
+	cw, ok := w.(closeWriter)
+	if !ok {
+		return false
+	}
+	return cw.CloseWrite() == nil
+}
+
+// transferStats 一个连接两个方向上copy的字节数
+type transferStats struct {
+	in  int64 // client -> backend
+	out int64 // backend -> client
+}
+
 // NOTE must call setdeadline before use this func or may goroutine  leak
-func transport(rw1, rw2 io.ReadWriter) error {
-	errc := make(chan error, 1)
+// client是发起连接的一端 backend是ehco dial出去的一端
+// 一个方向读到EOF时 如果对端支持半关闭就只关闭对端的写 等另一个方向也结束再返回
+// 不支持半关闭的(ws和smux stream)和以前一样 任意一个方向结束就返回
+// 返回的时候另一个方向可能还没退出 字节数以返回时为准
+func transport(client, backend io.ReadWriter, cfg *RelayConfig) (transferStats, error) {
+	var st transferStats
+	m := newTrafficMetrics(cfg)
+	m.connOpen()
+	defer m.connClose()
+
+	var watchdog *idleWatchdog
+	if cfg.IdleTimeoutSec > 0 {
+		watchdog = newIdleWatchdog(time.Duration(cfg.IdleTimeoutSec) * time.Second)
+		done := make(chan struct{})
+		defer close(done)
+		var closers []io.Closer
+		for _, rw := range []io.ReadWriter{client, backend} {
+			if c, ok := rw.(io.Closer); ok {
+				closers = append(closers, c)
+			}
+		}
+		go watchdog.watch(done, closers...)
+	}
+
+	var streams func() int
+	if cfg.RateLimitBytesPerSec > 0 && cfg.MWSSFairShareStreams > 0 {
+		streams = sessionStreamsOf(client, backend)
+	}
+
+	var sharedIn, sharedOut *rate.Limiter
+	if bw := bandwidthFor(cfg.Listen); bw != nil {
+		sharedIn, sharedOut = bw.in, bw.out
+	}
+
+	errc := make(chan error, 2)
+	cp := func(dst io.Writer, src io.Reader, bufferPool *sync.Pool, counter prometheus.Counter, total, conn *int64, shared *rate.Limiter) error {
+		dst = &countWriter{Writer: dst, counter: counter, total: total, conn: conn}
+		if watchdog != nil {
+			src = &activityReader{Reader: src, w: watchdog}
+		}
+		// 两个方向各自一个limiter 没有配置时不分配
+		if cfg.RateLimitBytesPerSec > 0 {
+			rl := newRateLimitedReader(src, cfg.RateLimitBytesPerSec)
+			if streams != nil {
+				rl.fairShare(streams, cfg.MWSSFairShareStreams)
+			}
+			src = rl
+		}
+		// relay上所有连接共用的限速 和单个连接的限速同时生效
+		if shared != nil {
+			src = newSharedRateLimitedReader(src, shared)
+		}
+		if cfg.WriteCoalesceWindowMs > 0 {
+			cw := newCoalesceWriter(dst, time.Duration(cfg.WriteCoalesceWindowMs)*time.Millisecond)
+			defer cw.Flush()
+			dst = cw
+		}
+		// 同步copy时在途的数据不会超过一个buffer
+		if cfg.MaxInflightBytes > BufferSize {
+			return inflightCopy(dst, src, bufferPool, cfg.MaxInflightBytes)
+		}
+		return copyBuffer(dst, src, bufferPool)
+	}
+	halfClose := func(dst io.Writer, err error) error {
+		if (err == nil || err == io.EOF) && closeWrite(dst) {
+			return errHalfClosed
+		}
+		return err
+	}
 	go func() {
-		errc <- copyBuffer(rw1, rw2, inboundBufferPool)
+		errc <- halfClose(client, cp(client, backend, inboundBufferPool, m.out, &m.stats.bytesOut, &st.out, sharedOut))
 	}()
 
 	go func() {
-		errc <- copyBuffer(rw2, rw1, outboundBufferPool)
+		errc <- halfClose(backend, cp(backend, client, outboundBufferPool, m.in, &m.stats.bytesIn, &st.in, sharedIn))
 	}()
 
-	err := <-errc
-	if err != nil && err == io.EOF {
-		err = nil
+	for i := 0; i < 2; i++ {
+		err := <-errc
+		if err == errHalfClosed {
+			continue
+		}
+		if err == io.EOF {
+			err = nil
+		}
+		return st.load(), err
 	}
-	return err
+	return st.load(), nil
+}
+
+func (st *transferStats) load() transferStats {
+	return transferStats{in: atomic.LoadInt64(&st.in), out: atomic.LoadInt64(&st.out)}
 }
 
+// udpBufferCh 一个udp flow收到的datagram 只在持有Relay.udpMu时发送和关闭
 type udpBufferCh struct {
-	Ch      chan []byte
-	Handled bool
+	Ch chan []byte
 }
 
 func newudpBufferCh() *udpBufferCh {
 	return &udpBufferCh{
-		Ch:      make(chan []byte, 100),
-		Handled: false,
+		Ch: make(chan []byte, 100),
 	}
 }
@@ -0,0 +1,185 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var benchData = make([]byte, 256*1024)
+
+// 包一层 防止io.CopyBuffer走WriterTo/ReaderFrom绕过buffer
+type onlyReader struct{ io.Reader }
+type onlyWriter struct{ io.Writer }
+
+func BenchmarkCopyBufferPooled(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		src := onlyReader{bytes.NewReader(benchData)}
+		if err := copyBuffer(onlyWriter{ioutil.Discard}, src, inboundBufferPool); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCopyBufferUnpooled(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		src := onlyReader{bytes.NewReader(benchData)}
+		buf := make([]byte, BufferSize)
+		if _, err := io.CopyBuffer(onlyWriter{ioutil.Discard}, src, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// tcpPair 返回一对互相连接的tcp conn
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, _ := ln.Accept()
+		accepted <- c
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := <-accepted
+	if s == nil {
+		t.Fatal("accept failed")
+	}
+	return c.(*net.TCPConn), s.(*net.TCPConn)
+}
+
+func TestTransportHalfClose(t *testing.T) {
+	testTransportHalfClose(t, &RelayConfig{})
+}
+
+func TestTransportHalfCloseInflight(t *testing.T) {
+	testTransportHalfClose(t, &RelayConfig{MaxInflightBytes: 4 * BufferSize})
+}
+
+func testTransportHalfClose(t *testing.T, cfg *RelayConfig) {
+	// 后端读到EOF之后才返回结果
+	client, relayIn := tcpPair(t)
+	relayOut, backend := tcpPair(t)
+	defer client.Close()
+	defer backend.Close()
+	go func() {
+		defer backend.Close()
+		b, _ := ioutil.ReadAll(backend)
+		fmt.Fprintf(backend, "got %d bytes", len(b))
+	}()
+
+	for _, c := range []net.Conn{client, relayIn, relayOut, backend} {
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+	}
+	errc := make(chan error, 1)
+	var st transferStats
+	go func() {
+		defer relayIn.Close()
+		defer relayOut.Close()
+		var err error
+		st, err = transport(relayIn, relayOut, cfg)
+		errc <- err
+	}()
+
+	client.Write([]byte("hello"))
+	if err := client.CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	res, err := ioutil.ReadAll(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != "got 5 bytes" {
+		t.Fatalf("unexpected response %q", res)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if st.in != 5 || st.out != int64(len(res)) {
+		t.Fatalf("unexpected transfer stats %+v", st)
+	}
+}
+
+// countingReader 记录一共读出了多少字节
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	atomic.AddInt64(&r.n, int64(n))
+	return n, err
+}
+
+// gateWriter gate关闭之前所有的Write都阻塞
+type gateWriter struct {
+	gate chan struct{}
+	buf  bytes.Buffer
+}
+
+func (w *gateWriter) Write(p []byte) (int, error) {
+	<-w.gate
+	return w.buf.Write(p)
+}
+
+func TestInflightCopyBackPressure(t *testing.T) {
+	data := make([]byte, 64*1024)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	pool := newBufferPool(1024)
+	maxInflight := 4 * 1024
+	src := &countingReader{Reader: bytes.NewReader(data)}
+	dst := &gateWriter{gate: make(chan struct{})}
+	errc := make(chan error, 1)
+	go func() { errc <- inflightCopy(dst, onlyReader{src}, pool, maxInflight) }()
+
+	// 写端卡住时读端最多多读一个buffer
+	time.Sleep(100 * time.Millisecond)
+	if n := atomic.LoadInt64(&src.n); n == 0 || n > int64(maxInflight+1024) {
+		t.Fatalf("read %d bytes while writer blocked, max inflight %d", n, maxInflight)
+	}
+
+	close(dst.gate)
+	select {
+	case err := <-errc:
+		// 读到EOF之后把剩下的写完再返回EOF 由transport处理半关闭
+		if err != io.EOF {
+			t.Fatalf("expect io.EOF, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("inflightCopy not return after writer unblocked")
+	}
+	if !bytes.Equal(dst.buf.Bytes(), data) {
+		t.Fatal("data reordered or lost through inflightCopy")
+	}
+}
+
+func TestMaxInflightBytesLimit(t *testing.T) {
+	for _, n := range []int{-1, MaxInflightBytesLimit + 1} {
+		_, err := NewRelayWithConfig(&RelayConfig{
+			Listen:           "127.0.0.1:1285",
+			ListenType:       Listen_RAW,
+			Remote:           "127.0.0.1:1241",
+			TransportType:    Transport_RAW,
+			MaxInflightBytes: n,
+		})
+		if err == nil {
+			t.Fatalf("expect max_inflight_bytes %d rejected", n)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// chain里的节点和最终的target在connect请求里用逗号分隔
+const chainSep = ","
+
+// checkChainHop chain里的每一个节点都是一个mwss地址 wss://host:port
+func checkChainHop(hop string) error {
+	if strings.Contains(hop, chainSep) {
+		return fmt.Errorf("invalid chain hop: %s", hop)
+	}
+	u, err := url.Parse(hop)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "wss" || u.Host == "" || u.Path != "" {
+		return fmt.Errorf("chain hop must be wss://host:port: %s", hop)
+	}
+	return nil
+}
+
+// chain的target也可以是一个listen_type为wss的ehco节点 wss://host:port/ws_path/
+// 最后一个mwss节点用一个单独的websocket连过去 由那个节点转发给它自己的remote
+const chainWSSTargetPrefix = "wss://"
+
+// checkChainTarget target是host:port或者wss节点的url
+func checkChainTarget(target string) error {
+	if !strings.HasPrefix(target, chainWSSTargetPrefix) {
+		_, _, err := net.SplitHostPort(target)
+		return err
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" || u.Path == "" || strings.Contains(target, chainSep) {
+		return fmt.Errorf("chain wss target must be wss://host:port/ws_path/: %s", target)
+	}
+	return nil
+}
+
+// dialConnectTarget 最后一跳 wss节点经过websocket 其他的直接dial tcp
+func (r *Relay) dialConnectTarget(target string) (net.Conn, error) {
+	if !strings.HasPrefix(target, chainWSSTargetPrefix) {
+		return r.dialTCP(target)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), r.dialTimeout())
+	defer cancel()
+	return (&wsTransporter{relay: r}).Dial(ctx, target)
+}
+
+// dialChain 和hops[0]建立connect stream 剩下的节点和target交给它继续往下dial
+// 每一跳都复用自己的session池 任何一跳失败都会一路回复失败的状态 返回错误
+func (r *Relay) dialChain(hops []string, target string) (net.Conn, error) {
+	wsc, err := r.tr.Dial(context.Background(), hops[0]+r.mwssConnectPath())
+	if err != nil {
+		return nil, err
+	}
+	// 后面每一跳都要等下一跳的回复
+	wsc.SetDeadline(time.Now().Add(SOCKS5HandshakeDeadline * time.Duration(len(hops))))
+	if err := requestConnectTarget(wsc, target, hops[1:]...); err != nil {
+		wsc.Close()
+		return nil, err
+	}
+	return wsc, nil
+}
+
+// handleTcpOverMWSSChain 依次经过chain里的节点 最后一个节点dial后端
+func (r *Relay) handleTcpOverMWSSChain(c net.Conn) error {
+	defer c.Close()
+
+	lc, cs := r.traceConn(c, "ehco.mwss.chain")
+	dialDone := cs.phase("mwss.dial")
+	var wsc net.Conn
+	remote, err := r.backends.try(r.cfg.MaxDialAttempts, func(remote string) (err error) {
+		wsc, err = r.dialChain(r.cfg.Chain, remote)
+		return err
+	})
+	dialDone(err)
+	if err != nil {
+		cs.end(remote, err)
+		return err
+	}
+	defer wsc.Close()
+	r.conns.add(remote, c)
+	defer r.conns.remove(remote, c)
+	r.logAccess(cs, "handleTcpOverMWSSChain", "from", c.RemoteAddr(), "to", remote, "via", r.cfg.Chain,
+		"session", mwssSessionName(wsc.LocalAddr(), wsc.RemoteAddr()))
+	start := time.Now()
+	if err := wsc.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
+		cs.end(remote, err)
+		return err
+	}
+	if err := c.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
+		cs.end(remote, err)
+		return err
+	}
+	r.connOpened(cs, c.RemoteAddr(), remote)
+	st, err := transport(lc, wsc, r.cfg)
+	cs.end(remote, err)
+	r.logTransfer(cs, "handleTcpOverMWSSChain", start, st, "from", c.RemoteAddr(), "to", remote,
+		"session", mwssSessionName(wsc.LocalAddr(), wsc.RemoteAddr()))
+	return nil
+}
@@ -0,0 +1,42 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestCheckChainTarget(t *testing.T) {
+	for target, ok := range map[string]bool{
+		"127.0.0.1:1234":           true,
+		"example.com:443":          true,
+		"wss://example.com/tcp/":   true,
+		"wss://example.com:8443/x": true,
+		"example.com":              false,
+		"wss://example.com":        false,
+		"wss:///tcp/":              false,
+	} {
+		if err := checkChainTarget(target); (err == nil) != ok {
+			t.Fatalf("%s: expect ok %v, got %v", target, ok, err)
+		}
+	}
+}
+
+func TestReadConnectTargetWSS(t *testing.T) {
+	payload := "wss://a.example.com:443,wss://b.example.com:443/tcp/"
+	frame := make([]byte, 2+len(payload))
+	binary.BigEndian.PutUint16(frame, uint16(len(payload)))
+	copy(frame[2:], payload)
+
+	target, via, err := readConnectTarget(bytes.NewReader(frame))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if target != "wss://b.example.com:443/tcp/" {
+		t.Fatalf("unexpected target %s", target)
+	}
+	if !reflect.DeepEqual(via, []string{"wss://a.example.com:443"}) {
+		t.Fatalf("unexpected via %v", via)
+	}
+}
@@ -0,0 +1,72 @@
+package relay
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// coalesceWriter 把小的写操作攒起来 最多等window时间再一起写出去
+// 和内核的Nagle无关 开启TCP_NODELAY时也能减少小包
+type coalesceWriter struct {
+	mu     sync.Mutex
+	w      io.Writer
+	window time.Duration
+	buf    []byte
+	timer  *time.Timer
+	err    error
+}
+
+func newCoalesceWriter(w io.Writer, window time.Duration) *coalesceWriter {
+	return &coalesceWriter{w: w, window: window, buf: make([]byte, 0, BufferSize)}
+}
+
+func (c *coalesceWriter) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	if len(c.buf)+len(b) > cap(c.buf) {
+		if err := c.flushLocked(); err != nil {
+			return 0, err
+		}
+	}
+	// 大的写直接写出去
+	if len(b) >= cap(c.buf) {
+		n, err := c.w.Write(b)
+		c.err = err
+		return n, err
+	}
+
+	c.buf = append(c.buf, b...)
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.window, func() {
+			c.mu.Lock()
+			c.timer = nil
+			c.flushLocked()
+			c.mu.Unlock()
+		})
+	}
+	return len(b), nil
+}
+
+func (c *coalesceWriter) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flushLocked()
+}
+
+func (c *coalesceWriter) flushLocked() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if c.err != nil || len(c.buf) == 0 {
+		return c.err
+	}
+	_, c.err = c.w.Write(c.buf)
+	c.buf = c.buf[:0]
+	return c.err
+}
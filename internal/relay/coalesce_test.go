@@ -0,0 +1,61 @@
+package relay
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chunkWriter 记录每一次Write
+type chunkWriter struct {
+	mu     sync.Mutex
+	chunks [][]byte
+}
+
+func (w *chunkWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.chunks = append(w.chunks, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+func (w *chunkWriter) load() [][]byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([][]byte(nil), w.chunks...)
+}
+
+func TestCoalesceWriter(t *testing.T) {
+	w := &chunkWriter{}
+	cw := newCoalesceWriter(w, 50*time.Millisecond)
+
+	// window内的小写合并成一次
+	for _, s := range []string{"a", "b", "c"} {
+		cw.Write([]byte(s))
+	}
+	if n := len(w.load()); n != 0 {
+		t.Fatalf("expect writes held in window, got %d chunks", n)
+	}
+	time.Sleep(200 * time.Millisecond)
+	if chunks := w.load(); len(chunks) != 1 || string(chunks[0]) != "abc" {
+		t.Fatalf("expect one coalesced write, got %q", chunks)
+	}
+
+	// 大的写先把攒着的写出去 再直接写 顺序不变
+	cw.Write([]byte("d"))
+	big := bytes.Repeat([]byte("x"), BufferSize)
+	cw.Write(big)
+	if chunks := w.load(); len(chunks) != 3 || string(chunks[1]) != "d" || !bytes.Equal(chunks[2], big) {
+		t.Fatalf("unexpected chunks after big write: %d", len(chunks))
+	}
+
+	// Flush不用等window
+	cw.Write([]byte("e"))
+	if err := cw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if chunks := w.load(); len(chunks) != 4 || string(chunks[3]) != "e" {
+		t.Fatalf("flush did not write pending bytes: %d chunks", len(chunks))
+	}
+}
@@ -2,10 +2,15 @@ package relay
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"path/filepath"
 	"strings"
 	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 type RelayConfig struct {
@@ -13,6 +18,186 @@ type RelayConfig struct {
 	ListenType    string `json:"listen_type"`
 	Remote        string `json:"remote"`
 	TransportType string `json:"transport_type"`
+	// tcp(默认 双栈)/tcp4/tcp6 raw listen的udp跟着一起
+	ListenNetwork string `json:"listen_network"`
+	// 绑定到这个网卡上和listen_network匹配的地址 listen只需要写端口 例如 :1234
+	ListenInterface string `json:"listen_interface"`
+	// 多个后端 配置了之后remote可以不填 默认用第一个
+	Remotes []string `json:"remotes"`
+	// 多个后端之间的负载均衡方式 round_robin/random/least_conn 默认round_robin
+	LBPolicy string `json:"lb_policy"`
+	// dial后端失败时最多尝试几个后端 0表示每个后端都试一次
+	MaxDialAttempts int `json:"max_dial_attempts"`
+	// dial后端的超时 单位秒 0使用默认值
+	DialTimeoutSec int `json:"dial_timeout_sec"`
+	// 同一个后端在circuit_breaker_window_sec内连续dial失败这么多次之后熔断 0表示不开启
+	// 熔断期间新连接直接失败 circuit_breaker_cooldown_sec之后放一个连接去试探 单位秒 0使用默认值
+	CircuitBreakerThreshold   int `json:"circuit_breaker_threshold"`
+	CircuitBreakerWindowSec   int `json:"circuit_breaker_window_sec"`
+	CircuitBreakerCooldownSec int `json:"circuit_breaker_cooldown_sec"`
+	// 每隔这么多秒主动dial一次每个后端 失败的后端不再被选中 直到探测成功 0表示不开启
+	// down的后端探测间隔会翻倍 开启了reap_on_backend_down时变成down会断开已有的连接
+	HealthCheckIntervalSec int `json:"health_check_interval_sec"`
+	// 探测的dial超时 单位秒 0使用dial_timeout_sec
+	HealthCheckTimeoutSec int `json:"health_check_timeout_sec"`
+	// mwss client新建session时tcp dial和ws握手的超时 单位秒 0使用默认值
+	WSDialTimeoutSec      int `json:"ws_dial_timeout_sec"`
+	WSHandshakeTimeoutSec int `json:"ws_handshake_timeout_sec"`
+	// 后端是域名时解析结果的缓存时间 单位秒 0使用默认值 负数表示不缓存 依赖dns做failover时关掉
+	DNSCacheTTLSec int `json:"dns_cache_ttl_sec"`
+
+	// 每个连接单方向最多缓存的字节数 读写分开在两个goroutine里 慢的一端不会挡住读
+	// 默认0 和不大于buffer_size时一样使用同步copy 最大4MB
+	MaxInflightBytes int `json:"max_inflight_bytes"`
+	// 后端不可用时是否主动断开已有连接
+	ReapOnBackendDown bool `json:"reap_on_backend_down"`
+	// wss/mwss升级成websocket的路径 两端需要一致 默认/tcp/ udp使用这个路径下的udp/
+	// 默认值很容易被识别 最好每个relay用ehco gen-ws-path生成一个随机路径
+	WSPath string `json:"ws_path"`
+	// 已废弃 ws_path为空时使用 只对mwss生效的旧配置
+	MWSSPath string `json:"mwss_path"`
+	// mwss和quic client 每个session最多复用的stream数 0使用默认值 quic最多100
+	MaxMWSSStreamCnt int `json:"max_mwss_stream_cnt"`
+	// mwss client 每个remote最多同时有多少个session 0表示不限制 过期的session不算
+	MaxMWSSSessions int `json:"max_mwss_sessions"`
+	// session数到了上限并且都满了的时候最多等多少毫秒 0表示直接返回错误
+	MWSSSessionWaitMs int `json:"mwss_session_wait_ms"`
+	// mwss client 一个session最多使用多少秒 之后新的连接会换新的session 0表示不限制
+	MaxMWSSSessionAgeSec int `json:"max_mwss_session_age_sec"`
+	// mwss和quic client 没有stream的session空闲多少秒之后关掉 0使用默认值MWSSSessionIdleGrace
+	MWSSSessionIdleSec int `json:"mwss_session_idle_sec"`
+	// mwss session的smux参数 两端需要一致 0使用smux的默认值
+	SmuxKeepAliveIntervalSec int `json:"smux_keepalive_interval_sec"`
+	SmuxKeepAliveTimeoutSec  int `json:"smux_keepalive_timeout_sec"`
+	SmuxMaxReceiveBuffer     int `json:"smux_max_receive_buffer"`
+	SmuxMaxFrameSize         int `json:"smux_max_frame_size"`
+	// smux协议版本 现在用的smux只支持1 0使用默认值1 留着给以后升级smux时两端对齐用
+	SmuxVersion int `json:"smux_version"`
+	// wss/mwss 两端各自发送websocket ping的间隔 单位秒 0表示不发送
+	// 超过间隔加上ws_pong_timeout_sec没有收到pong就断开 mwss的session也会一起关闭
+	WSPingIntervalSec int `json:"ws_ping_interval_sec"`
+	WSPongTimeoutSec  int `json:"ws_pong_timeout_sec"`
+	// mwss server 是否允许client指定dial的目标 socks5/http inbound的远端和chain上的节点需要开启
+	AllowConnectTarget bool `json:"allow_connect_target"`
+	// socks5 listen 配置了用户名之后客户端需要用户名密码认证 不配置时不需要认证
+	SOCKS5Username string `json:"socks5_username"`
+	SOCKS5Password string `json:"socks5_password"`
+	// mwss client 依次经过的mwss节点 wss://host:port 最后一个节点dial remote
+	// remote也可以是listen_type为wss的ehco节点 wss://host:port/ws_path/ 由它转发给自己的remote
+	// 节点之间用各自的psk/mwss_path等配置建立session 需要和下一跳保持一致 只支持tcp
+	Chain []string `json:"chain"`
+	// mwss session上的数据用permessage-deflate压缩 两端都开启才会生效 对已经压缩过的数据没有用
+	MWSSCompression bool `json:"mwss_compression"`
+	// 压缩级别 1(最快)到9(压缩率最高) 0使用默认值1
+	MWSSCompressionLevel int `json:"mwss_compression_level"`
+	// mwss server 每个session同时在处理的stream上限
+	MaxAcceptingStreams int `json:"max_accepting_streams"`
+	// 同时处理的连接数上限 mwss server每个stream算一个 超过时新的连接直接关掉 0表示不限制
+	MaxConns int `json:"max_conns"`
+	// mwss server 等待处理的stream队列长度 0使用默认值
+	MWSSConnQueueSize int `json:"mwss_conn_queue_size"`
+	// 队列满时最多等待多少毫秒 0表示直接丢弃新的stream
+	MWSSConnQueueWaitMs int `json:"mwss_conn_queue_wait_ms"`
+	// mwss server 升级成websocket之后psk认证和第一个stream需要在这个时间内完成 单位秒 0使用默认值
+	MWSSHandshakeTimeoutSec int `json:"mwss_handshake_timeout_sec"`
+	// tls透传时按SNI选择后端 server_name -> remote
+	SNIRoutes map[string]string `json:"sni_routes"`
+	// mwss 两端一致的预共享密钥 用来做session的challenge-response认证
+	PSK string `json:"psk"`
+	// wss/mwss 升级websocket时校验的token grpc放在metadata里 为空表示不校验
+	AuthToken string `json:"auth_token"`
+	// wss/mwss client 把auth_token放在url query里而不是header里 server两种都接受
+	AuthTokenInQuery bool `json:"auth_token_in_query"`
+	// wss/mwss client 升级websocket时额外带上的header 例如走CDN时的Host和User-Agent
+	WSHeaders map[string]string `json:"ws_headers"`
+	// wss/mwss 握手时协商的Sec-WebSocket-Protocol 两端需要一致 不一致时握手失败
+	WSSubprotocol string `json:"ws_subprotocol"`
+	// 连接后端时先发送PROXY protocol header 1/2表示版本 0表示不发送
+	// raw直接用accept到的客户端地址 mwss client开启时会把客户端地址带给server
+	// mwss server只在client带了地址时使用它 否则用的是client ehco的地址
+	// 客户端在别的代理后面时拿到的是那个代理的地址
+	ProxyProtocol int `json:"proxy_protocol"`
+	// 后端RST时的处理方式 close/retry
+	OnBackendReset string `json:"on_backend_reset"`
+	// retry时最多记录多少字节客户端发送的数据用来重放 超过之后不再重试 0使用默认值
+	MaxReplayBytes int `json:"max_replay_bytes"`
+	// 应用层合并小的写操作的窗口 单位毫秒 0表示不合并
+	WriteCoalesceWindowMs int `json:"write_coalesce_window_ms"`
+	// 每个连接每个方向的限速 单位字节每秒 0表示不限速
+	RateLimitBytesPerSec int `json:"rate_limit_bytes_per_sec"`
+	// 这个relay上所有连接加起来的带宽上限 单位字节每秒 upload是client->remote download是remote->client 0表示不限速
+	UploadLimitBytesPerSec   int `json:"upload_limit_bytes_per_sec"`
+	DownloadLimitBytesPerSec int `json:"download_limit_bytes_per_sec"`
+	// 上传和下载加在一起的流量限额 超过之后拒绝新的连接 0表示不限制
+	// quota_period为monthly时每个自然月重新算 为空时算总量 需要traffic_file才能在重启之后接着算
+	QuotaBytes  int64  `json:"quota_bytes"`
+	QuotaPeriod string `json:"quota_period"`
+	// 超过quota之后是否断开正在转发的连接
+	QuotaKillActive bool `json:"quota_kill_active"`
+	// mwss 同一个session上的stream超过这个数时按stream数平分rate_limit_bytes_per_sec*这个数的带宽
+	// 避免一个大流量的stream饿死其他stream 需要配置rate_limit_bytes_per_sec 0表示不开启
+	MWSSFairShareStreams int `json:"mwss_fair_share_streams"`
+	// 接入的tcp连接和dial的后端连接默认开启TCP_NODELAY 交互式的流量可以减少延迟
+	DisableTCPNoDelay bool `json:"disable_tcp_nodelay"`
+	// tcp keepalive的间隔 单位秒 0使用默认值 负数表示关闭keepalive
+	TCPKeepAliveSec int `json:"tcp_keepalive_sec"`
+	// 两个方向都没有数据流动超过这么多秒就断开 0使用默认值 负数表示不限制
+	IdleTimeoutSec int `json:"idle_timeout_sec"`
+
+	// wss/mwss server 使用的证书 不配置时使用自签名证书
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// wss/mwss/grpc server 用Let's Encrypt自动申请这些域名的证书 不能和cert_file一起用
+	// 需要让acme server能通过443(tls-alpn-01)或者acme_http_listen(http-01 一般是:80)访问到
+	ACMEDomains []string `json:"acme_domains"`
+	ACMEEmail   string   `json:"acme_email"`
+	// 证书和账号的缓存目录 为空时使用ehco-acme 多个relay可以共用
+	ACMECacheDir string `json:"acme_cache_dir"`
+	// http-01 challenge的监听地址 为空时只用tls-alpn-01
+	ACMEHTTPListen string `json:"acme_http_listen"`
+	// wss/mwss client 配置了其中一个就会校验server证书 ca_file为空时使用系统根证书
+	ServerName string `json:"server_name"`
+	CAFile     string `json:"ca_file"`
+	// wss/mwss client tls握手时发送的SNI 不影响dial的地址 为空时和server_name一致
+	// 两个都没有配置时使用ws_headers里的Host
+	SNI string `json:"sni"`
+
+	// wss/mwss server 只允许这些sha256指纹的客户端证书建立连接
+	AllowedClientCertFingerprints []string `json:"allowed_client_cert_fingerprints"`
+	// wss/mwss/grpc server 要求客户端出示由这个CA签发的证书 可以和指纹白名单一起用
+	ClientCAFile string `json:"client_ca_file"`
+	// wss/mwss client 向server出示的证书
+	ClientCertFile string `json:"client_cert_file"`
+	ClientKeyFile  string `json:"client_key_file"`
+
+	// mwss server不做tls 直接提供ws 用在nginx之类已经终结了tls的反代后面
+	MWSSPlainListen bool `json:"mwss_plain_listen"`
+	// mwss client用ws://连接remote 不做tls
+	MWSSPlainTransport bool `json:"mwss_plain_transport"`
+
+	// 来源ip的白名单和黑名单 支持ipv4/ipv6的cidr或者单个ip 黑名单优先 白名单为空表示全部允许
+	AllowCIDRs []string `json:"allow_cidrs"`
+	DenyCIDRs  []string `json:"deny_cidrs"`
+
+	// 只在这些时间窗口内接受新连接
+	Schedule *ScheduleConfig `json:"schedule"`
+
+	// wss/mwss server 非websocket请求返回的伪装页面 不配置时返回默认的静态页面
+	FakeIndex *FakeIndexConfig `json:"fake_index"`
+	// wss/mwss server http请求头的最大字节数和读完整个请求的超时 单位秒 0使用默认值
+	// 升级成websocket之后的连接不受读超时影响
+	HTTPMaxHeaderBytes int `json:"http_max_header_bytes"`
+	HTTPReadTimeoutSec int `json:"http_read_timeout_sec"`
+	// 伪装页面请求体的最大字节数 0使用默认值
+	FakeIndexMaxBodyBytes int64 `json:"fake_index_max_body_bytes"`
+	// 每个ip每秒最多请求多少次伪装页面 超过返回429 0表示不限制
+	FakeIndexRateLimit int `json:"fake_index_rate_limit"`
+
+	// 连接access log的采样率 (0,1] 例如0.01表示每100个连接打印一个 0表示全部打印
+	// 每个连接只决定一次 一个连接的日志要么都打印要么都不打印
+	AccessLogSampleRate float64 `json:"access_log_sample_rate"`
+	// 持续时间超过这么多毫秒的连接 结束时的日志总是打印 不参与采样 0表示不启用
+	AccessLogSlowMs int `json:"access_log_slow_ms"`
 }
 
 type Config struct {
@@ -29,10 +214,35 @@ func NewConfig(path string) *Config {
 }
 
 func (c *Config) LoadConfig() error {
-	if strings.Contains(c.PATH, "http") {
-		return c.readFromHttp()
+	var err error
+	if strings.HasPrefix(c.PATH, "http://") || strings.HasPrefix(c.PATH, "https://") {
+		err = c.readFromHttp()
+	} else {
+		err = c.readFromFile()
 	}
-	return c.readFromFile()
+	if err != nil {
+		return err
+	}
+	return c.validate()
+}
+
+// validate 每条规则都要有listen 同一个listen地址只能出现一次
+// 更细的检查在NewRelayWithConfig里做
+func (c *Config) validate() error {
+	if len(c.Configs) == 0 {
+		return fmt.Errorf("no relay configs in %s", c.PATH)
+	}
+	seen := make(map[string]struct{}, len(c.Configs))
+	for idx, cfg := range c.Configs {
+		if cfg.Listen == "" {
+			return fmt.Errorf("configs[%d]: listen is required", idx)
+		}
+		if _, ok := seen[cfg.Listen]; ok {
+			return fmt.Errorf("duplicate listen address: %s", cfg.Listen)
+		}
+		seen[cfg.Listen] = struct{}{}
+	}
+	return nil
 }
 
 func (c *Config) readFromFile() error {
@@ -40,12 +250,9 @@ func (c *Config) readFromFile() error {
 	if err != nil {
 		return err
 	}
-	jsonConfig := JsonConfig{}
-	err = json.Unmarshal([]byte(file), &jsonConfig)
-	if err != nil {
+	if err := c.decode(file); err != nil {
 		return err
 	}
-	c.Configs = jsonConfig.Configs
 	Logger.Info("load config from file:", c.PATH)
 	return nil
 }
@@ -57,9 +264,50 @@ func (c *Config) readFromHttp() error {
 		return err
 	}
 	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return fmt.Errorf("load config from %s: %s", c.PATH, r.Status)
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	if err := c.decode(body); err != nil {
+		return err
+	}
+	// 配置里有psk和token 定期同步时也不能打到日志里
+	Logger.Infof("load config from http: %s, %d relays", c.PATH, len(c.Configs))
+	return nil
+}
+
+// isYAML 按扩展名选择格式 .yaml/.yml是yaml 其他的都当成json http地址看url的path
+func (c *Config) isYAML() bool {
+	p := c.PATH
+	if u, err := url.Parse(p); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+		p = u.Path
+	}
+	switch strings.ToLower(filepath.Ext(p)) {
+	case ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// decode yaml和json用同样的字段名 yaml先转成json 再按json tag解析
+func (c *Config) decode(data []byte) error {
+	if c.isYAML() {
+		var v interface{}
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return err
+		}
+		var err error
+		if data, err = json.Marshal(v); err != nil {
+			return err
+		}
+	}
 	jsonConfig := JsonConfig{}
-	json.NewDecoder(r.Body).Decode(&jsonConfig)
+	if err := json.Unmarshal(data, &jsonConfig); err != nil {
+		return err
+	}
 	c.Configs = jsonConfig.Configs
-	Logger.Info("load config from http:", c.PATH, c.Configs)
 	return nil
 }
@@ -0,0 +1,135 @@
+package relay
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ehco")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// 文件名里带http也要当成文件读
+	path := filepath.Join(dir, "http.json")
+
+	cases := []struct {
+		content string
+		wantErr string
+	}{
+		{`{"configs": [{"listen": "0.0.0.0:1234", "remote": "0.0.0.0:5201"}, {"listen": "0.0.0.0:1235", "remote": "0.0.0.0:5201"}]}`, ""},
+		{`{"configs": []}`, "no relay configs"},
+		{`{"configs": [{"remote": "0.0.0.0:5201"}]}`, "listen is required"},
+		{`{"configs": [{"listen": "0.0.0.0:1234"}, {"listen": "0.0.0.0:1234"}]}`, "duplicate listen address"},
+		{`{"configs": [`, "unexpected end of JSON input"},
+	}
+	for _, c := range cases {
+		if err := ioutil.WriteFile(path, []byte(c.content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		cfg := NewConfig(path)
+		err := cfg.LoadConfig()
+		if c.wantErr == "" {
+			if err != nil {
+				t.Fatalf("load %s: %v", c.content, err)
+			}
+			if len(cfg.Configs) != 2 {
+				t.Fatalf("expect 2 configs, got %d", len(cfg.Configs))
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+			t.Fatalf("load %s: expect error %q, got %v", c.content, c.wantErr, err)
+		}
+	}
+}
+
+func TestLoadConfigFromHttp(t *testing.T) {
+	body := `{"configs": [{"listen": "0.0.0.0:1234", "remote": "0.0.0.0:5201"}]}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	cfg := NewConfig(srv.URL + "/ok")
+	if err := cfg.LoadConfig(); err != nil || len(cfg.Configs) != 1 {
+		t.Fatalf("expect 1 config, got %v %v", cfg.Configs, err)
+	}
+	if err := NewConfig(srv.URL + "/missing").LoadConfig(); err == nil {
+		t.Fatal("expect error for non 200 response")
+	}
+}
+
+func TestLoadYAMLConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ehco")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	content := `
+configs:
+  - listen: 0.0.0.0:1234
+    remote: wss://example.com:443
+    transport_type: mwss
+    ws_headers:
+      Host: cdn.example.com
+    allow_cidrs: [10.0.0.0/8]
+    access_log_sample_rate: 0.5
+    schedule:
+      timezone: Asia/Shanghai
+      windows:
+        - days: [mon, tue]
+          start: "09:00"
+          end: "18:00"
+`
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := NewConfig(path)
+	if err := cfg.LoadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	// 字段名和json一样
+	rc := cfg.Configs[0]
+	if len(cfg.Configs) != 1 || rc.Remote != "wss://example.com:443" || rc.TransportType != Transport_MWSS ||
+		rc.WSHeaders["Host"] != "cdn.example.com" || len(rc.AllowCIDRs) != 1 || rc.AccessLogSampleRate != 0.5 ||
+		rc.Schedule == nil || rc.Schedule.Windows[0].Start != "09:00" || len(rc.Schedule.Windows[0].Days) != 2 {
+		t.Fatalf("unexpected yaml config %+v", cfg.Configs)
+	}
+
+	// 同样的内容用.json扩展名读不出来
+	jsonPath := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(jsonPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewConfig(jsonPath).LoadConfig(); err == nil {
+		t.Fatal("expect yaml content rejected as json")
+	}
+	if err := ioutil.WriteFile(path, []byte("configs: [\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewConfig(path).LoadConfig(); err == nil {
+		t.Fatal("expect invalid yaml rejected")
+	}
+
+	// http地址按url的path判断
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("configs:\n  - listen: 0.0.0.0:1234\n    remote: 0.0.0.0:5201\n"))
+	}))
+	defer srv.Close()
+	remote := NewConfig(srv.URL + "/ehco.yml?token=x")
+	if err := remote.LoadConfig(); err != nil || len(remote.Configs) != 1 || remote.Configs[0].Remote != "0.0.0.0:5201" {
+		t.Fatalf("expect 1 config from yaml url, got %v %v", remote.Configs, err)
+	}
+}
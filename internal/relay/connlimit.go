@@ -0,0 +1,88 @@
+package relay
+
+import (
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	ConnLimitScope_Relay  = "relay"
+	ConnLimitScope_Global = "global"
+	// 超过了quota_bytes
+	ConnLimitScope_Quota = "quota"
+)
+
+var (
+	// 所有relay加起来的连接数上限 nil表示不限制
+	globalConns *connLimiter
+
+	connsRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ehco",
+		Subsystem: "relay",
+		Name:      "conns_rejected_total",
+		Help:      "accepted conns and mwss streams closed because max_conns or quota_bytes was reached",
+	}, []string{"relay", "scope"})
+)
+
+func init() {
+	prometheus.MustRegister(connsRejected)
+}
+
+// connLimiter 同时在处理的连接数上限 nil表示不限制
+type connLimiter struct {
+	max int64
+	cur int64
+}
+
+func newConnLimiter(max int) *connLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &connLimiter{max: int64(max)}
+}
+
+// SetMaxConns 设置全局的连接数上限 0表示不限制 需要在relay启动前调用
+func SetMaxConns(n int) {
+	globalConns = newConnLimiter(n)
+}
+
+func (l *connLimiter) acquire() bool {
+	if l == nil {
+		return true
+	}
+	if atomic.AddInt64(&l.cur, 1) > l.max {
+		atomic.AddInt64(&l.cur, -1)
+		return false
+	}
+	return true
+}
+
+func (l *connLimiter) release() {
+	if l != nil {
+		atomic.AddInt64(&l.cur, -1)
+	}
+}
+
+// acquireConn 超过quota时直接拒绝 然后先占relay的名额再占全局的 满了直接拒绝 不排队
+// 成功时返回的release需要在连接处理完之后调用
+func (r *Relay) acquireConn() (release func(), ok bool) {
+	if r.quotaExceeded() {
+		connsRejected.WithLabelValues(r.cfg.Listen, ConnLimitScope_Quota).Inc()
+		return nil, false
+	}
+	if !r.connLimit.acquire() {
+		connsRejected.WithLabelValues(r.cfg.Listen, ConnLimitScope_Relay).Inc()
+		return nil, false
+	}
+	global := globalConns
+	if !global.acquire() {
+		r.connLimit.release()
+		connsRejected.WithLabelValues(r.cfg.Listen, ConnLimitScope_Global).Inc()
+		return nil, false
+	}
+	return func() {
+		global.release()
+		r.connLimit.release()
+	}, true
+}
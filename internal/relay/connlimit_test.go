@@ -0,0 +1,57 @@
+package relay
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestAcquireConn(t *testing.T) {
+	r, err := NewRelayWithConfig(&RelayConfig{
+		Listen:        "127.0.0.1:1265",
+		ListenType:    Listen_RAW,
+		Remote:        "127.0.0.1:1",
+		TransportType: Transport_RAW,
+		MaxConns:      2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejected := connsRejected.WithLabelValues(r.cfg.Listen, ConnLimitScope_Relay)
+	before := testutil.ToFloat64(rejected)
+
+	r1, ok1 := r.acquireConn()
+	_, ok2 := r.acquireConn()
+	if !ok1 || !ok2 {
+		t.Fatal("expect conns under max_conns accepted")
+	}
+	if _, ok := r.acquireConn(); ok {
+		t.Fatal("expect conn over max_conns rejected")
+	}
+	if got := testutil.ToFloat64(rejected) - before; got != 1 {
+		t.Fatalf("expect 1 rejected conn, got %v", got)
+	}
+	r1()
+	if _, ok := r.acquireConn(); !ok {
+		t.Fatal("expect conn accepted after release")
+	}
+
+	// 全局的上限对所有relay生效
+	SetMaxConns(1)
+	defer SetMaxConns(0)
+	other, err := NewRelayWithConfig(&RelayConfig{
+		Listen:        "127.0.0.1:1266",
+		ListenType:    Listen_RAW,
+		Remote:        "127.0.0.1:1",
+		TransportType: Transport_RAW,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := other.acquireConn(); !ok {
+		t.Fatal("expect first conn accepted")
+	}
+	if _, ok := other.acquireConn(); ok {
+		t.Fatal("expect conn over global max_conns rejected")
+	}
+}
@@ -0,0 +1,98 @@
+package relay
+
+import (
+	"net"
+	"sync"
+)
+
+// connTracker 按后端地址记录正在转发的连接
+type connTracker struct {
+	mu    sync.Mutex
+	conns map[string]map[net.Conn]struct{}
+}
+
+func newConnTracker() *connTracker {
+	return &connTracker{conns: make(map[string]map[net.Conn]struct{})}
+}
+
+func (t *connTracker) add(remote string, c net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m, ok := t.conns[remote]
+	if !ok {
+		m = make(map[net.Conn]struct{})
+		t.conns[remote] = m
+	}
+	m[c] = struct{}{}
+}
+
+func (t *connTracker) remove(remote string, c net.Conn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m, ok := t.conns[remote]
+	if !ok {
+		return
+	}
+	delete(m, c)
+	if len(m) == 0 {
+		delete(t.conns, remote)
+	}
+}
+
+// count 正在转发的连接数
+func (t *connTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, m := range t.conns {
+		n += len(m)
+	}
+	return n
+}
+
+// countOf 正在转发到remote的连接数
+func (t *connTracker) countOf(remote string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.conns[remote])
+}
+
+// closeAll 关闭所有转发到remote的连接 返回关闭的数量
+func (t *connTracker) closeAll(remote string) int {
+	t.mu.Lock()
+	m := t.conns[remote]
+	delete(t.conns, remote)
+	t.mu.Unlock()
+
+	for c := range m {
+		c.Close()
+	}
+	return len(m)
+}
+
+// closeEverything 关闭所有正在转发的连接
+func (t *connTracker) closeEverything() int {
+	t.mu.Lock()
+	remotes := make([]string, 0, len(t.conns))
+	for remote := range t.conns {
+		remotes = append(remotes, remote)
+	}
+	t.mu.Unlock()
+
+	n := 0
+	for _, remote := range remotes {
+		n += t.closeAll(remote)
+	}
+	return n
+}
+
+// MarkBackendDown 后端被判定为不可用时调用
+// 开启了reap_on_backend_down的话会主动断开所有转发到该后端的连接 让客户端重连
+func (r *Relay) MarkBackendDown(remote string) {
+	if !r.cfg.ReapOnBackendDown {
+		return
+	}
+	if n := r.conns.closeAll(remote); n > 0 {
+		Logger.Warnf("backend %s is down, closed %d conns", remote, n)
+	}
+}
@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnTrackerCloseAll(t *testing.T) {
+	tracker := newConnTracker()
+	down, downPeer := net.Pipe()
+	up, upPeer := net.Pipe()
+	defer downPeer.Close()
+	defer upPeer.Close()
+	defer up.Close()
+	tracker.add("down:1", down)
+	tracker.add("up:1", up)
+
+	// 没有开启reap_on_backend_down时不断开
+	r := &Relay{cfg: &RelayConfig{}, conns: tracker}
+	r.MarkBackendDown("down:1")
+	if tracker.countOf("down:1") != 1 {
+		t.Fatal("expect conns kept without reap_on_backend_down")
+	}
+
+	r.cfg.ReapOnBackendDown = true
+	r.MarkBackendDown("down:1")
+	if n := tracker.countOf("down:1"); n != 0 {
+		t.Fatalf("expect conns of the down backend untracked, got %d", n)
+	}
+	if _, err := downPeer.Write([]byte("x")); err == nil {
+		t.Fatal("expect conn of the down backend closed")
+	}
+	// 其他后端的连接不受影响
+	if tracker.count() != 1 {
+		t.Fatalf("expect conns of other backends kept, got %d", tracker.count())
+	}
+}
+
+func TestMarkBackendDownClosesRelayedConns(t *testing.T) {
+	backend := startEchoBackend(t)
+	defer backend.Close()
+
+	listen := "127.0.0.1:1296"
+	r, err := NewRelayWithConfig(&RelayConfig{
+		Listen:            listen,
+		ListenType:        Listen_RAW,
+		Remote:            backend.Addr().String(),
+		TransportType:     Transport_RAW,
+		ReapOnBackendDown: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.ListenAndServe()
+	defer r.Shutdown(context.Background())
+	select {
+	case <-r.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay not ready")
+	}
+
+	c, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+
+	r.MarkBackendDown(backend.Addr().String())
+	// 后端本身还活着 连接是被reaper断开的
+	c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expect relayed conn closed after backend marked down, got %v", err)
+	}
+	if n := r.conns.count(); n != 0 {
+		t.Fatalf("expect no tracked conns, got %d", n)
+	}
+}
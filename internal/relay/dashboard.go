@@ -0,0 +1,190 @@
+package relay
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+)
+
+// kill连接的请求必须带上这个header 跨站的表单没法设置 防止csrf
+const dashboardCSRFHeader = "X-Ehco-Dashboard"
+
+// NewDashboardHandler 网页版的管理界面 显示每个relay的状态和流量 正在转发的连接 可以断开单个连接
+// 所有请求都需要basic auth 需要先调用EnableLiveConns才能看到连接
+func NewDashboardHandler(relays func() []*Relay, user, password string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(dashboardHTML))
+	})
+	mux.HandleFunc("/api/relays", func(w http.ResponseWriter, req *http.Request) {
+		current := relays()
+		res := make([]RelayStatus, 0, len(current))
+		for _, r := range current {
+			res = append(res, r.Status())
+		}
+		writeJSON(w, res)
+	})
+	mux.HandleFunc("/api/conns", func(w http.ResponseWriter, req *http.Request) {
+		res := []ConnStatus{}
+		for _, r := range relays() {
+			res = append(res, r.LiveConns()...)
+		}
+		writeJSON(w, res)
+	})
+	mux.HandleFunc("/api/conns/kill", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost || req.Header.Get(dashboardCSRFHeader) == "" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		listen, id := req.FormValue("relay"), req.FormValue("id")
+		for _, r := range relays() {
+			if r.cfg.Listen == listen && r.KillConn(id) {
+				w.Write([]byte("ok"))
+				return
+			}
+		}
+		http.Error(w, "conn not found", http.StatusNotFound)
+	})
+	return basicAuth(mux, user, password)
+}
+
+func basicAuth(h http.Handler, user, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		u, p, ok := req.BasicAuth()
+		if !ok || subtle.ConstantTimeCompare([]byte(u), []byte(user))&
+			subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="ehco"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		Logger.Warnf("encode json error: %s", err)
+	}
+}
+
+// dashboardHTML 每2秒拉一次api 流量曲线是最近两分钟每个relay的速率
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>ehco dashboard</title>
+<style>
+body { font-family: sans-serif; margin: 20px; color: #222; }
+table { border-collapse: collapse; width: 100%; margin-bottom: 24px; }
+th, td { border-bottom: 1px solid #ddd; padding: 4px 8px; text-align: left; font-size: 13px; }
+th { background: #f4f4f4; }
+canvas { border: 1px solid #eee; }
+button { font-size: 12px; }
+</style>
+</head>
+<body>
+<h2>Relays</h2>
+<table>
+<thead><tr><th>listen</th><th>type</th><th>remote</th><th>ready</th><th>conns</th><th>in</th><th>out</th><th>rate</th></tr></thead>
+<tbody id="relays"></tbody>
+</table>
+<h2>Connections</h2>
+<table>
+<thead><tr><th>id</th><th>relay</th><th>client</th><th>backend</th><th>since</th><th>in</th><th>out</th><th></th></tr></thead>
+<tbody id="conns"></tbody>
+</table>
+<script>
+var rates = {}, last = {}, points = 60;
+
+function size(n) {
+  var units = ["B", "KB", "MB", "GB", "TB"], i = 0;
+  while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+  return n.toFixed(i ? 1 : 0) + " " + units[i];
+}
+
+function cell(tr, text) {
+  var td = document.createElement("td");
+  td.textContent = text;
+  tr.appendChild(td);
+  return td;
+}
+
+function draw(canvas, data) {
+  var ctx = canvas.getContext("2d"), max = Math.max.apply(null, data.concat([1]));
+  ctx.clearRect(0, 0, canvas.width, canvas.height);
+  ctx.strokeStyle = "#2a7ae2";
+  ctx.beginPath();
+  data.forEach(function (v, i) {
+    var x = i * canvas.width / (points - 1), y = canvas.height - v / max * (canvas.height - 2) - 1;
+    i ? ctx.lineTo(x, y) : ctx.moveTo(x, y);
+  });
+  ctx.stroke();
+}
+
+function loadRelays() {
+  fetch("api/relays").then(function (r) { return r.json(); }).then(function (relays) {
+    var tbody = document.getElementById("relays"), now = Date.now();
+    tbody.innerHTML = "";
+    relays.forEach(function (s) {
+      var total = s.bytes_in + s.bytes_out, h = rates[s.listen] || [], p = last[s.listen];
+      if (p) { h.push(Math.max(0, (total - p.total) * 1000 / (now - p.time))); }
+      rates[s.listen] = h.slice(-points);
+      last[s.listen] = { total: total, time: now };
+      var tr = document.createElement("tr");
+      cell(tr, s.listen);
+      cell(tr, s.listen_type + " -> " + s.transport_type);
+      cell(tr, s.remote);
+      cell(tr, s.ready ? "yes" : "no");
+      cell(tr, s.active_conns);
+      cell(tr, size(s.bytes_in));
+      cell(tr, size(s.bytes_out));
+      var rate = rates[s.listen], canvas = document.createElement("canvas");
+      canvas.width = 160; canvas.height = 30;
+      var td = cell(tr, rate.length ? size(rate[rate.length - 1]) + "/s " : "");
+      td.appendChild(canvas);
+      draw(canvas, rate);
+      tbody.appendChild(tr);
+    });
+  });
+}
+
+function kill(c) {
+  var body = new URLSearchParams({ relay: c.relay, id: c.id });
+  fetch("api/conns/kill", { method: "POST", body: body, headers: { "X-Ehco-Dashboard": "1" } }).then(loadConns);
+}
+
+function loadConns() {
+  fetch("api/conns").then(function (r) { return r.json(); }).then(function (conns) {
+    var tbody = document.getElementById("conns");
+    tbody.innerHTML = "";
+    conns.forEach(function (c) {
+      var tr = document.createElement("tr");
+      cell(tr, c.id);
+      cell(tr, c.relay);
+      cell(tr, c.client);
+      cell(tr, c.backend);
+      cell(tr, new Date(c.start).toLocaleTimeString());
+      cell(tr, size(c.bytes_in));
+      cell(tr, size(c.bytes_out));
+      var btn = document.createElement("button");
+      btn.textContent = "kill";
+      btn.onclick = function () { kill(c); };
+      cell(tr, "").appendChild(btn);
+      tbody.appendChild(tr);
+    });
+  });
+}
+
+function refresh() { loadRelays(); loadConns(); }
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
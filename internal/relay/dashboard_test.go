@@ -0,0 +1,66 @@
+package relay
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDashboardKillConn(t *testing.T) {
+	r, err := NewRelayWithConfig(&RelayConfig{
+		Listen:        "127.0.0.1:0",
+		ListenType:    Listen_RAW,
+		Remote:        "127.0.0.1:1",
+		TransportType: Transport_RAW,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	defer client.Close()
+	cs := newConnSpan("")
+	cs.cc = &countConn{Conn: server}
+	r.live.add(cs, ConnStatus{ID: cs.id, Relay: r.cfg.Listen})
+
+	h := NewDashboardHandler(func() []*Relay { return []*Relay{r} }, "admin", "secret")
+	do := func(method, path string, auth bool, header string, form url.Values) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if auth {
+			req.SetBasicAuth("admin", "secret")
+		}
+		if header != "" {
+			req.Header.Set(dashboardCSRFHeader, header)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("GET", "/api/conns", false, "", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expect 401 without auth, got %d", w.Code)
+	}
+	w := do("GET", "/api/conns", true, "", nil)
+	var conns []ConnStatus
+	if err := json.NewDecoder(w.Body).Decode(&conns); err != nil {
+		t.Fatal(err)
+	}
+	if len(conns) != 1 || conns[0].ID != cs.id {
+		t.Fatalf("unexpected conns %+v", conns)
+	}
+
+	form := url.Values{"relay": {r.cfg.Listen}, "id": {cs.id}}
+	if w := do("POST", "/api/conns/kill", true, "", form); w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("expect kill without csrf header rejected, got %d", w.Code)
+	}
+	if w := do("POST", "/api/conns/kill", true, "1", form); w.Code != http.StatusOK {
+		t.Fatalf("expect kill ok, got %d %s", w.Code, w.Body.String())
+	}
+	if _, err := client.Read(make([]byte, 1)); err == nil {
+		t.Fatal("expect killed conn closed")
+	}
+}
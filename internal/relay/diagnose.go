@@ -0,0 +1,102 @@
+package relay
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+)
+
+const (
+	DiagPass = "PASS"
+	DiagWarn = "WARN"
+	DiagFail = "FAIL"
+
+	// 低于这个值时fd可能不够用
+	recommendedNoFile = 65535
+)
+
+type DiagResult struct {
+	Name   string
+	Status string
+	Detail string
+}
+
+func diagResult(name string, err error) DiagResult {
+	if err != nil {
+		return DiagResult{Name: name, Status: DiagFail, Detail: err.Error()}
+	}
+	return DiagResult{Name: name, Status: DiagPass, Detail: "ok"}
+}
+
+// Diagnose 检查运行环境以及每个relay的监听端口 证书和后端是否可用
+func Diagnose(cfgs []RelayConfig) []DiagResult {
+	var results []DiagResult
+	results = append(results, checkNoFile())
+	results = append(results, checkSocketOptions()...)
+	for i := range cfgs {
+		results = append(results, diagnoseRelay(&cfgs[i])...)
+	}
+	return results
+}
+
+func diagnoseRelay(cfg *RelayConfig) []DiagResult {
+	prefix := "relay " + cfg.Listen
+	r, err := NewRelayWithConfig(cfg)
+	if err != nil {
+		return []DiagResult{diagResult(prefix+" config", err)}
+	}
+	if r.tr != nil {
+		defer r.tr.Close()
+	}
+	results := []DiagResult{diagResult(prefix+" config", nil)}
+
+	ln, err := r.listenStream()
+	if err == nil {
+		ln.Close()
+	}
+	results = append(results, diagResult(prefix+" tcp bind", err))
+	if r.ListenType == Listen_RAW && r.udpEnabled() {
+		uc, err := net.ListenUDP(r.udpNetwork(), r.LocalUDPAddr)
+		if err == nil {
+			uc.Close()
+		}
+		results = append(results, diagResult(prefix+" udp bind", err))
+	}
+
+	if cfg.ClientCertFile != "" {
+		results = append(results, checkCertFile(prefix+" client cert", cfg.ClientCertFile, cfg.ClientKeyFile))
+	}
+	if cfg.CertFile != "" {
+		results = append(results, checkCertFile(prefix+" server cert", cfg.CertFile, cfg.KeyFile))
+	}
+
+	network, backend, err := backendDialAddr(r.TransportType, r.RemoteTCPAddr)
+	if err != nil {
+		return append(results, diagResult(prefix+" backend", err))
+	}
+	c, err := net.DialTimeout(network, backend, WsDeadline)
+	if err == nil {
+		c.Close()
+	}
+	return append(results, diagResult(prefix+" backend "+backend, err))
+}
+
+func checkCertFile(name, certFile, keyFile string) DiagResult {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return diagResult(name, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return diagResult(name, err)
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return diagResult(name, fmt.Errorf("certificate expired at %s", leaf.NotAfter))
+	}
+	if time.Until(leaf.NotAfter) < 7*24*time.Hour {
+		return DiagResult{Name: name, Status: DiagWarn, Detail: fmt.Sprintf("certificate expires at %s", leaf.NotAfter)}
+	}
+	return diagResult(name, nil)
+}
@@ -0,0 +1,31 @@
+package relay
+
+import (
+	"io/ioutil"
+	"strings"
+)
+
+func checkSocketOptions() []DiagResult {
+	var results []DiagResult
+
+	cc, err := ioutil.ReadFile("/proc/sys/net/ipv4/tcp_available_congestion_control")
+	switch {
+	case err != nil:
+		results = append(results, DiagResult{Name: "bbr", Status: DiagWarn, Detail: err.Error()})
+	case strings.Contains(string(cc), "bbr"):
+		results = append(results, DiagResult{Name: "bbr", Status: DiagPass, Detail: "available"})
+	default:
+		results = append(results, DiagResult{Name: "bbr", Status: DiagWarn, Detail: "not available: " + strings.TrimSpace(string(cc))})
+	}
+
+	tfo, err := ioutil.ReadFile("/proc/sys/net/ipv4/tcp_fastopen")
+	switch {
+	case err != nil:
+		results = append(results, DiagResult{Name: "tcp fast open", Status: DiagWarn, Detail: err.Error()})
+	case strings.TrimSpace(string(tfo)) == "0":
+		results = append(results, DiagResult{Name: "tcp fast open", Status: DiagWarn, Detail: "disabled"})
+	default:
+		results = append(results, DiagResult{Name: "tcp fast open", Status: DiagPass, Detail: "tcp_fastopen=" + strings.TrimSpace(string(tfo))})
+	}
+	return results
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+// +build !linux
+
+package relay
+
+func checkSocketOptions() []DiagResult {
+	return []DiagResult{{Name: "socket options", Status: DiagWarn, Detail: "bbr/tfo check only supported on linux"}}
+}
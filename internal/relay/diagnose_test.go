@@ -0,0 +1,60 @@
+package relay
+
+import (
+	"net"
+	"testing"
+)
+
+// diagStatus 按名字查找检查结果
+func diagStatus(results []DiagResult) map[string]string {
+	m := make(map[string]string)
+	for _, res := range results {
+		m[res.Name] = res.Status
+	}
+	return m
+}
+
+func TestDiagnoseRelay(t *testing.T) {
+	backend := startEchoBackend(t)
+	defer backend.Close()
+
+	cfg := &RelayConfig{
+		Listen:        "127.0.0.1:1292",
+		ListenType:    Listen_RAW,
+		Remote:        backend.Addr().String(),
+		TransportType: Transport_RAW,
+	}
+	got := diagStatus(diagnoseRelay(cfg))
+	for _, name := range []string{
+		"relay 127.0.0.1:1292 config",
+		"relay 127.0.0.1:1292 tcp bind",
+		"relay 127.0.0.1:1292 udp bind",
+		"relay 127.0.0.1:1292 backend " + backend.Addr().String(),
+	} {
+		if got[name] != DiagPass {
+			t.Fatalf("expect %s pass, got %v", name, got)
+		}
+	}
+
+	// 端口被占用 后端连不上
+	ln, err := net.Listen("tcp", "127.0.0.1:1292")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	down := backend.Addr().String()
+	backend.Close()
+	got = diagStatus(diagnoseRelay(cfg))
+	if got["relay 127.0.0.1:1292 tcp bind"] != DiagFail {
+		t.Fatalf("expect tcp bind fail on used port, got %v", got)
+	}
+	if got["relay 127.0.0.1:1292 backend "+down] != DiagFail {
+		t.Fatalf("expect backend fail when it is down, got %v", got)
+	}
+
+	// 配置错误时只有config这一项
+	bad := &RelayConfig{Listen: "127.0.0.1:1292", ListenType: Listen_RAW, Remote: down, TransportType: Transport_RAW, AccessLogSampleRate: 2}
+	if results := diagnoseRelay(bad); len(results) != 1 || results[0].Status != DiagFail {
+		t.Fatalf("expect only a failed config result, got %v", results)
+	}
+}
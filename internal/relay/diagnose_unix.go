@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package relay
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func checkNoFile() DiagResult {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return diagResult("fd limit", err)
+	}
+	detail := fmt.Sprintf("RLIMIT_NOFILE soft: %d hard: %d", rl.Cur, rl.Max)
+	if rl.Cur < recommendedNoFile {
+		return DiagResult{Name: "fd limit", Status: DiagWarn, Detail: detail + fmt.Sprintf(", recommend >= %d", recommendedNoFile)}
+	}
+	return DiagResult{Name: "fd limit", Status: DiagPass, Detail: detail}
+}
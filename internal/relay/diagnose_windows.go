@@ -0,0 +1,5 @@
+package relay
+
+func checkNoFile() DiagResult {
+	return DiagResult{Name: "fd limit", Status: DiagWarn, Detail: "not supported on windows"}
+}
@@ -0,0 +1,92 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// dnsEntry 一个域名解析出来的ip 过期之后仍然先返回旧的结果 同时在后台刷新
+type dnsEntry struct {
+	ips        []string
+	expireAt   time.Time
+	refreshing bool
+}
+
+// dnsCache 按ttl缓存后端域名的解析结果 remote是ip的时候不会用到
+type dnsCache struct {
+	ttl    time.Duration
+	lookup func(ctx context.Context, host string) ([]string, error)
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		ttl:     ttl,
+		lookup:  net.DefaultResolver.LookupHost,
+		entries: make(map[string]*dnsEntry),
+	}
+}
+
+// resolve 命中缓存时直接返回 没有命中时同步解析
+func (c *dnsCache) resolve(host string) ([]string, error) {
+	c.mu.Lock()
+	e, ok := c.entries[host]
+	if ok {
+		if time.Now().After(e.expireAt) && !e.refreshing {
+			e.refreshing = true
+			go c.refresh(host)
+		}
+		ips := e.ips
+		c.mu.Unlock()
+		return ips, nil
+	}
+	c.mu.Unlock()
+	return c.refresh(host)
+}
+
+func (c *dnsCache) refresh(host string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultDialTimeout)
+	defer cancel()
+	ips, err := c.lookup(ctx, host)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil {
+		// 刷新失败的话旧的结果继续用 下次过期再试
+		if e, ok := c.entries[host]; ok {
+			e.refreshing = false
+		}
+		Logger.Warnf("resolve %s error: %s", host, err)
+		return nil, err
+	}
+	c.entries[host] = &dnsEntry{ips: ips, expireAt: time.Now().Add(c.ttl)}
+	return ips, nil
+}
+
+// invalidate dial失败时删掉缓存 下一次重新解析
+func (c *dnsCache) invalidate(host string) {
+	c.mu.Lock()
+	delete(c.entries, host)
+	c.mu.Unlock()
+}
+
+// dial 用缓存的ip dial 失败时清掉缓存再用域名直接dial一次
+func (c *dnsCache) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return net.DialTimeout("tcp", addr, timeout)
+	}
+	ips, err := c.resolve(host)
+	if err == nil && len(ips) > 0 {
+		conn, err := net.DialTimeout("tcp", net.JoinHostPort(ips[0], port), timeout)
+		if err == nil {
+			return conn, nil
+		}
+		c.invalidate(host)
+	}
+	return net.DialTimeout("tcp", addr, timeout)
+}
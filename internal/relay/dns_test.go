@@ -0,0 +1,73 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDNSCache(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	var lookups int32
+	ip := "127.0.0.1"
+	c := newDNSCache(time.Minute)
+	c.lookup = func(ctx context.Context, host string) ([]string, error) {
+		atomic.AddInt32(&lookups, 1)
+		return []string{ip}, nil
+	}
+
+	addr := net.JoinHostPort("backend.test", port)
+	for i := 0; i < 3; i++ {
+		conn, err := c.dial(addr, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if n := atomic.LoadInt32(&lookups); n != 1 {
+		t.Fatalf("expected 1 lookup, got %d", n)
+	}
+
+	// 过期之后先用旧的结果 后台刷新
+	c.mu.Lock()
+	c.entries["backend.test"].expireAt = time.Now()
+	c.mu.Unlock()
+	if _, err := c.resolve("backend.test"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&lookups) != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&lookups); n != 2 {
+		t.Fatalf("expected background refresh, got %d lookups", n)
+	}
+
+	// 缓存的ip连不上时清掉缓存 127.0.0.2上没有监听
+	c.mu.Lock()
+	c.entries["backend.test"] = &dnsEntry{ips: []string{"127.0.0.2"}, expireAt: time.Now().Add(time.Minute)}
+	c.mu.Unlock()
+	c.dial(addr, time.Second)
+	c.mu.Lock()
+	_, ok := c.entries["backend.test"]
+	c.mu.Unlock()
+	if ok {
+		t.Fatal("entry not invalidated after dial failure")
+	}
+}
@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+)
+
+// transport结束的原因 只有CloseReason_Error是预料之外的
+const (
+	CloseReason_EOF     = "eof"
+	CloseReason_Reset   = "reset"
+	CloseReason_Timeout = "timeout"
+	CloseReason_Error   = "error"
+)
+
+// closeReason 把transport返回的错误归类
+// 对端正常断开以及本地已经关掉的连接都算eof 对端RST或者写到已经断开的连接算reset
+func closeReason(err error) string {
+	switch {
+	case err == nil, err == errHalfClosed, errors.Is(err, io.EOF),
+		errors.Is(err, io.ErrClosedPipe), errors.Is(err, websocket.ErrCloseSent), isClosedConnErr(err):
+		return CloseReason_EOF
+	case isPeerReset(err), errors.Is(err, io.ErrUnexpectedEOF):
+		return CloseReason_Reset
+	case isTimeout(err):
+		return CloseReason_Timeout
+	}
+	var ce *websocket.CloseError
+	if errors.As(err, &ce) {
+		switch ce.Code {
+		case websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived:
+			return CloseReason_EOF
+		case websocket.CloseAbnormalClosure:
+			return CloseReason_Reset
+		}
+	}
+	return CloseReason_Error
+}
+
+// isClosedConnErr 读写已经被本地关掉的连接 比如另一个方向先结束了
+// go1.16之前没有net.ErrClosed 只能比较错误信息
+func isClosedConnErr(err error) bool {
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// isPeerReset 对端RST或者连接已经断开 各个平台的errno见connResetErrnos和brokenPipeErrnos
+func isPeerReset(err error) bool {
+	return isErrno(err, connResetErrnos) || isErrno(err, brokenPipeErrnos)
+}
+
+func isTimeout(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	// smux的超时错误没有导出 也没有实现net.Error
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if e.Error() == "timeout" {
+			return true
+		}
+	}
+	return false
+}
+
+func isErrno(err error, errnos []syscall.Errno) bool {
+	for _, errno := range errnos {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
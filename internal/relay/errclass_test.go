@@ -0,0 +1,85 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	pkgerrors "github.com/pkg/errors"
+)
+
+type testTimeoutErr struct{}
+
+func (testTimeoutErr) Error() string   { return "i/o timeout" }
+func (testTimeoutErr) Timeout() bool   { return true }
+func (testTimeoutErr) Temporary() bool { return true }
+
+func TestCloseReason(t *testing.T) {
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{nil, CloseReason_EOF},
+		{io.EOF, CloseReason_EOF},
+		{errHalfClosed, CloseReason_EOF},
+		{pkgerrors.WithStack(io.ErrClosedPipe), CloseReason_EOF},
+		{&net.OpError{Op: "read", Net: "tcp", Err: errors.New("use of closed network connection")}, CloseReason_EOF},
+		{&websocket.CloseError{Code: websocket.CloseNormalClosure}, CloseReason_EOF},
+		{&websocket.CloseError{Code: websocket.CloseAbnormalClosure}, CloseReason_Reset},
+		{io.ErrUnexpectedEOF, CloseReason_Reset},
+		{pkgerrors.WithStack(errors.New("timeout")), CloseReason_Timeout},
+		{&net.OpError{Op: "read", Net: "tcp", Err: testTimeoutErr{}}, CloseReason_Timeout},
+		{errors.New("something else"), CloseReason_Error},
+		{&websocket.CloseError{Code: websocket.CloseProtocolError}, CloseReason_Error},
+	}
+	// 当前平台的errno 和net包返回的一样包在OpError和SyscallError里面
+	for _, errno := range append(connResetErrnos, brokenPipeErrnos...) {
+		err := &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", errno)}
+		cases = append(cases, struct {
+			err  error
+			want string
+		}{fmt.Errorf("copy: %w", err), CloseReason_Reset})
+	}
+	for _, c := range cases {
+		if got := closeReason(c.err); got != c.want {
+			t.Errorf("closeReason(%v) = %s, want %s", c.err, got, c.want)
+		}
+	}
+}
+
+func TestCloseReasonRealReset(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		// 等client连上并发了数据 linger为0时close发送RST
+		c.Read(make([]byte, 1))
+		c.(*net.TCPConn).SetLinger(0)
+		c.Close()
+	}()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("x"))
+	_, err = c.Read(make([]byte, 1))
+	if got := closeReason(err); got != CloseReason_Reset {
+		t.Fatalf("expect reset, got %s: %v", got, err)
+	}
+	if !isConnReset(err) {
+		t.Fatalf("isConnReset should be true for %v", err)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package relay
+
+import "syscall"
+
+var (
+	connResetErrnos  = []syscall.Errno{syscall.ECONNRESET}
+	brokenPipeErrnos = []syscall.Errno{syscall.EPIPE, syscall.ECONNABORTED}
+)
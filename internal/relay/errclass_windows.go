@@ -0,0 +1,12 @@
+package relay
+
+import "syscall"
+
+// windows上socket返回的是WSA开头的错误码 和unix的errno不一样
+var (
+	connResetErrnos  = []syscall.Errno{syscall.WSAECONNRESET, syscall.ECONNRESET}
+	brokenPipeErrnos = []syscall.Errno{
+		syscall.WSAECONNABORTED, syscall.ERROR_BROKEN_PIPE, syscall.ERROR_NETNAME_DELETED,
+		syscall.EPIPE, syscall.ECONNABORTED,
+	}
+)
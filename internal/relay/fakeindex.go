@@ -0,0 +1,183 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// 多久没有请求的ip从限速表里删掉
+var FakeIndexLimiterIdle = 3 * time.Minute
+
+type FakeIndexConfig struct {
+	// 反向代理到一个真实的网站 例如https://example.com 配置了之后下面的都不生效
+	ProxyURL string `json:"proxy_url"`
+	// 固定返回的状态码 0表示200
+	Status  int               `json:"status"`
+	Headers map[string]string `json:"headers"`
+	// 返回的内容 body_file不为空时读取文件的内容
+	Body     string `json:"body"`
+	BodyFile string `json:"body_file"`
+}
+
+// newFakeIndex 非websocket请求的伪装页面 不配置时返回默认的静态页面
+func newFakeIndex(cfg *FakeIndexConfig) (http.Handler, error) {
+	if cfg == nil {
+		return http.HandlerFunc(index), nil
+	}
+	if cfg.ProxyURL != "" {
+		return newFakeIndexProxy(cfg.ProxyURL)
+	}
+	if cfg.Status != 0 && (cfg.Status < 100 || cfg.Status > 999) {
+		return nil, fmt.Errorf("invalid fake_index status: %d", cfg.Status)
+	}
+	body := []byte(cfg.Body)
+	if cfg.BodyFile != "" {
+		var err error
+		if body, err = ioutil.ReadFile(cfg.BodyFile); err != nil {
+			return nil, err
+		}
+	}
+	header := http.Header{}
+	for k, v := range cfg.Headers {
+		header.Set(k, v)
+	}
+	// 200的时候和默认页面一样交给ServeContent 可以处理条件请求和Range
+	if cfg.Status == 0 || cfg.Status == http.StatusOK {
+		modTime := indexModTime
+		if cfg.BodyFile != "" {
+			if fi, err := os.Stat(cfg.BodyFile); err == nil {
+				modTime = fi.ModTime().UTC().Truncate(time.Second)
+			}
+		}
+		if header.Get("ETag") == "" {
+			header.Set("ETag", fmt.Sprintf(`"%x"`, sha1.Sum(body)))
+		}
+		name := filepath.Base(cfg.BodyFile)
+		if cfg.BodyFile == "" && header.Get("Content-Type") == "" {
+			header.Set("Content-Type", "text/html; charset=utf-8")
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Logger.Debugf("index call from %s", r.RemoteAddr)
+			copyHeader(w.Header(), header)
+			http.ServeContent(w, r, name, modTime, bytes.NewReader(body))
+		}), nil
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Logger.Debugf("index call from %s", r.RemoteAddr)
+		copyHeader(w.Header(), header)
+		w.WriteHeader(cfg.Status)
+		w.Write(body)
+	}), nil
+}
+
+// newFakeIndexProxy Host也改成目标网站的 不然大部分虚拟主机都不会正常返回
+func newFakeIndexProxy(rawURL string) (http.Handler, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid fake_index proxy_url: %s", rawURL)
+	}
+	proxy := httputil.NewSingleHostReverseProxy(u)
+	director := proxy.Director
+	proxy.Director = func(r *http.Request) {
+		director(r)
+		r.Host = u.Host
+		// 不把客户端的真实地址带给目标网站
+		r.Header["X-Forwarded-For"] = nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		Logger.Debugf("fake index proxy to %s error: %s", u.Host, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	return proxy, nil
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, v := range src {
+		dst[k] = v
+	}
+}
+
+type ipLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// fakeIndexGuard 限制伪装页面的请求体大小和每个ip的请求频率
+// 只包在伪装页面外面 升级之后的ws连接不受影响
+type fakeIndexGuard struct {
+	next         http.Handler
+	maxBodyBytes int64
+	// 每个ip每秒的请求数 0表示不限制
+	rateLimit int
+	now       func() time.Time
+
+	mu        sync.Mutex
+	limiters  map[string]*ipLimiter
+	lastSweep time.Time
+}
+
+func newFakeIndexGuard(next http.Handler, maxBodyBytes int64, rateLimit int) *fakeIndexGuard {
+	return &fakeIndexGuard{
+		next:         next,
+		maxBodyBytes: maxBodyBytes,
+		rateLimit:    rateLimit,
+		now:          time.Now,
+		limiters:     make(map[string]*ipLimiter),
+	}
+}
+
+func (g *fakeIndexGuard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !g.allow(r.RemoteAddr) {
+		Logger.Debugf("index call from %s rate limited", r.RemoteAddr)
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	if g.maxBodyBytes > 0 && r.Body != nil {
+		r.Body = http.MaxBytesReader(w, r.Body, g.maxBodyBytes)
+	}
+	g.next.ServeHTTP(w, r)
+}
+
+func (g *fakeIndexGuard) allow(remoteAddr string) bool {
+	if g.rateLimit <= 0 {
+		return true
+	}
+	ip := remoteAddr
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		ip = host
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	// 顺便清理很久没来的ip 避免表一直变大
+	if now.Sub(g.lastSweep) > FakeIndexLimiterIdle {
+		for k, l := range g.limiters {
+			if now.Sub(l.lastSeen) > FakeIndexLimiterIdle {
+				delete(g.limiters, k)
+			}
+		}
+		g.lastSweep = now
+	}
+	l, ok := g.limiters[ip]
+	if !ok {
+		l = &ipLimiter{limiter: rate.NewLimiter(rate.Limit(g.rateLimit), g.rateLimit)}
+		g.limiters[ip] = l
+	}
+	l.lastSeen = now
+	return l.limiter.AllowN(now, 1)
+}
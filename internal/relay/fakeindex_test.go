@@ -0,0 +1,170 @@
+package relay
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getFakeIndex(t *testing.T, cfg *FakeIndexConfig) (*http.Response, string) {
+	h, err := newFakeIndex(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestFakeIndex(t *testing.T) {
+	resp, body := getFakeIndex(t, nil)
+	if resp.StatusCode != http.StatusOK || body != string(indexContent) {
+		t.Fatalf("default index: %d %q", resp.StatusCode, body)
+	}
+
+	resp, body = getFakeIndex(t, &FakeIndexConfig{
+		Status:  http.StatusNotFound,
+		Headers: map[string]string{"Server": "nginx"},
+		Body:    "not found",
+	})
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get("Server") != "nginx" || body != "not found" {
+		t.Fatalf("static index: %d %v %q", resp.StatusCode, resp.Header, body)
+	}
+
+	var host string
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		w.Write([]byte("real site"))
+	}))
+	defer site.Close()
+	resp, body = getFakeIndex(t, &FakeIndexConfig{ProxyURL: site.URL, Body: "ignored"})
+	if resp.StatusCode != http.StatusOK || body != "real site" || host != site.Listener.Addr().String() {
+		t.Fatalf("proxy index: %d %q host %s", resp.StatusCode, body, host)
+	}
+
+	for _, cfg := range []*FakeIndexConfig{
+		{ProxyURL: "example.com"},
+		{Status: 42},
+		{BodyFile: "/not/exist"},
+	} {
+		if _, err := newFakeIndex(cfg); err == nil {
+			t.Fatalf("expect error for %+v", cfg)
+		}
+	}
+}
+
+func TestFakeIndexGuard(t *testing.T) {
+	now := time.Unix(0, 0)
+	g := newFakeIndexGuard(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := ioutil.ReadAll(r.Body); err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		}
+	}), 4, 2)
+	g.now = func() time.Time { return now }
+	serve := func(remote, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		req.RemoteAddr = remote
+		rec := httptest.NewRecorder()
+		g.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := serve("1.1.1.1:1", "too large"); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("body should be limited, got %d", code)
+	}
+	if code := serve("1.1.1.1:2", "ok"); code != http.StatusOK {
+		t.Fatalf("expect 200, got %d", code)
+	}
+	// 同一个ip不同端口共用一个限速
+	if code := serve("1.1.1.1:3", "ok"); code != http.StatusTooManyRequests {
+		t.Fatalf("expect 429, got %d", code)
+	}
+	if code := serve("2.2.2.2:1", "ok"); code != http.StatusOK {
+		t.Fatalf("other ip should not be limited, got %d", code)
+	}
+	now = now.Add(time.Second)
+	if code := serve("1.1.1.1:4", "ok"); code != http.StatusOK {
+		t.Fatalf("expect 200 after refill, got %d", code)
+	}
+
+	// 很久没来的ip被清理掉
+	now = now.Add(2 * FakeIndexLimiterIdle)
+	serve("3.3.3.3:1", "")
+	if len(g.limiters) != 1 {
+		t.Fatalf("idle limiters should be evicted, got %d", len(g.limiters))
+	}
+}
+
+func TestTunnelPathServeFakeIndex(t *testing.T) {
+	newRelay := func(listenType string) *Relay {
+		r, err := NewRelayWithConfig(&RelayConfig{
+			Listen:        "127.0.0.1:0",
+			ListenType:    listenType,
+			Remote:        "127.0.0.1:1",
+			TransportType: Transport_RAW,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	wss := newRelay(Listen_WSS)
+	mwss := newRelay(Listen_MWSS)
+	s := mwss.newMWSSServer()
+
+	// 隧道路径上的普通GET和其他路径返回一样的伪装页面
+	for name, h := range map[string]http.HandlerFunc{
+		"wss":     wss.handleWsToTcp,
+		"wss udp": wss.handleWsToUdp,
+		"mwss":    s.upgrade,
+	} {
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest("GET", "/tcp/", nil))
+		if w.Code != http.StatusOK || w.Body.String() != string(indexContent) {
+			t.Fatalf("%s: expect fake index, got %d %q", name, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestIndexCacheHeaders(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(index))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+	if etag == "" || resp.Header.Get("Last-Modified") == "" || resp.Header.Get("Cache-Control") == "" {
+		t.Fatalf("missing cache headers: %v", resp.Header)
+	}
+
+	// 带上缓存的校验值时和真的静态站一样返回304
+	for k, v := range map[string]string{
+		"If-None-Match":     etag,
+		"If-Modified-Since": resp.Header.Get("Last-Modified"),
+	} {
+		req, _ := http.NewRequest("GET", srv.URL+"/", nil)
+		req.Header.Set(k, v)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotModified {
+			t.Fatalf("%s: expect 304, got %d", k, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package relay
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// grpc transport 每个tcp连接是一个双向流 http2自己会多路复用 不需要smux
+// 没有用protoc生成代码 service和method都是手写的 消息就是原始的字节
+const (
+	grpcServiceName = "ehco.Tunnel"
+	grpcTunMethod   = "/" + grpcServiceName + "/Tun"
+	// content-subtype 两端都用它选择rawCodec
+	grpcCodecName = "ehco-raw"
+	// metadata的key只能是小写
+	grpcAuthTokenKey = "x-auth-token"
+	grpcRemotePrefix = "grpc://"
+)
+
+func init() {
+	encoding.RegisterCodec(rawCodec{})
+}
+
+// rawCodec 收发的消息都是*[]byte
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("rawCodec: unexpected message type %T", v)
+	}
+	return *b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("rawCodec: unexpected message type %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return grpcCodecName
+}
+
+var grpcTunnelDesc = grpc.ServiceDesc{
+	ServiceName: grpcServiceName,
+	HandlerType: (*interface{})(nil),
+	Streams: []grpc.StreamDesc{{
+		StreamName: "Tun",
+		Handler: func(srv interface{}, stream grpc.ServerStream) error {
+			return srv.(*Relay).handleGRPCToTcp(stream)
+		},
+		ServerStreams: true,
+		ClientStreams: true,
+	}},
+}
+
+// grpcStream grpc.ClientStream和grpc.ServerStream共有的部分
+type grpcStream interface {
+	Context() context.Context
+	SendMsg(m interface{}) error
+	RecvMsg(m interface{}) error
+}
+
+// grpcAddr client端拿不到底下的tcp连接 用remote当地址
+type grpcAddr string
+
+func (a grpcAddr) Network() string { return "grpc" }
+func (a grpcAddr) String() string  { return string(a) }
+
+// GRPCConn 把一个grpc双向流包装成net.Conn
+// 流上没有deadline 到时间之后直接Close
+type GRPCConn struct {
+	stream grpcStream
+	rb     []byte
+
+	local  net.Addr
+	remote net.Addr
+
+	// client端cancel掉流的ctx server端关掉后端 让handler返回
+	cancel func()
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	deadlineMu sync.Mutex
+	deadline   *time.Timer
+}
+
+func newGRPCConn(stream grpcStream, local, remote net.Addr, cancel func()) *GRPCConn {
+	return &GRPCConn{
+		stream: stream,
+		local:  local,
+		remote: remote,
+		cancel: cancel,
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *GRPCConn) Read(b []byte) (n int, err error) {
+	if len(c.rb) == 0 {
+		var msg []byte
+		if err = c.stream.RecvMsg(&msg); err != nil {
+			return 0, c.convertErr(err)
+		}
+		c.rb = msg
+	}
+	n = copy(b, c.rb)
+	c.rb = c.rb[n:]
+	return
+}
+
+func (c *GRPCConn) Write(b []byte) (n int, err error) {
+	// SendMsg返回之后消息可能还在发送队列里 不能直接用copy的buffer
+	msg := append([]byte(nil), b...)
+	if err = c.stream.SendMsg(&msg); err != nil {
+		return 0, c.convertErr(err)
+	}
+	return len(b), nil
+}
+
+// convertErr 自己Close之后的错误当成本地关闭的连接 对端正常结束的流是io.EOF
+func (c *GRPCConn) convertErr(err error) error {
+	select {
+	case <-c.closed:
+		return io.ErrClosedPipe
+	default:
+	}
+	if status.Code(err) == codes.Canceled {
+		return io.EOF
+	}
+	return err
+}
+
+// CloseWrite client端CloseSend之后server读到EOF server端的流不支持半关闭
+func (c *GRPCConn) CloseWrite() error {
+	cs, ok := c.stream.(grpc.ClientStream)
+	if !ok {
+		return errHalfCloseUnsupported
+	}
+	return cs.CloseSend()
+}
+
+func (c *GRPCConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.deadlineMu.Lock()
+		if c.deadline != nil {
+			c.deadline.Stop()
+		}
+		c.deadlineMu.Unlock()
+		c.cancel()
+	})
+	return nil
+}
+
+// Done 在Close之后关闭
+func (c *GRPCConn) Done() <-chan struct{} {
+	return c.closed
+}
+
+func (c *GRPCConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *GRPCConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// SetDeadline 读写共用一个deadline 到时间之后关闭连接 零值表示取消
+func (c *GRPCConn) SetDeadline(t time.Time) error {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	if c.deadline != nil {
+		c.deadline.Stop()
+		c.deadline = nil
+	}
+	if t.IsZero() {
+		return nil
+	}
+	c.deadline = time.AfterFunc(time.Until(t), func() { c.Close() })
+	return nil
+}
+
+func (c *GRPCConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+func (c *GRPCConn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+// grpcServerCloser StopAccept时不再接受新的连接 已经在转发的流不受影响
+// GracefulStop会等所有的流结束才返回 所以放到后台 listener要马上关掉让出地址
+type grpcServerCloser struct {
+	server *grpc.Server
+	ln     net.Listener
+}
+
+func (c grpcServerCloser) Close() error {
+	err := c.ln.Close()
+	go c.server.GracefulStop()
+	return err
+}
+
+func (relay *Relay) RunLocalGRPCServer() error {
+	ln, err := relay.listenStream()
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	server := grpc.NewServer(grpc.Creds(credentials.NewTLS(relay.serverTLSConfig())))
+	server.RegisterService(&grpcTunnelDesc, relay)
+	relay.trackListener(grpcServerCloser{server: server, ln: ln})
+	relay.listenerReady()
+	return server.Serve(ln)
+}
+
+// checkGRPCAuthToken 和ws的auth_token一样 没有配置时总是放行
+func checkGRPCAuthToken(ctx context.Context, token string) bool {
+	if token == "" {
+		return true
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, got := range md.Get(grpcAuthTokenKey) {
+		if subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (relay *Relay) handleGRPCToTcp(stream grpc.ServerStream) error {
+	var remoteAddr net.Addr = grpcAddr("")
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		remoteAddr = p.Addr
+	}
+	if !relay.scheduleOpen() || !relay.allowAddr(remoteAddr) {
+		return status.Error(codes.PermissionDenied, "not allowed")
+	}
+	if !checkGRPCAuthToken(stream.Context(), relay.cfg.AuthToken) {
+		Logger.Warnf("[grpc] %s auth token mismatch", remoteAddr)
+		return status.Error(codes.PermissionDenied, "not allowed")
+	}
+	release, ok := relay.acquireConn()
+	if !ok {
+		return status.Error(codes.ResourceExhausted, "too many conns")
+	}
+	defer release()
+	ctx, cancel := context.WithCancel(stream.Context())
+	defer cancel()
+	gc := newGRPCConn(stream, relay.listenAddr(), remoteAddr, cancel)
+	defer gc.Close()
+	lc, cs := relay.traceConn(gc, "ehco.grpc.server")
+	dialDone := cs.phase("dial")
+	rc, remote, err := relay.dialBackend()
+	dialDone(err)
+	if err != nil {
+		cs.end(remote, err)
+		cs.log.Warnf("dial error: %s", err)
+		return status.Error(codes.Unavailable, "dial backend failed")
+	}
+	defer rc.Close()
+	// server端的流只有handler返回才会结束 gc被关掉或者client取消时关掉后端 让transport退出
+	go func() {
+		<-ctx.Done()
+		rc.Close()
+	}()
+	relay.conns.add(remote, gc)
+	defer relay.conns.remove(remote, gc)
+	relay.logAccess(cs, "handleGRPCToTcp", "from", remoteAddr, "to", rc.RemoteAddr())
+	if err := gc.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
+		cs.end(remote, err)
+		return nil
+	}
+	if err := rc.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
+		cs.end(remote, err)
+		return nil
+	}
+	relay.connOpened(cs, remoteAddr, remote)
+	_, err = transport(lc, rc, relay.cfg)
+	cs.end(remote, err)
+	return nil
+}
+
+// grpcTransporter 每个remote一个grpc.ClientConn 每次Dial在上面开一个新的流
+// ClientConn断开之后grpc会自己重连 不需要像mwss一样管理session
+type grpcTransporter struct {
+	relay *Relay
+
+	mu    sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func newGRPCTransporter(r *Relay) *grpcTransporter {
+	return &grpcTransporter{relay: r, conns: make(map[string]*grpc.ClientConn)}
+}
+
+// clientConn 第一次用到remote时建立连接 握手失败不缓存 下次Dial重新建立
+func (tr *grpcTransporter) clientConn(ctx context.Context, addr string) (*grpc.ClientConn, error) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if cc, ok := tr.conns[addr]; ok {
+		return cc, nil
+	}
+	limiter := handshakes
+	if !limiter.acquire("client") {
+		return nil, ErrTooManyHandshakes
+	}
+	defer limiter.release()
+	ctx, cancel := context.WithTimeout(ctx, tr.relay.dialTimeout())
+	defer cancel()
+	cc, err := grpc.DialContext(ctx, addr,
+		grpc.WithTransportCredentials(credentials.NewTLS(tr.relay.clientTLSConfig())),
+		grpc.WithBlock(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	tr.conns[addr] = cc
+	return cc, nil
+}
+
+// Dial addr是remote 可以带上grpc://前缀
+func (tr *grpcTransporter) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	addr = strings.TrimPrefix(addr, grpcRemotePrefix)
+	cc, err := tr.clientConn(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	// 流的生命周期和这次dial的ctx无关 由GRPCConn.Close结束
+	sctx, cancel := context.WithCancel(context.Background())
+	if tr.relay.cfg.AuthToken != "" {
+		sctx = metadata.AppendToOutgoingContext(sctx, grpcAuthTokenKey, tr.relay.cfg.AuthToken)
+	}
+	stream, err := cc.NewStream(sctx, &grpcTunnelDesc.Streams[0], grpcTunMethod, grpc.CallContentSubtype(grpcCodecName))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return newGRPCConn(stream, grpcAddr(""), grpcAddr(addr), cancel), nil
+}
+
+func (tr *grpcTransporter) Close() error {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for addr, cc := range tr.conns {
+		cc.Close()
+		delete(tr.conns, addr)
+	}
+	return nil
+}
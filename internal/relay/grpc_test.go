@@ -0,0 +1,86 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func startGRPCRelays(t *testing.T, serverToken, clientToken string) func() {
+	if DefaultTLSConfig == nil {
+		InitTlsCfg()
+	}
+	backend := startEchoBackend(t)
+	server, err := NewRelayWithConfig(&RelayConfig{
+		Listen:        "127.0.0.1:1261",
+		ListenType:    Listen_GRPC,
+		Remote:        backend.Addr().String(),
+		TransportType: Transport_RAW,
+		AuthToken:     serverToken,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ListenAndServe()
+	client, err := NewRelayWithConfig(&RelayConfig{
+		Listen:        "127.0.0.1:1262",
+		ListenType:    Listen_RAW,
+		Remote:        "grpc://127.0.0.1:1261",
+		TransportType: Transport_GRPC,
+		AuthToken:     clientToken,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.ListenAndServe()
+	for _, r := range []*Relay{server, client} {
+		select {
+		case <-r.Ready():
+		case <-time.After(5 * time.Second):
+			t.Fatal("relay not ready")
+		}
+	}
+	return func() {
+		client.Shutdown(context.Background())
+		server.Shutdown(context.Background())
+		backend.Close()
+	}
+}
+
+func TestGRPCTransport(t *testing.T) {
+	cleanup := startGRPCRelays(t, "secret", "secret")
+	defer cleanup()
+
+	// 同一个ClientConn上的多个流
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", "127.0.0.1:1262")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("echo through grpc failed: %q %v", buf, err)
+		}
+		c.Close()
+	}
+}
+
+func TestGRPCTransportAuthToken(t *testing.T) {
+	cleanup := startGRPCRelays(t, "secret", "wrong")
+	defer cleanup()
+
+	c, err := net.Dial("tcp", "127.0.0.1:1262")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("ping"))
+	if _, err := io.ReadFull(c, make([]byte, 4)); err == nil {
+		t.Fatal("expect conn with wrong token closed")
+	}
+}
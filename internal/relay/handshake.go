@@ -0,0 +1,83 @@
+package relay
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	HandshakeQueueTimeout = 5 * time.Second
+
+	ErrTooManyHandshakes = errors.New("too many concurrent handshakes")
+
+	handshakes *handshakeLimiter
+
+	handshakesQueued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ehco",
+		Name:      "handshakes_queued_total",
+		Help:      "handshakes that had to wait for a free handshake slot",
+	}, []string{"side"})
+
+	handshakesRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ehco",
+		Name:      "handshakes_rejected_total",
+		Help:      "handshakes rejected after waiting too long for a free handshake slot",
+	}, []string{"side"})
+)
+
+func init() {
+	prometheus.MustRegister(handshakesQueued, handshakesRejected)
+}
+
+// handshakeLimiter 限制同时进行的tls+ws+smux握手数量 nil表示不限制
+type handshakeLimiter struct {
+	sem chan struct{}
+}
+
+// SetMaxConcurrentHandshakes 设置全局的握手并发上限 0表示不限制
+func SetMaxConcurrentHandshakes(n int) {
+	if n <= 0 {
+		handshakes = nil
+		return
+	}
+	handshakes = &handshakeLimiter{sem: make(chan struct{}, n)}
+}
+
+// acquire 没有空位时最多排队HandshakeQueueTimeout 超时返回false
+func (l *handshakeLimiter) acquire(side string) bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	default:
+	}
+
+	handshakesQueued.WithLabelValues(side).Inc()
+	timer := time.NewTimer(HandshakeQueueTimeout)
+	defer timer.Stop()
+	select {
+	case l.sem <- struct{}{}:
+		return true
+	case <-timer.C:
+		handshakesRejected.WithLabelValues(side).Inc()
+		return false
+	}
+}
+
+func (l *handshakeLimiter) release() {
+	if l == nil {
+		return
+	}
+	<-l.sem
+}
+
+// releaseFunc 返回只会生效一次的release 方便在多个出口调用
+func (l *handshakeLimiter) releaseFunc() func() {
+	var once sync.Once
+	return func() { once.Do(l.release) }
+}
@@ -0,0 +1,44 @@
+package relay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestHandshakeLimiter(t *testing.T) {
+	defer SetMaxConcurrentHandshakes(0)
+	defer func(d time.Duration) { HandshakeQueueTimeout = d }(HandshakeQueueTimeout)
+	HandshakeQueueTimeout = 100 * time.Millisecond
+
+	// 默认不限制
+	if !handshakes.acquire("test") {
+		t.Fatal("nil limiter should always allow")
+	}
+
+	SetMaxConcurrentHandshakes(1)
+	l := handshakes
+	if !l.acquire("test") {
+		t.Fatal("first handshake rejected")
+	}
+	queued := testutil.ToFloat64(handshakesQueued.WithLabelValues("test"))
+	rejected := testutil.ToFloat64(handshakesRejected.WithLabelValues("test"))
+	if l.acquire("test") {
+		t.Fatal("second handshake allowed over limit")
+	}
+	if testutil.ToFloat64(handshakesQueued.WithLabelValues("test")) != queued+1 ||
+		testutil.ToFloat64(handshakesRejected.WithLabelValues("test")) != rejected+1 {
+		t.Fatal("queued and rejected handshakes not counted")
+	}
+
+	// 排队期间有空位释放出来就可以继续握手
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		l.release()
+	}()
+	if !l.acquire("test") {
+		t.Fatal("queued handshake rejected after a slot released")
+	}
+	l.release()
+}
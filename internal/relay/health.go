@@ -0,0 +1,101 @@
+package relay
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	BackendHealth_Up   = "up"
+	BackendHealth_Down = "down"
+)
+
+// 后端down之后探测间隔每次翻倍 最多到这么久
+var HealthCheckMaxBackoff = 5 * time.Minute
+
+var backendUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "ehco",
+	Subsystem: "backend",
+	Name:      "up",
+	Help:      "whether the last health check of the backend succeeded, only exported when health checking is enabled",
+}, []string{"relay", "remote"})
+
+func init() {
+	prometheus.MustRegister(backendUp)
+}
+
+// backendDialAddr remote对应的tcp地址 wss/mwss/grpc的remote是url 只取host:port
+// quic的remote是udp地址
+func backendDialAddr(transportType, remote string) (network, addr string, err error) {
+	if path, ok := unixSocketPath(remote); ok {
+		return "unix", path, nil
+	}
+	if transportType == Transport_QUIC {
+		return "udp", strings.TrimPrefix(remote, quicRemotePrefix), nil
+	}
+	if transportType == Transport_RAW || !strings.Contains(remote, "://") {
+		return "tcp", remote, nil
+	}
+	u, err := url.Parse(remote)
+	if err != nil {
+		return "", "", err
+	}
+	return "tcp", u.Host, nil
+}
+
+// probeBackend 能建立tcp连接就算健康 不做ws/tls握手 避免在server上留下session
+func (r *Relay) probeBackend(remote string) error {
+	network, addr, err := backendDialAddr(r.TransportType, remote)
+	if err != nil {
+		return err
+	}
+	timeout := time.Duration(r.cfg.HealthCheckTimeoutSec) * time.Second
+	if timeout <= 0 {
+		timeout = r.dialTimeout()
+	}
+	c, err := net.DialTimeout(network, addr, timeout)
+	if err != nil {
+		return err
+	}
+	return c.Close()
+}
+
+// watchBackendHealth 每health_check_interval_sec探测一次remote 失败时标记为down并按MarkBackendDown处理
+// down的后端每次探测失败后等待时间翻倍 直到HealthCheckMaxBackoff 恢复之后回到正常间隔
+func (r *Relay) watchBackendHealth(remote string) {
+	interval := time.Duration(r.cfg.HealthCheckIntervalSec) * time.Second
+	gauge := backendUp.WithLabelValues(r.cfg.Listen, remote)
+	gauge.Set(1)
+	wait := interval
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-timer.C:
+		}
+		err := r.probeBackend(remote)
+		if err == nil {
+			gauge.Set(1)
+			if r.backends.setHealth(remote, true) {
+				Logger.Infof("relay %s backend %s is up", r.cfg.Listen, remote)
+			}
+			wait = interval
+		} else {
+			gauge.Set(0)
+			if r.backends.setHealth(remote, false) {
+				Logger.Warnf("relay %s backend %s is down: %s", r.cfg.Listen, remote, err)
+				r.MarkBackendDown(remote)
+			}
+			if wait *= 2; wait > HealthCheckMaxBackoff {
+				wait = HealthCheckMaxBackoff
+			}
+		}
+		timer.Reset(wait)
+	}
+}
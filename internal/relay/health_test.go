@@ -0,0 +1,69 @@
+package relay
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBackendDialAddr(t *testing.T) {
+	cases := []struct {
+		transport, remote, network, addr string
+	}{
+		{Transport_RAW, "127.0.0.1:1234", "tcp", "127.0.0.1:1234"},
+		{Transport_RAW, "unix:/tmp/ehco.sock", "unix", "/tmp/ehco.sock"},
+		{Transport_MWSS, "wss://127.0.0.1:443", "tcp", "127.0.0.1:443"},
+		{Transport_GRPC, "127.0.0.1:443", "tcp", "127.0.0.1:443"},
+	}
+	for _, c := range cases {
+		network, addr, err := backendDialAddr(c.transport, c.remote)
+		if err != nil || network != c.network || addr != c.addr {
+			t.Fatalf("backendDialAddr(%s, %s) = %s %s %v", c.transport, c.remote, network, addr, err)
+		}
+	}
+}
+
+func TestBackendHealthCheck(t *testing.T) {
+	backend := startEchoBackend(t)
+	defer backend.Close()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	r, err := NewRelayWithConfig(&RelayConfig{
+		Listen:                 "127.0.0.1:1263",
+		ListenType:             Listen_RAW,
+		Remotes:                []string{deadAddr, backend.Addr().String()},
+		TransportType:          Transport_RAW,
+		HealthCheckIntervalSec: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.ListenAndServe()
+	defer r.StopAccept()
+	<-r.Ready()
+	if h := r.Status().BackendHealth; h[deadAddr] != BackendHealth_Up {
+		t.Fatalf("backends should be up before the first check: %v", h)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for r.Status().BackendHealth[deadAddr] != BackendHealth_Down {
+		if time.Now().After(deadline) {
+			t.Fatalf("dead backend not marked down: %v", r.Status().BackendHealth)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if h := r.Status().BackendHealth[backend.Addr().String()]; h != BackendHealth_Up {
+		t.Fatalf("alive backend should be up, got %s", h)
+	}
+	// down的后端不会被选中
+	for i := 0; i < 10; i++ {
+		if got := r.backends.pick(); got == deadAddr {
+			t.Fatal("down backend picked")
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package relay
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+// ConnInfo 传给OnConnect/OnDisconnect的连接信息
+type ConnInfo struct {
+	// 和日志里的conn_id一致
+	ID string
+	// relay的listen地址
+	Relay   string
+	Client  net.Addr
+	Backend string
+	Start   time.Time
+}
+
+// connHook 同一个连接的OnDisconnect在OnConnect返回之后才调用
+type connHook struct {
+	r         *Relay
+	info      ConnInfo
+	connected chan struct{}
+}
+
+// connOpened 连上后端开始transport之前调用 没有设置hook时只做标记
+func (r *Relay) connOpened(cs *connSpan, client net.Addr, backend string) {
+	cs.transporting = true
+	r.trackLive(cs, client, backend)
+	if r.OnConnect == nil && r.OnDisconnect == nil {
+		return
+	}
+	h := &connHook{
+		r:         r,
+		info:      ConnInfo{ID: cs.id, Relay: r.cfg.Listen, Client: client, Backend: backend, Start: time.Now()},
+		connected: make(chan struct{}),
+	}
+	cs.hook = h
+	go func() {
+		defer close(h.connected)
+		if r.OnConnect != nil {
+			r.OnConnect(h.info)
+		}
+	}()
+}
+
+func (h *connHook) disconnect(cc *countConn) {
+	if h.r.OnDisconnect == nil {
+		return
+	}
+	var in, out int64
+	if cc != nil {
+		in, out = atomic.LoadInt64(&cc.in), atomic.LoadInt64(&cc.out)
+	}
+	d := time.Since(h.info.Start)
+	go func() {
+		<-h.connected
+		h.r.OnDisconnect(h.info, in, out, d)
+	}()
+}
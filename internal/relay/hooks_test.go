@@ -0,0 +1,77 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRelayConnHooks(t *testing.T) {
+	backend := startEchoBackend(t)
+	defer backend.Close()
+
+	listen := "127.0.0.1:1257"
+	r, err := NewRelay(listen, Listen_RAW, backend.Addr().String(), Transport_RAW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connected := make(chan ConnInfo, 1)
+	type closed struct {
+		info      ConnInfo
+		in, out   int64
+		afterOpen bool
+	}
+	var opened int32
+	disconnected := make(chan closed, 1)
+	r.OnConnect = func(info ConnInfo) {
+		// 慢的hook不能阻塞转发
+		time.Sleep(100 * time.Millisecond)
+		atomic.StoreInt32(&opened, 1)
+		connected <- info
+	}
+	r.OnDisconnect = func(info ConnInfo, in, out int64, d time.Duration) {
+		disconnected <- closed{info, in, out, atomic.LoadInt32(&opened) == 1}
+	}
+	go r.ListenAndServe()
+	defer r.Shutdown(context.Background())
+	select {
+	case <-r.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay not ready")
+	}
+
+	c, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(50 * time.Millisecond))
+	buf := make([]byte, 4)
+	c.Write([]byte("ping"))
+	if _, err := io.ReadFull(c, buf); err != nil {
+		t.Fatalf("relay blocked by OnConnect: %s", err)
+	}
+	c.Close()
+
+	select {
+	case info := <-connected:
+		if info.Relay != listen || info.Backend != backend.Addr().String() || info.Client.String() != c.LocalAddr().String() || info.ID == "" {
+			t.Fatalf("bad conn info: %+v", info)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnConnect not called")
+	}
+	select {
+	case d := <-disconnected:
+		if !d.afterOpen {
+			t.Fatal("OnDisconnect called before OnConnect returned")
+		}
+		if d.in != 4 || d.out != 4 {
+			t.Fatalf("bad bytes in/out: %d %d", d.in, d.out)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("OnDisconnect not called")
+	}
+}
@@ -0,0 +1,60 @@
+package relay
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// http listen 只支持CONNECT 普通的http代理请求回复405
+func (r *Relay) RunLocalHTTPProxyServer() error {
+	return r.runLocalProxyServer(r.handleHTTPConnectOverMWSS)
+}
+
+// handleHTTPConnectOverMWSS 读出CONNECT请求的目标 和socks5一样放在stream最开始发给server
+func (r *Relay) handleHTTPConnectOverMWSS(c net.Conn) error {
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(SOCKS5HandshakeDeadline))
+	br := bufio.NewReader(c)
+	target, err := readHTTPConnect(br, c)
+	if err != nil {
+		return err
+	}
+	// 客户端可能不等200就把tls握手发过来了 已经读进buffer的要先转发
+	if br.Buffered() > 0 {
+		c = &peekedConn{Conn: c, r: br}
+	}
+	return r.connectTargetOverMWSS(c, target, func(err error) error {
+		if err != nil {
+			return writeHTTPStatus(c, http.StatusBadGateway)
+		}
+		_, err = io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return err
+	})
+}
+
+// readHTTPConnect 不是CONNECT的请求回复405 目标没有端口回复400
+func readHTTPConnect(br *bufio.Reader, w io.Writer) (string, error) {
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return "", err
+	}
+	if req.Method != http.MethodConnect {
+		writeHTTPStatus(w, http.StatusMethodNotAllowed)
+		return "", fmt.Errorf("http proxy method not supported: %s", req.Method)
+	}
+	if _, _, err := net.SplitHostPort(req.Host); err != nil {
+		writeHTTPStatus(w, http.StatusBadRequest)
+		return "", err
+	}
+	return req.Host, nil
+}
+
+func writeHTTPStatus(w io.Writer, code int) error {
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\n\r\n", code, http.StatusText(code))
+	return err
+}
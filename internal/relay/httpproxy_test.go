@@ -0,0 +1,39 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestReadHTTPConnect(t *testing.T) {
+	cases := []struct {
+		req        string
+		wantTarget string
+		wantStatus string
+	}{
+		{req: "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n", wantTarget: "example.com:443"},
+		{req: "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n", wantStatus: "HTTP/1.1 405 "},
+		{req: "CONNECT example.com HTTP/1.1\r\nHost: example.com\r\n\r\n", wantStatus: "HTTP/1.1 400 "},
+	}
+	for _, tc := range cases {
+		var w bytes.Buffer
+		target, err := readHTTPConnect(bufio.NewReader(strings.NewReader(tc.req)), &w)
+		if tc.wantTarget != "" {
+			if err != nil || target != tc.wantTarget {
+				t.Fatalf("%q: expect target %s, got %s %v", tc.req, tc.wantTarget, target, err)
+			}
+			if w.Len() != 0 {
+				t.Fatalf("%q: unexpected reply %q", tc.req, w.String())
+			}
+			continue
+		}
+		if err == nil {
+			t.Fatalf("%q: expect error", tc.req)
+		}
+		if !strings.HasPrefix(w.String(), tc.wantStatus) {
+			t.Fatalf("%q: expect reply %q, got %q", tc.req, tc.wantStatus, w.String())
+		}
+	}
+}
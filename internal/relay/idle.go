@@ -0,0 +1,63 @@
+package relay
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// idleWatchdog 记录最后一次有数据流动的时间
+type idleWatchdog struct {
+	last    int64
+	timeout time.Duration
+}
+
+func newIdleWatchdog(timeout time.Duration) *idleWatchdog {
+	return &idleWatchdog{last: time.Now().UnixNano(), timeout: timeout}
+}
+
+func (w *idleWatchdog) touch() {
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
+}
+
+func (w *idleWatchdog) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&w.last)))
+}
+
+// watch 超过timeout没有数据流动时关闭两端 让阻塞的copy和smux stream都能退出
+func (w *idleWatchdog) watch(done <-chan struct{}, closers ...io.Closer) {
+	interval := w.timeout / 4
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if w.idle() < w.timeout {
+				continue
+			}
+			Logger.Debugf("transport idle for %s, closing", w.timeout)
+			for _, c := range closers {
+				c.Close()
+			}
+			return
+		}
+	}
+}
+
+type activityReader struct {
+	io.Reader
+	w *idleWatchdog
+}
+
+func (r *activityReader) Read(b []byte) (int, error) {
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		r.w.touch()
+	}
+	return n, err
+}
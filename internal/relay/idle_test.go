@@ -0,0 +1,101 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+func TestResetRetryBackendIdleTimeout(t *testing.T) {
+	client, clientPeer := net.Pipe()
+	backend, backendPeer := net.Pipe()
+	defer clientPeer.Close()
+	defer backendPeer.Close()
+	dial := func() (net.Conn, error) { return nil, errors.New("should not redial") }
+
+	errc := make(chan error, 1)
+	go func() {
+		cfg := &RelayConfig{Listen: "idle-reset-retry", IdleTimeoutSec: 1}
+		_, err := transport(client, newResetRetryBackend(backend, dial, 1024), cfg)
+		errc <- err
+	}()
+	// 两边都不发数据 watchdog最多两个检查间隔之后关掉两端
+	select {
+	case <-errc:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect idle conn closed")
+	}
+	if _, err := clientPeer.Write([]byte("x")); err == nil {
+		t.Fatal("expect client side closed")
+	}
+}
+
+func TestTransportIdleTimeout(t *testing.T) {
+	c1, c2 := net.Pipe()
+	session, err := smux.Client(c1, smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	server, err := smux.Server(c2, smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		for {
+			s, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, s)
+		}
+	}()
+	stream, err := session.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, clientPeer := net.Pipe()
+	defer clientPeer.Close()
+
+	errc := make(chan error, 1)
+	go func() {
+		cfg := &RelayConfig{Listen: "idle-transport", IdleTimeoutSec: 1}
+		_, err := transport(client, stream, cfg)
+		errc <- err
+	}()
+	// 一直有数据流动时超过timeout也不会断开
+	for i := 0; i < 8; i++ {
+		if _, err := clientPeer.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(300 * time.Millisecond)
+	}
+	select {
+	case err := <-errc:
+		t.Fatalf("expect active conn kept open, got %v", err)
+	default:
+	}
+
+	select {
+	case <-errc:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expect idle conn closed")
+	}
+	// 两端都被关掉 smux stream被回收
+	if _, err := clientPeer.Write([]byte("x")); err == nil {
+		t.Fatal("expect client side closed")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for session.NumStreams() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expect stream reclaimed, got %d streams", session.NumStreams())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
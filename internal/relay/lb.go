@@ -0,0 +1,199 @@
+package relay
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	LBPolicy_RoundRobin = "round_robin"
+	LBPolicy_Random     = "random"
+	// 选正在转发的连接最少的后端 一样多时按顺序轮流
+	LBPolicy_LeastConn = "least_conn"
+)
+
+// 后端dial失败之后多久之内不再选它
+var BackendFailCooldown = 30 * time.Second
+
+// backendPool 在多个后端之间做负载均衡 跳过最近dial失败的后端
+type backendPool struct {
+	addrs  []string
+	policy string
+
+	mu       sync.Mutex
+	next     int
+	failedAt map[string]time.Time
+	// 开启健康检查时探测失败的后端 为nil表示没有开启
+	down map[string]bool
+
+	// 为nil表示不熔断
+	breaker *circuitBreaker
+	// least_conn用来拿每个后端正在转发的连接数 为nil时退化成round_robin
+	load func(addr string) int
+}
+
+func newBackendPool(addrs []string, policy string) (*backendPool, error) {
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no remote backend")
+	}
+	switch policy {
+	case "":
+		policy = LBPolicy_RoundRobin
+	case LBPolicy_RoundRobin, LBPolicy_Random, LBPolicy_LeastConn:
+	default:
+		return nil, fmt.Errorf("unknown lb_policy: %s", policy)
+	}
+	return &backendPool{
+		addrs:    addrs,
+		policy:   policy,
+		failedAt: make(map[string]time.Time),
+	}, nil
+}
+
+// pick 选出下一个后端 所有后端都在冷却中时也返回一个 总比直接断开好
+func (p *backendPool) pick() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	start := p.next
+	if p.policy == LBPolicy_Random {
+		start = rand.Intn(len(p.addrs))
+	}
+	p.next = (start + 1) % len(p.addrs)
+	now := time.Now()
+	if p.policy == LBPolicy_LeastConn && p.load != nil {
+		return p.pickLeastConn(start, now)
+	}
+	for i := 0; i < len(p.addrs); i++ {
+		idx := (start + i) % len(p.addrs)
+		addr := p.addrs[idx]
+		if p.unavailable(addr, now) {
+			continue
+		}
+		if p.policy == LBPolicy_RoundRobin {
+			p.next = (idx + 1) % len(p.addrs)
+		}
+		return addr
+	}
+	return p.addrs[start]
+}
+
+// unavailable 健康检查判定为down 或者最近dial失败还在冷却中 NOTE must hold mu
+func (p *backendPool) unavailable(addr string, now time.Time) bool {
+	if p.down[addr] {
+		return true
+	}
+	failedAt, ok := p.failedAt[addr]
+	return ok && now.Sub(failedAt) < BackendFailCooldown
+}
+
+// setHealth 记录健康检查的结果 状态有变化时返回true
+func (p *backendPool) setHealth(addr string, up bool) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down == nil {
+		p.down = make(map[string]bool)
+	}
+	changed := p.down[addr] == up
+	p.down[addr] = !up
+	return changed
+}
+
+// healthStates 每个后端的健康状态 没有开启健康检查时返回nil
+func (p *backendPool) healthStates() map[string]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.down == nil {
+		return nil
+	}
+	res := make(map[string]string, len(p.addrs))
+	for _, addr := range p.addrs {
+		if p.down[addr] {
+			res[addr] = BackendHealth_Down
+		} else {
+			res[addr] = BackendHealth_Up
+		}
+	}
+	return res
+}
+
+// pickLeastConn 从start开始找连接数最少的后端 NOTE must hold mu
+func (p *backendPool) pickLeastConn(start int, now time.Time) string {
+	best, bestLoad := -1, 0
+	for i := 0; i < len(p.addrs); i++ {
+		idx := (start + i) % len(p.addrs)
+		addr := p.addrs[idx]
+		if p.unavailable(addr, now) {
+			continue
+		}
+		if load := p.load(addr); best < 0 || load < bestLoad {
+			best, bestLoad = idx, load
+		}
+	}
+	if best < 0 {
+		return p.addrs[start]
+	}
+	return p.addrs[best]
+}
+
+func (p *backendPool) markFailed(addr string) {
+	p.mu.Lock()
+	p.failedAt[addr] = time.Now()
+	p.mu.Unlock()
+}
+
+func (p *backendPool) markOK(addr string) {
+	p.mu.Lock()
+	delete(p.failedAt, addr)
+	p.mu.Unlock()
+}
+
+// try 依次在选出来的后端上执行fn 直到成功或者用完attempts次 失败的后端会进入冷却
+func (p *backendPool) try(attempts int, fn func(addr string) error) (string, error) {
+	if attempts <= 0 {
+		attempts = len(p.addrs)
+	}
+	var err error
+	for i := 0; i < attempts; i++ {
+		addr := p.pick()
+		if err = p.breaker.allow(addr); err != nil {
+			// 熔断中的后端不会真的去dial 也不算一次失败
+			Logger.Debugf("backend %s skipped: %s attempt: %d/%d", addr, err, i+1, attempts)
+			continue
+		}
+		if err = fn(addr); err == nil {
+			p.markOK(addr)
+			p.breaker.success(addr)
+			return addr, nil
+		}
+		p.markFailed(addr)
+		p.breaker.failure(addr)
+		Logger.Warnf("backend %s failed: %s attempt: %d/%d", addr, err, i+1, attempts)
+	}
+	return "", err
+}
+
+// breakerStates 每个后端的熔断状态 没有开启熔断时返回nil
+func (p *backendPool) breakerStates() map[string]string {
+	if p.breaker == nil {
+		return nil
+	}
+	res := make(map[string]string, len(p.addrs))
+	for _, addr := range p.addrs {
+		res[addr] = p.breaker.state(addr)
+	}
+	return res
+}
+
+// dial 返回第一个dial成功的后端
+func (p *backendPool) dial(dial func(addr string) (net.Conn, error), attempts int) (net.Conn, string, error) {
+	var c net.Conn
+	addr, err := p.try(attempts, func(addr string) (err error) {
+		c, err = dial(addr)
+		return err
+	})
+	return c, addr, err
+}
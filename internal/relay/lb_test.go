@@ -0,0 +1,119 @@
+package relay
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBackendPoolRoundRobin(t *testing.T) {
+	addrs := []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"}
+	p, err := newBackendPool(addrs, LBPolicy_RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counts := map[string]int{}
+	for i := 0; i < 300; i++ {
+		counts[p.pick()]++
+	}
+	for _, addr := range addrs {
+		if counts[addr] != 100 {
+			t.Fatalf("uneven distribution: %v", counts)
+		}
+	}
+}
+
+func TestBackendPoolSkipFailed(t *testing.T) {
+	addrs := []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"}
+	p, err := newBackendPool(addrs, LBPolicy_RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.markFailed(addrs[1])
+	counts := map[string]int{}
+	for i := 0; i < 300; i++ {
+		counts[p.pick()]++
+	}
+	if counts[addrs[1]] != 0 || counts[addrs[0]] != 150 || counts[addrs[2]] != 150 {
+		t.Fatalf("failed backend not skipped: %v", counts)
+	}
+
+	p.markOK(addrs[1])
+	if got := p.pick(); got != addrs[0] {
+		// 上一次选的是addrs[2]
+		t.Fatalf("expect %s got %s", addrs[0], got)
+	}
+	if got := p.pick(); got != addrs[1] {
+		t.Fatalf("recovered backend not picked: %s", got)
+	}
+}
+
+func TestBackendPoolLeastConn(t *testing.T) {
+	addrs := []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"}
+	p, err := newBackendPool(addrs, LBPolicy_LeastConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	load := map[string]int{addrs[0]: 2, addrs[1]: 0, addrs[2]: 1}
+	p.load = func(addr string) int { return load[addr] }
+	for i := 0; i < 3; i++ {
+		if got := p.pick(); got != addrs[1] {
+			t.Fatalf("expect least loaded %s got %s", addrs[1], got)
+		}
+	}
+	load[addrs[1]] = 5
+	if got := p.pick(); got != addrs[2] {
+		t.Fatalf("expect %s got %s", addrs[2], got)
+	}
+	p.markFailed(addrs[2])
+	if got := p.pick(); got != addrs[0] {
+		t.Fatalf("failed backend not skipped: %s", got)
+	}
+
+	// 连接数一样时轮流选
+	load = map[string]int{}
+	p.markOK(addrs[2])
+	counts := map[string]int{}
+	for i := 0; i < 300; i++ {
+		counts[p.pick()]++
+	}
+	for _, addr := range addrs {
+		if counts[addr] != 100 {
+			t.Fatalf("uneven distribution: %v", counts)
+		}
+	}
+}
+
+func TestBackendPoolDialFailover(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	// 先拿一个端口再关掉 当作挂掉的后端
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	p, err := newBackendPool([]string{deadAddr, ln.Addr().String()}, LBPolicy_RoundRobin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, addr, err := p.dial(func(addr string) (net.Conn, error) {
+		return net.DialTimeout("tcp", addr, time.Second)
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if addr != ln.Addr().String() {
+		t.Fatalf("expect %s got %s", ln.Addr(), addr)
+	}
+	// 冷却期内不会再选挂掉的后端
+	if got := p.pick(); got == deadAddr {
+		t.Fatalf("dead backend picked during cooldown")
+	}
+}
@@ -0,0 +1,174 @@
+package relay
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// listen和remote写成unix:/path/to.sock时使用unix socket
+const unixSocketPrefix = "unix:"
+
+// unixSocketPath 返回unix:后面的socket文件路径
+func unixSocketPath(addr string) (string, bool) {
+	if !strings.HasPrefix(addr, unixSocketPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(addr, unixSocketPrefix), true
+}
+
+// listenAddr listen在unix socket上时LocalTCPAddr为nil
+func (r *Relay) listenAddr() net.Addr {
+	if path, ok := unixSocketPath(r.cfg.Listen); ok {
+		return &net.UnixAddr{Name: path, Net: "unix"}
+	}
+	return r.LocalTCPAddr
+}
+
+// listenStream tcp或者unix socket的listener unix socket的文件在listener关闭时删除
+func (r *Relay) listenStream() (net.Listener, error) {
+	path, ok := unixSocketPath(r.cfg.Listen)
+	if !ok {
+		return net.Listen(r.tcpNetwork(), r.LocalTCPAddr.String())
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// removeStaleSocket 上次没有正常退出留下的socket文件 还有进程在listen的话不删除
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a unix socket", path)
+	}
+	if c, err := net.Dial("unix", path); err == nil {
+		c.Close()
+		return fmt.Errorf("unix socket %s is already in use", path)
+	}
+	Logger.Infof("remove stale unix socket %s", path)
+	return os.Remove(path)
+}
+
+// checkUnixListen unix socket没有网卡和来源ip 这些配置不能生效
+func checkUnixListen(cfg *RelayConfig) error {
+	if cfg.ListenType == Listen_QUIC {
+		return fmt.Errorf("quic listen type needs udp, can not listen on unix socket %s", cfg.Listen)
+	}
+	if cfg.ListenNetwork != "" || cfg.ListenInterface != "" {
+		return fmt.Errorf("listen_network and listen_interface do not work with unix socket listen %s", cfg.Listen)
+	}
+	if len(cfg.AllowCIDRs) > 0 || len(cfg.DenyCIDRs) > 0 {
+		return fmt.Errorf("allow_cidrs and deny_cidrs do not work with unix socket listen %s", cfg.Listen)
+	}
+	return nil
+}
+
+// udpEnabled unix socket只有stream 两端任意一边是unix socket时raw不转发udp
+// grpc/quic/mtcp transport只支持tcp
+func (r *Relay) udpEnabled() bool {
+	switch r.TransportType {
+	case Transport_GRPC, Transport_QUIC, Transport_MTCP:
+		return false
+	}
+	if _, ok := unixSocketPath(r.cfg.Listen); ok {
+		return false
+	}
+	for _, remote := range r.backends.addrs {
+		if _, ok := unixSocketPath(remote); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// tcpNetwork listen使用的network 默认tcp是双栈
+func (r *Relay) tcpNetwork() string {
+	return r.cfg.ListenNetwork
+}
+
+func (r *Relay) udpNetwork() string {
+	return udpNetwork(r.cfg.ListenNetwork)
+}
+
+// udpNetwork tcp/tcp4/tcp6对应的udp network
+func udpNetwork(tcpNetwork string) string {
+	return "udp" + strings.TrimPrefix(tcpNetwork, "tcp")
+}
+
+// resolveListenAddr 配置了listen_interface时用网卡上和network匹配的地址替换listen的host
+// 并检查listen地址和network是不是同一个协议族
+func resolveListenAddr(cfg *RelayConfig) (string, error) {
+	switch cfg.ListenNetwork {
+	case "":
+		cfg.ListenNetwork = ListenNetwork_TCP
+	case ListenNetwork_TCP, ListenNetwork_TCP4, ListenNetwork_TCP6:
+	default:
+		return "", fmt.Errorf("unknown listen_network: %s", cfg.ListenNetwork)
+	}
+	host, port, err := net.SplitHostPort(cfg.Listen)
+	if err != nil {
+		return "", err
+	}
+	if cfg.ListenInterface != "" {
+		if ip := net.ParseIP(host); host != "" && (ip == nil || !ip.IsUnspecified()) {
+			return "", fmt.Errorf("listen address %s conflicts with listen_interface %s", cfg.Listen, cfg.ListenInterface)
+		}
+		ip, err := interfaceIP(cfg.ListenInterface, cfg.ListenNetwork)
+		if err != nil {
+			return "", err
+		}
+		host = ip.String()
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if cfg.ListenNetwork == ListenNetwork_TCP4 && ip.To4() == nil {
+			return "", fmt.Errorf("listen address %s is not ipv4", cfg.Listen)
+		}
+		if cfg.ListenNetwork == ListenNetwork_TCP6 && ip.To4() != nil {
+			return "", fmt.Errorf("listen address %s is not ipv6", cfg.Listen)
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// interfaceIP 网卡上第一个和network匹配的地址 tcp时优先ipv4
+func interfaceIP(name, network string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var v4, v6 net.IP
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			if v4 == nil {
+				v4 = ipNet.IP
+			}
+		} else if v6 == nil && !ipNet.IP.IsLinkLocalUnicast() {
+			// link local的地址需要带zone 不适合用来listen
+			v6 = ipNet.IP
+		}
+	}
+	switch {
+	case network != ListenNetwork_TCP6 && v4 != nil:
+		return v4, nil
+	case network != ListenNetwork_TCP4 && v6 != nil:
+		return v6, nil
+	}
+	return nil, fmt.Errorf("interface %s has no %s address", name, network)
+}
@@ -0,0 +1,185 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestResolveListenAddr(t *testing.T) {
+	// 只有linux上的loopback叫lo
+	_, noLo := net.InterfaceByName("lo")
+	for _, tc := range []struct {
+		listen, network, iface string
+		want                   string
+		wantErr                bool
+	}{
+		{listen: "0.0.0.0:1234", want: "0.0.0.0:1234"},
+		{listen: "0.0.0.0:1234", network: ListenNetwork_TCP4, want: "0.0.0.0:1234"},
+		{listen: "[::]:1234", network: ListenNetwork_TCP6, want: "[::]:1234"},
+		{listen: "[::1]:1234", network: ListenNetwork_TCP4, wantErr: true},
+		{listen: "127.0.0.1:1234", network: ListenNetwork_TCP6, wantErr: true},
+		{listen: "127.0.0.1:1234", network: "udp", wantErr: true},
+		{listen: ":1234", network: ListenNetwork_TCP4, iface: "lo", want: "127.0.0.1:1234"},
+		{listen: "0.0.0.0:1234", iface: "lo", want: "127.0.0.1:1234"},
+		{listen: "127.0.0.1:1234", iface: "lo", wantErr: true},
+		{listen: ":1234", iface: "ehco-no-such-iface", wantErr: true},
+	} {
+		if tc.iface == "lo" && noLo != nil {
+			continue
+		}
+		cfg := &RelayConfig{Listen: tc.listen, ListenNetwork: tc.network, ListenInterface: tc.iface}
+		got, err := resolveListenAddr(cfg)
+		if tc.wantErr {
+			if err == nil {
+				t.Fatalf("%+v: expect error, got %s", tc, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%+v: %s", tc, err)
+		}
+		if got != tc.want {
+			t.Fatalf("%+v: got %s", tc, got)
+		}
+	}
+}
+
+func TestRelayListenTCP4Only(t *testing.T) {
+	r, err := NewRelayWithConfig(&RelayConfig{
+		Listen:        "0.0.0.0:1253",
+		ListenNetwork: ListenNetwork_TCP4,
+		ListenType:    Listen_RAW,
+		Remote:        "127.0.0.1:1241",
+		TransportType: Transport_RAW,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.ListenAndServe()
+	<-r.Ready()
+	defer r.StopAccept()
+
+	c, err := net.Dial("tcp4", "127.0.0.1:1253")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	// 只listen了ipv4 ipv6的地址连不上
+	if c, err := net.Dial("tcp6", "[::1]:1253"); err == nil {
+		c.Close()
+		t.Fatal("tcp4 relay should not accept ipv6 conns")
+	}
+}
+
+func TestRelayUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ehco")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	listen := filepath.Join(dir, "relay.sock")
+	backendPath := filepath.Join(dir, "backend.sock")
+
+	backend, err := net.Listen("unix", backendPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+
+	// 模拟上次没有正常退出留下的socket文件
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: listen, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	r, err := NewRelay("unix:"+listen, Listen_RAW, "unix:"+backendPath, Transport_RAW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.ListenAndServe()
+	select {
+	case <-r.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay not ready")
+	}
+	// 还在listen的socket不能被别的relay删掉
+	if err := removeStaleSocket(listen); err == nil {
+		t.Fatal("socket in use should not be removed")
+	}
+
+	c, err := net.Dial("unix", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	c.Write([]byte("ping"))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo over unix socket failed: %q %v", buf, err)
+	}
+	c.Close()
+
+	if err := r.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(listen); !os.IsNotExist(err) {
+		t.Fatalf("socket file not removed after shutdown: %v", err)
+	}
+
+	if _, err := NewRelay("unix:"+listen, Listen_RAW, "unix:"+backendPath, Transport_MWSS); err == nil {
+		t.Fatal("unix socket remote should only work with raw transport")
+	}
+}
+
+func TestRelayReadyAfterAllListeners(t *testing.T) {
+	listen := "127.0.0.1:1289"
+	// udp端口被占用时tcp可以bind成功 但relay不能算是起来了 startup_timeout依赖这一点
+	uc, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewRelay(listen, Listen_RAW, "127.0.0.1:1241", Transport_RAW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.ListenAndServe()
+	select {
+	case <-r.Ready():
+		t.Fatal("relay ready with udp listener not bound")
+	case <-time.After(300 * time.Millisecond):
+	}
+	r.StopAccept()
+	uc.Close()
+
+	r, err = NewRelay(listen, Listen_RAW, "127.0.0.1:1241", Transport_RAW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.ListenAndServe()
+	defer r.Shutdown(context.Background())
+	select {
+	case <-r.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay not ready after tcp and udp listeners bound")
+	}
+}
@@ -0,0 +1,97 @@
+package relay
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// liveConnsEnabled 开启之后每个连接都统计流量 可以在dashboard上看到和断开
+var liveConnsEnabled bool
+
+// EnableLiveConns 需要在relay开始转发之前调用
+func EnableLiveConns() {
+	liveConnsEnabled = true
+}
+
+// ConnStatus 一个正在转发的连接 BytesIn是从客户端读到的 BytesOut是写给客户端的
+type ConnStatus struct {
+	ID       string    `json:"id"`
+	Relay    string    `json:"relay"`
+	Client   string    `json:"client"`
+	Backend  string    `json:"backend"`
+	Start    time.Time `json:"start"`
+	BytesIn  int64     `json:"bytes_in"`
+	BytesOut int64     `json:"bytes_out"`
+}
+
+type liveConn struct {
+	status ConnStatus
+	cc     *countConn
+}
+
+// liveConns 按conn_id记录正在转发的连接 只在connOpened和end之间存在
+type liveConns struct {
+	mu    sync.Mutex
+	conns map[string]*liveConn
+}
+
+func newLiveConns() *liveConns {
+	return &liveConns{conns: make(map[string]*liveConn)}
+}
+
+func (l *liveConns) add(cs *connSpan, status ConnStatus) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.conns[cs.id] = &liveConn{status: status, cc: cs.cc}
+}
+
+func (l *liveConns) remove(id string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.conns, id)
+}
+
+// LiveConns 正在转发的连接 按开始时间排序 没有EnableLiveConns时为空
+func (r *Relay) LiveConns() []ConnStatus {
+	r.live.mu.Lock()
+	res := make([]ConnStatus, 0, len(r.live.conns))
+	for _, lc := range r.live.conns {
+		s := lc.status
+		s.BytesIn, s.BytesOut = atomic.LoadInt64(&lc.cc.in), atomic.LoadInt64(&lc.cc.out)
+		res = append(res, s)
+	}
+	r.live.mu.Unlock()
+	sort.Slice(res, func(i, j int) bool { return res[i].Start.Before(res[j].Start) })
+	return res
+}
+
+// KillConn 断开conn_id为id的连接 连接不存在时返回false
+func (r *Relay) KillConn(id string) bool {
+	r.live.mu.Lock()
+	lc, ok := r.live.conns[id]
+	r.live.mu.Unlock()
+	if !ok {
+		return false
+	}
+	Logger.Infow("kill conn", "relay", r.cfg.Listen, "conn_id", id)
+	lc.cc.Close()
+	return true
+}
+
+// trackLive connOpened时调用 cs没有统计流量时不记录
+func (r *Relay) trackLive(cs *connSpan, client net.Addr, backend string) {
+	if !liveConnsEnabled || cs.cc == nil {
+		return
+	}
+	r.live.add(cs, ConnStatus{
+		ID:      cs.id,
+		Relay:   r.cfg.Listen,
+		Client:  client.String(),
+		Backend: backend,
+		Start:   time.Now(),
+	})
+	cs.live = r.live
+}
@@ -1,12 +1,110 @@
 package relay
 
-import "go.uber.org/zap"
+import (
+	"math/rand"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+const (
+	LogFormat_Console = "console"
+	LogFormat_JSON    = "json"
+)
 
 var Logger *zap.SugaredLogger
 
+// 当前Logger写的日志文件 重新InitLogger时关掉
+var logFile *rotateFile
+
 func init() {
-	logger, _ := zap.NewProduction()
-	defer logger.Sync()
-	Logger = logger.Sugar()
-	Logger.Info("Init zap logger")
+	if err := InitLogger("info", LogFormat_Console, LogFile{}); err != nil {
+		panic(err)
+	}
+	Logger.Debug("Init zap logger")
+}
+
+// InitLogger level是debug/info/warn/error format是console/json 默认console方便直接看
+// file.Path为空时和以前一样写到stderr
+func InitLogger(level, format string, file LogFile) error {
+	var lvl zapcore.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return err
+	}
+	cfg := zap.NewProductionConfig()
+	cfg.Level = zap.NewAtomicLevelAt(lvl)
+	cfg.Encoding = format
+	if format == LogFormat_Console {
+		cfg.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+		cfg.EncoderConfig.EncodeLevel = zapcore.CapitalLevelEncoder
+	}
+	// 线上按warn跑的时候也能看到所有的错误 不需要按秒采样
+	cfg.Sampling = nil
+	var opts []zap.Option
+	var rf *rotateFile
+	if file.Path != "" {
+		var err error
+		if rf, err = newRotateFile(file); err != nil {
+			return err
+		}
+		enc := zapcore.NewConsoleEncoder(cfg.EncoderConfig)
+		if format == LogFormat_JSON {
+			enc = zapcore.NewJSONEncoder(cfg.EncoderConfig)
+		}
+		opts = append(opts, zap.WrapCore(func(zapcore.Core) zapcore.Core {
+			return zapcore.NewCore(enc, rf, cfg.Level)
+		}))
+	}
+	logger, err := cfg.Build(opts...)
+	if err != nil {
+		if rf != nil {
+			rf.Close()
+		}
+		return err
+	}
+	if Logger != nil {
+		Logger.Sync()
+	}
+	if logFile != nil {
+		logFile.Close()
+	}
+	Logger, logFile = logger.Sugar(), rf
+	return nil
+}
+
+// logSampled 按access_log_sample_rate决定这个连接的日志是否打印 每个连接只决定一次
+func (r *Relay) logSampled(cs *connSpan) bool {
+	cs.sampleOnce.Do(func() {
+		rate := r.cfg.AccessLogSampleRate
+		cs.sampled = rate <= 0 || rate >= 1 || rand.Float64() < rate
+	})
+	return cs.sampled
+}
+
+// logAccess 按access_log_sample_rate采样打印连接的access log 带上relay的listen地址和conn_id
+func (r *Relay) logAccess(cs *connSpan, msg string, keysAndValues ...interface{}) {
+	if !r.logSampled(cs) {
+		return
+	}
+	cs.log.Infow(msg, append([]interface{}{"relay", r.cfg.Listen}, keysAndValues...)...)
+}
+
+// logTransfer 连接结束时打印时长和两个方向的字节数 用来按连接统计流量
+// 和access log一起采样 持续时间超过access_log_slow_ms的连接总是打印
+func (r *Relay) logTransfer(cs *connSpan, msg string, start time.Time, st transferStats, keysAndValues ...interface{}) {
+	d := time.Since(start)
+	slow := r.cfg.AccessLogSlowMs > 0 && d >= time.Duration(r.cfg.AccessLogSlowMs)*time.Millisecond
+	if !slow && !r.logSampled(cs) {
+		return
+	}
+	keysAndValues = append(keysAndValues,
+		"duration", d, "bytes_in", st.in, "bytes_out", st.out)
+	cs.log.Infow(msg+" done", append([]interface{}{"relay", r.cfg.Listen}, keysAndValues...)...)
+}
+
+// mwssSessionName 两端都按client->server的顺序打印 同一个session在两边日志里是一样的
+func mwssSessionName(client, server net.Addr) string {
+	return client.String() + "->" + server.String()
 }
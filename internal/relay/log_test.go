@@ -0,0 +1,54 @@
+package relay
+
+import (
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestAccessLogSampling(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	logger := zap.New(core).Sugar()
+
+	r := &Relay{cfg: &RelayConfig{Listen: "127.0.0.1:0", AccessLogSampleRate: 0.1, AccessLogSlowMs: 1000}}
+	const n = 2000
+	for i := 0; i < n; i++ {
+		cs := &connSpan{id: "test", log: logger}
+		r.logAccess(cs, "access")
+		r.logAccess(cs, "access")
+		r.logTransfer(cs, "access", time.Now(), transferStats{})
+	}
+	// 一个连接的日志要么都打印要么都不打印
+	access := logs.FilterMessage("access").Len()
+	done := logs.FilterMessage("access done").Len()
+	if access != 2*done {
+		t.Fatalf("expect access and transfer logs sampled per conn, got %d access %d done", access, done)
+	}
+	if done < n/20 || done > n/5 {
+		t.Fatalf("expect about %d sampled conns, got %d", n/10, done)
+	}
+
+	// 慢的连接总是打印
+	logs.TakeAll()
+	for i := 0; i < 100; i++ {
+		r.logTransfer(&connSpan{id: "slow", log: logger}, "slow", time.Now().Add(-2*time.Second), transferStats{})
+	}
+	if got := logs.FilterMessage("slow done").Len(); got != 100 {
+		t.Fatalf("expect every slow transfer logged, got %d", got)
+	}
+
+	// 0表示全部打印
+	logs.TakeAll()
+	all := &Relay{cfg: &RelayConfig{Listen: "127.0.0.1:0"}}
+	for i := 0; i < 100; i++ {
+		cs := &connSpan{id: "all", log: logger}
+		all.logAccess(cs, "access")
+		all.logTransfer(cs, "access", time.Now(), transferStats{})
+	}
+	if got := logs.Len(); got != 200 {
+		t.Fatalf("expect all logs without sampling, got %d", got)
+	}
+}
@@ -0,0 +1,106 @@
+package relay
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// LogFile 日志写到文件 超过MaxSizeMB之后切到path.1 path.2 ... 最多保留MaxBackups个旧文件
+type LogFile struct {
+	Path       string
+	MaxSizeMB  int
+	MaxBackups int
+}
+
+// rotateFile 按大小切分的日志文件 实现zapcore.WriteSyncer
+type rotateFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func newRotateFile(cfg LogFile) (*rotateFile, error) {
+	if cfg.MaxSizeMB < 0 || cfg.MaxBackups < 0 {
+		return nil, fmt.Errorf("log max size and max backups can not be negative")
+	}
+	rf := &rotateFile{
+		path:       cfg.Path,
+		maxSize:    int64(cfg.MaxSizeMB) * 1024 * 1024,
+		maxBackups: cfg.MaxBackups,
+	}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotateFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, info.Size()
+	return nil
+}
+
+// rotate path.N-1 -> path.N ... path -> path.1 超出maxBackups的直接删掉
+func (rf *rotateFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+	if rf.maxBackups == 0 {
+		os.Remove(rf.path)
+		return rf.open()
+	}
+	os.Remove(rf.backupName(rf.maxBackups))
+	for i := rf.maxBackups - 1; i > 0; i-- {
+		os.Rename(rf.backupName(i), rf.backupName(i+1))
+	}
+	if err := os.Rename(rf.path, rf.backupName(1)); err != nil {
+		// 切分失败就继续写原来的文件
+		if oerr := rf.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+	return rf.open()
+}
+
+func (rf *rotateFile) backupName(i int) string {
+	return fmt.Sprintf("%s.%d", rf.path, i)
+}
+
+// Write 一条日志不会被拆到两个文件里 maxSize为0时不切分
+func (rf *rotateFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotateFile) Sync() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.f.Sync()
+}
+
+func (rf *rotateFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.f.Close()
+}
@@ -0,0 +1,44 @@
+package relay
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotateFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ehco-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "ehco.log")
+	rf, err := newRotateFile(LogFile{Path: path, MaxSizeMB: 1, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	line := bytes.Repeat([]byte("a"), 600*1024)
+	for _, b := range []byte("abcd") {
+		line[0] = b
+		if _, err := rf.Write(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 每个文件只放得下一行 最早的a被删掉
+	for name, want := range map[string]byte{path: 'd', path + ".1": 'c', path + ".2": 'b'} {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(data) != len(line) || data[0] != want {
+			t.Fatalf("%s: want line %c got %d bytes starting with %c", name, want, len(data), data[0])
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("expect at most 2 backups, got %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package relay
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var MetricsReportInterval = 10 * time.Second
+
+var (
+	mwssSessionPoolSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ehco",
+		Subsystem: "mwss",
+		Name:      "session_pool_size",
+		Help:      "number of mux sessions in the pool of each remote",
+	}, []string{"relay", "remote"})
+
+	mwssSessionStreams = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ehco",
+		Subsystem: "mwss",
+		Name:      "session_streams",
+		Help:      "number of streams across all mux sessions of each remote",
+	}, []string{"relay", "remote"})
+
+	mwssSessionLimitReached = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ehco",
+		Subsystem: "mwss",
+		Name:      "session_limit_reached_total",
+		Help:      "dials that found the session pool of the remote at max_mwss_sessions with every session full",
+	}, []string{"relay", "remote"})
+
+	mwssDroppedStreams = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ehco",
+		Subsystem: "mwss",
+		Name:      "dropped_streams_total",
+		Help:      "streams closed by the mwss server because the connection queue is full",
+	}, []string{"relay"})
+
+	trafficLabels = []string{"relay", "remote", "listen_type", "transport_type"}
+
+	trafficBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ehco",
+		Subsystem: "traffic",
+		Name:      "bytes_total",
+		Help:      "bytes relayed, in is client to backend and out is backend to client",
+	}, append(trafficLabels, "direction"))
+
+	activeConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "ehco",
+		Subsystem: "traffic",
+		Name:      "active_connections",
+		Help:      "connections currently being relayed",
+	}, trafficLabels)
+
+	// phase是connSpan.phase的名字 例如dial mwss.dial ws.handshake
+	// mwss.dial需要新建session时包含了tls/ws/smux握手
+	phaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "ehco",
+		Subsystem: "relay",
+		Name:      "phase_duration_seconds",
+		Help:      "duration of the dial and handshake phases before relaying, failed ones included",
+		// 5ms到10s
+		Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+	}, []string{"relay", "phase"})
+
+	phaseErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "ehco",
+		Subsystem: "relay",
+		Name:      "phase_errors_total",
+		Help:      "dial and handshake phases that failed before relaying",
+	}, []string{"relay", "phase"})
+)
+
+func init() {
+	prometheus.MustRegister(mwssSessionPoolSize, mwssSessionStreams, mwssSessionLimitReached, mwssDroppedStreams, trafficBytes, activeConnections,
+		phaseDuration, phaseErrors)
+}
+
+// observePhase relay为空的connSpan不是从traceConn来的 不记录
+func observePhase(relay, phase string, start time.Time, err error) {
+	if relay == "" {
+		return
+	}
+	phaseDuration.WithLabelValues(relay, phase).Observe(time.Since(start).Seconds())
+	if err != nil {
+		phaseErrors.WithLabelValues(relay, phase).Inc()
+	}
+}
+
+type trafficMetrics struct {
+	in     prometheus.Counter
+	out    prometheus.Counter
+	active prometheus.Gauge
+
+	stats *relayStats
+}
+
+func newTrafficMetrics(cfg *RelayConfig) *trafficMetrics {
+	labels := []string{cfg.Listen, cfg.Remote, cfg.ListenType, cfg.TransportType}
+	return &trafficMetrics{
+		in:     trafficBytes.WithLabelValues(append(labels, "in")...),
+		out:    trafficBytes.WithLabelValues(append(labels, "out")...),
+		active: activeConnections.WithLabelValues(labels...),
+		stats:  statsFor(cfg.Listen),
+	}
+}
+
+func (m *trafficMetrics) connOpen() {
+	m.active.Inc()
+	atomic.AddInt64(&m.stats.activeConns, 1)
+}
+
+func (m *trafficMetrics) connClose() {
+	m.active.Dec()
+	atomic.AddInt64(&m.stats.activeConns, -1)
+}
+
+// countIn countOut udp不经过transport 每个datagram写出去之后直接记上
+func (m *trafficMetrics) countIn(n int) {
+	m.in.Add(float64(n))
+	atomic.AddInt64(&m.stats.bytesIn, int64(n))
+}
+
+func (m *trafficMetrics) countOut(n int) {
+	m.out.Add(float64(n))
+	atomic.AddInt64(&m.stats.bytesOut, int64(n))
+}
+
+// countWriter 每次写完之后累加到counter上 counter内部是原子操作
+type countWriter struct {
+	io.Writer
+	counter prometheus.Counter
+	total   *int64
+	// conn 这个连接这个方向上的字节数
+	conn *int64
+}
+
+func (w *countWriter) Write(b []byte) (int, error) {
+	n, err := w.Writer.Write(b)
+	w.counter.Add(float64(n))
+	atomic.AddInt64(w.total, int64(n))
+	atomic.AddInt64(w.conn, int64(n))
+	return n, err
+}
+
+// NOTE must hold sessionMutex
+func (tr *mwssTransporter) reportSessionMetrics(addr string) {
+	sessions := tr.sessions[addr]
+	streams := 0
+	for _, s := range sessions {
+		streams += s.NumStreams()
+	}
+	mwssSessionPoolSize.WithLabelValues(tr.relay, addr).Set(float64(len(sessions)))
+	mwssSessionStreams.WithLabelValues(tr.relay, addr).Set(float64(streams))
+}
+
+// 定期刷新 session断开或者stream关闭这种被动的变化不会经过Dial
+func (tr *mwssTransporter) reportMetricsLoop() {
+	ticker := time.NewTicker(MetricsReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tr.stop:
+			return
+		case <-ticker.C:
+		}
+		tr.sessionMutex.Lock()
+		for addr := range tr.sessions {
+			tr.reportSessionMetrics(addr)
+		}
+		tr.sessionMutex.Unlock()
+	}
+}
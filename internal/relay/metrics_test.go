@@ -0,0 +1,90 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMWSSSessionPoolMetrics(t *testing.T) {
+	startMWSSTestServer(t)
+
+	tr := NewMWSSTransporter("metrics-test")
+	defer tr.Close()
+	addr := "wss://" + mwssTestListen + "/tcp/"
+	opts := &mwssDialOptions{tlsConfig: DefaultTLSConfig, maxStreamCnt: 2}
+
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		c, err := tr.DialContext(context.Background(), addr, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	// Dial改变池子之后马上更新
+	if n := testutil.ToFloat64(mwssSessionPoolSize.WithLabelValues("metrics-test", addr)); n != 2 {
+		t.Fatalf("expect pool size 2, got %v", n)
+	}
+	if n := testutil.ToFloat64(mwssSessionStreams.WithLabelValues("metrics-test", addr)); n != 3 {
+		t.Fatalf("expect 3 streams, got %v", n)
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+func TestTrafficMetrics(t *testing.T) {
+	backend := startEchoBackend(t)
+	defer backend.Close()
+
+	listen := "127.0.0.1:1293"
+	r, err := NewRelay(listen, Listen_RAW, backend.Addr().String(), Transport_RAW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.ListenAndServe()
+	defer r.Shutdown(context.Background())
+	select {
+	case <-r.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay not ready")
+	}
+
+	labels := []string{listen, backend.Addr().String(), Listen_RAW, Transport_RAW}
+	active := activeConnections.WithLabelValues(labels...)
+	in := trafficBytes.WithLabelValues(append(labels, "in")...)
+	out := trafficBytes.WithLabelValues(append(labels, "out")...)
+	// 计数在写完之后才加上 要等一会
+	waitMetric := func(name string, c prometheus.Collector, want float64) {
+		deadline := time.Now().Add(5 * time.Second)
+		for testutil.ToFloat64(c) != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("expect %s %v, got %v", name, want, testutil.ToFloat64(c))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	c, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	waitMetric("active", active, 1)
+	waitMetric("bytes in", in, 4)
+	waitMetric("bytes out", out, 4)
+
+	c.Close()
+	waitMetric("active", active, 0)
+}
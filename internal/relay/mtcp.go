@@ -0,0 +1,92 @@
+package relay
+
+import (
+	"net"
+	"strings"
+	"sync"
+)
+
+// mtcp transport 和mwss一样用smux复用连接 但是直接跑在tcp上 没有tls和ws
+// 只适合可信的内网 认证只能靠psk和allow_cidrs
+const mtcpRemotePrefix = "mtcp://"
+
+// doneConn 给mtcp的tcp连接加上和WsConn一样的Done smux session关闭时会关掉它
+type doneConn struct {
+	net.Conn
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+func newDoneConn(c net.Conn) *doneConn {
+	return &doneConn{Conn: c, done: make(chan struct{})}
+}
+
+// Read 和WsConn一样 出错之后关掉连接
+func (c *doneConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err != nil {
+		c.Close()
+	}
+	return n, err
+}
+
+func (c *doneConn) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+func (c *doneConn) Done() <-chan struct{} {
+	return c.done
+}
+
+// checkMTCPRemote mwssTransporter按url解析remote 需要带上mtcp://前缀
+func checkMTCPRemote(remote string) error {
+	if !strings.HasPrefix(remote, mtcpRemotePrefix) {
+		return &net.AddrError{Err: "mtcp remote must start with " + mtcpRemotePrefix, Addr: remote}
+	}
+	return nil
+}
+
+func (r *Relay) RunLocalMTCPServer() error {
+	s := r.newMWSSServer()
+	ln, err := r.listenStream()
+	if err != nil {
+		return err
+	}
+	s.ln = ln
+	r.trackListener(ln)
+	r.listenerReady()
+	go func() {
+		defer close(s.errChan)
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				s.errChan <- err
+				// 临时错误由serveMWSSStreams等一会之后继续accept
+				if ne, ok := err.(net.Error); ok && ne.Temporary() {
+					continue
+				}
+				return
+			}
+			if !r.scheduleOpen() || !r.allowAddr(c.RemoteAddr()) {
+				c.Close()
+				continue
+			}
+			r.tuneTCPConn(c)
+			go s.serveMTCPConn(c)
+		}
+	}()
+	return r.serveMWSSStreams(s)
+}
+
+// serveMTCPConn 和upgrade一样占一个握手的名额 直到psk认证完成
+func (s *MWSSServer) serveMTCPConn(c net.Conn) {
+	limiter := handshakes
+	if !limiter.acquire("server") {
+		c.Close()
+		return
+	}
+	handshakeDone := limiter.releaseFunc()
+	defer handshakeDone()
+	s.mux(newDoneConn(c), handshakeDone, mwssStreamTCP)
+}
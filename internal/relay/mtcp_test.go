@@ -0,0 +1,72 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMTCPTransport(t *testing.T) {
+	backend := startEchoBackend(t)
+	defer backend.Close()
+	server, err := NewRelayWithConfig(&RelayConfig{
+		Listen:        "127.0.0.1:1269",
+		ListenType:    Listen_MTCP,
+		Remote:        backend.Addr().String(),
+		TransportType: Transport_RAW,
+		PSK:           "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ListenAndServe()
+	defer server.Shutdown(context.Background())
+	client, err := NewRelayWithConfig(&RelayConfig{
+		Listen:        "127.0.0.1:1270",
+		ListenType:    Listen_RAW,
+		Remote:        "mtcp://127.0.0.1:1269",
+		TransportType: Transport_MTCP,
+		PSK:           "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.ListenAndServe()
+	defer client.Shutdown(context.Background())
+	for _, r := range []*Relay{server, client} {
+		select {
+		case <-r.Ready():
+		case <-time.After(5 * time.Second):
+			t.Fatal("relay not ready")
+		}
+	}
+
+	// 同一个session上的多个stream
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", "127.0.0.1:1270")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("echo through mtcp failed: %q %v", buf, err)
+		}
+		c.Close()
+	}
+}
+
+func TestMTCPRemoteNeedsPrefix(t *testing.T) {
+	_, err := NewRelayWithConfig(&RelayConfig{
+		Listen:        "127.0.0.1:1271",
+		ListenType:    Listen_RAW,
+		Remote:        "127.0.0.1:1269",
+		TransportType: Transport_MTCP,
+	})
+	if err == nil {
+		t.Fatal("expect mtcp remote without mtcp:// rejected")
+	}
+}
@@ -1,20 +1,43 @@
 package relay
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/xtaci/smux"
 )
 
+// mwssStreamKind 由建立session时的路径决定 同一个session上的stream都一样
+type mwssStreamKind int
+
+const (
+	mwssStreamTCP mwssStreamKind = iota
+	// 按帧转发udp
+	mwssStreamUDP
+	// stream开头带着client指定的目标地址
+	mwssStreamConnect
+	// stream开头带着client写的PROXY v2 header 里面是客户端地址
+	mwssStreamTCPProxied
+)
+
 type muxStreamConn struct {
 	net.Conn
-	stream *smux.Stream
+	stream  *smux.Stream
+	session *smux.Session
+	kind    mwssStreamKind
+
+	onClose   func()
+	closeOnce sync.Once
 }
 
 func (c *muxStreamConn) Read(b []byte) (n int, err error) {
@@ -25,14 +48,35 @@ func (c *muxStreamConn) Write(b []byte) (n int, err error) {
 	return c.stream.Write(b)
 }
 
+// sessionStreams 同一个session上还没有关闭的stream数 包括自己
+func (c *muxStreamConn) sessionStreams() int {
+	return c.session.NumStreams()
+}
+
 func (c *muxStreamConn) Close() error {
+	if c.onClose != nil {
+		c.closeOnce.Do(c.onClose)
+	}
 	return c.stream.Close()
 }
 
 type muxSession struct {
+	// 同时存在过的最多stream数 原子读写 放在第一个保证32位平台上对齐
+	peakStreams int64
+
 	conn         net.Conn
 	session      *smux.Session
 	maxStreamCnt int
+	// 超过maxAge之后不再分配新的stream 已有的stream继续用完 0表示不限制
+	createdAt time.Time
+	maxAge    time.Duration
+
+	// 开始没有stream的时间 只在持有sessionMutex时读写
+	idleSince time.Time
+}
+
+func (session *muxSession) expired(now time.Time) bool {
+	return session.maxAge > 0 && now.Sub(session.createdAt) >= session.maxAge
 }
 
 func (session *muxSession) GetConn() (net.Conn, error) {
@@ -40,7 +84,8 @@ func (session *muxSession) GetConn() (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &muxStreamConn{Conn: session.conn, stream: stream}, nil
+	session.observeStreams()
+	return &muxStreamConn{Conn: session.conn, stream: stream, session: session.session}, nil
 }
 
 func (session *muxSession) Accept() (net.Conn, error) {
@@ -48,7 +93,19 @@ func (session *muxSession) Accept() (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &muxStreamConn{Conn: session.conn, stream: stream}, nil
+	session.observeStreams()
+	return &muxStreamConn{Conn: session.conn, stream: stream, session: session.session}, nil
+}
+
+// observeStreams stream数增加之后更新peakStreams 只有变大时才写
+func (session *muxSession) observeStreams() {
+	n := int64(session.session.NumStreams())
+	for {
+		peak := atomic.LoadInt64(&session.peakStreams)
+		if n <= peak || atomic.CompareAndSwapInt64(&session.peakStreams, peak, n) {
+			return
+		}
+	}
 }
 
 func (session *muxSession) Close() error {
@@ -72,136 +129,570 @@ func (session *muxSession) NumStreams() int {
 	return 0
 }
 
+// mwssTransporter 每个relay一个 session池不会在relay之间共享
 type mwssTransporter struct {
+	// 所属relay的listen地址 只用在metrics的label上
+	relay string
+
 	sessions     map[string][]*muxSession
 	sessionMutex sync.Mutex
+	// 每个remote连续建立session失败的退避状态 也由sessionMutex保护
+	backoffs map[string]*dialBackoff
+	// 每个remote正在建立的session 也由sessionMutex保护
+	dialing map[string]*sessionDial
+	// 每个remote已经移除的session的stream峰值 也由sessionMutex保护
+	retiredPeaks map[string]*streamPeaks
+
+	stop      chan struct{}
+	closeOnce sync.Once
+
+	// 没有stream的session空闲多久之后被reap关掉
+	idleGrace time.Duration
+	// 测试时替换成假的时钟
+	now func() time.Time
+	// Dial时使用的参数 由relay设置 直接调用DialContext时不需要
+	opts func() *mwssDialOptions
 }
 
-func NewMWSSTransporter() *mwssTransporter {
-	return &mwssTransporter{
+func NewMWSSTransporter(relay string) *mwssTransporter {
+	tr := &mwssTransporter{
+		relay:    relay,
 		sessions: make(map[string][]*muxSession),
+		backoffs: make(map[string]*dialBackoff),
+		dialing:  make(map[string]*sessionDial),
+
+		retiredPeaks: make(map[string]*streamPeaks),
+		stop:         make(chan struct{}),
+		idleGrace:    MWSSSessionIdleGrace,
+		now:          time.Now,
 	}
+	go tr.reportMetricsLoop()
+	go tr.reapLoop()
+	return tr
 }
 
-func (tr *mwssTransporter) Dial(addr string) (conn net.Conn, err error) {
-	tr.sessionMutex.Lock()
-	defer tr.sessionMutex.Unlock()
+// Close 停止后台的goroutine 并关闭所有session
+func (tr *mwssTransporter) Close() error {
+	tr.closeOnce.Do(func() {
+		close(tr.stop)
+		tr.sessionMutex.Lock()
+		defer tr.sessionMutex.Unlock()
+		for addr, sessions := range tr.sessions {
+			for _, s := range sessions {
+				s.Close()
+				s.conn.Close()
+			}
+			delete(tr.sessions, addr)
+		}
+	})
+	return nil
+}
 
-	var session *muxSession
-	var sessionIndex int
-	sessions, ok := tr.sessions[addr]
+// reapLoop 定期清理已经关闭 或者空闲超过idleGrace的session
+func (tr *mwssTransporter) reapLoop() {
+	ticker := time.NewTicker(MWSSReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tr.stop:
+			return
+		case <-ticker.C:
+			tr.reap()
+		}
+	}
+}
 
-	// 找到可以用的session
-	for sessionIndex, session = range sessions {
-		if session.NumStreams() >= session.maxStreamCnt {
-			ok = false
+func (tr *mwssTransporter) reap() {
+	tr.sessionMutex.Lock()
+	defer tr.sessionMutex.Unlock()
+	now := tr.now()
+	for addr, sessions := range tr.sessions {
+		alive := make([]*muxSession, 0, len(sessions))
+		for _, s := range sessions {
+			if !s.IsClosed() {
+				if s.NumStreams() > 0 {
+					s.idleSince = time.Time{}
+					alive = append(alive, s)
+					continue
+				}
+				if s.idleSince.IsZero() {
+					s.idleSince = now
+				}
+				// 过期的session不会再有新的stream 没有stream了就直接关掉
+				if !s.expired(now) && now.Sub(s.idleSince) < tr.idleGrace {
+					alive = append(alive, s)
+					continue
+				}
+			}
+			Logger.Infow("[mwss] reap session", "relay", tr.relay,
+				"session", mwssSessionName(s.conn.LocalAddr(), s.conn.RemoteAddr()))
+			s.Close()
+			s.conn.Close()
+			tr.retireSession(addr, s)
+		}
+		if len(alive) == 0 {
+			delete(tr.sessions, addr)
 		} else {
-			ok = true
-			break
+			tr.sessions[addr] = alive
 		}
+		tr.reportSessionMetrics(addr)
 	}
+}
 
-	// 删除已经关闭的session
-	if session != nil && session.IsClosed() {
-		Logger.Infof("find closed session %v idx: %d", session, sessionIndex)
-		sessions = append(sessions[:sessionIndex], sessions[sessionIndex+1:]...)
+// ErrMWSSBackoff remote连续建立session失败 还在退避时间内
+var ErrMWSSBackoff = errors.New("mwss session init backoff")
+
+// ErrMWSSSessionLimit remote的session数到了上限 并且每个session的stream都满了
+var ErrMWSSSessionLimit = errors.New("mwss session limit reached")
+
+// dialBackoff 连续失败的次数 以及下次可以尝试建立session的时间
+type dialBackoff struct {
+	failures int
+	until    time.Time
+}
+
+// next 再失败一次之后的退避状态 退避时间从MWSSDialBackoffBase开始翻倍 最多MWSSDialBackoffMax
+func (b *dialBackoff) next(now time.Time) *dialBackoff {
+	failures := 1
+	if b != nil {
+		failures = b.failures + 1
 	}
+	delay := MWSSDialBackoffBase
+	for i := 1; i < failures && delay < MWSSDialBackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > MWSSDialBackoffMax {
+		delay = MWSSDialBackoffMax
+	}
+	return &dialBackoff{failures: failures, until: now.Add(delay)}
+}
 
-	// 创建新的session
-	if !ok {
-		u, err := url.Parse(addr)
+// mwssDialOptions 每个relay自己的dial参数
+type mwssDialOptions struct {
+	psk       string
+	tlsConfig *tls.Config
+	// 升级websocket时带上的header 可以为nil
+	header http.Header
+	// 不为空时放在url query里的auth token
+	queryToken string
+	smuxConfig *smux.Config
+	// 新建的session最多承载的stream数
+	maxStreamCnt int
+	// 新建的session最多使用多久 0表示不限制
+	maxSessionAge time.Duration
+	// ws的ping间隔 不大于0表示不发送ping
+	pingInterval time.Duration
+	pongTimeout  time.Duration
+	// 新建session时tcp dial和ws握手各自的超时 0使用WsDeadline
+	dialTimeout      time.Duration
+	handshakeTimeout time.Duration
+	// 不为0时协商permessage-deflate 使用这个压缩级别
+	compressionLevel int
+	// 不为空时握手需要协商这个Sec-WebSocket-Protocol
+	subprotocol string
+	// 用ws://连接 不做tls
+	plain bool
+	// mtcp 不做tls和ws 直接在tcp连接上跑smux
+	mtcp bool
+	// 每个remote最多的session数 0表示不限制 到了上限时最多等sessionWait
+	maxSessions int
+	sessionWait time.Duration
+}
+
+// mwssDialOptions client新建session时使用的参数
+func (r *Relay) mwssDialOptions() *mwssDialOptions {
+	return &mwssDialOptions{
+		psk:              r.cfg.PSK,
+		tlsConfig:        r.clientTLSConfig(),
+		header:           r.wsDialHeader(),
+		queryToken:       r.mwssQueryToken(),
+		smuxConfig:       r.smuxConfig,
+		maxStreamCnt:     r.cfg.MaxMWSSStreamCnt,
+		maxSessionAge:    time.Duration(r.cfg.MaxMWSSSessionAgeSec) * time.Second,
+		pingInterval:     r.wsPingInterval(),
+		pongTimeout:      r.wsPongTimeout(),
+		dialTimeout:      time.Duration(r.cfg.WSDialTimeoutSec) * time.Second,
+		handshakeTimeout: time.Duration(r.cfg.WSHandshakeTimeoutSec) * time.Second,
+		compressionLevel: r.mwssCompressionLevel(),
+		subprotocol:      r.cfg.WSSubprotocol,
+		plain:            r.cfg.MWSSPlainTransport,
+		mtcp:             r.TransportType == Transport_MTCP,
+		maxSessions:      r.cfg.MaxMWSSSessions,
+		sessionWait:      time.Duration(r.cfg.MWSSSessionWaitMs) * time.Millisecond,
+	}
+}
+
+// mwssQueryToken 没有开启auth_token_in_query时返回空
+func (r *Relay) mwssQueryToken() string {
+	if !r.cfg.AuthTokenInQuery {
+		return ""
+	}
+	return r.cfg.AuthToken
+}
+
+// mwssCompressionLevel 没有开启mwss_compression时返回0
+func (r *Relay) mwssCompressionLevel() int {
+	if !r.cfg.MWSSCompression {
+		return 0
+	}
+	return r.cfg.MWSSCompressionLevel
+}
+
+// enableCompression 两端都开启时permessage-deflate才会协商成功 否则和没有开启一样
+func enableCompression(conn *websocket.Conn, level int) {
+	if level == 0 {
+		return
+	}
+	if err := conn.SetCompressionLevel(level); err != nil {
+		Logger.Warnf("[mwss] set compression level %d error: %s", level, err)
+	}
+}
+
+func orWsDeadline(d time.Duration) time.Duration {
+	if d <= 0 {
+		return WsDeadline
+	}
+	return d
+}
+
+// Dial 使用relay的参数 实现Transporter
+func (tr *mwssTransporter) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	return tr.DialContext(ctx, addr, tr.opts())
+}
+
+// DialContext ctx取消时会中断tcp dial以及ws/smux的握手 已经建立好的session不受影响
+// session数到了上限时最多等opts.sessionWait 期间有stream释放出来就复用
+func (tr *mwssTransporter) DialContext(ctx context.Context, addr string, opts *mwssDialOptions) (net.Conn, error) {
+	deadline := time.Now().Add(opts.sessionWait)
+	for {
+		conn, err := tr.dial(ctx, addr, opts)
+		if err != ErrMWSSSessionLimit || !time.Now().Before(deadline) {
+			return conn, err
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(MWSSSessionWaitInterval):
+		}
+	}
+}
+
+// sessionDial 正在建立的session 同一个remote同时只建立一个 其他dial等它完成之后再挑session
+type sessionDial struct {
+	done chan struct{}
+	err  error
+	// 失败是remote的问题 等待的dial直接返回这个错误 否则自己再试
+	remoteErr bool
+}
+
+// dial tcp tls ws smux的握手都不持有sessionMutex 一个remote握手慢不会挡住其他remote
+func (tr *mwssTransporter) dial(ctx context.Context, addr string, opts *mwssDialOptions) (net.Conn, error) {
+	for {
+		tr.sessionMutex.Lock()
+		session, err := tr.pickSession(addr, opts)
 		if err != nil {
+			tr.sessionMutex.Unlock()
 			return nil, err
 		}
-		conn, err = net.DialTimeout("tcp", u.Host, WsDeadline)
+		if session != nil {
+			cc, err := session.GetConn()
+			if err == nil {
+				tr.touchSession(addr, session)
+				tr.sessionMutex.Unlock()
+				return cc, nil
+			}
+			// 复用的session上open stream失败不应该让用户的连接失败 关掉它换一个session再试
+			Logger.Warnf("[mwss] open stream on %s error: %s, retry on another session", addr, err)
+			session.Close()
+			tr.sessionMutex.Unlock()
+			continue
+		}
+		if d := tr.dialing[addr]; d != nil {
+			tr.sessionMutex.Unlock()
+			select {
+			case <-d.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if d.remoteErr {
+				return nil, d.err
+			}
+			continue
+		}
+		if b := tr.backoffs[addr]; b != nil && tr.now().Before(b.until) {
+			tr.sessionMutex.Unlock()
+			return nil, fmt.Errorf("%w: %s retry in %s", ErrMWSSBackoff, addr, time.Until(b.until).Round(time.Millisecond))
+		}
+		d := &sessionDial{done: make(chan struct{})}
+		tr.dialing[addr] = d
+		tr.sessionMutex.Unlock()
+
+		session, err = tr.newSession(ctx, addr, opts)
+
+		tr.sessionMutex.Lock()
+		delete(tr.dialing, addr)
+		// 调用方取消和本地握手限流不是remote的问题 不计入退避
+		d.err, d.remoteErr = err, err != nil && ctx.Err() == nil && err != ErrTooManyHandshakes
+		close(d.done)
 		if err != nil {
+			if d.remoteErr {
+				tr.backoffs[addr] = tr.backoffs[addr].next(tr.now())
+			}
+			tr.sessionMutex.Unlock()
 			return nil, err
 		}
-		conn.SetDeadline(time.Now().Add(WsDeadline))
-
-		session, err = tr.initSession(addr, conn)
+		delete(tr.backoffs, addr)
+		tr.sessions[addr] = append(tr.sessions[addr], session)
+		cc, err := session.GetConn()
 		if err != nil {
-			conn.Close()
+			session.Close()
+			tr.sessionMutex.Unlock()
 			return nil, err
 		}
-		sessions = append(sessions, session)
+		tr.touchSession(addr, session)
+		tr.sessionMutex.Unlock()
+		return cc, nil
 	}
+}
 
-	cc, err := session.GetConn()
-	if err != nil {
-		session.Close()
-		return nil, err
-	}
+// touchSession 刚在session上open了stream 需要持有sessionMutex
+func (tr *mwssTransporter) touchSession(addr string, session *muxSession) {
 	// TODO 统一管理session的deadline
 	session.conn.SetDeadline(time.Now().Add(MWSSSessionDeadLine))
 	session.session.SetDeadline(time.Now().Add(MWSSSessionDeadLine))
+	tr.reportSessionMetrics(addr)
+}
+
+// pickSession 返回一个还能open stream的session 都满了返回nil 需要调用方新建 需要持有sessionMutex
+func (tr *mwssTransporter) pickSession(addr string, opts *mwssDialOptions) (*muxSession, error) {
+	// 先删除已经关闭的session 用新的slice 不在原来的底层数组上原地修改
+	sessions := make([]*muxSession, 0, len(tr.sessions[addr])+1)
+	for _, s := range tr.sessions[addr] {
+		if s.IsClosed() {
+			Logger.Debugf("remove closed session %v", s)
+			tr.retireSession(addr, s)
+			continue
+		}
+		sessions = append(sessions, s)
+	}
 	tr.sessions[addr] = sessions
-	return cc, nil
+
+	// 找到可以用的session 每个session按自己创建时的上限判断 跳过已经过期的
+	now := tr.now()
+	alive := 0
+	for _, s := range sessions {
+		if s.expired(now) {
+			continue
+		}
+		alive++
+		if s.NumStreams() < s.maxStreamCnt {
+			return s, nil
+		}
+	}
+
+	// 过期的session不会再有新的stream 不算在上限里 否则长连接会一直占着名额
+	// 正在建立的session同时只有一个 开始建立的时候还没有到上限 等它建好就有空位
+	if opts.maxSessions > 0 && alive >= opts.maxSessions && tr.dialing[addr] == nil {
+		mwssSessionLimitReached.WithLabelValues(tr.relay, addr).Inc()
+		return nil, ErrMWSSSessionLimit
+	}
+	return nil, nil
+}
+
+func (tr *mwssTransporter) newSession(ctx context.Context, addr string, opts *mwssDialOptions) (*muxSession, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{Timeout: orWsDeadline(opts.dialTimeout)}
+	conn, err := d.DialContext(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	// tls ws smux以及psk认证的握手都要在这个时间内完成
+	conn.SetDeadline(time.Now().Add(orWsDeadline(opts.handshakeTimeout)))
+
+	session, err := tr.initSession(ctx, addr, opts, conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return session, nil
 }
 
-func (tr *mwssTransporter) initSession(addr string, conn net.Conn) (*muxSession, error) {
+func (tr *mwssTransporter) initSession(ctx context.Context, addr string, opts *mwssDialOptions, conn net.Conn) (*muxSession, error) {
+	limiter := handshakes
+	if !limiter.acquire("client") {
+		return nil, ErrTooManyHandshakes
+	}
+	defer limiter.release()
+
+	// 握手过程中ctx取消的话直接关掉底层conn 让阻塞的读写返回
+	handshakeDone := make(chan struct{})
+	defer close(handshakeDone)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-handshakeDone:
+		}
+	}()
+
+	if opts.mtcp {
+		return tr.initMuxSession(ctx, opts, newDoneConn(conn))
+	}
+
 	d := websocket.Dialer{
-		TLSClientConfig: DefaultTLSConfig,
+		EnableCompression: opts.compressionLevel != 0,
+		Subprotocols:      wsSubprotocols(opts.subprotocol),
 		NetDial: func(net, addr string) (net.Conn, error) {
 			return conn, nil
 		}}
+	addr, err := withAuthTokenQuery(addr, opts.queryToken)
+	if err != nil {
+		return nil, err
+	}
 	u, err := url.Parse(addr)
 	if err != nil {
 		return nil, err
 	}
-	c, resp, err := d.Dial(u.String(), nil)
+	if opts.plain {
+		// remote还是按wss://配置 这里换成ws://
+		u.Scheme = "ws"
+	} else {
+		d.TLSClientConfig = opts.tlsConfig
+	}
+	c, resp, err := d.DialContext(ctx, u.String(), opts.header)
 	if err != nil {
 		return nil, err
 	}
 	resp.Body.Close()
+	if err := checkNegotiatedSubprotocol(c, opts.subprotocol); err != nil {
+		c.Close()
+		return nil, err
+	}
+	if opts.compressionLevel != 0 {
+		if !strings.Contains(resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate") {
+			Logger.Warnf("[mwss] %s does not enable mwss_compression, session is not compressed", addr)
+		}
+		enableCompression(c, opts.compressionLevel)
+	}
 	wsc := newWsConn(c)
+	wsc.keepalive(opts.pingInterval, opts.pongTimeout)
+	return tr.initMuxSession(ctx, opts, wsc)
+}
+
+// initMuxSession 在ws或者mtcp的tcp连接上建立smux session
+func (tr *mwssTransporter) initMuxSession(ctx context.Context, opts *mwssDialOptions, conn muxConn) (*muxSession, error) {
 	// stream multiplex
-	smuxConfig := smux.DefaultConfig()
-	session, err := smux.Client(wsc, smuxConfig)
+	session, err := smux.Client(conn, opts.smuxConfig)
 	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if opts.psk != "" {
+		if err := clientChallenge(session, opts.psk); err != nil {
+			session.Close()
+			return nil, err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		session.Close()
 		return nil, err
 	}
-	Logger.Infof("[mwss] Init new session %s", session.RemoteAddr())
-	return &muxSession{conn: wsc, session: session, maxStreamCnt: MaxMWSSStreamCnt}, nil
+	Logger.Infow("[mwss] init new session", "relay", tr.relay,
+		"session", mwssSessionName(session.LocalAddr(), session.RemoteAddr()))
+	// ws断开之后smux不会自己关闭session 这里关掉并马上从池子里清理
+	go func() {
+		<-conn.Done()
+		session.Close()
+		tr.reap()
+	}()
+	return &muxSession{
+		conn:         conn,
+		session:      session,
+		maxStreamCnt: opts.maxStreamCnt,
+		createdAt:    tr.now(),
+		maxAge:       opts.maxSessionAge,
+	}, nil
 }
 
-func (r *Relay) RunLocalMWSSServer() error {
+// mwssUDPPath 转发udp的session使用的路径
+func (r *Relay) mwssUDPPath() string {
+	return r.cfg.WSPath + "udp/"
+}
+
+// mwssProxiedPath stream带着客户端地址的tcp session使用的路径
+func (r *Relay) mwssProxiedPath() string {
+	return r.cfg.WSPath + "proxied/"
+}
 
-	s := &MWSSServer{
-		addr:     r.LocalTCPAddr.String(),
-		upgrader: &websocket.Upgrader{},
-		connChan: make(chan net.Conn, 1024),
+// mwssTCPAddr 开启proxy_protocol时换成带客户端地址的路径
+// server按路径而不是自己的配置决定要不要读header 只有一端开启也不会把header当成数据
+func (r *Relay) mwssTCPAddr(remote string) string {
+	if r.cfg.ProxyProtocol != 0 {
+		return remote + r.mwssProxiedPath()
+	}
+	return r.transportAddr(remote)
+}
+
+// newMWSSServer mwss和mtcp server共用 mtcp不需要upgrader和http server
+func (r *Relay) newMWSSServer() *MWSSServer {
+	return &MWSSServer{
+		upgrader: &websocket.Upgrader{
+			EnableCompression: r.cfg.MWSSCompression,
+			Subprotocols:      wsSubprotocols(r.cfg.WSSubprotocol),
+		},
+		connChan: make(chan net.Conn, r.cfg.MWSSConnQueueSize),
 		errChan:  make(chan error, 1),
+
+		maxAcceptingStreams: r.cfg.MaxAcceptingStreams,
+		psk:                 r.cfg.PSK,
+		handshakeTimeout:    time.Duration(r.cfg.MWSSHandshakeTimeoutSec) * time.Second,
+		relay:               r,
 	}
+}
 
+func (r *Relay) RunLocalMWSSServer() error {
+	s := r.newMWSSServer()
 	mux := http.NewServeMux()
-	mux.Handle("/tcp/", http.HandlerFunc(s.upgrade))
+	// udp的路径在tcp路径下面 一起注册
+	mux.Handle(r.cfg.WSPath, http.HandlerFunc(s.upgrade))
 	// fake
-	mux.Handle("/", http.HandlerFunc(index))
-	server := &http.Server{
-		Addr:              r.LocalTCPAddr.String(),
-		Handler:           mux,
-		TLSConfig:         DefaultTLSConfig,
-		ReadHeaderTimeout: 30 * time.Second,
-	}
+	mux.Handle("/", r.fakeIndex)
+	server := r.newHTTPServer(mux)
 	s.server = server
 
-	ln, err := net.Listen("tcp", r.LocalTCPAddr.String())
+	ln, err := r.listenStream()
 	if err != nil {
 		return err
 	}
+	r.trackListener(server)
+	r.listenerReady()
+	if !r.cfg.MWSSPlainListen {
+		ln = tls.NewListener(ln, server.TLSConfig)
+	}
 	go func() {
-		err := server.Serve(tls.NewListener(ln, server.TLSConfig))
+		err := server.Serve(ln)
 		if err != nil {
 			s.errChan <- err
 		}
 		close(s.errChan)
 	}()
+	return r.serveMWSSStreams(s)
+}
 
+// serveMWSSStreams 处理server上所有session里accept到的stream
+func (r *Relay) serveMWSSStreams(s *MWSSServer) error {
+	// 退出之前已经accept到的stream也要处理 不能留在队列里
+	defer s.closeQueue(r.serveMWSSStream)
 	var tempDelay time.Duration
 	for {
 		conn, e := s.Accept()
 		if e != nil {
+			if e == ErrServerClosed {
+				return e
+			}
 			if ne, ok := e.(net.Error); ok && ne.Temporary() {
 				if tempDelay == 0 {
 					tempDelay = 5 * time.Millisecond
@@ -211,120 +702,429 @@ func (r *Relay) RunLocalMWSSServer() error {
 				if max := 1 * time.Second; tempDelay > max {
 					tempDelay = max
 				}
-				Logger.Infof("server: Accept error: %v; retrying in %v", e, tempDelay)
+				Logger.Warnf("server: Accept error: %v; retrying in %v", e, tempDelay)
 				time.Sleep(tempDelay)
 				continue
 			}
 			return e
 		}
 		tempDelay = 0
+		r.serveMWSSStream(conn)
+	}
+}
 
-		go r.handleMWSSConnToTcp(conn)
+func (r *Relay) serveMWSSStream(conn net.Conn) {
+	// 已经建立的session上的新stream也要拒绝
+	if !r.scheduleOpen() {
+		conn.Close()
+		return
+	}
+	// 每个stream算一个连接
+	release, ok := r.acquireConn()
+	if !ok {
+		conn.Close()
+		return
 	}
+	kind := mwssStreamTCP
+	if mc, ok := conn.(*muxStreamConn); ok {
+		kind = mc.kind
+	}
+	go func() {
+		defer release()
+		switch kind {
+		case mwssStreamUDP:
+			r.handleMWSSConnToUdp(conn)
+		case mwssStreamConnect:
+			r.handleMWSSConnToTarget(conn)
+		default:
+			r.handleMWSSConnToTcp(conn)
+		}
+	}()
 }
 
 type MWSSServer struct {
-	addr     string
 	upgrader *websocket.Upgrader
 	server   *http.Server
 	connChan chan net.Conn
 	errChan  chan error
+
+	// 每个session同时在处理的stream上限 0表示不限制
+	maxAcceptingStreams int
+	// 不为空时session需要先通过nonce challenge才能转发
+	psk string
+	// 升级之后一直不发smux数据的连接在这个时间之后断开
+	handshakeTimeout time.Duration
+	// mtcp直接accept tcp连接 没有http server
+	ln net.Listener
+
+	// serveMWSSStreams退出之后queueClosed为true 不再往connChan里放stream
+	queueMu     sync.RWMutex
+	queueClosed bool
+
+	relay *Relay
 }
 
 func (s *MWSSServer) upgrade(w http.ResponseWriter, r *http.Request) {
+	// 不是ws请求或者不在开放时间的话返回和其他路径一样的伪装页面
+	if !websocket.IsWebSocketUpgrade(r) || !s.relay.scheduleOpen() {
+		s.relay.fakeIndex.ServeHTTP(w, r)
+		return
+	}
+	if !s.relay.allowAddr(r.RemoteAddr) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	limiter := handshakes
+	if !limiter.acquire("server") {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	handshakeDone := limiter.releaseFunc()
+	defer handshakeDone()
+	if !checkAuthToken(r, s.relay.cfg.AuthToken) {
+		Logger.Warnf("[mwss] %s auth token mismatch", r.RemoteAddr)
+		s.relay.fakeIndex.ServeHTTP(w, r)
+		return
+	}
+	if !checkWSSubprotocol(r, s.relay.cfg.WSSubprotocol) {
+		Logger.Warnf("[mwss] %s subprotocol mismatch: %v", r.RemoteAddr, websocket.Subprotocols(r))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		Logger.Info(err)
+		Logger.Warn(err)
 		return
 	}
-	s.mux(newWsConn(conn))
+	enableCompression(conn, s.relay.mwssCompressionLevel())
+	kind := mwssStreamTCP
+	switch {
+	case strings.HasPrefix(r.URL.Path, s.relay.mwssUDPPath()):
+		kind = mwssStreamUDP
+	case strings.HasPrefix(r.URL.Path, s.relay.mwssConnectPath()):
+		kind = mwssStreamConnect
+	case strings.HasPrefix(r.URL.Path, s.relay.mwssProxiedPath()):
+		kind = mwssStreamTCPProxied
+	}
+	wsc := newWsConn(conn)
+	wsc.keepalive(s.relay.wsPingInterval(), s.relay.wsPongTimeout())
+	s.mux(wsc, handshakeDone, kind)
 }
 
-func (s *MWSSServer) mux(conn net.Conn) {
-	smuxConfig := smux.DefaultConfig()
-	mux, err := smux.Server(conn, smuxConfig)
+// muxConn smux session底下的连接 Done在连接关闭后关闭
+type muxConn interface {
+	net.Conn
+	Done() <-chan struct{}
+}
+
+func (s *MWSSServer) mux(conn muxConn, handshakeDone func(), kind mwssStreamKind) {
+	// psk认证和第一个stream都要在deadline之前完成 之后清掉 由stream自己的deadline接管
+	conn.SetDeadline(time.Now().Add(orWsDeadline(s.handshakeTimeout)))
+	mux, err := smux.Server(conn, s.relay.smuxConfig)
 	if err != nil {
 		Logger.Infof("[mwss] %s - %s : %s", conn.RemoteAddr(), s.Addr(), err)
+		conn.Close()
 		return
 	}
 	defer mux.Close()
+	// ws断开之后让阻塞的AcceptStream返回
+	go func() {
+		<-conn.Done()
+		mux.Close()
+	}()
+
+	if s.psk != "" {
+		if err := serverChallenge(mux, s.psk); err != nil {
+			Logger.Warnf("[mwss] %s - %s : challenge error: %s", conn.RemoteAddr(), s.Addr(), err)
+			return
+		}
+	}
+	handshakeDone()
 
-	Logger.Infof("[mwss] %s <-> %s", conn.RemoteAddr(), s.Addr())
-	defer Logger.Infof("[mwss] %s >-< %s", conn.RemoteAddr(), s.Addr())
+	name := mwssSessionName(conn.RemoteAddr(), conn.LocalAddr())
+	Logger.Infow("[mwss] session open", "relay", s.Addr().String(), "session", name)
+	defer Logger.Infow("[mwss] session closed", "relay", s.Addr().String(), "session", name)
 
+	// 还没有关闭的stream数 relay停止之后等它变成0再关掉session
+	var active int64
+	go s.closeOnStop(conn, mux, &active)
+
+	var sem chan struct{}
+	if s.maxAcceptingStreams > 0 {
+		sem = make(chan struct{}, s.maxAcceptingStreams)
+	}
+
+	established := false
 	failedCount := 0
 	for failedCount < 5 {
+		if sem != nil {
+			// 处理中的stream太多时暂停accept 给这个session加上背压
+			sem <- struct{}{}
+		}
 		stream, err := mux.AcceptStream()
 		if err != nil {
 			Logger.Infof("[mwss] accept stream err: %s failedCount: %s", err, failedCount)
 			failedCount++
 			break
 		}
+		if !established {
+			established = true
+			conn.SetDeadline(time.Time{})
+		}
+		// relay停止之后不再接受新的stream client会在别的session上重试
+		if s.relay.isStopped() {
+			stream.Close()
+			if sem != nil {
+				<-sem
+			}
+			continue
+		}
+
+		atomic.AddInt64(&active, 1)
+		cc := &muxStreamConn{Conn: conn, stream: stream, session: mux, kind: kind}
+		cc.onClose = func() {
+			atomic.AddInt64(&active, -1)
+			if sem != nil {
+				<-sem
+			}
+		}
+		if !s.enqueue(cc) {
+			cc.Close()
+			mwssDroppedStreams.WithLabelValues(s.relay.cfg.Listen).Inc()
+			Logger.Warnw("[mwss] connection queue is full", "session", name)
+		}
+	}
+}
+
+// closeOnStop relay停止之后 session上的stream都关闭了就关掉session 让client去连新的relay
+func (s *MWSSServer) closeOnStop(conn muxConn, mux *smux.Session, active *int64) {
+	select {
+	case <-s.relay.stop:
+	case <-conn.Done():
+		return
+	}
+	ticker := time.NewTicker(DrainCheckInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt64(active) > 0 {
+		select {
+		case <-conn.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+	mux.Close()
+}
+
+// enqueue 队列满时按配置最多等待一段时间 等不到空位或者relay已经停止返回false
+func (s *MWSSServer) enqueue(cc net.Conn) bool {
+	s.queueMu.RLock()
+	defer s.queueMu.RUnlock()
+	if s.queueClosed {
+		return false
+	}
+	select {
+	case s.connChan <- cc:
+		return true
+	default:
+	}
+	wait := time.Duration(s.relay.cfg.MWSSConnQueueWaitMs) * time.Millisecond
+	if wait <= 0 {
+		return false
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case s.connChan <- cc:
+		return true
+	case <-timer.C:
+		return false
+	case <-s.relay.stop:
+		return false
+	}
+}
 
-		cc := &muxStreamConn{Conn: conn, stream: stream}
+// closeQueue serveMWSSStreams退出时调用 之后enqueue都返回false 已经在队列里的stream交给serve处理
+func (s *MWSSServer) closeQueue(serve func(net.Conn)) {
+	s.queueMu.Lock()
+	s.queueClosed = true
+	s.queueMu.Unlock()
+	for {
 		select {
-		case s.connChan <- cc:
+		case conn := <-s.connChan:
+			serve(conn)
 		default:
-			cc.Close()
-			Logger.Infof("[mwss] %s - %s: connection queue is full", conn.RemoteAddr(), conn.LocalAddr())
+			return
 		}
 	}
 }
 
-func (s *MWSSServer) Accept() (conn net.Conn, err error) {
+// ErrServerClosed mwss server的http server已经退出 Accept不会再返回新的conn
+var ErrServerClosed = errors.New("mwss server closed")
+
+// Accept http server退出之后返回ErrServerClosed 不会返回nil的conn和err
+func (s *MWSSServer) Accept() (net.Conn, error) {
 	select {
-	case conn = <-s.connChan:
-	case err = <-s.errChan:
+	case conn := <-s.connChan:
+		return conn, nil
+	case err, ok := <-s.errChan:
+		if !ok || err == http.ErrServerClosed {
+			return nil, ErrServerClosed
+		}
+		return nil, err
 	}
-	return
 }
 
 func (s *MWSSServer) Close() error {
+	if s.server == nil {
+		// mtcp server没有http server
+		return s.ln.Close()
+	}
 	return s.server.Close()
 }
 
-func (s *MWSSServer) Addr() string {
-	return s.addr
+func (s *MWSSServer) Addr() net.Addr {
+	return s.relay.listenAddr()
 }
 
-var tr = NewMWSSTransporter()
-
-func (r *Relay) handleTcpOverMWSS(c *net.TCPConn) error {
+func (r *Relay) handleTcpOverMWSS(c net.Conn) error {
+	if len(r.cfg.Chain) > 0 {
+		return r.handleTcpOverMWSSChain(c)
+	}
 	defer c.Close()
 
-	addr := r.RemoteTCPAddr + "/tcp/"
-	wsc, err := tr.Dial(addr)
+	lc, cs := r.traceConn(c, "ehco.mwss.client")
+	// session不存在时包含了ws和smux的握手
+	dialDone := cs.phase("mwss.dial")
+	var wsc net.Conn
+	remote, err := r.backends.try(r.cfg.MaxDialAttempts, func(remote string) (err error) {
+		wsc, err = r.tr.Dial(context.Background(), r.mwssTCPAddr(remote))
+		return err
+	})
+	dialDone(err)
 	if err != nil {
+		cs.end(remote, err)
 		return err
 	}
 	defer wsc.Close()
-	Logger.Infof("handleTcpOverMWSS from:%s to:%s", c.RemoteAddr(), wsc.RemoteAddr())
+	if r.cfg.ProxyProtocol != 0 {
+		// 客户端地址放在stream最开始的v2 header里带给server 由server按自己配置的版本发给后端
+		// server没有开启proxy_protocol时读出来之后丢掉
+		hdr, err := buildProxyHeader(ProxyProtocol_V2, c.RemoteAddr(), c.LocalAddr())
+		if err != nil {
+			cs.end(remote, err)
+			return err
+		}
+		if _, err := wsc.Write(hdr); err != nil {
+			cs.end(remote, err)
+			return err
+		}
+	}
+	r.conns.add(remote, c)
+	defer r.conns.remove(remote, c)
+	r.logAccess(cs, "handleTcpOverMWSS", "from", c.RemoteAddr(), "to", wsc.RemoteAddr(),
+		"session", mwssSessionName(wsc.LocalAddr(), wsc.RemoteAddr()))
+	start := time.Now()
 	if err := wsc.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
+		cs.end(remote, err)
 		return err
 	}
 	if err := c.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
+		cs.end(remote, err)
 		return err
 	}
-	transport(wsc, c)
+	r.connOpened(cs, c.RemoteAddr(), remote)
+	st, err := transport(lc, wsc, r.cfg)
+	cs.end(remote, err)
+	r.logTransfer(cs, "handleTcpOverMWSS", start, st, "from", c.RemoteAddr(), "to", remote,
+		"session", mwssSessionName(wsc.LocalAddr(), wsc.RemoteAddr()))
 	return nil
 }
 
 func (r *Relay) handleMWSSConnToTcp(c net.Conn) {
 	defer c.Close()
-	rc, err := net.Dial("tcp", r.RemoteTCPAddr)
+	session := mwssSessionName(c.RemoteAddr(), c.LocalAddr())
+	mc, ok := c.(*muxStreamConn)
+	proxied := ok && mc.kind == mwssStreamTCPProxied
+	c, cs := r.traceConn(c, "ehco.mwss.server")
+	// client没有带客户端地址的话 和raw一样用accept到的连接的地址 也就是client ehco的地址
+	src, dst := c.RemoteAddr(), c.LocalAddr()
+	if proxied {
+		var err error
+		if src, dst, err = readProxyHeaderV2(c); err != nil {
+			cs.log.Warnw("read proxy header error", "session", session, "error", err)
+			cs.end("", err)
+			return
+		}
+	}
+	var proxyHeader []byte
+	if r.cfg.ProxyProtocol != 0 {
+		var err error
+		if proxyHeader, err = buildProxyHeader(r.cfg.ProxyProtocol, src, dst); err != nil {
+			cs.log.Warnf("build proxy header error: %s", err)
+			cs.end("", err)
+			return
+		}
+	}
+	dialDone := cs.phase("dial")
+	rc, remote, err := r.dialBackend()
+	dialDone(err)
 	if err != nil {
-		Logger.Infof("dial error: %s", err)
+		cs.end(remote, err)
+		cs.log.Warnf("dial error: %s", err)
 		return
 	}
 	defer rc.Close()
-	Logger.Infof("handleMWSSConnToTcp from:%s to:%s", c.RemoteAddr(), rc.RemoteAddr())
+	if len(proxyHeader) > 0 {
+		if _, err := rc.Write(proxyHeader); err != nil {
+			cs.end(remote, err)
+			cs.log.Warnf("write proxy header error: %s", err)
+			return
+		}
+	}
+	r.conns.add(remote, c)
+	defer r.conns.remove(remote, c)
+	r.logAccess(cs, "handleMWSSConnToTcp", "from", c.RemoteAddr(), "to", rc.RemoteAddr(), "session", session)
+	start := time.Now()
 	if err := rc.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
-		Logger.Infof("set deadline error: %s", err)
+		cs.end(remote, err)
 		return
 	}
 	if err := c.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
-		Logger.Infof("set deadline error: %s", err)
+		cs.end(remote, err)
 		return
 	}
-	transport(rc, c)
+	r.connOpened(cs, c.RemoteAddr(), remote)
+	backend := r.backendConn(rc, remote, proxyHeader)
+	defer backend.Close()
+	st, err := transport(c, backend, r.cfg)
+	cs.end(remote, err)
+	r.logTransfer(cs, "handleMWSSConnToTcp", start, st, "from", c.RemoteAddr(), "to", remote, "session", session)
+}
+
+// 依赖的smux版本只实现了协议版本1
+const SmuxVersion = 1
+
+// newSmuxConfig 在smux默认配置上覆盖relay里配置了的参数 配置不合法时直接返回错误
+func newSmuxConfig(cfg *RelayConfig) (*smux.Config, error) {
+	c := smux.DefaultConfig()
+	if cfg.SmuxKeepAliveIntervalSec > 0 {
+		c.KeepAliveInterval = time.Duration(cfg.SmuxKeepAliveIntervalSec) * time.Second
+	}
+	if cfg.SmuxKeepAliveTimeoutSec > 0 {
+		c.KeepAliveTimeout = time.Duration(cfg.SmuxKeepAliveTimeoutSec) * time.Second
+	}
+	if cfg.SmuxMaxReceiveBuffer > 0 {
+		c.MaxReceiveBuffer = cfg.SmuxMaxReceiveBuffer
+	}
+	if cfg.SmuxMaxFrameSize > 0 {
+		c.MaxFrameSize = cfg.SmuxMaxFrameSize
+	}
+	if cfg.SmuxVersion != 0 && cfg.SmuxVersion != SmuxVersion {
+		return nil, fmt.Errorf("unsupported smux_version %d, only %d is supported", cfg.SmuxVersion, SmuxVersion)
+	}
+	if err := smux.VerifyConfig(c); err != nil {
+		return nil, fmt.Errorf("invalid smux config: %s", err)
+	}
+	return c, nil
 }
@@ -0,0 +1,945 @@
+package relay
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/xtaci/smux"
+)
+
+var mwssTestListen = "127.0.0.1:1240"
+
+var startMWSSTestServerOnce sync.Once
+
+func startMWSSTestServer(t *testing.T) {
+	startMWSSTestServerOnce.Do(func() {
+		InitTlsCfg()
+		r, err := NewRelay(mwssTestListen, Listen_MWSS, "127.0.0.1:1241", Transport_RAW)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go r.ListenAndServe()
+		select {
+		case <-r.Ready():
+		case <-time.After(5 * time.Second):
+			t.Fatal("mwss server not ready")
+		}
+	})
+}
+
+func TestMWSSTransporterConcurrentDial(t *testing.T) {
+	startMWSSTestServer(t)
+
+	tr := NewMWSSTransporter("test")
+	defer tr.Close()
+	addr := "wss://" + mwssTestListen + "/tcp/"
+	opts := &mwssDialOptions{tlsConfig: DefaultTLSConfig, maxStreamCnt: 2}
+
+	// 一边dial一边关闭session
+	stop := make(chan struct{})
+	closerDone := make(chan struct{})
+	go func() {
+		defer close(closerDone)
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+			tr.sessionMutex.Lock()
+			for i, s := range tr.sessions[addr] {
+				if i%2 == 0 {
+					s.Close()
+				}
+			}
+			tr.sessionMutex.Unlock()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := tr.DialContext(context.Background(), addr, opts)
+			if err != nil {
+				return
+			}
+			c.Close()
+		}()
+	}
+	wg.Wait()
+	close(stop)
+	<-closerDone
+
+	c, err := tr.DialContext(context.Background(), addr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tr.sessionMutex.Lock()
+	defer tr.sessionMutex.Unlock()
+	for _, s := range tr.sessions[addr] {
+		if s.IsClosed() {
+			t.Fatal("closed session left in pool")
+		}
+		if s.NumStreams() > s.maxStreamCnt {
+			t.Fatalf("session has %d streams, max %d", s.NumStreams(), s.maxStreamCnt)
+		}
+	}
+}
+
+func TestMWSSTransporterReap(t *testing.T) {
+	startMWSSTestServer(t)
+
+	tr := NewMWSSTransporter("test")
+	defer tr.Close()
+	now := time.Now()
+	tr.now = func() time.Time { return now }
+	tr.idleGrace = time.Minute
+	addr := "wss://" + mwssTestListen + "/tcp/"
+	opts := &mwssDialOptions{tlsConfig: DefaultTLSConfig, maxStreamCnt: 2}
+
+	c, err := tr.DialContext(context.Background(), addr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr.reap()
+	tr.sessionMutex.Lock()
+	if len(tr.sessions[addr]) != 1 {
+		t.Fatalf("session with open stream reaped")
+	}
+	tr.sessionMutex.Unlock()
+
+	// 没有stream之后还要空闲超过idleGrace才会被关掉
+	c.Close()
+	tr.reap()
+	tr.sessionMutex.Lock()
+	if len(tr.sessions[addr]) != 1 {
+		t.Fatalf("session reaped before idle grace")
+	}
+	tr.sessionMutex.Unlock()
+
+	now = now.Add(2 * time.Minute)
+	tr.reap()
+	tr.sessionMutex.Lock()
+	defer tr.sessionMutex.Unlock()
+	if _, ok := tr.sessions[addr]; ok {
+		t.Fatalf("idle session not reaped")
+	}
+}
+
+func TestMWSSTransporterStreamPeaks(t *testing.T) {
+	startMWSSTestServer(t)
+
+	tr := NewMWSSTransporter("test")
+	defer tr.Close()
+	tr.idleGrace = 0
+	addr := "wss://" + mwssTestListen + "/tcp/"
+	opts := &mwssDialOptions{tlsConfig: DefaultTLSConfig, maxStreamCnt: 2}
+
+	// 第一个session上到过2个stream 第二个session只有1个
+	var conns []net.Conn
+	for i := 0; i < 3; i++ {
+		c, err := tr.DialContext(context.Background(), addr, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns = append(conns, c)
+	}
+	want := StreamPeakStats{Sessions: 2, MaxStreams: 2, AvgStreams: 1.5}
+	if got := tr.streamPeakStats()[addr]; got != want {
+		t.Fatalf("expect %+v, got %+v", want, got)
+	}
+
+	// reap之后峰值还在
+	for _, c := range conns {
+		c.Close()
+	}
+	tr.reap()
+	tr.sessionMutex.Lock()
+	n := len(tr.sessions[addr])
+	tr.sessionMutex.Unlock()
+	if n != 0 {
+		t.Fatalf("sessions not reaped: %d", n)
+	}
+	if got := tr.streamPeakStats()[addr]; got != want {
+		t.Fatalf("expect %+v after reap, got %+v", want, got)
+	}
+}
+
+func TestMWSSTransporterDialBackoff(t *testing.T) {
+	tr := NewMWSSTransporter("test")
+	defer tr.Close()
+	// 没有server在监听
+	addr := "wss://127.0.0.1:1242/tcp/"
+	opts := &mwssDialOptions{tlsConfig: DefaultTLSConfig, maxStreamCnt: 2}
+
+	if _, err := tr.DialContext(context.Background(), addr, opts); err == nil || errors.Is(err, ErrMWSSBackoff) {
+		t.Fatalf("first dial should fail with dial error, got %v", err)
+	}
+	if _, err := tr.DialContext(context.Background(), addr, opts); !errors.Is(err, ErrMWSSBackoff) {
+		t.Fatalf("dial during backoff should fail fast, got %v", err)
+	}
+
+	// 退避结束之后再失败一次 退避时间翻倍
+	tr.sessionMutex.Lock()
+	tr.backoffs[addr].until = time.Now()
+	tr.sessionMutex.Unlock()
+	if _, err := tr.DialContext(context.Background(), addr, opts); err == nil || errors.Is(err, ErrMWSSBackoff) {
+		t.Fatalf("dial after backoff should retry, got %v", err)
+	}
+	tr.sessionMutex.Lock()
+	b := tr.backoffs[addr]
+	tr.sessionMutex.Unlock()
+	if b.failures != 2 || time.Until(b.until) <= MWSSDialBackoffBase {
+		t.Fatalf("unexpected backoff after 2 failures: %+v", b)
+	}
+
+	// 成功之后清掉退避状态
+	startMWSSTestServer(t)
+	ok := "wss://" + mwssTestListen + "/tcp/"
+	tr.sessionMutex.Lock()
+	tr.backoffs[ok] = &dialBackoff{failures: 3}
+	tr.sessionMutex.Unlock()
+	c, err := tr.DialContext(context.Background(), ok, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	tr.sessionMutex.Lock()
+	defer tr.sessionMutex.Unlock()
+	if _, exist := tr.backoffs[ok]; exist {
+		t.Fatal("backoff not reset after success")
+	}
+}
+
+func TestMWSSTransporterSessionMaxAge(t *testing.T) {
+	startMWSSTestServer(t)
+
+	tr := NewMWSSTransporter("test")
+	defer tr.Close()
+	var mu sync.Mutex
+	now := time.Now()
+	tr.now = func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	advance := func(d time.Duration) {
+		mu.Lock()
+		now = now.Add(d)
+		mu.Unlock()
+	}
+	addr := "wss://" + mwssTestListen + "/tcp/"
+	opts := &mwssDialOptions{tlsConfig: DefaultTLSConfig, maxStreamCnt: 10, maxSessionAge: time.Minute}
+
+	c1, err := tr.DialContext(context.Background(), addr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	c2, err := tr.DialContext(context.Background(), addr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	tr.sessionMutex.Lock()
+	if n := len(tr.sessions[addr]); n != 1 {
+		t.Fatalf("expected 1 session before expiry, got %d", n)
+	}
+	old := tr.sessions[addr][0]
+	tr.sessionMutex.Unlock()
+
+	// 过期之后新的dial换新的session 旧session上的stream还能继续用
+	advance(time.Minute)
+	c3, err := tr.DialContext(context.Background(), addr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c3.Close()
+	tr.sessionMutex.Lock()
+	sessions := tr.sessions[addr]
+	tr.sessionMutex.Unlock()
+	if len(sessions) != 2 || sessions[1] == old {
+		t.Fatalf("expected a fresh session after expiry, got %d sessions", len(sessions))
+	}
+	if old.IsClosed() || old.NumStreams() != 2 {
+		t.Fatalf("old session should keep draining its streams")
+	}
+
+	// 旧session的stream都关闭之后被清理
+	c1.Close()
+	c2.Close()
+	tr.reap()
+	tr.sessionMutex.Lock()
+	defer tr.sessionMutex.Unlock()
+	if len(tr.sessions[addr]) != 1 || tr.sessions[addr][0] == old {
+		t.Fatal("expired session not reaped after draining")
+	}
+}
+
+func TestMWSSDialHeadersAndSNI(t *testing.T) {
+	InitTlsCfg()
+	var gotSNI, gotHost, gotUA, gotToken string
+	var mu sync.Mutex
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		gotHost, gotUA, gotToken = req.Host, req.UserAgent(), req.Header.Get(AuthTokenHeader)
+		mu.Unlock()
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	srv.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		mu.Lock()
+		gotSNI = hello.ServerName
+		mu.Unlock()
+		return nil, nil
+	}}
+	srv.StartTLS()
+	defer srv.Close()
+
+	r, err := NewRelayWithConfig(&RelayConfig{
+		Listen:        "127.0.0.1:0",
+		ListenType:    Listen_RAW,
+		Remote:        "wss://" + srv.Listener.Addr().String(),
+		TransportType: Transport_MWSS,
+		AuthToken:     "token",
+		WSHeaders:     map[string]string{"Host": "cdn.example.com", "User-Agent": "ehco-test"},
+		SNI:           "edge.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.tr.Close()
+	if _, err := r.tr.Dial(context.Background(), r.RemoteTCPAddr+r.cfg.WSPath); err == nil {
+		t.Fatal("expect upgrade to be rejected")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if gotSNI != "edge.example.com" || gotHost != "cdn.example.com" || gotUA != "ehco-test" || gotToken != "token" {
+		t.Fatalf("unexpected sni %q host %q ua %q token %q", gotSNI, gotHost, gotUA, gotToken)
+	}
+
+	if _, err := NewRelayWithConfig(&RelayConfig{
+		Listen: "127.0.0.1:0", ListenType: Listen_RAW, Remote: "127.0.0.1:1", TransportType: Transport_RAW,
+		WSHeaders: map[string]string{"sec-websocket-key": "x"},
+	}); err == nil {
+		t.Fatal("expect reserved ws header to be rejected")
+	}
+}
+
+func TestMWSSHandshakeTimeout(t *testing.T) {
+	// 只accept不说话的remote
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	tr := NewMWSSTransporter("test")
+	defer tr.Close()
+	opts := &mwssDialOptions{
+		tlsConfig:        DefaultTLSConfig,
+		maxStreamCnt:     2,
+		dialTimeout:      time.Second,
+		handshakeTimeout: 200 * time.Millisecond,
+	}
+	start := time.Now()
+	if _, err := tr.DialContext(context.Background(), "wss://"+ln.Addr().String()+"/tcp/", opts); err == nil {
+		t.Fatal("expect handshake timeout")
+	}
+	if cost := time.Since(start); cost > 2*time.Second {
+		t.Fatalf("handshake took %s, should give up after handshake timeout", cost)
+	}
+}
+
+// countingConn 统计写到网络上的字节数
+type countingConn struct {
+	net.Conn
+	n int64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// dialCompressedWs level为0表示那一端不开启压缩 server一直读并丢弃收到的数据
+func dialCompressedWs(tb testing.TB, serverLevel, clientLevel int) (*WsConn, *countingConn, func()) {
+	upgrader := websocket.Upgrader{EnableCompression: serverLevel != 0}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		enableCompression(conn, serverLevel)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	var cc *countingConn
+	d := websocket.Dialer{
+		EnableCompression: clientLevel != 0,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			c, err := net.Dial(network, addr)
+			if err != nil {
+				return nil, err
+			}
+			cc = &countingConn{Conn: c}
+			return cc, nil
+		},
+	}
+	conn, _, err := d.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		srv.Close()
+		tb.Fatal(err)
+	}
+	enableCompression(conn, clientLevel)
+	wsc := newWsConn(conn)
+	return wsc, cc, func() {
+		wsc.Close()
+		srv.Close()
+	}
+}
+
+func compressiblePayload() []byte {
+	line := `{"level":"info","ts":"2020-01-01T00:00:00Z","msg":"handle request","path":"/api/v1/items","status":200}` + "\n"
+	return bytes.Repeat([]byte(line), 32*1024/len(line))
+}
+
+func incompressiblePayload() []byte {
+	b := make([]byte, 32*1024)
+	rand.Read(b)
+	return b
+}
+
+func TestMWSSCompressionNegotiate(t *testing.T) {
+	payload := compressiblePayload()
+	for _, tc := range []struct {
+		name                     string
+		serverLevel, clientLevel int
+		compressed               bool
+	}{
+		{"both", flate.BestSpeed, flate.BestSpeed, true},
+		{"client only", 0, flate.BestSpeed, false},
+		{"server only", flate.BestSpeed, 0, false},
+	} {
+		wsc, cc, cleanup := dialCompressedWs(t, tc.serverLevel, tc.clientLevel)
+		before := atomic.LoadInt64(&cc.n)
+		if _, err := wsc.Write(payload); err != nil {
+			t.Fatal(err)
+		}
+		wire := atomic.LoadInt64(&cc.n) - before
+		cleanup()
+		if compressed := wire < int64(len(payload))/2; compressed != tc.compressed {
+			t.Fatalf("%s: %d bytes on wire for %d bytes payload", tc.name, wire, len(payload))
+		}
+	}
+}
+
+// 比较不同压缩级别下的吞吐 wire-B/op是实际写到网络上的字节数
+func BenchmarkMWSSCompression(b *testing.B) {
+	payloads := []struct {
+		name string
+		data []byte
+	}{
+		{"compressible", compressiblePayload()},
+		{"incompressible", incompressiblePayload()},
+	}
+	for _, p := range payloads {
+		for _, level := range []int{0, flate.BestSpeed, flate.BestCompression} {
+			b.Run(fmt.Sprintf("%s/level=%d", p.name, level), func(b *testing.B) {
+				wsc, cc, cleanup := dialCompressedWs(b, level, level)
+				defer cleanup()
+				before := atomic.LoadInt64(&cc.n)
+				b.SetBytes(int64(len(p.data)))
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := wsc.Write(p.data); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+				b.ReportMetric(float64(atomic.LoadInt64(&cc.n)-before)/float64(b.N), "wire-B/op")
+			})
+		}
+	}
+}
+
+func TestMWSSServerAcceptClosed(t *testing.T) {
+	s := &MWSSServer{connChan: make(chan net.Conn), errChan: make(chan error, 1)}
+	s.errChan <- http.ErrServerClosed
+	close(s.errChan)
+	// 关闭之后每次Accept都要返回ErrServerClosed 而不是nil, nil
+	for i := 0; i < 3; i++ {
+		if conn, err := s.Accept(); conn != nil || err != ErrServerClosed {
+			t.Fatalf("accept after close got %v, %v", conn, err)
+		}
+	}
+}
+
+func TestMWSSServerLoopExitOnClose(t *testing.T) {
+	r, err := NewRelay("127.0.0.1:1252", Listen_MWSS, "127.0.0.1:1241", Transport_RAW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.readyWant = 1
+	done := make(chan error, 1)
+	go func() { done <- r.RunLocalMWSSServer() }()
+	select {
+	case <-r.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("mwss server not ready")
+	}
+	r.StopAccept()
+	select {
+	case err := <-done:
+		if err != ErrServerClosed {
+			t.Fatalf("expect ErrServerClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("accept loop not exit after server closed")
+	}
+}
+
+func TestMWSSSessionLimit(t *testing.T) {
+	startMWSSTestServer(t)
+
+	tr := NewMWSSTransporter("test")
+	defer tr.Close()
+	addr := "wss://" + mwssTestListen + "/tcp/"
+	opts := &mwssDialOptions{tlsConfig: DefaultTLSConfig, maxStreamCnt: 1, maxSessions: 1}
+
+	first, err := tr.DialContext(context.Background(), addr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.DialContext(context.Background(), addr, opts); err != ErrMWSSSessionLimit {
+		t.Fatalf("expect ErrMWSSSessionLimit, got %v", err)
+	}
+
+	// 等待期间有stream释放出来就复用原来的session
+	opts.sessionWait = 2 * time.Second
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		first.Close()
+	}()
+	second, err := tr.DialContext(context.Background(), addr, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	tr.sessionMutex.Lock()
+	n := len(tr.sessions[addr])
+	tr.sessionMutex.Unlock()
+	if n != 1 {
+		t.Fatalf("expect 1 session, got %d", n)
+	}
+}
+
+func TestMWSSServerHandshakeDeadline(t *testing.T) {
+	r, err := NewRelay("127.0.0.1:1255", Listen_MWSS, "127.0.0.1:1241", Transport_RAW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &MWSSServer{
+		upgrader:         &websocket.Upgrader{},
+		connChan:         make(chan net.Conn, 1),
+		handshakeTimeout: 200 * time.Millisecond,
+		relay:            r,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(s.upgrade))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/tcp/"
+
+	// 升级之后一直不发smux数据的连接会被server断开
+	idle, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	idle.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, _, err := idle.ReadMessage(); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatal("idle conn not closed after handshake timeout")
+			}
+			break
+		}
+	}
+
+	// 第一个stream建立之后deadline被清掉 session不会因为超时断开
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := smux.Client(newWsConn(conn), smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	if _, err := session.OpenStream(); err != nil {
+		t.Fatal(err)
+	}
+	<-s.connChan
+	time.Sleep(400 * time.Millisecond)
+	if session.IsClosed() {
+		t.Fatal("established session closed by handshake deadline")
+	}
+}
+
+func TestMWSSSubprotocol(t *testing.T) {
+	cfg := &RelayConfig{
+		Listen:        "127.0.0.1:1256",
+		ListenType:    Listen_MWSS,
+		Remote:        "127.0.0.1:1241",
+		TransportType: Transport_RAW,
+		WSSubprotocol: "ehco",
+	}
+	r, err := NewRelayWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &MWSSServer{
+		upgrader: &websocket.Upgrader{Subprotocols: wsSubprotocols(cfg.WSSubprotocol)},
+		connChan: make(chan net.Conn, 1),
+		relay:    r,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(s.upgrade))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/tcp/"
+
+	for _, c := range []struct {
+		offer string
+		ok    bool
+	}{
+		{"ehco", true},
+		{"other", false},
+		{"", false},
+	} {
+		d := websocket.Dialer{Subprotocols: wsSubprotocols(c.offer)}
+		conn, resp, err := d.Dial(url, nil)
+		if !c.ok {
+			if err == nil || resp.StatusCode != http.StatusBadRequest {
+				t.Fatalf("offer %q: expect handshake rejected, got %v", c.offer, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("offer %q: %s", c.offer, err)
+		}
+		if err := checkNegotiatedSubprotocol(conn, c.offer); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+
+	// server没有配置时不会选择client提供的子协议 client需要自己发现不一致
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err == nil {
+			conn.Close()
+		}
+	}))
+	defer plain.Close()
+	d := websocket.Dialer{Subprotocols: wsSubprotocols("ehco")}
+	conn, _, err := d.Dial("ws"+strings.TrimPrefix(plain.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := checkNegotiatedSubprotocol(conn, "ehco"); !errors.Is(err, ErrWSSubprotocolMismatch) {
+		t.Fatalf("expect subprotocol mismatch, got %v", err)
+	}
+}
+
+// brokenWriteConn 写总是失败 smux在上面open stream会失败 但session不会马上关闭
+type brokenWriteConn struct {
+	net.Conn
+}
+
+func (c *brokenWriteConn) Write(b []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func TestMWSSTransporterRetryOpenStream(t *testing.T) {
+	startMWSSTestServer(t)
+
+	tr := NewMWSSTransporter("test")
+	defer tr.Close()
+	addr := "wss://" + mwssTestListen + "/tcp/"
+	opts := &mwssDialOptions{tlsConfig: DefaultTLSConfig, maxStreamCnt: 10}
+
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	broken, err := smux.Client(&brokenWriteConn{Conn: c1}, smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	saturated := &muxSession{conn: c1, session: broken, maxStreamCnt: 10, createdAt: tr.now()}
+	tr.sessionMutex.Lock()
+	tr.sessions[addr] = []*muxSession{saturated}
+	tr.sessionMutex.Unlock()
+
+	c, err := tr.DialContext(context.Background(), addr, opts)
+	if err != nil {
+		t.Fatalf("open stream failure should fall back to a new session: %s", err)
+	}
+	defer c.Close()
+	if !saturated.IsClosed() {
+		t.Fatal("session failed to open stream should be closed")
+	}
+	tr.sessionMutex.Lock()
+	defer tr.sessionMutex.Unlock()
+	if len(tr.sessions[addr]) != 1 || tr.sessions[addr][0] == saturated {
+		t.Fatalf("expect one fresh session, got %d", len(tr.sessions[addr]))
+	}
+}
+
+func TestMWSSPlain(t *testing.T) {
+	backend := startEchoBackend(t)
+	defer backend.Close()
+
+	server, err := NewRelayWithConfig(&RelayConfig{
+		Listen:          "127.0.0.1:1259",
+		ListenType:      Listen_MWSS,
+		Remote:          backend.Addr().String(),
+		TransportType:   Transport_RAW,
+		MWSSPlainListen: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ListenAndServe()
+	defer server.Shutdown(context.Background())
+	client, err := NewRelayWithConfig(&RelayConfig{
+		Listen:             "127.0.0.1:1260",
+		ListenType:         Listen_RAW,
+		Remote:             "wss://127.0.0.1:1259",
+		TransportType:      Transport_MWSS,
+		MWSSPlainTransport: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.ListenAndServe()
+	defer client.Shutdown(context.Background())
+	for _, r := range []*Relay{server, client} {
+		select {
+		case <-r.Ready():
+		case <-time.After(5 * time.Second):
+			t.Fatal("relay not ready")
+		}
+	}
+
+	// plain模式下server直接说http
+	resp, err := http.Get("http://127.0.0.1:1259/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	c, err := net.Dial("tcp", "127.0.0.1:1260")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	c.Write([]byte("ping"))
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo through plain mwss failed: %q %v", buf, err)
+	}
+}
+
+func TestMWSSHandshakeOutsideLock(t *testing.T) {
+	startMWSSTestServer(t)
+
+	// accept之后一直不回应的remote 握手会一直卡到超时
+	stuck, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+	go func() {
+		for {
+			c, err := stuck.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	tr := NewMWSSTransporter("test")
+	defer tr.Close()
+	opts := &mwssDialOptions{tlsConfig: DefaultTLSConfig, maxStreamCnt: 10, handshakeTimeout: 3 * time.Second}
+	stuckDone := make(chan struct{})
+	go func() {
+		defer close(stuckDone)
+		tr.DialContext(context.Background(), "wss://"+stuck.Addr().String()+"/tcp/", opts)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// 另一个remote不受影响 同时dial的stream只建立一个session
+	addr := "wss://" + mwssTestListen + "/tcp/"
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c, err := tr.DialContext(context.Background(), addr, opts)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			c.Close()
+		}()
+	}
+	wg.Wait()
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("dial blocked by another remote's handshake for %s", d)
+	}
+	tr.sessionMutex.Lock()
+	n := len(tr.sessions[addr])
+	tr.sessionMutex.Unlock()
+	if n != 1 {
+		t.Fatalf("expect 1 session for concurrent dials, got %d", n)
+	}
+	<-stuckDone
+}
+
+func TestMWSSServerMaxAcceptingStreams(t *testing.T) {
+	r, err := NewRelay("127.0.0.1:1287", Listen_MWSS, "127.0.0.1:1241", Transport_RAW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &MWSSServer{
+		upgrader:            &websocket.Upgrader{},
+		connChan:            make(chan net.Conn, 2),
+		maxAcceptingStreams: 1,
+		relay:               r,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(s.upgrade))
+	defer srv.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/tcp/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, err := smux.Client(newWsConn(conn), smux.DefaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := session.OpenStream(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var first net.Conn
+	select {
+	case first = <-s.connChan:
+	case <-time.After(2 * time.Second):
+		t.Fatal("first stream not accepted")
+	}
+	// 第一个stream还在处理 第二个stream不会被accept
+	select {
+	case <-s.connChan:
+		t.Fatal("second stream accepted over max_accepting_streams")
+	case <-time.After(200 * time.Millisecond):
+	}
+	first.Close()
+	select {
+	case c := <-s.connChan:
+		c.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("second stream not accepted after first closed")
+	}
+}
+
+func TestPerRelayMaxMWSSStreamCnt(t *testing.T) {
+	startMWSSTestServer(t)
+	addr := "wss://" + mwssTestListen + "/tcp/"
+
+	for _, c := range []struct {
+		listen       string
+		maxStreamCnt int
+		sessions     int
+	}{
+		// 没有配置时使用默认的MaxMWSSStreamCnt
+		{"127.0.0.1:1294", 0, 1},
+		{"127.0.0.1:1295", 2, 2},
+	} {
+		r, err := NewRelayWithConfig(&RelayConfig{
+			Listen:           c.listen,
+			ListenType:       Listen_RAW,
+			Remote:           "wss://" + mwssTestListen,
+			TransportType:    Transport_MWSS,
+			MaxMWSSStreamCnt: c.maxStreamCnt,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.tr.Close()
+		opts := r.mwssDialOptions()
+		want := c.maxStreamCnt
+		if want == 0 {
+			want = MaxMWSSStreamCnt
+		}
+		if opts.maxStreamCnt != want {
+			t.Fatalf("%s: expect max stream cnt %d, got %d", c.listen, want, opts.maxStreamCnt)
+		}
+
+		tr := NewMWSSTransporter(c.listen)
+		var conns []net.Conn
+		for i := 0; i < 3; i++ {
+			conn, err := tr.DialContext(context.Background(), addr, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conns = append(conns, conn)
+		}
+		tr.sessionMutex.Lock()
+		n := len(tr.sessions[addr])
+		tr.sessionMutex.Unlock()
+		if n != c.sessions {
+			t.Fatalf("%s: expect 3 streams in %d sessions, got %d", c.listen, c.sessions, n)
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+		tr.Close()
+	}
+}
@@ -0,0 +1,172 @@
+package relay
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// ipv4下udp payload的上限 也是帧长度的上限
+const MaxUDPDatagramSize = 65507
+
+var ErrDatagramTooLarge = errors.New("udp datagram too large")
+
+// writeUDPFrame 一个datagram编码成 2字节长度(大端) + payload 一次write写进stream
+func writeUDPFrame(w io.Writer, b []byte) error {
+	if len(b) > MaxUDPDatagramSize {
+		return ErrDatagramTooLarge
+	}
+	frame := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(frame, uint16(len(b)))
+	copy(frame[2:], b)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readUDPFrame buf需要至少MaxUDPDatagramSize大
+func readUDPFrame(r io.Reader, buf []byte) (int, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(header[:]))
+	if n > len(buf) {
+		return 0, ErrDatagramTooLarge
+	}
+	return io.ReadFull(r, buf[:n])
+}
+
+// handleUdpOverMWSS 每个客户端地址对应一个stream 超过UdpDeadline没有数据就关闭
+func (r *Relay) handleUdpOverMWSS(addr string, ubc *udpBufferCh) {
+	uaddr, _ := net.ResolveUDPAddr("udp", addr)
+	defer r.removeUbc(addr, ubc)
+	if len(r.cfg.Chain) > 0 {
+		Logger.Info("not support relay udp over mwss chain currently")
+		return
+	}
+
+	wsc, err := r.tr.Dial(context.Background(), r.RemoteUDPAddr+r.mwssUDPPath())
+	if err != nil {
+		Logger.Warnf("handleUdpOverMWSS dial err %s", err)
+		return
+	}
+	defer wsc.Close()
+	// 和tcp一样算在relay的连接里 Drain的时候会等它结束或者关掉
+	r.conns.add(r.RemoteUDPAddr, wsc)
+	defer r.conns.remove(r.RemoteUDPAddr, wsc)
+
+	watchdog := newIdleWatchdog(UdpDeadline)
+	done := make(chan struct{})
+	defer close(done)
+	go watchdog.watch(done, wsc)
+	// 按payload计数 不算帧头
+	m := newTrafficMetrics(r.cfg)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	readDone := make(chan struct{})
+	go func() {
+		defer wg.Done()
+		defer close(readDone)
+		buf := make([]byte, MaxUDPDatagramSize)
+		for {
+			n, err := readUDPFrame(wsc, buf)
+			if err != nil {
+				Logger.Debug(err)
+				return
+			}
+			watchdog.touch()
+			n, err = r.UDPConn.WriteToUDP(buf[:n], uaddr)
+			m.countOut(n)
+			if err != nil {
+				Logger.Debug(err)
+				return
+			}
+		}
+	}()
+
+	for {
+		var b []byte
+		select {
+		case b = <-ubc.Ch:
+		case <-readDone:
+			wg.Wait()
+			return
+		}
+		watchdog.touch()
+		if err := writeUDPFrame(wsc, b); err != nil {
+			Logger.Debug(err)
+			break
+		}
+		m.countIn(len(b))
+	}
+	wsc.Close()
+	wg.Wait()
+}
+
+// handleMWSSConnToUdp server端每个stream用一个单独的PacketConn和后端通信
+func (r *Relay) handleMWSSConnToUdp(c net.Conn) {
+	defer c.Close()
+	cs := newConnSpan("")
+	session := mwssSessionName(c.RemoteAddr(), c.LocalAddr())
+	raddr, err := net.ResolveUDPAddr("udp", r.RemoteUDPAddr)
+	if err != nil {
+		cs.log.Warnf("resolve udp addr error: %s", err)
+		return
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		cs.log.Warnf("listen udp error: %s", err)
+		return
+	}
+	defer pc.Close()
+	r.conns.add(r.RemoteUDPAddr, c)
+	defer r.conns.remove(r.RemoteUDPAddr, c)
+	r.logAccess(cs, "handleMWSSConnToUdp", "from", c.RemoteAddr(), "to", raddr, "session", session)
+
+	watchdog := newIdleWatchdog(UdpDeadline)
+	done := make(chan struct{})
+	defer close(done)
+	go watchdog.watch(done, c, pc)
+	m := newTrafficMetrics(r.cfg)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// 后端那边断了也要让下面读stream的循环退出
+		defer c.Close()
+		buf := make([]byte, MaxUDPDatagramSize)
+		for {
+			n, _, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			watchdog.touch()
+			if err := writeUDPFrame(c, buf[:n]); err != nil {
+				return
+			}
+			m.countOut(n)
+		}
+	}()
+
+	buf := make([]byte, MaxUDPDatagramSize)
+	for {
+		n, err := readUDPFrame(c, buf)
+		if err != nil {
+			break
+		}
+		watchdog.touch()
+		n, err = pc.WriteTo(buf[:n], raddr)
+		m.countIn(n)
+		if err != nil {
+			Logger.Debug(err)
+			break
+		}
+	}
+	pc.Close()
+	wg.Wait()
+}
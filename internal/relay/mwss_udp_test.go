@@ -0,0 +1,39 @@
+package relay
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestUDPFrame(t *testing.T) {
+	var stream bytes.Buffer
+	datagrams := [][]byte{[]byte("hello"), {}, bytes.Repeat([]byte("x"), MaxUDPDatagramSize)}
+	for _, d := range datagrams {
+		if err := writeUDPFrame(&stream, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 多个帧粘在一起也要按边界拆开
+	buf := make([]byte, MaxUDPDatagramSize)
+	for _, d := range datagrams {
+		n, err := readUDPFrame(&stream, buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], d) {
+			t.Fatalf("expect %d bytes datagram, got %d", len(d), n)
+		}
+	}
+	if _, err := readUDPFrame(&stream, buf); err != io.EOF {
+		t.Fatalf("expect EOF at the end of stream, got %v", err)
+	}
+
+	if err := writeUDPFrame(&stream, make([]byte, MaxUDPDatagramSize+1)); err != ErrDatagramTooLarge {
+		t.Fatalf("expect ErrDatagramTooLarge, got %v", err)
+	}
+	writeUDPFrame(&stream, []byte("hello"))
+	if _, err := readUDPFrame(&stream, make([]byte, 4)); err != ErrDatagramTooLarge {
+		t.Fatalf("expect ErrDatagramTooLarge for small buffer, got %v", err)
+	}
+}
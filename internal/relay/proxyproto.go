@@ -0,0 +1,101 @@
+package relay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// PROXY protocol 让后端拿到真实的客户端地址
+// 使用的地址是最前面那个ehco accept到的tcp连接的对端地址
+// 如果客户端本身在别的代理(比如cdn)后面 拿到的是那个代理的地址 X-Forwarded-For之类的header不会被使用
+const (
+	ProxyProtocol_V1 = 1
+	ProxyProtocol_V2 = 2
+)
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var ErrBadProxyHeader = errors.New("bad proxy protocol header")
+
+// buildProxyHeader src是客户端地址 dst是客户端连上来的地址
+func buildProxyHeader(version int, src, dst net.Addr) ([]byte, error) {
+	sa, sok := src.(*net.TCPAddr)
+	da, dok := dst.(*net.TCPAddr)
+	switch version {
+	case ProxyProtocol_V1:
+		if !sok || !dok {
+			return []byte("PROXY UNKNOWN\r\n"), nil
+		}
+		proto := "TCP4"
+		if sa.IP.To4() == nil || da.IP.To4() == nil {
+			proto = "TCP6"
+		}
+		return []byte(fmt.Sprintf("PROXY %s %s %s %d %d\r\n", proto, sa.IP, da.IP, sa.Port, da.Port)), nil
+	case ProxyProtocol_V2:
+		buf := bytes.NewBuffer(append([]byte{}, proxyV2Signature...))
+		if !sok || !dok {
+			// LOCAL命令 不带地址
+			buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+			return buf.Bytes(), nil
+		}
+		sip, dip := sa.IP.To4(), da.IP.To4()
+		family := byte(0x11)
+		if sip == nil || dip == nil {
+			sip, dip = sa.IP.To16(), da.IP.To16()
+			family = 0x21
+		}
+		buf.WriteByte(0x21)
+		buf.WriteByte(family)
+		binary.Write(buf, binary.BigEndian, uint16(len(sip)*2+4))
+		buf.Write(sip)
+		buf.Write(dip)
+		binary.Write(buf, binary.BigEndian, uint16(sa.Port))
+		binary.Write(buf, binary.BigEndian, uint16(da.Port))
+		return buf.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown proxy protocol version: %d", version)
+}
+
+// readProxyHeaderV2 mwss client会在stream最开始写一个v2的header 用来把客户端地址带给server
+// LOCAL命令返回的地址是nil
+func readProxyHeaderV2(r io.Reader) (src, dst net.Addr, err error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(header[:12], proxyV2Signature) || header[12]>>4 != 2 {
+		return nil, nil, ErrBadProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, nil, err
+	}
+	if header[12]&0x0f == 0 {
+		return nil, nil, nil
+	}
+	var ipLen int
+	switch header[13] {
+	case 0x11:
+		ipLen = net.IPv4len
+	case 0x21:
+		ipLen = net.IPv6len
+	default:
+		return nil, nil, ErrBadProxyHeader
+	}
+	if len(body) < ipLen*2+4 {
+		return nil, nil, ErrBadProxyHeader
+	}
+	src = &net.TCPAddr{
+		IP:   net.IP(body[:ipLen]),
+		Port: int(binary.BigEndian.Uint16(body[ipLen*2:])),
+	}
+	dst = &net.TCPAddr{
+		IP:   net.IP(body[ipLen : ipLen*2]),
+		Port: int(binary.BigEndian.Uint16(body[ipLen*2+2:])),
+	}
+	return src, dst, nil
+}
@@ -0,0 +1,222 @@
+package relay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildProxyHeaderV1(t *testing.T) {
+	for _, c := range []struct {
+		src, dst net.Addr
+		want     string
+	}{
+		{
+			&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1000},
+			&net.TCPAddr{IP: net.ParseIP("5.6.7.8"), Port: 443},
+			"PROXY TCP4 1.2.3.4 5.6.7.8 1000 443\r\n",
+		},
+		{
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1000},
+			&net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443},
+			"PROXY TCP6 2001:db8::1 2001:db8::2 1000 443\r\n",
+		},
+		// 不是tcp地址时不带地址
+		{nil, nil, "PROXY UNKNOWN\r\n"},
+	} {
+		got, err := buildProxyHeader(ProxyProtocol_V1, c.src, c.dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != c.want {
+			t.Fatalf("expect %q, got %q", c.want, got)
+		}
+	}
+}
+
+func TestProxyHeaderV2RoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		src, dst *net.TCPAddr
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("1.2.3.4").To4(), Port: 1000}, &net.TCPAddr{IP: net.ParseIP("5.6.7.8").To4(), Port: 443}},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 1000}, &net.TCPAddr{IP: net.ParseIP("2001:db8::2"), Port: 443}},
+	} {
+		hdr, err := buildProxyHeader(ProxyProtocol_V2, c.src, c.dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// header后面的数据原样留在reader里
+		r := bytes.NewReader(append(hdr, "payload"...))
+		src, dst, err := readProxyHeaderV2(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if src.String() != c.src.String() || dst.String() != c.dst.String() {
+			t.Fatalf("expect %s -> %s, got %s -> %s", c.src, c.dst, src, dst)
+		}
+		if rest, _ := io.ReadAll(r); string(rest) != "payload" {
+			t.Fatalf("header read too much or too little, left %q", rest)
+		}
+	}
+
+	// LOCAL命令不带地址
+	hdr, err := buildProxyHeader(ProxyProtocol_V2, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hdr) != 16 {
+		t.Fatalf("expect 16 bytes LOCAL header, got %d", len(hdr))
+	}
+	src, dst, err := readProxyHeaderV2(bytes.NewReader(hdr))
+	if err != nil || src != nil || dst != nil {
+		t.Fatalf("expect LOCAL without addrs, got %v %v %v", src, dst, err)
+	}
+
+	if _, err := buildProxyHeader(3, nil, nil); err == nil {
+		t.Fatal("expect unknown version rejected")
+	}
+}
+
+func TestReadProxyHeaderV2Malformed(t *testing.T) {
+	valid, err := buildProxyHeader(ProxyProtocol_V2,
+		&net.TCPAddr{IP: net.ParseIP("1.2.3.4"), Port: 1000}, &net.TCPAddr{IP: net.ParseIP("5.6.7.8"), Port: 443})
+	if err != nil {
+		t.Fatal(err)
+	}
+	modify := func(f func(b []byte) []byte) []byte {
+		return f(append([]byte{}, valid...))
+	}
+	for name, c := range map[string]struct {
+		hdr []byte
+		err error
+	}{
+		"signature":    {modify(func(b []byte) []byte { b[0] = 'X'; return b }), ErrBadProxyHeader},
+		"version":      {modify(func(b []byte) []byte { b[12] = 0x11; return b }), ErrBadProxyHeader},
+		"family":       {modify(func(b []byte) []byte { b[13] = 0x31; return b }), ErrBadProxyHeader},
+		"short body":   {modify(func(b []byte) []byte { b[15] = 4; return b[:20] }), ErrBadProxyHeader},
+		"short header": {valid[:10], io.ErrUnexpectedEOF},
+		"cut body":     {valid[:20], io.ErrUnexpectedEOF},
+		"plain data":   {[]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"), ErrBadProxyHeader},
+	} {
+		if _, _, err := readProxyHeaderV2(bytes.NewReader(c.hdr)); err != c.err {
+			t.Fatalf("%s: expect %v, got %v", name, c.err, err)
+		}
+	}
+}
+
+// startProxyHeaderBackend 把每个连接第一行之前收到的数据发到ch 然后回一个ok
+func startProxyHeaderBackend(t *testing.T, ch chan<- string) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				c.SetDeadline(time.Now().Add(5 * time.Second))
+				// 客户端最后发送的是ping\n
+				var buf bytes.Buffer
+				br := bufio.NewReader(c)
+				for !strings.HasSuffix(buf.String(), "ping\n") {
+					line, err := br.ReadString('\n')
+					buf.WriteString(line)
+					if err != nil {
+						break
+					}
+				}
+				ch <- buf.String()
+				c.Write([]byte("ok"))
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestMWSSProxyProtocolOneSided(t *testing.T) {
+	received := make(chan string, 1)
+	backend := startProxyHeaderBackend(t, received)
+	defer backend.Close()
+
+	for i, c := range []struct {
+		client, server int
+		// 后端收到的数据的前缀 不包括最后的ping
+		prefix string
+	}{
+		// 只有client开启 server读出地址之后丢掉
+		{ProxyProtocol_V2, 0, ""},
+		// 只有server开启 用的是client ehco的地址
+		{0, ProxyProtocol_V1, "PROXY TCP4 127.0.0.1 127.0.0.1 "},
+		// 两端都开启 是真正的客户端地址
+		{ProxyProtocol_V2, ProxyProtocol_V1, "PROXY TCP4 127.0.0.1 127.0.0.1 "},
+	} {
+		serverListen := "127.0.0.1:" + []string{"1297", "1299", "1301"}[i]
+		clientListen := "127.0.0.1:" + []string{"1298", "1300", "1302"}[i]
+		server, err := NewRelayWithConfig(&RelayConfig{
+			Listen:          serverListen,
+			ListenType:      Listen_MWSS,
+			Remote:          backend.Addr().String(),
+			TransportType:   Transport_RAW,
+			MWSSPlainListen: true,
+			ProxyProtocol:   c.server,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go server.ListenAndServe()
+		client, err := NewRelayWithConfig(&RelayConfig{
+			Listen:             clientListen,
+			ListenType:         Listen_RAW,
+			Remote:             "wss://" + serverListen,
+			TransportType:      Transport_MWSS,
+			MWSSPlainTransport: true,
+			ProxyProtocol:      c.client,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go client.ListenAndServe()
+		for _, r := range []*Relay{server, client} {
+			select {
+			case <-r.Ready():
+			case <-time.After(5 * time.Second):
+				t.Fatal("relay not ready")
+			}
+		}
+
+		conn, err := net.Dial("tcp", clientListen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conn.Write([]byte("ping\n"))
+		if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+			t.Fatalf("case %d: relay failed: %v", i, err)
+		}
+		got := <-received
+		if c.prefix == "" && got != "ping\n" {
+			t.Fatalf("case %d: expect only the payload, backend got %q", i, got)
+		}
+		if c.prefix != "" && (!strings.HasPrefix(got, c.prefix) || !strings.HasSuffix(got, "\r\nping\n")) {
+			t.Fatalf("case %d: expect a v1 header before the payload, backend got %q", i, got)
+		}
+		if c.client != 0 && c.server != 0 {
+			// 客户端地址是连到client relay的本地端口
+			if want := strings.Split(conn.LocalAddr().String(), ":")[1] + " "; !strings.Contains(got, " "+want) {
+				t.Fatalf("case %d: expect client port %s in %q", i, want, got)
+			}
+		}
+		conn.Close()
+		client.Shutdown(context.Background())
+		server.Shutdown(context.Background())
+	}
+}
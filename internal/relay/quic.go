@@ -0,0 +1,398 @@
+package relay
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// quic transport 每个tcp连接是quic connection上的一个stream 不需要smux
+// connection跑在udp上 丢包时不会像tcp over tcp那样队头阻塞 nat换了端口也能继续用
+const (
+	quicALPN         = "ehco-quic"
+	quicRemotePrefix = "quic://"
+	// auth_token放在每个stream开头 一个字节的长度加上token
+	quicMaxTokenLen = 255
+	// 空闲的connection上发送keepalive的间隔 比quic默认的30s空闲超时短
+	quicKeepAlivePeriod = 15 * time.Second
+	// server允许一个connection上同时打开的stream数 client的max_mwss_stream_cnt不能超过它
+	quicMaxIncomingStreams = 100
+)
+
+var errQUICAuthFailed = errors.New("quic auth token mismatch")
+
+func quicConfig() *quic.Config {
+	return &quic.Config{KeepAlivePeriod: quicKeepAlivePeriod, MaxIncomingStreams: quicMaxIncomingStreams}
+}
+
+// QUICConn 把quic stream包装成net.Conn 地址用connection的
+type QUICConn struct {
+	*quic.Stream
+	conn *quic.Conn
+
+	onClose   func()
+	closeOnce sync.Once
+}
+
+func (c *QUICConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *QUICConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// CloseWrite stream的Close只关闭写的方向 对端读到EOF
+func (c *QUICConn) CloseWrite() error {
+	return c.Stream.Close()
+}
+
+// Close 读写两个方向都关掉
+func (c *QUICConn) Close() error {
+	if c.onClose != nil {
+		c.closeOnce.Do(c.onClose)
+	}
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// quicTLSConfig quic必须协商ALPN 不能直接改共用的tls配置
+func quicTLSConfig(cfg *tls.Config) *tls.Config {
+	if cfg == nil {
+		cfg = &tls.Config{}
+	} else {
+		cfg = cfg.Clone()
+	}
+	cfg.NextProtos = append(cfg.NextProtos, quicALPN)
+	return cfg
+}
+
+// writeQUICToken token为空时什么都不发
+func writeQUICToken(w io.Writer, token string) error {
+	if token == "" {
+		return nil
+	}
+	_, err := w.Write(append([]byte{byte(len(token))}, token...))
+	return err
+}
+
+// readQUICToken 没有配置token时总是放行
+func readQUICToken(r io.Reader, token string) error {
+	if token == "" {
+		return nil
+	}
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return err
+	}
+	got := make([]byte, n[0])
+	if _, err := io.ReadFull(r, got); err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(got, []byte(token)) != 1 {
+		return errQUICAuthFailed
+	}
+	return nil
+}
+
+func (relay *Relay) RunLocalQUICServer() error {
+	uc, err := net.ListenUDP(relay.udpNetwork(), relay.LocalUDPAddr)
+	if err != nil {
+		return err
+	}
+	defer uc.Close()
+	ln, err := quic.Listen(uc, quicTLSConfig(relay.serverTLSConfig()), quicConfig())
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	// quic不会关闭传进去的udp conn 两个都要关
+	relay.trackListener(ln)
+	relay.trackListener(uc)
+	relay.listenerReady()
+	for {
+		conn, err := ln.Accept(context.Background())
+		if err != nil {
+			if !relay.isStopped() {
+				Logger.Warnf("accept quic conn error: %s", err)
+			}
+			return err
+		}
+		if !relay.scheduleOpen() || !relay.allowAddr(conn.RemoteAddr()) {
+			conn.CloseWithError(0, "not allowed")
+			continue
+		}
+		go relay.handleQUICConn(conn)
+	}
+}
+
+// handleQUICConn connection上的每个stream算一个连接 connection关掉之后AcceptStream返回错误
+func (relay *Relay) handleQUICConn(conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			Logger.Debugf("[quic] %s accept stream err: %s", conn.RemoteAddr(), err)
+			return
+		}
+		// 已经建立的connection上的新stream也要拒绝
+		if !relay.scheduleOpen() {
+			stream.CancelRead(0)
+			stream.Close()
+			continue
+		}
+		release, ok := relay.acquireConn()
+		if !ok {
+			stream.CancelRead(0)
+			stream.Close()
+			continue
+		}
+		go func(c net.Conn) {
+			defer release()
+			relay.handleQUICConnToTcp(c)
+		}(&QUICConn{Stream: stream, conn: conn})
+	}
+}
+
+func (relay *Relay) handleQUICConnToTcp(c net.Conn) {
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(WsDeadline))
+	if err := readQUICToken(c, relay.cfg.AuthToken); err != nil {
+		Logger.Warnf("[quic] %s auth error: %s", c.RemoteAddr(), err)
+		return
+	}
+	lc, cs := relay.traceConn(c, "ehco.quic.server")
+	dialDone := cs.phase("dial")
+	rc, remote, err := relay.dialBackend()
+	dialDone(err)
+	if err != nil {
+		cs.end(remote, err)
+		cs.log.Warnf("dial error: %s", err)
+		return
+	}
+	defer rc.Close()
+	relay.conns.add(remote, c)
+	defer relay.conns.remove(remote, c)
+	relay.logAccess(cs, "handleQUICConnToTcp", "from", c.RemoteAddr(), "to", rc.RemoteAddr())
+	if err := c.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
+		cs.end(remote, err)
+		return
+	}
+	if err := rc.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
+		cs.end(remote, err)
+		return
+	}
+	relay.connOpened(cs, c.RemoteAddr(), remote)
+	_, err = transport(lc, rc, relay.cfg)
+	cs.end(remote, err)
+}
+
+// quicPooledConn 池子里的一个quic connection streams是还没有关闭的stream数 由quicTransporter.mu保护
+type quicPooledConn struct {
+	conn    *quic.Conn
+	streams int
+	// 开始没有stream的时间
+	idleSince time.Time
+}
+
+func (pc *quicPooledConn) closed() bool {
+	select {
+	case <-pc.conn.Context().Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// quicDial 正在建立的connection 同一个remote同时只建立一个 其他Dial等它完成
+type quicDial struct {
+	done chan struct{}
+	err  error
+}
+
+// quicTransporter 和mwssTransporter一样 每个remote一个connection池 每次Dial在其中一个上面开一个新的stream
+// 每个connection最多承载maxStreamCnt个stream 都满了就新建一个 没有stream的connection空闲idleGrace之后关掉
+type quicTransporter struct {
+	relay        *Relay
+	maxStreamCnt int
+	idleGrace    time.Duration
+
+	mu      sync.Mutex
+	conns   map[string][]*quicPooledConn
+	dialing map[string]*quicDial
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+func newQUICTransporter(r *Relay) *quicTransporter {
+	maxStreamCnt := r.cfg.MaxMWSSStreamCnt
+	// 超过server允许的stream数时OpenStreamSync会一直阻塞
+	if maxStreamCnt > quicMaxIncomingStreams {
+		maxStreamCnt = quicMaxIncomingStreams
+	}
+	tr := &quicTransporter{
+		relay:        r,
+		maxStreamCnt: maxStreamCnt,
+		idleGrace:    MWSSSessionIdleGrace,
+		conns:        make(map[string][]*quicPooledConn),
+		dialing:      make(map[string]*quicDial),
+		stop:         make(chan struct{}),
+	}
+	if r.cfg.MWSSSessionIdleSec > 0 {
+		tr.idleGrace = time.Duration(r.cfg.MWSSSessionIdleSec) * time.Second
+	}
+	go tr.reapLoop()
+	return tr
+}
+
+// pick 找一个还有空位的connection 占上一个stream 都满了就新建一个 握手失败不缓存
+// 握手不持有mu 一个remote握手慢不会挡住其他remote的Dial
+func (tr *quicTransporter) pick(ctx context.Context, addr string) (*quicPooledConn, error) {
+	for {
+		tr.mu.Lock()
+		alive := tr.conns[addr][:0:0]
+		var picked *quicPooledConn
+		for _, pc := range tr.conns[addr] {
+			if pc.closed() {
+				continue
+			}
+			alive = append(alive, pc)
+			if picked == nil && pc.streams < tr.maxStreamCnt {
+				picked = pc
+			}
+		}
+		tr.conns[addr] = alive
+		if picked != nil {
+			picked.streams++
+			picked.idleSince = time.Time{}
+			tr.mu.Unlock()
+			return picked, nil
+		}
+		if d, ok := tr.dialing[addr]; ok {
+			tr.mu.Unlock()
+			select {
+			case <-d.done:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if d.err != nil {
+				return nil, d.err
+			}
+			continue
+		}
+		d := &quicDial{done: make(chan struct{})}
+		tr.dialing[addr] = d
+		tr.mu.Unlock()
+
+		conn, err := tr.dial(ctx, addr)
+		tr.mu.Lock()
+		delete(tr.dialing, addr)
+		d.err = err
+		close(d.done)
+		if err != nil {
+			tr.mu.Unlock()
+			return nil, err
+		}
+		pc := &quicPooledConn{conn: conn, streams: 1}
+		tr.conns[addr] = append(tr.conns[addr], pc)
+		tr.mu.Unlock()
+		return pc, nil
+	}
+}
+
+func (tr *quicTransporter) dial(ctx context.Context, addr string) (*quic.Conn, error) {
+	limiter := handshakes
+	if !limiter.acquire("client") {
+		return nil, ErrTooManyHandshakes
+	}
+	defer limiter.release()
+	ctx, cancel := context.WithTimeout(ctx, tr.relay.dialTimeout())
+	defer cancel()
+	return quic.DialAddr(ctx, addr, quicTLSConfig(tr.relay.clientTLSConfig()), quicConfig())
+}
+
+func (tr *quicTransporter) release(pc *quicPooledConn) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	pc.streams--
+	if pc.streams == 0 {
+		pc.idleSince = time.Now()
+	}
+}
+
+// Dial addr是remote 可以带上quic://前缀
+func (tr *quicTransporter) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	addr = strings.TrimPrefix(addr, quicRemotePrefix)
+	pc, err := tr.pick(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := pc.conn.OpenStreamSync(ctx)
+	if err != nil {
+		tr.release(pc)
+		return nil, err
+	}
+	c := &QUICConn{Stream: stream, conn: pc.conn, onClose: func() { tr.release(pc) }}
+	if err := writeQUICToken(c, tr.relay.cfg.AuthToken); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (tr *quicTransporter) reapLoop() {
+	ticker := time.NewTicker(MWSSReapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-tr.stop:
+			return
+		case <-ticker.C:
+			tr.reap(time.Now())
+		}
+	}
+}
+
+// reap 关掉已经断开或者空闲超过idleGrace的connection
+func (tr *quicTransporter) reap(now time.Time) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for addr, conns := range tr.conns {
+		alive := conns[:0:0]
+		for _, pc := range conns {
+			if !pc.closed() && (pc.streams > 0 || now.Sub(pc.idleSince) < tr.idleGrace) {
+				alive = append(alive, pc)
+				continue
+			}
+			pc.conn.CloseWithError(0, "")
+		}
+		if len(alive) == 0 {
+			delete(tr.conns, addr)
+		} else {
+			tr.conns[addr] = alive
+		}
+	}
+}
+
+func (tr *quicTransporter) Close() error {
+	tr.closeOnce.Do(func() {
+		close(tr.stop)
+		tr.mu.Lock()
+		defer tr.mu.Unlock()
+		for addr, conns := range tr.conns {
+			for _, pc := range conns {
+				pc.conn.CloseWithError(0, "")
+			}
+			delete(tr.conns, addr)
+		}
+	})
+	return nil
+}
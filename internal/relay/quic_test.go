@@ -0,0 +1,157 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func startQUICRelays(t *testing.T, serverToken, clientToken string) func() {
+	if DefaultTLSConfig == nil {
+		InitTlsCfg()
+	}
+	backend := startEchoBackend(t)
+	server, err := NewRelayWithConfig(&RelayConfig{
+		Listen:        "127.0.0.1:1267",
+		ListenType:    Listen_QUIC,
+		Remote:        backend.Addr().String(),
+		TransportType: Transport_RAW,
+		AuthToken:     serverToken,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ListenAndServe()
+	client, err := NewRelayWithConfig(&RelayConfig{
+		Listen:        "127.0.0.1:1268",
+		ListenType:    Listen_RAW,
+		Remote:        "quic://127.0.0.1:1267",
+		TransportType: Transport_QUIC,
+		AuthToken:     clientToken,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.ListenAndServe()
+	for _, r := range []*Relay{server, client} {
+		select {
+		case <-r.Ready():
+		case <-time.After(5 * time.Second):
+			t.Fatal("relay not ready")
+		}
+	}
+	return func() {
+		client.Shutdown(context.Background())
+		server.Shutdown(context.Background())
+		backend.Close()
+	}
+}
+
+func TestQUICTransport(t *testing.T) {
+	cleanup := startQUICRelays(t, "secret", "secret")
+	defer cleanup()
+
+	// 同一个connection上的多个stream
+	for i := 0; i < 3; i++ {
+		c, err := net.Dial("tcp", "127.0.0.1:1268")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		c.Write([]byte("ping"))
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("echo through quic failed: %q %v", buf, err)
+		}
+		c.Close()
+	}
+}
+
+func TestQUICTransportAuthToken(t *testing.T) {
+	cleanup := startQUICRelays(t, "secret", "wrong")
+	defer cleanup()
+
+	c, err := net.Dial("tcp", "127.0.0.1:1268")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("ping"))
+	if _, err := io.ReadFull(c, make([]byte, 4)); err == nil {
+		t.Fatal("expect conn with wrong token closed")
+	}
+}
+
+func TestQUICTransporterPool(t *testing.T) {
+	if DefaultTLSConfig == nil {
+		InitTlsCfg()
+	}
+	backend := startEchoBackend(t)
+	defer backend.Close()
+	server, err := NewRelayWithConfig(&RelayConfig{
+		Listen:        "127.0.0.1:1278",
+		ListenType:    Listen_QUIC,
+		Remote:        backend.Addr().String(),
+		TransportType: Transport_RAW,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ListenAndServe()
+	defer server.Shutdown(context.Background())
+	select {
+	case <-server.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay not ready")
+	}
+	client, err := NewRelayWithConfig(&RelayConfig{
+		Listen:           "127.0.0.1:1279",
+		Remote:           "quic://127.0.0.1:1278",
+		TransportType:    Transport_QUIC,
+		MaxMWSSStreamCnt: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := newQUICTransporter(client)
+	defer tr.Close()
+
+	// 每个connection最多两个stream 第三个stream开在新的connection上
+	var streams []net.Conn
+	for i := 0; i < 3; i++ {
+		c, err := tr.Dial(context.Background(), "quic://127.0.0.1:1278")
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, c)
+	}
+	tr.mu.Lock()
+	n := len(tr.conns["127.0.0.1:1278"])
+	tr.mu.Unlock()
+	if n != 2 {
+		t.Fatalf("expect 2 pooled conns, got %d", n)
+	}
+
+	// 有stream的connection不会被清理 stream都关掉并且空闲超过idleGrace之后关掉
+	tr.reap(time.Now().Add(2 * tr.idleGrace))
+	tr.mu.Lock()
+	n = len(tr.conns["127.0.0.1:1278"])
+	tr.mu.Unlock()
+	if n != 2 {
+		t.Fatalf("expect busy conns kept, got %d", n)
+	}
+	for _, c := range streams {
+		c.Close()
+		c.Close()
+	}
+	tr.reap(time.Now().Add(2 * tr.idleGrace))
+	tr.mu.Lock()
+	n = len(tr.conns["127.0.0.1:1278"])
+	tr.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("expect idle conns reaped, got %d", n)
+	}
+}
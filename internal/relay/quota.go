@@ -0,0 +1,133 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// 从第一次使用开始算总量 不会自动重置
+	QuotaPeriod_Total = ""
+	// 每个自然月重新开始算 按本地时间
+	QuotaPeriod_Monthly = "monthly"
+)
+
+// 开启quota_kill_active时多久检查一次流量有没有超过quota
+var QuotaCheckInterval = 10 * time.Second
+
+// 测试时替换成假的时钟
+var quotaNow = time.Now
+
+// relayQuota 一个listen地址上的流量限额 上传和下载加在一起算
+// 和relayStatsMap一样按listen地址区分 reload之后已经用掉的流量还在
+type relayQuota struct {
+	mu     sync.Mutex
+	limit  int64
+	period string
+	// 当前周期开始时的累计流量 和周期的名字 按月时是2006-01 总量时为空
+	base  int64
+	cycle string
+}
+
+var relayQuotaMap sync.Map
+
+func quotaFor(listen string) *relayQuota {
+	v, _ := relayQuotaMap.LoadOrStore(listen, &relayQuota{})
+	return v.(*relayQuota)
+}
+
+// setRelayQuota 创建relay时按配置更新限额 已经用掉的流量不变
+func setRelayQuota(cfg *RelayConfig) {
+	q := quotaFor(cfg.Listen)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limit, q.period = cfg.QuotaBytes, cfg.QuotaPeriod
+}
+
+func quotaCycle(period string, now time.Time) string {
+	if period == QuotaPeriod_Monthly {
+		return now.Format("2006-01")
+	}
+	return ""
+}
+
+// usedLocked 进入新的周期时从当前的累计流量重新开始算 需要持有mu
+func (q *relayQuota) usedLocked(listen string) int64 {
+	t := trafficOf(listen)
+	total := t.Upload + t.Download
+	if cycle := quotaCycle(q.period, quotaNow()); cycle != q.cycle {
+		q.base, q.cycle = total, cycle
+	}
+	return total - q.base
+}
+
+func (q *relayQuota) exceeded(listen string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.limit > 0 && q.usedLocked(listen) >= q.limit
+}
+
+// QuotaStatus 一个relay的限额和当前周期用掉的流量
+type QuotaStatus struct {
+	Limit  int64  `json:"quota_bytes"`
+	Period string `json:"quota_period,omitempty"`
+	Cycle  string `json:"cycle,omitempty"`
+	Used   int64  `json:"used"`
+}
+
+// QuotaSnapshot 所有设置了限额的relay 按listen地址
+func QuotaSnapshot() map[string]QuotaStatus {
+	res := make(map[string]QuotaStatus)
+	relayQuotaMap.Range(func(k, v interface{}) bool {
+		q := v.(*relayQuota)
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		if q.limit > 0 {
+			used := q.usedLocked(k.(string))
+			res[k.(string)] = QuotaStatus{Limit: q.limit, Period: q.period, Cycle: q.cycle, Used: used}
+		}
+		return true
+	})
+	return res
+}
+
+// SetQuota 运行时调整限额 0表示不限制 relay重新创建时恢复成配置里的值
+func SetQuota(listen string, bytes int64) {
+	q := quotaFor(listen)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.limit = bytes
+}
+
+// ResetQuota 从现在开始重新计算用掉的流量
+func ResetQuota(listen string) {
+	q := quotaFor(listen)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	t := trafficOf(listen)
+	q.base, q.cycle = t.Upload+t.Download, quotaCycle(q.period, quotaNow())
+}
+
+// quotaExceeded 超过限额之后拒绝新的连接 直到进入下一个周期或者限额被调高
+func (r *Relay) quotaExceeded() bool {
+	return quotaFor(r.cfg.Listen).exceeded(r.cfg.Listen)
+}
+
+// watchQuota quota_kill_active 超过限额时断开正在转发的连接
+func (r *Relay) watchQuota() {
+	ticker := time.NewTicker(QuotaCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+		if !r.quotaExceeded() {
+			continue
+		}
+		if n := r.conns.closeEverything(); n > 0 {
+			Logger.Warnf("relay %s quota exceeded, closed %d conns", r.cfg.Listen, n)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package relay
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRelayQuota(t *testing.T) {
+	now := time.Date(2026, 1, 31, 12, 0, 0, 0, time.Local)
+	quotaNow = func() time.Time { return now }
+	defer func() { quotaNow = time.Now }()
+
+	r, err := NewRelayWithConfig(&RelayConfig{
+		Listen:        "127.0.0.1:1272",
+		ListenType:    Listen_RAW,
+		Remote:        "127.0.0.1:1",
+		TransportType: Transport_RAW,
+		QuotaBytes:    100,
+		QuotaPeriod:   QuotaPeriod_Monthly,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	setRelayQuota(r.cfg)
+	acquire := func() bool {
+		release, ok := r.acquireConn()
+		if ok {
+			release()
+		}
+		return ok
+	}
+	s := statsFor(r.cfg.Listen)
+
+	if !acquire() {
+		t.Fatal("expect conn accepted under quota")
+	}
+	atomic.AddInt64(&s.bytesIn, 60)
+	atomic.AddInt64(&s.bytesOut, 40)
+	if acquire() {
+		t.Fatal("expect conn rejected after quota exceeded")
+	}
+
+	SetQuota(r.cfg.Listen, 200)
+	if !acquire() {
+		t.Fatal("expect conn accepted after quota raised")
+	}
+	atomic.AddInt64(&s.bytesOut, 100)
+	if acquire() {
+		t.Fatal("expect conn rejected after raised quota exceeded")
+	}
+
+	// 下个月重新开始算
+	now = now.AddDate(0, 0, 1)
+	if !acquire() {
+		t.Fatal("expect conn accepted in next month")
+	}
+	if got := QuotaSnapshot()[r.cfg.Listen]; got.Used != 0 || got.Cycle != "2026-02" {
+		t.Fatalf("unexpected quota status %+v", got)
+	}
+}
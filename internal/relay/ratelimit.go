@@ -0,0 +1,121 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitedReader 每次读到数据之后按字节数等待令牌 读得慢了对端自然就发得慢了
+type rateLimitedReader struct {
+	io.Reader
+	limiter *rate.Limiter
+
+	// 不为nil时按session上的stream数调整限速 见fairShare
+	streams     func() int
+	fairStreams int
+	bytesPerSec int
+}
+
+// sessionStreamsOf client和backend里是mwss stream的那一个 用来拿到session上的stream数
+// 开启tracing或者hook时stream外面还包了一层countConn
+func sessionStreamsOf(rws ...io.ReadWriter) func() int {
+	for _, rw := range rws {
+		if cc, ok := rw.(*countConn); ok {
+			rw = cc.Conn
+		}
+		if mc, ok := rw.(*muxStreamConn); ok {
+			return mc.sessionStreams
+		}
+	}
+	return nil
+}
+
+// relayBandwidth 一个relay上所有连接共用的限速 in是client->backend out是backend->client
+// 没有配置的方向为nil
+type relayBandwidth struct {
+	in, out *rate.Limiter
+}
+
+// 按listen地址区分relay 和relayStatsMap一样 reload之后新的连接用新的限速
+var relayBandwidthMap sync.Map
+
+// setRelayBandwidth 创建relay时按配置更新这个listen地址上的共享限速
+func setRelayBandwidth(cfg *RelayConfig) {
+	if cfg.UploadLimitBytesPerSec <= 0 && cfg.DownloadLimitBytesPerSec <= 0 {
+		relayBandwidthMap.Delete(cfg.Listen)
+		return
+	}
+	bw := &relayBandwidth{}
+	if cfg.UploadLimitBytesPerSec > 0 {
+		bw.in = rate.NewLimiter(rate.Limit(cfg.UploadLimitBytesPerSec), BufferSize)
+	}
+	if cfg.DownloadLimitBytesPerSec > 0 {
+		bw.out = rate.NewLimiter(rate.Limit(cfg.DownloadLimitBytesPerSec), BufferSize)
+	}
+	relayBandwidthMap.Store(cfg.Listen, bw)
+}
+
+// bandwidthFor 没有配置relay级别的限速时返回nil
+func bandwidthFor(listen string) *relayBandwidth {
+	v, ok := relayBandwidthMap.Load(listen)
+	if !ok {
+		return nil
+	}
+	return v.(*relayBandwidth)
+}
+
+// newSharedRateLimitedReader 和其他连接共用limiter 单次读不超过BufferSize 不会超过burst
+func newSharedRateLimitedReader(r io.Reader, limiter *rate.Limiter) *rateLimitedReader {
+	return &rateLimitedReader{Reader: r, limiter: limiter}
+}
+
+// newRateLimitedReader bytesPerSec是单个方向的上限
+// burst固定为一个buffer的大小 避免刚开始的时候突发太多
+func newRateLimitedReader(r io.Reader, bytesPerSec int) *rateLimitedReader {
+	return &rateLimitedReader{
+		Reader:      r,
+		limiter:     rate.NewLimiter(rate.Limit(bytesPerSec), BufferSize),
+		bytesPerSec: bytesPerSec,
+	}
+}
+
+// fairShare mwss_fair_share_streams 同一个session上的stream超过fairStreams个时
+// 每个stream的限速降到bytesPerSec*fairStreams/stream数 整个session最多用fairStreams个stream的带宽
+// 一个大流量的stream就不会把交互式的stream饿死
+// 代价是按stream数平分而不是按实际流量 空闲的stream也占一份 带宽用不满的时候大流量的stream也会被限速
+func (r *rateLimitedReader) fairShare(streams func() int, fairStreams int) {
+	r.streams, r.fairStreams = streams, fairStreams
+}
+
+// adjust 每次读之前按当前的stream数更新限速 只在变化时调用SetLimit
+func (r *rateLimitedReader) adjust() {
+	limit := r.bytesPerSec
+	if n := r.streams(); n > r.fairStreams {
+		limit = r.bytesPerSec * r.fairStreams / n
+	}
+	if limit < 1 {
+		limit = 1
+	}
+	if rate.Limit(limit) != r.limiter.Limit() {
+		r.limiter.SetLimit(rate.Limit(limit))
+	}
+}
+
+func (r *rateLimitedReader) Read(b []byte) (int, error) {
+	if len(b) > BufferSize {
+		b = b[:BufferSize]
+	}
+	if r.streams != nil {
+		r.adjust()
+	}
+	n, err := r.Reader.Read(b)
+	if n > 0 {
+		if werr := r.limiter.WaitN(context.Background(), n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
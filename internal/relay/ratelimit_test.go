@@ -0,0 +1,115 @@
+package relay
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTransportRateLimit(t *testing.T) {
+	limit := 256 * 1024
+	client, clientPeer := net.Pipe()
+	backend, backendPeer := net.Pipe()
+	defer clientPeer.Close()
+	defer backendPeer.Close()
+	go transport(client, backend, &RelayConfig{RateLimitBytesPerSec: limit})
+
+	// 客户端一直发 从后端那一侧统计收到的速度
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			if _, err := clientPeer.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	duration := 2 * time.Second
+	backendPeer.SetReadDeadline(time.Now().Add(duration))
+	start := time.Now()
+	n, _ := io.Copy(ioutil.Discard, backendPeer)
+	elapsed := time.Since(start)
+
+	got := float64(n) / elapsed.Seconds()
+	if got > float64(limit)*1.2 || got < float64(limit)*0.8 {
+		t.Fatalf("rate %.0f B/s out of tolerance, limit %d B/s", got, limit)
+	}
+}
+
+func TestRateLimitFairShare(t *testing.T) {
+	limit := 1000
+	streams := 1
+	rl := newRateLimitedReader(strings.NewReader("x"), limit)
+	rl.fairShare(func() int { return streams }, 4)
+
+	for _, c := range []struct {
+		streams int
+		want    float64
+	}{
+		{1, 1000},
+		{4, 1000},
+		// 超过4个stream之后session总共最多4000
+		{8, 500},
+		{16, 250},
+		{2, 1000},
+	} {
+		streams = c.streams
+		rl.adjust()
+		if got := float64(rl.limiter.Limit()); got != c.want {
+			t.Fatalf("%d streams: limit %.0f, want %.0f", c.streams, got, c.want)
+		}
+	}
+}
+
+func TestSessionStreamsOf(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if sessionStreamsOf(c1, c2) != nil {
+		t.Fatal("plain conns have no mwss session")
+	}
+	// 开启tracing时stream外面包了一层countConn
+	if sessionStreamsOf(c1, &countConn{Conn: &muxStreamConn{Conn: c2}}) == nil {
+		t.Fatal("mwss stream not found")
+	}
+}
+
+func TestTransportRelayBandwidth(t *testing.T) {
+	limit := 256 * 1024
+	cfg := &RelayConfig{Listen: "127.0.0.1:1264", UploadLimitBytesPerSec: limit}
+	setRelayBandwidth(cfg)
+	defer relayBandwidthMap.Delete(cfg.Listen)
+
+	// 两个连接同时上传 加起来不超过relay的限速
+	duration := 2 * time.Second
+	total := make(chan int64, 2)
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		client, clientPeer := net.Pipe()
+		backend, backendPeer := net.Pipe()
+		defer clientPeer.Close()
+		defer backendPeer.Close()
+		go transport(client, backend, cfg)
+		go func() {
+			buf := make([]byte, 32*1024)
+			for {
+				if _, err := clientPeer.Write(buf); err != nil {
+					return
+				}
+			}
+		}()
+		go func() {
+			backendPeer.SetReadDeadline(start.Add(duration))
+			n, _ := io.Copy(ioutil.Discard, backendPeer)
+			total <- n
+		}()
+	}
+	n := <-total + <-total
+	got := float64(n) / time.Since(start).Seconds()
+	if got > float64(limit)*1.2 || got < float64(limit)*0.8 {
+		t.Fatalf("rate %.0f B/s out of tolerance, limit %d B/s", got, limit)
+	}
+}
@@ -6,68 +6,156 @@ import (
 	"time"
 )
 
-func (r *Relay) handleTCPConn(c *net.TCPConn) error {
-	rc, err := net.Dial("tcp", r.RemoteTCPAddr)
+func (r *Relay) handleTCPConn(c net.Conn) error {
+	var lc net.Conn = c
+	remote := ""
+	var peekErr error
+	if len(r.cfg.SNIRoutes) > 0 {
+		// 不终结tls 只偷看SNI来选择后端 握手的字节会原样发给后端
+		serverName, pc, err := peekSNI(c)
+		if pc == nil {
+			return err
+		}
+		peekErr = err
+		lc = pc
+		remote = r.getRemoteBySNI(serverName)
+	}
+
+	lc, cs := r.traceConn(lc, "ehco.raw")
+	if peekErr != nil {
+		cs.log.Infof("peek sni from %s error: %s", c.RemoteAddr(), peekErr)
+	}
+	dialDone := cs.phase("dial")
+	var rc net.Conn
+	var err error
+	if remote != "" {
+		rc, err = r.dialRemote(remote)
+	} else {
+		// 没有命中SNI路由的话在所有后端之间failover
+		rc, remote, err = r.dialBackend()
+	}
+	dialDone(err)
 	if err != nil {
+		cs.end(remote, err)
 		return err
 	}
 	defer rc.Close()
+	var proxyHeader []byte
+	if r.cfg.ProxyProtocol != 0 {
+		if proxyHeader, err = buildProxyHeader(r.cfg.ProxyProtocol, c.RemoteAddr(), c.LocalAddr()); err != nil {
+			cs.end(remote, err)
+			return err
+		}
+		if _, err := rc.Write(proxyHeader); err != nil {
+			cs.end(remote, err)
+			return err
+		}
+	}
+	r.conns.add(remote, c)
+	defer r.conns.remove(remote, c)
 	if err := rc.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
+		cs.end(remote, err)
 		return err
 	}
 	if err := c.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
+		cs.end(remote, err)
 		return err
 	}
-	transport(c, rc)
+	r.connOpened(cs, c.RemoteAddr(), remote)
+	backend := r.backendConn(rc, remote, proxyHeader)
+	defer backend.Close()
+	_, err = transport(lc, backend, r.cfg)
+	cs.end(remote, err)
 	return nil
 }
 
+func (r *Relay) dialTimeout() time.Duration {
+	return time.Duration(r.cfg.DialTimeoutSec) * time.Second
+}
+
+// dialBackend 按负载均衡的顺序dial后端 失败时换下一个 最多MaxDialAttempts次
+func (r *Relay) dialBackend() (net.Conn, string, error) {
+	return r.backends.dial(r.dialRemote, r.cfg.MaxDialAttempts)
+}
+
+// dialBackendFunc 后端RST后重连用 proxyHeader不为空时重连之后要先发一遍
+func (r *Relay) dialBackendFunc(remote string, proxyHeader []byte) func() (net.Conn, error) {
+	return func() (net.Conn, error) {
+		rc, err := r.dialRemote(remote)
+		if err != nil {
+			return nil, err
+		}
+		if len(proxyHeader) > 0 {
+			if _, err := rc.Write(proxyHeader); err != nil {
+				rc.Close()
+				return nil, err
+			}
+		}
+		if err := rc.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
+			rc.Close()
+			return nil, err
+		}
+		return rc, nil
+	}
+}
+
 func (r *Relay) handleOneUDPConn(addr string, ubc *udpBufferCh) {
+	defer r.removeUbc(addr, ubc)
 	uaddr, _ := net.ResolveUDPAddr("udp", addr)
 	rc, err := net.Dial("udp", r.RemoteUDPAddr)
 	if err != nil {
-		Logger.Info(err)
+		Logger.Warn(err)
+		return
 	}
+	defer rc.Close()
 
-	defer func() {
-		rc.Close()
-		close(ubc.Ch)
-		delete(r.udpCache, addr)
-	}()
-
+	m := newTrafficMetrics(r.cfg)
 	var wg sync.WaitGroup
 	wg.Add(1)
-
+	readDone := make(chan struct{})
 	go func() {
 		buf := outboundBufferPool.Get().([]byte)
 		for {
 			i, err := rc.Read(buf)
 			if err != nil {
-				Logger.Info(err, 1)
+				Logger.Debug(err)
 				break
 			}
 			if err := r.keepAliveAndSetNextTimeout(rc); err != nil {
-				Logger.Info(err)
+				Logger.Debug(err)
 				break
 			}
-			if _, err := r.UDPConn.WriteToUDP(buf[0:i], uaddr); err != nil {
-				Logger.Info(err)
+			n, err := r.UDPConn.WriteToUDP(buf[0:i], uaddr)
+			m.countOut(n)
+			if err != nil {
+				Logger.Debug(err)
 				break
 			}
 		}
 		outboundBufferPool.Put(buf)
 		wg.Done()
+		close(readDone)
 	}()
 
-	for b := range ubc.Ch {
-		if _, err := rc.Write(b); err != nil {
-			Logger.Info(err)
+	for {
+		var b []byte
+		// 后端超时没有回包时读的goroutine会退出 这里不能一直等客户端的下一个包
+		select {
+		case b = <-ubc.Ch:
+		case <-readDone:
+			return
+		}
+		n, err := rc.Write(b)
+		m.countIn(n)
+		if err != nil {
+			Logger.Debug(err)
 			break
 		}
 		if err := r.keepAliveAndSetNextTimeout(rc); err != nil {
-			Logger.Info(err)
+			Logger.Debug(err)
 			break
 		}
 	}
+	rc.Close()
 	wg.Wait()
 }
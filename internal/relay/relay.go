@@ -1,9 +1,19 @@
 package relay
 
 import (
+	"compress/flate"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/xtaci/smux"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 var (
@@ -14,16 +24,62 @@ var (
 	MaxMWSSStreamCnt    = 10
 	MWSSSessionDeadLine = 600 * time.Second
 	TransportDeadLine   = 10 * time.Minute
+
+	// 后台清理session的间隔 以及没有stream的session最多保留多久
+	MWSSReapInterval     = 30 * time.Second
+	MWSSSessionIdleGrace = 60 * time.Second
+
+	// 连续建立session失败时的退避时间 每次失败翻倍
+	MWSSDialBackoffBase = 1 * time.Second
+	MWSSDialBackoffMax  = 30 * time.Second
+
+	// session数到了上限时 多久检查一次有没有释放出来的stream
+	MWSSSessionWaitInterval = 10 * time.Millisecond
+
+	// max_inflight_bytes最大可以配置多少 每个连接两个方向都可能缓存这么多
+	MaxInflightBytesLimit       = 4 * 1024 * 1024
+	DefaultMaxReplayBytes       = 64 * 1024
+	DefaultIdleTimeout          = 90 * time.Second
+	DefaultWSPath               = "/tcp/"
+	DefaultDialTimeout          = 5 * time.Second
+	DefaultMWSSConnQueueSize    = 1024
+	DefaultTCPKeepAlive         = 30 * time.Second
+	DefaultDNSCacheTTL          = 60 * time.Second
+	DefaultWSPongTimeout        = 10 * time.Second
+	DefaultMWSSCompressionLevel = flate.BestSpeed
+
+	// wss/mwss server 伪装页面的http请求
+	DefaultHTTPMaxHeaderBytes    = 16 * 1024
+	DefaultHTTPReadTimeout       = 30 * time.Second
+	DefaultFakeIndexMaxBodyBytes = int64(64 * 1024)
 )
 
 const (
 	Listen_RAW  = "raw"
 	Listen_WSS  = "wss"
 	Listen_MWSS = "mwss"
+	// 只能配合mwss transport使用 目标地址由socks5客户端指定
+	Listen_SOCKS5 = "socks5"
+	Listen_GRPC   = "grpc"
+	Listen_QUIC   = "quic"
+	Listen_MTCP   = "mtcp"
+	// 和socks5一样 目标地址由http客户端的CONNECT请求指定
+	Listen_HTTP = "http"
 
 	Transport_RAW  = "raw"
 	Transport_WSS  = "wss"
 	Transport_MWSS = "mwss"
+	// 每个连接是一个grpc双向流 只支持tcp
+	Transport_GRPC = "grpc"
+	// 每个连接是一个quic stream 只支持tcp
+	Transport_QUIC = "quic"
+	// smux直接跑在tcp上 没有tls和ws 只支持tcp
+	Transport_MTCP = "mtcp"
+
+	// tcp是双栈 tcp4/tcp6只listen一种地址 udp跟着一起
+	ListenNetwork_TCP  = "tcp"
+	ListenNetwork_TCP4 = "tcp4"
+	ListenNetwork_TCP6 = "tcp6"
 )
 
 type Relay struct {
@@ -37,108 +93,539 @@ type Relay struct {
 	TransportType string
 
 	// may not init
-	TCPListener *net.TCPListener
+	// listen在unix socket上时是*net.UnixListener
+	TCPListener net.Listener
 	UDPConn     *net.UDPConn
 
+	// 可选 连接开始转发和结束时调用 在单独的goroutine里运行不会阻塞转发
+	// 同一个连接的OnDisconnect在OnConnect返回之后才调用 需要在ListenAndServe之前设置
+	OnConnect    func(info ConnInfo)
+	OnDisconnect func(info ConnInfo, bytesIn, bytesOut int64, duration time.Duration)
+
+	// 配置了多个remote时在这里面选
+	backends *backendPool
+	// 按transport_type创建 raw transport时为nil
+	tr Transporter
+	// raw listener上每个tcp连接的处理方式 按transport_type选择
+	handleTCP func(c net.Conn) error
+	// 后端域名的解析缓存 为nil表示每次都重新解析
+	dns *dnsCache
+	// mwss两端的session都用这个配置
+	smuxConfig *smux.Config
+	// 为nil表示不限制来源
+	acl *ipACL
+	// wss/mwss server 不是升级websocket的请求都交给它
+	fakeIndex http.Handler
+
+	udpMu    sync.Mutex
 	udpCache map[string]*udpBufferCh
+	conns    *connTracker
+	// dashboard上显示的正在转发的连接 按conn_id
+	live *liveConns
+
+	// 所有listener都bind成功后关闭ready
+	ready     chan struct{}
+	readyMu   sync.Mutex
+	readyCnt  int
+	readyWant int
+
+	// StopAccept之后关闭stop 并关闭所有listener
+	stopMu    sync.Mutex
+	stopped   bool
+	stop      chan struct{}
+	listeners []io.Closer
+
+	clientCert *tls.Certificate
+	serverCert *tls.Certificate
+	rootCAs    *x509.CertPool
+	clientCAs  *x509.CertPool
+	// max_conns 为nil时不限制
+	connLimit *connLimiter
+	// 配置了acme_domains时不为nil server证书从这里拿
+	acme     *autocert.Manager
+	schedule *schedule
+
+	cfg *RelayConfig
 }
 
 func NewRelay(localAddr, listenType, remoteAddr, transportType string) (*Relay, error) {
-	localTCPAddr, err := net.ResolveTCPAddr("tcp", localAddr)
+	return NewRelayWithConfig(&RelayConfig{
+		Listen:        localAddr,
+		ListenType:    listenType,
+		Remote:        remoteAddr,
+		TransportType: transportType,
+	})
+}
+
+func NewRelayWithConfig(cfg *RelayConfig) (*Relay, error) {
+	var localTCPAddr *net.TCPAddr
+	var localUDPAddr *net.UDPAddr
+	if _, ok := unixSocketPath(cfg.Listen); ok {
+		if err := checkUnixListen(cfg); err != nil {
+			return nil, err
+		}
+	} else {
+		listen, err := resolveListenAddr(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if localTCPAddr, err = net.ResolveTCPAddr(cfg.ListenNetwork, listen); err != nil {
+			return nil, err
+		}
+		if localUDPAddr, err = net.ResolveUDPAddr(udpNetwork(cfg.ListenNetwork), listen); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.MaxInflightBytes < 0 || cfg.MaxInflightBytes > MaxInflightBytesLimit {
+		return nil, fmt.Errorf("max_inflight_bytes must be in [0, %d]: %d", MaxInflightBytesLimit, cfg.MaxInflightBytes)
+	}
+	if cfg.WSPath == "" {
+		cfg.WSPath = cfg.MWSSPath
+	}
+	if cfg.WSPath == "" {
+		cfg.WSPath = DefaultWSPath
+	}
+	if !strings.HasPrefix(cfg.WSPath, "/") {
+		cfg.WSPath = "/" + cfg.WSPath
+	}
+	if !strings.HasSuffix(cfg.WSPath, "/") {
+		cfg.WSPath += "/"
+	}
+	if cfg.WSPath == "/" {
+		return nil, fmt.Errorf("ws_path can not be /")
+	}
+	if (cfg.ListenType == Listen_SOCKS5 || cfg.ListenType == Listen_HTTP) && cfg.TransportType != Transport_MWSS {
+		return nil, fmt.Errorf("%s listen type only works over mwss transport", cfg.ListenType)
+	}
+	if cfg.SOCKS5Username != "" || cfg.SOCKS5Password != "" {
+		if cfg.ListenType != Listen_SOCKS5 {
+			return nil, fmt.Errorf("socks5_username and socks5_password only work with socks5 listen type")
+		}
+		if cfg.SOCKS5Username == "" {
+			return nil, fmt.Errorf("socks5_password requires socks5_username")
+		}
+		// 用户名和密码的长度都只有一个字节
+		if len(cfg.SOCKS5Username) > 255 || len(cfg.SOCKS5Password) > 255 {
+			return nil, fmt.Errorf("socks5_username and socks5_password can not be longer than 255 bytes")
+		}
+	}
+	if err := checkWSHeaders(cfg.WSHeaders); err != nil {
+		return nil, err
+	}
+	// 走CDN时tls的SNI一般要和Host一致
+	if cfg.SNI == "" && cfg.ServerName == "" {
+		cfg.SNI = wsHeaderHostname(cfg.WSHeaders)
+	}
+	if len(cfg.Chain) > 0 {
+		if cfg.ListenType != Listen_RAW || cfg.TransportType != Transport_MWSS {
+			return nil, fmt.Errorf("chain only works with raw listen type and mwss transport")
+		}
+		for _, hop := range cfg.Chain {
+			if err := checkChainHop(hop); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if cfg.DialTimeoutSec <= 0 {
+		cfg.DialTimeoutSec = int(DefaultDialTimeout / time.Second)
+	}
+	if cfg.MWSSCompressionLevel == 0 {
+		cfg.MWSSCompressionLevel = DefaultMWSSCompressionLevel
+	}
+	if cfg.MWSSCompressionLevel < flate.BestSpeed || cfg.MWSSCompressionLevel > flate.BestCompression {
+		return nil, fmt.Errorf("mwss_compression_level must be in [1, 9]: %d", cfg.MWSSCompressionLevel)
+	}
+	if cfg.WSDialTimeoutSec <= 0 {
+		cfg.WSDialTimeoutSec = int(WsDeadline / time.Second)
+	}
+	if cfg.WSHandshakeTimeoutSec <= 0 {
+		cfg.WSHandshakeTimeoutSec = int(WsDeadline / time.Second)
+	}
+	if cfg.HTTPMaxHeaderBytes <= 0 {
+		cfg.HTTPMaxHeaderBytes = DefaultHTTPMaxHeaderBytes
+	}
+	if cfg.HTTPReadTimeoutSec <= 0 {
+		cfg.HTTPReadTimeoutSec = int(DefaultHTTPReadTimeout / time.Second)
+	}
+	if cfg.FakeIndexMaxBodyBytes <= 0 {
+		cfg.FakeIndexMaxBodyBytes = DefaultFakeIndexMaxBodyBytes
+	}
+	if cfg.FakeIndexRateLimit < 0 {
+		return nil, fmt.Errorf("fake_index_rate_limit can not be negative: %d", cfg.FakeIndexRateLimit)
+	}
+	if cfg.MWSSHandshakeTimeoutSec <= 0 {
+		cfg.MWSSHandshakeTimeoutSec = int(WsDeadline / time.Second)
+	}
+	switch cfg.ProxyProtocol {
+	case 0, ProxyProtocol_V1, ProxyProtocol_V2:
+	default:
+		return nil, fmt.Errorf("unknown proxy_protocol version: %d", cfg.ProxyProtocol)
+	}
+	if cfg.MaxMWSSStreamCnt <= 0 {
+		cfg.MaxMWSSStreamCnt = MaxMWSSStreamCnt
+	}
+	if cfg.WSPongTimeoutSec <= 0 {
+		cfg.WSPongTimeoutSec = int(DefaultWSPongTimeout / time.Second)
+	}
+	if cfg.DNSCacheTTLSec == 0 {
+		cfg.DNSCacheTTLSec = int(DefaultDNSCacheTTL / time.Second)
+	}
+	if cfg.TCPKeepAliveSec == 0 {
+		cfg.TCPKeepAliveSec = int(DefaultTCPKeepAlive / time.Second)
+	}
+	if cfg.MWSSConnQueueSize <= 0 {
+		cfg.MWSSConnQueueSize = DefaultMWSSConnQueueSize
+	}
+	if cfg.MaxMWSSSessionAgeSec < 0 {
+		return nil, fmt.Errorf("max_mwss_session_age_sec can not be negative: %d", cfg.MaxMWSSSessionAgeSec)
+	}
+	if cfg.MWSSSessionIdleSec < 0 {
+		return nil, fmt.Errorf("mwss_session_idle_sec can not be negative: %d", cfg.MWSSSessionIdleSec)
+	}
+	if cfg.MaxMWSSSessions < 0 || cfg.MWSSSessionWaitMs < 0 {
+		return nil, fmt.Errorf("max_mwss_sessions and mwss_session_wait_ms can not be negative")
+	}
+	if cfg.MWSSFairShareStreams < 0 {
+		return nil, fmt.Errorf("mwss_fair_share_streams can not be negative: %d", cfg.MWSSFairShareStreams)
+	}
+	if cfg.MWSSFairShareStreams > 0 && cfg.RateLimitBytesPerSec <= 0 {
+		return nil, fmt.Errorf("mwss_fair_share_streams requires rate_limit_bytes_per_sec")
+	}
+	if cfg.TransportType == Transport_QUIC && cfg.HealthCheckIntervalSec > 0 {
+		// udp dial总是成功 探测不出后端是不是活着
+		return nil, fmt.Errorf("health check does not work with quic transport")
+	}
+	if (cfg.ListenType == Listen_QUIC || cfg.TransportType == Transport_QUIC) && len(cfg.AuthToken) > quicMaxTokenLen {
+		return nil, fmt.Errorf("auth_token over quic can not be longer than %d", quicMaxTokenLen)
+	}
+	if cfg.MaxConns < 0 {
+		return nil, fmt.Errorf("max_conns can not be negative: %d", cfg.MaxConns)
+	}
+	if cfg.UploadLimitBytesPerSec < 0 || cfg.DownloadLimitBytesPerSec < 0 {
+		return nil, fmt.Errorf("upload_limit_bytes_per_sec and download_limit_bytes_per_sec can not be negative")
+	}
+	if cfg.QuotaBytes < 0 {
+		return nil, fmt.Errorf("quota_bytes can not be negative: %d", cfg.QuotaBytes)
+	}
+	if cfg.QuotaPeriod != QuotaPeriod_Total && cfg.QuotaPeriod != QuotaPeriod_Monthly {
+		return nil, fmt.Errorf("unknown quota_period: %s", cfg.QuotaPeriod)
+	}
+	if cfg.HealthCheckIntervalSec < 0 || cfg.HealthCheckTimeoutSec < 0 {
+		return nil, fmt.Errorf("health_check_interval_sec and health_check_timeout_sec can not be negative")
+	}
+	if cfg.MWSSConnQueueWaitMs < 0 {
+		return nil, fmt.Errorf("mwss_conn_queue_wait_ms can not be negative: %d", cfg.MWSSConnQueueWaitMs)
+	}
+	if cfg.IdleTimeoutSec == 0 {
+		cfg.IdleTimeoutSec = int(DefaultIdleTimeout / time.Second)
+	}
+	if cfg.AccessLogSampleRate < 0 || cfg.AccessLogSampleRate > 1 {
+		return nil, fmt.Errorf("access_log_sample_rate must be in [0, 1]: %f", cfg.AccessLogSampleRate)
+	}
+	if cfg.AccessLogSlowMs < 0 {
+		return nil, fmt.Errorf("access_log_slow_ms can not be negative: %d", cfg.AccessLogSlowMs)
+	}
+	switch cfg.OnBackendReset {
+	case "":
+		cfg.OnBackendReset = ResetPolicy_Close
+	case ResetPolicy_Close, ResetPolicy_Retry:
+	default:
+		return nil, fmt.Errorf("unknown on_backend_reset policy: %s", cfg.OnBackendReset)
+	}
+	if cfg.MaxReplayBytes < 0 {
+		return nil, fmt.Errorf("max_replay_bytes can not be negative: %d", cfg.MaxReplayBytes)
+	}
+	if cfg.MaxReplayBytes == 0 {
+		cfg.MaxReplayBytes = DefaultMaxReplayBytes
+	}
+	if cfg.MWSSPlainListen && (len(cfg.AllowedClientCertFingerprints) > 0 || cfg.ClientCAFile != "") {
+		return nil, fmt.Errorf("allowed_client_cert_fingerprints and client_ca_file can not be used with mwss_plain_listen")
+	}
+	var clientCert *tls.Certificate
+	if cfg.ClientCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.ClientCertFile, cfg.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		clientCert = &cert
+		Logger.Infof("load client cert %s fingerprint: %s", cfg.ClientCertFile, certFingerprint(cert.Certificate[0]))
+	}
+	var serverCert *tls.Certificate
+	if cfg.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		serverCert = &cert
+	}
+	var rootCAs *x509.CertPool
+	var err error
+	if cfg.CAFile != "" {
+		if rootCAs, err = loadCAPool(cfg.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	var clientCAs *x509.CertPool
+	if cfg.ClientCAFile != "" {
+		if clientCAs, err = loadCAPool(cfg.ClientCAFile); err != nil {
+			return nil, err
+		}
+	}
+	remotes := cfg.Remotes
+	if len(remotes) == 0 {
+		remotes = []string{cfg.Remote}
+	}
+	if cfg.Remote == "" {
+		cfg.Remote = remotes[0]
+	}
+	for _, remote := range remotes {
+		if _, ok := unixSocketPath(remote); ok && cfg.TransportType != Transport_RAW {
+			return nil, fmt.Errorf("unix socket remote %s only works with raw transport", remote)
+		}
+		if cfg.TransportType == Transport_MTCP {
+			if err := checkMTCPRemote(remote); err != nil {
+				return nil, err
+			}
+		}
+		// 有chain时remote由最后一个节点dial
+		if len(cfg.Chain) > 0 {
+			if err := checkChainTarget(remote); err != nil {
+				return nil, err
+			}
+		}
+	}
+	backends, err := newBackendPool(remotes, cfg.LBPolicy)
+	if err != nil {
+		return nil, err
+	}
+	backends.breaker = newCircuitBreaker(cfg.CircuitBreakerThreshold,
+		time.Duration(cfg.CircuitBreakerWindowSec)*time.Second,
+		time.Duration(cfg.CircuitBreakerCooldownSec)*time.Second)
+	acl, err := newIPACL(cfg.AllowCIDRs, cfg.DenyCIDRs)
+	if err != nil {
+		return nil, err
+	}
+	smuxConfig, err := newSmuxConfig(cfg)
 	if err != nil {
 		return nil, err
 	}
-	localUDPAddr, err := net.ResolveUDPAddr("udp", localAddr)
+	fakeIndex, err := newFakeIndex(cfg.FakeIndex)
 	if err != nil {
 		return nil, err
 	}
+	fakeIndex = newFakeIndexGuard(fakeIndex, cfg.FakeIndexMaxBodyBytes, cfg.FakeIndexRateLimit)
+	acme, err := newACMEManager(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if acme != nil {
+		// http-01的challenge请求不经过伪装页面的限流
+		fakeIndex = acme.HTTPHandler(fakeIndex)
+	}
+	var sche *schedule
+	if cfg.Schedule != nil {
+		if sche, err = newSchedule(cfg.Schedule); err != nil {
+			return nil, err
+		}
+	}
 	r := &Relay{
 		LocalTCPAddr: localTCPAddr,
 		LocalUDPAddr: localUDPAddr,
 
-		RemoteTCPAddr: remoteAddr,
-		RemoteUDPAddr: remoteAddr,
+		RemoteTCPAddr: cfg.Remote,
+		RemoteUDPAddr: cfg.Remote,
 
-		ListenType:    listenType,
-		TransportType: transportType,
+		ListenType:    cfg.ListenType,
+		TransportType: cfg.TransportType,
+
+		backends:   backends,
+		smuxConfig: smuxConfig,
+		acl:        acl,
 
 		udpCache: make(map[string](*udpBufferCh)),
+		conns:    newConnTracker(),
+		live:     newLiveConns(),
+
+		ready: make(chan struct{}),
+		stop:  make(chan struct{}),
+
+		clientCert: clientCert,
+		serverCert: serverCert,
+		rootCAs:    rootCAs,
+		clientCAs:  clientCAs,
+		connLimit:  newConnLimiter(cfg.MaxConns),
+		acme:       acme,
+		schedule:   sche,
+		fakeIndex:  fakeIndex,
+
+		cfg: cfg,
+	}
+	r.tr = newTransporter(r)
+	r.handleTCP = r.tcpHandler()
+	backends.load = r.conns.countOf
+	if cfg.DNSCacheTTLSec > 0 {
+		r.dns = newDNSCache(time.Duration(cfg.DNSCacheTTLSec) * time.Second)
 	}
 
 	return r, nil
 }
 
+// RelayError ListenAndServe里listener出错时返回 Listen是relay配置里的listen地址
+type RelayError struct {
+	Listen string
+	Err    error
+}
+
+func (e *RelayError) Error() string {
+	return fmt.Sprintf("relay %s: %s", e.Listen, e.Err)
+}
+
+func (e *RelayError) Unwrap() error {
+	return e.Err
+}
+
+// Serve 在后台运行ListenAndServe 出错时把*RelayError发到errc 被StopAccept停掉的relay不发送
+// 收到错误之后可以Shutdown清理已有的连接 再用同样的配置新建一个relay重启
+func (r *Relay) Serve(errc chan<- error) {
+	go func() {
+		if err := r.ListenAndServe(); err != nil {
+			errc <- err
+		}
+	}()
+}
+
+// listenServers 除了raw之外每种listen_type的server raw要同时listen tcp和udp 单独处理
+var listenServers = map[string]func(r *Relay) error{
+	Listen_WSS:    (*Relay).RunLocalWSSServer,
+	Listen_MWSS:   (*Relay).RunLocalMWSSServer,
+	Listen_GRPC:   (*Relay).RunLocalGRPCServer,
+	Listen_QUIC:   (*Relay).RunLocalQUICServer,
+	Listen_MTCP:   (*Relay).RunLocalMTCPServer,
+	Listen_SOCKS5: (*Relay).RunLocalSOCKS5Server,
+	Listen_HTTP:   (*Relay).RunLocalHTTPProxyServer,
+}
+
+// ListenAndServe StopAccept之后返回nil 任何一个listener出错时关掉其他的listener 返回*RelayError
 func (r *Relay) ListenAndServe() error {
-	errChan := make(chan error)
+	errChan := make(chan error, 2)
 	Logger.Infof("start relay AT: %s Over: %s TO: %s Through %s",
-		r.LocalTCPAddr, r.ListenType, r.RemoteTCPAddr, r.TransportType)
+		r.cfg.Listen, r.ListenType, r.RemoteTCPAddr, r.TransportType)
+
+	r.readyMu.Lock()
+	r.readyWant = 1
+	if r.ListenType == Listen_RAW && r.udpEnabled() {
+		r.readyWant = 2
+	}
+	r.readyMu.Unlock()
+
+	if r.schedule != nil {
+		go r.watchSchedule()
+	}
+	// reload失败时不会走到这里 在跑的relay还是用原来的限速
+	setRelayBandwidth(r.cfg)
+	setRelayQuota(r.cfg)
+	if r.cfg.QuotaKillActive {
+		go r.watchQuota()
+	}
+	if r.acme != nil && r.cfg.ACMEHTTPListen != "" {
+		go r.runACMEHTTPServer()
+	}
+	if r.cfg.HealthCheckIntervalSec > 0 {
+		for _, remote := range r.backends.addrs {
+			r.backends.setHealth(remote, true)
+			go r.watchBackendHealth(remote)
+		}
+	}
 
 	if r.ListenType == Listen_RAW {
 		go func() {
 			errChan <- r.RunLocalTCPServer()
 		}()
+		if r.udpEnabled() {
+			go func() {
+				errChan <- r.RunLocalUDPServer()
+			}()
+		}
+	} else if serve, ok := listenServers[r.ListenType]; ok {
 		go func() {
-			errChan <- r.RunLocalUDPServer()
-		}()
-	} else if r.ListenType == Listen_WSS {
-		go func() {
-			errChan <- r.RunLocalWSSServer()
-		}()
-	} else if r.ListenType == Listen_MWSS {
-		go func() {
-			errChan <- r.RunLocalMWSSServer()
+			errChan <- serve(r)
 		}()
 	} else {
 		Logger.Fatalf("unknown listen type: %s ", r.ListenType)
 	}
-	return <-errChan
+	err := <-errChan
+	if r.isStopped() {
+		return nil
+	}
+	// raw同时listen了tcp和udp 不能只剩一半还在服务
+	r.StopAccept()
+	return &RelayError{Listen: r.cfg.Listen, Err: err}
+}
+
+// Ready 在ListenAndServe启动的所有listener都bind成功后关闭
+func (r *Relay) Ready() <-chan struct{} {
+	return r.ready
+}
+
+func (r *Relay) listenerReady() {
+	r.readyMu.Lock()
+	defer r.readyMu.Unlock()
+	r.readyCnt++
+	if r.readyCnt == r.readyWant {
+		close(r.ready)
+	}
 }
 
 func (r *Relay) RunLocalTCPServer() error {
 	var err error
-	r.TCPListener, err = net.ListenTCP("tcp", r.LocalTCPAddr)
+	r.TCPListener, err = r.listenStream()
 	if err != nil {
 		return err
 	}
 	defer r.TCPListener.Close()
+	r.trackListener(r.TCPListener)
+	r.listenerReady()
 	for {
-		c, err := r.TCPListener.AcceptTCP()
+		c, err := r.TCPListener.Accept()
 		if err != nil {
-			Logger.Infof("accept tcp con error: %s", err)
+			if !r.isStopped() {
+				Logger.Warnf("accept tcp con error: %s", err)
+			}
 			return err
 		}
-		switch r.TransportType {
-		case Transport_WSS:
-			go func(c *net.TCPConn) {
-				// need close conn in handleTcpOverWs
-				if err := r.handleTcpOverWs(c); err != nil && err != io.EOF {
-					Logger.Infof("handleTcpOverWs err %s", err)
-				}
-			}(c)
-		case Transport_RAW:
-			go func(c *net.TCPConn) {
-				defer c.Close()
-				if err := r.handleTCPConn(c); err != nil {
-					Logger.Infof("handleTCPConn err %s", err)
-				}
-			}(c)
-		case Transport_MWSS:
-			go func(c *net.TCPConn) {
-				if err := r.handleTcpOverMWSS(c); err != nil && err != io.EOF {
-					Logger.Infof("handleTcpOverMWSS err %s", err)
-				}
-			}(c)
+		if !r.scheduleOpen() || !r.allowAddr(c.RemoteAddr()) {
+			c.Close()
+			continue
+		}
+		release, ok := r.acquireConn()
+		if !ok {
+			c.Close()
+			continue
 		}
+		if r.handleTCP == nil {
+			release()
+			c.Close()
+			continue
+		}
+		r.tuneTCPConn(c)
+		go func(c net.Conn) {
+			defer release()
+			if err := r.handleTCP(c); err != nil && err != io.EOF {
+				Logger.Warnf("handle tcp conn over %s err %s", r.TransportType, err)
+			}
+		}(c)
 	}
 }
 
 func (r *Relay) RunLocalUDPServer() error {
 	var err error
-	r.UDPConn, err = net.ListenUDP("udp", r.LocalUDPAddr)
+	r.UDPConn, err = net.ListenUDP(r.udpNetwork(), r.LocalUDPAddr)
 	if err != nil {
 		return err
 	}
 	defer r.UDPConn.Close()
+	r.trackListener(r.UDPConn)
+	r.listenerReady()
 
 	for {
 		buf := inboundBufferPool.Get().([]byte)
@@ -146,35 +633,71 @@ func (r *Relay) RunLocalUDPServer() error {
 		if err != nil {
 			return err
 		}
-		ubc, err := r.getOrCreateUbc(addr)
-		if err != nil {
-			return err
+		// buf马上放回pool 队列里放一份拷贝
+		ubc := r.pushUDP(addr, append([]byte(nil), buf[:n]...))
+		inboundBufferPool.Put(buf)
+		if ubc == nil {
+			continue
 		}
-		ubc.Ch <- buf[0:n]
-		if !ubc.Handled {
-			ubc.Handled = true
-			Logger.Infof("handle udp con from %s over: %s", addr, r.TransportType)
-			switch r.TransportType {
-			case Transport_WSS:
-				go r.handleUdpOverWs(addr.String(), ubc)
-			case Transport_RAW:
-				go r.handleOneUDPConn(addr.String(), ubc)
-			}
+		r.logAccess(newConnSpan(""), "handle udp conn", "from", addr, "transport", r.TransportType)
+		switch r.TransportType {
+		case Transport_WSS:
+			go r.handleUdpOverWs(addr.String(), ubc)
+		case Transport_RAW:
+			go r.handleOneUDPConn(addr.String(), ubc)
+		case Transport_MWSS:
+			go r.handleUdpOverMWSS(addr.String(), ubc)
+		default:
+			r.removeUbc(addr.String(), ubc)
 		}
-		inboundBufferPool.Put(buf)
 	}
 }
 
+// pushUDP 把datagram放进addr对应flow的队列 返回新建的flow 需要调用方启动handler
+// 新的flow和tcp连接一样受开放时间 acl和流量限额的限制
+// 队列满了直接丢掉 不能让一个处理不过来的flow挡住其他flow
+func (r *Relay) pushUDP(addr *net.UDPAddr, b []byte) *udpBufferCh {
+	r.udpMu.Lock()
+	defer r.udpMu.Unlock()
+	ubc, found := r.udpCache[addr.String()]
+	if !found {
+		if !r.scheduleOpen() || !r.allowAddr(addr) || r.quotaExceeded() {
+			return nil
+		}
+		ubc = newudpBufferCh()
+		r.udpCache[addr.String()] = ubc
+	}
+	select {
+	case ubc.Ch <- b:
+	default:
+	}
+	if found {
+		return nil
+	}
+	return ubc
+}
+
+// removeUbc flow的handler退出时调用 先从udpCache里删掉再关闭Ch
+// 之后同一个地址的datagram会新建flow 不会发到已经关闭的Ch上
+func (r *Relay) removeUbc(addr string, ubc *udpBufferCh) {
+	r.udpMu.Lock()
+	defer r.udpMu.Unlock()
+	if r.udpCache[addr] == ubc {
+		delete(r.udpCache, addr)
+	}
+	close(ubc.Ch)
+}
+
 func (r *Relay) keepAliveAndSetNextTimeout(conn interface{}) error {
 	switch c := conn.(type) {
 	case *net.TCPConn:
 		if err := c.SetDeadline(time.Now().Add(TcpDeadline)); err != nil {
-			Logger.Info("keep alive error", err.Error())
+			Logger.Warn("keep alive error", err.Error())
 			return err
 		}
 	case *net.UDPConn:
 		if err := c.SetDeadline(time.Now().Add(UdpDeadline)); err != nil {
-			Logger.Info("keep alive error", err.Error())
+			Logger.Warn("keep alive error", err.Error())
 			return err
 		}
 	default:
@@ -182,14 +705,3 @@ func (r *Relay) keepAliveAndSetNextTimeout(conn interface{}) error {
 	}
 	return nil
 }
-
-// NOTE not thread safe
-func (r *Relay) getOrCreateUbc(addr *net.UDPAddr) (*udpBufferCh, error) {
-	ubc, found := r.udpCache[addr.String()]
-	if !found {
-		ubc := newudpBufferCh()
-		r.udpCache[addr.String()] = ubc
-		return ubc, nil
-	}
-	return ubc, nil
-}
@@ -0,0 +1,158 @@
+package relay
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	ResetPolicy_Close = "close"
+	ResetPolicy_Retry = "retry"
+
+	// 最多重试的次数
+	MaxResetRetries = 2
+)
+
+var errResetRetryClosed = errors.New("reset retry backend closed")
+
+// isConnReset 后端发送了RST 而不是正常的FIN
+func isConnReset(err error) bool {
+	return isErrno(err, connResetErrnos)
+}
+
+// resetRetryBackend 后端在返回任何数据前RST的话 重新dial并重放客户端已经发送的数据
+// 只适合幂等的协议 后端一旦开始响应就和普通的后端连接一样
+// 交给transport当作backend用 计数 限速 半关闭和空闲检测都和普通连接一样
+type resetRetryBackend struct {
+	dial      func() (net.Conn, error)
+	maxReplay int
+
+	mu sync.Mutex
+	// 当前的后端连接 重连之后换成新的
+	conn net.Conn
+	// 后端第一次响应前客户端发送的数据
+	replay    []byte
+	responded bool
+	// 重放的数据超过上限后就不再重试
+	giveUp      bool
+	retries     int
+	closedWrite bool
+	closed      bool
+}
+
+func newResetRetryBackend(rc net.Conn, dial func() (net.Conn, error), maxReplay int) *resetRetryBackend {
+	return &resetRetryBackend{conn: rc, dial: dial, maxReplay: maxReplay}
+}
+
+// backendConn on_backend_reset为retry时包装成RST后会重连的后端 需要调用方Close
+func (r *Relay) backendConn(rc net.Conn, remote string, proxyHeader []byte) io.ReadWriteCloser {
+	if r.cfg.OnBackendReset != ResetPolicy_Retry {
+		return rc
+	}
+	return newResetRetryBackend(rc, r.dialBackendFunc(remote, proxyHeader), r.cfg.MaxReplayBytes)
+}
+
+// retryableLocked 需要持有mu
+func (b *resetRetryBackend) retryableLocked() bool {
+	return !b.responded && !b.giveUp && !b.closed
+}
+
+// Write 还可以重试时写失败不返回错误 读的那一端会收到RST 重连之后这些数据会被重放
+func (b *resetRetryBackend) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	if b.retryableLocked() {
+		if len(b.replay)+len(p) > b.maxReplay {
+			b.giveUp = true
+			b.replay = nil
+		} else {
+			b.replay = append(b.replay, p...)
+		}
+	}
+	retryable := b.retryableLocked()
+	conn := b.conn
+	b.mu.Unlock()
+	n, err := conn.Write(p)
+	if err != nil && retryable {
+		return len(p), nil
+	}
+	return n, err
+}
+
+func (b *resetRetryBackend) Read(p []byte) (int, error) {
+	for {
+		b.mu.Lock()
+		conn := b.conn
+		b.mu.Unlock()
+		n, err := conn.Read(p)
+		if n > 0 {
+			b.mu.Lock()
+			b.responded = true
+			b.replay = nil
+			b.mu.Unlock()
+			return n, err
+		}
+		if err == nil {
+			continue
+		}
+		b.mu.Lock()
+		retryable := isConnReset(err) && b.retryableLocked() && b.retries < MaxResetRetries
+		if retryable {
+			b.retries++
+		}
+		b.mu.Unlock()
+		if !retryable {
+			return 0, err
+		}
+		Logger.Warnf("backend %s reset before response, retry %d", conn.RemoteAddr(), b.retries)
+		if err := b.redial(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// redial 建立新的后端连接 重放数据之后替换掉旧的
+func (b *resetRetryBackend) redial() error {
+	nc, err := b.dial()
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		nc.Close()
+		return errResetRetryClosed
+	}
+	if _, err := nc.Write(b.replay); err != nil {
+		nc.Close()
+		return err
+	}
+	if b.closedWrite {
+		closeWrite(nc)
+	}
+	b.conn.Close()
+	b.conn = nc
+	return nil
+}
+
+// CloseWrite 客户端发完之后关闭后端的写 重连之后的连接也要关
+func (b *resetRetryBackend) CloseWrite() error {
+	b.mu.Lock()
+	b.closedWrite = true
+	conn := b.conn
+	b.mu.Unlock()
+	cw, ok := conn.(closeWriter)
+	if !ok {
+		return errHalfCloseUnsupported
+	}
+	return cw.CloseWrite()
+}
+
+// Close 关闭当前的后端连接 之后不会再重连
+func (b *resetRetryBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	return b.conn.Close()
+}
@@ -0,0 +1,121 @@
+package relay
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startResetOnceBackend 第一个连接读到数据之后发送RST 之后的连接原样写回
+func startResetOnceBackend(t *testing.T) net.Listener {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var accepted int32
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			if atomic.AddInt32(&accepted, 1) == 1 {
+				go func() {
+					c.Read(make([]byte, 1))
+					c.(*net.TCPConn).SetLinger(0)
+					c.Close()
+				}()
+				continue
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return ln
+}
+
+func TestResetRetryCountsTraffic(t *testing.T) {
+	backend := startResetOnceBackend(t)
+	defer backend.Close()
+
+	listen := "127.0.0.1:1273"
+	r, err := NewRelayWithConfig(&RelayConfig{
+		Listen:         listen,
+		ListenType:     Listen_RAW,
+		Remote:         backend.Addr().String(),
+		TransportType:  Transport_RAW,
+		OnBackendReset: ResetPolicy_Retry,
+		QuotaBytes:     8,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.ListenAndServe()
+	defer r.StopAccept()
+	select {
+	case <-r.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay not ready")
+	}
+
+	c, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expect ping replayed after reset, got %q %v", buf, err)
+	}
+	c.Close()
+
+	// 重放的数据不重复计数
+	s := statsFor(listen)
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&s.activeConns) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if in, out := atomic.LoadInt64(&s.bytesIn), atomic.LoadInt64(&s.bytesOut); in != 4 || out != 4 {
+		t.Fatalf("expect 4 bytes each way, got in=%d out=%d", in, out)
+	}
+	if got := trafficOf(listen); got.Upload != 4 || got.Download != 4 {
+		t.Fatalf("unexpected traffic %+v", got)
+	}
+	if !r.quotaExceeded() {
+		t.Fatal("expect quota exceeded by traffic on the retry path")
+	}
+}
+
+func TestResetRetryGiveUpOverMaxReplay(t *testing.T) {
+	backend := startResetOnceBackend(t)
+	defer backend.Close()
+	rc, err := net.Dial("tcp", backend.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	redialed := false
+	dial := func() (net.Conn, error) {
+		redialed = true
+		return net.Dial("tcp", backend.Addr().String())
+	}
+	b := newResetRetryBackend(rc, dial, 2)
+	defer b.Close()
+	rc.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := b.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Read(make([]byte, 4)); !isConnReset(err) {
+		t.Fatalf("expect reset returned after replay over max_replay_bytes, got %v", err)
+	}
+	if redialed {
+		t.Fatal("should not redial after giving up")
+	}
+}
@@ -0,0 +1,169 @@
+package relay
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var ScheduleCheckInterval = 10 * time.Second
+
+var relayScheduleOpen = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "ehco",
+	Subsystem: "relay",
+	Name:      "schedule_open",
+	Help:      "whether the relay is inside one of its configured time windows",
+}, []string{"relay"})
+
+func init() {
+	prometheus.MustRegister(relayScheduleOpen)
+}
+
+type ScheduleConfig struct {
+	// 例如 Asia/Shanghai 为空时使用UTC
+	Timezone string           `json:"timezone"`
+	Windows  []ScheduleWindow `json:"windows"`
+	// 时间窗口结束时是否断开已有的连接
+	CloseConnsAtEnd bool `json:"close_conns_at_end"`
+}
+
+type ScheduleWindow struct {
+	// mon tue wed thu fri sat sun 为空表示每天
+	Days []string `json:"days"`
+	// 15:04 格式 end小于start表示跨过零点
+	Start string `json:"start"`
+	End   string `json:"end"`
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+type scheduleWindow struct {
+	days       [7]bool
+	start, end int // 当天的第几分钟
+}
+
+type schedule struct {
+	loc     *time.Location
+	windows []scheduleWindow
+}
+
+func parseClock(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q: %s", s, err)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func newSchedule(cfg *ScheduleConfig) (*schedule, error) {
+	loc := time.UTC
+	if cfg.Timezone != "" {
+		var err error
+		if loc, err = time.LoadLocation(cfg.Timezone); err != nil {
+			return nil, err
+		}
+	}
+	if len(cfg.Windows) == 0 {
+		return nil, fmt.Errorf("schedule must have at least one window")
+	}
+
+	s := &schedule{loc: loc}
+	for _, w := range cfg.Windows {
+		var sw scheduleWindow
+		var err error
+		if sw.start, err = parseClock(w.Start); err != nil {
+			return nil, err
+		}
+		if sw.end, err = parseClock(w.End); err != nil {
+			return nil, err
+		}
+		if sw.start == sw.end {
+			return nil, fmt.Errorf("schedule window %s-%s is empty", w.Start, w.End)
+		}
+		if len(w.Days) == 0 {
+			for i := range sw.days {
+				sw.days[i] = true
+			}
+		}
+		for _, d := range w.Days {
+			wd, ok := weekdays[strings.ToLower(d)]
+			if !ok {
+				return nil, fmt.Errorf("invalid schedule day: %s", d)
+			}
+			sw.days[wd] = true
+		}
+		s.windows = append(s.windows, sw)
+	}
+	return s, nil
+}
+
+func (s *schedule) isOpen(t time.Time) bool {
+	t = t.In(s.loc)
+	now := t.Hour()*60 + t.Minute()
+	today := t.Weekday()
+	yesterday := (today + 6) % 7
+	for _, w := range s.windows {
+		if w.start < w.end {
+			if w.days[today] && now >= w.start && now < w.end {
+				return true
+			}
+			continue
+		}
+		// 跨零点的窗口 属于开始的那一天
+		if w.days[today] && now >= w.start {
+			return true
+		}
+		if w.days[yesterday] && now < w.end {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduleOpen 没有配置schedule时总是开放的
+func (r *Relay) scheduleOpen() bool {
+	if r.schedule == nil {
+		return true
+	}
+	return r.schedule.isOpen(time.Now())
+}
+
+// watchSchedule 更新开放状态 窗口结束时按配置断开已有的连接
+func (r *Relay) watchSchedule() {
+	gauge := relayScheduleOpen.WithLabelValues(r.cfg.Listen)
+	open := r.scheduleOpen()
+	ticker := time.NewTicker(ScheduleCheckInterval)
+	defer ticker.Stop()
+	for {
+		if open {
+			gauge.Set(1)
+		} else {
+			gauge.Set(0)
+		}
+		select {
+		case <-r.stop:
+			return
+		case <-ticker.C:
+		}
+		now := r.scheduleOpen()
+		if open && !now {
+			Logger.Infof("relay %s schedule window closed", r.cfg.Listen)
+			if r.cfg.Schedule.CloseConnsAtEnd {
+				r.conns.closeEverything()
+			}
+		} else if !open && now {
+			Logger.Infof("relay %s schedule window opened", r.cfg.Listen)
+		}
+		open = now
+	}
+}
@@ -0,0 +1,122 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestScheduleIsOpen(t *testing.T) {
+	s, err := newSchedule(&ScheduleConfig{
+		Timezone: "Asia/Shanghai",
+		Windows: []ScheduleWindow{
+			{Days: []string{"Mon"}, Start: "09:00", End: "18:00"},
+			// 周五晚上到周六早上
+			{Days: []string{"fri"}, Start: "22:00", End: "02:00"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	// 2024-01-01 是周一
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2024, 1, day, hour, min, 0, 0, loc)
+	}
+	cases := []struct {
+		t    time.Time
+		open bool
+	}{
+		{at(1, 8, 59), false},
+		{at(1, 9, 0), true},
+		{at(1, 17, 59), true},
+		{at(1, 18, 0), false},
+		{at(2, 12, 0), false},
+		{at(5, 21, 59), false},
+		{at(5, 23, 0), true},
+		{at(6, 1, 59), true},
+		{at(6, 2, 0), false},
+		// 周日凌晨不属于周六开始的窗口
+		{at(7, 1, 0), false},
+		// 按配置的时区判断 这是上海周一的10点
+		{at(1, 10, 0).UTC(), true},
+	}
+	for _, c := range cases {
+		if got := s.isOpen(c.t); got != c.open {
+			t.Errorf("isOpen(%s) = %v, expect %v", c.t.In(loc).Format("Mon 15:04"), got, c.open)
+		}
+	}
+}
+
+func TestStatusScheduleOpen(t *testing.T) {
+	r, err := NewRelay("127.0.0.1:0", Listen_RAW, "127.0.0.1:1", Transport_RAW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 没有配置schedule时总是开放的
+	if !r.Status().ScheduleOpen {
+		t.Fatal("expect schedule open without schedule")
+	}
+}
+
+func TestScheduleInvalid(t *testing.T) {
+	for _, cfg := range []*ScheduleConfig{
+		{},
+		{Windows: []ScheduleWindow{{Start: "9:00", End: "25:00"}}},
+		{Windows: []ScheduleWindow{{Start: "09:00", End: "09:00"}}},
+		{Windows: []ScheduleWindow{{Days: []string{"someday"}, Start: "09:00", End: "10:00"}}},
+		{Timezone: "Nowhere/City", Windows: []ScheduleWindow{{Start: "09:00", End: "10:00"}}},
+	} {
+		if _, err := newSchedule(cfg); err == nil {
+			t.Errorf("expect invalid schedule %+v rejected", cfg)
+		}
+	}
+}
+
+func TestScheduleClosedRefuses(t *testing.T) {
+	backend := startEchoBackend(t)
+	defer backend.Close()
+
+	// 只在三天之后开放的窗口 现在一定是关闭的
+	day := time.Now().UTC().AddDate(0, 0, 3).Weekday().String()[:3]
+	listen := "127.0.0.1:1291"
+	r, err := NewRelayWithConfig(&RelayConfig{
+		Listen:        listen,
+		ListenType:    Listen_RAW,
+		Remote:        backend.Addr().String(),
+		TransportType: Transport_RAW,
+		Schedule: &ScheduleConfig{
+			Windows: []ScheduleWindow{{Days: []string{day}, Start: "10:00", End: "11:00"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.ListenAndServe()
+	defer r.Shutdown(context.Background())
+	select {
+	case <-r.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay not ready")
+	}
+
+	c, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(2 * time.Second))
+	c.Write([]byte("ping"))
+	if n, err := c.Read(make([]byte, 4)); err == nil {
+		t.Fatalf("expect conn refused outside schedule window, read %d bytes", n)
+	}
+	if got := testutil.ToFloat64(relayScheduleOpen.WithLabelValues(listen)); got != 0 {
+		t.Fatalf("expect schedule_open 0, got %v", got)
+	}
+	if r.Status().ScheduleOpen {
+		t.Fatal("expect stats to report the schedule closed")
+	}
+}
@@ -0,0 +1,74 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// 等待连接转发完的时候多久检查一次
+var DrainCheckInterval = 100 * time.Millisecond
+
+// trackListener 记录relay打开的listener 在StopAccept时关闭 已经stop的relay上直接关闭
+func (r *Relay) trackListener(l io.Closer) {
+	r.stopMu.Lock()
+	defer r.stopMu.Unlock()
+	if r.stopped {
+		l.Close()
+		return
+	}
+	r.listeners = append(r.listeners, l)
+}
+
+func (r *Relay) isStopped() bool {
+	r.stopMu.Lock()
+	defer r.stopMu.Unlock()
+	return r.stopped
+}
+
+// StopAccept 关闭relay的所有listener 不再接受新的连接 已经在转发的连接不受影响
+// 返回之后listen地址就可以给新的relay使用了
+func (r *Relay) StopAccept() {
+	r.stopMu.Lock()
+	if r.stopped {
+		r.stopMu.Unlock()
+		return
+	}
+	r.stopped = true
+	close(r.stop)
+	listeners := r.listeners
+	r.listeners = nil
+	r.stopMu.Unlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+	Logger.Infof("relay %s stop accepting new conns", r.cfg.Listen)
+}
+
+// Drain 等待已有的连接都转发完 ctx结束时剩下的连接会被直接关闭
+// 需要先调用StopAccept
+func (r *Relay) Drain(ctx context.Context) error {
+	if r.tr != nil {
+		defer r.tr.Close()
+	}
+	ticker := time.NewTicker(DrainCheckInterval)
+	defer ticker.Stop()
+	for r.conns.count() > 0 {
+		select {
+		case <-ctx.Done():
+			n := r.conns.closeEverything()
+			Logger.Warnf("relay %s drain timeout, closed %d conns", r.cfg.Listen, n)
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	Logger.Infof("relay %s drained", r.cfg.Listen)
+	return nil
+}
+
+// Shutdown StopAccept之后等待已有的连接转发完
+func (r *Relay) Shutdown(ctx context.Context) error {
+	r.StopAccept()
+	return r.Drain(ctx)
+}
@@ -0,0 +1,310 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startEchoBackend 把收到的数据原样写回去的tcp后端
+func startEchoBackend(t *testing.T) net.Listener {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return backend
+}
+
+func TestRelayShutdownDrain(t *testing.T) {
+	backend := startEchoBackend(t)
+	defer backend.Close()
+
+	listen := "127.0.0.1:1250"
+	r, err := NewRelay(listen, Listen_RAW, backend.Addr().String(), Transport_RAW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- r.ListenAndServe() }()
+	select {
+	case <-r.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay not ready")
+	}
+
+	c, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	echo := func() {
+		buf := make([]byte, 4)
+		if _, err := c.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("echo failed: %q %v", buf, err)
+		}
+	}
+	echo()
+
+	r.StopAccept()
+	if err := <-served; err != nil {
+		t.Fatalf("ListenAndServe should return nil after StopAccept: %s", err)
+	}
+	if nc, err := net.Dial("tcp", listen); err == nil {
+		nc.Close()
+		t.Fatal("relay still accepting after StopAccept")
+	}
+	// 已经在转发的连接不受影响
+	echo()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := r.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected drain timeout, got %v", err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, 1)); err == nil {
+		t.Fatal("conn should be closed after drain timeout")
+	}
+}
+
+func TestRelayServeError(t *testing.T) {
+	listen := "127.0.0.1:1258"
+	// udp端口被占用 tcp可以listen成功
+	uc, err := net.ListenPacket("udp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+
+	r, err := NewRelay(listen, Listen_RAW, "127.0.0.1:1241", Transport_RAW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errc := make(chan error, 1)
+	r.Serve(errc)
+	select {
+	case err := <-errc:
+		var re *RelayError
+		if !errors.As(err, &re) || re.Listen != listen {
+			t.Fatalf("expect RelayError for %s, got %v", listen, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("serve error not reported")
+	}
+	// 出错之后tcp的listener也要关掉 同样的配置可以马上重启
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		t.Fatalf("tcp listener left open after serve error: %s", err)
+	}
+	ln.Close()
+}
+
+func TestMWSSShutdownSessions(t *testing.T) {
+	backend := startEchoBackend(t)
+	defer backend.Close()
+
+	server, err := NewRelayWithConfig(&RelayConfig{
+		Listen:          "127.0.0.1:1280",
+		ListenType:      Listen_MWSS,
+		Remote:          backend.Addr().String(),
+		TransportType:   Transport_RAW,
+		MWSSPlainListen: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ListenAndServe()
+	client, err := NewRelayWithConfig(&RelayConfig{
+		Listen:             "127.0.0.1:1281",
+		ListenType:         Listen_RAW,
+		Remote:             "wss://127.0.0.1:1280",
+		TransportType:      Transport_MWSS,
+		MWSSPlainTransport: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.ListenAndServe()
+	defer client.Shutdown(context.Background())
+	for _, r := range []*Relay{server, client} {
+		select {
+		case <-r.Ready():
+		case <-time.After(5 * time.Second):
+			t.Fatal("relay not ready")
+		}
+	}
+	echo := func(c net.Conn) error {
+		c.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := c.Write([]byte("ping")); err != nil {
+			return err
+		}
+		buf := make([]byte, 4)
+		_, err := io.ReadFull(c, buf)
+		return err
+	}
+
+	c, err := net.Dial("tcp", "127.0.0.1:1281")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := echo(c); err != nil {
+		t.Fatal(err)
+	}
+
+	server.StopAccept()
+	// 已经在转发的stream不受影响
+	if err := echo(c); err != nil {
+		t.Fatalf("active stream broken after StopAccept: %s", err)
+	}
+	// 已有session上的新stream被拒绝 而不是放进没人处理的队列
+	nc, err := net.Dial("tcp", "127.0.0.1:1281")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	if err := echo(nc); err == nil {
+		t.Fatal("new stream accepted after StopAccept")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("new stream black-holed after StopAccept")
+	}
+
+	// stream都结束之后session被关掉
+	c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := server.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+	tr := client.tr.(*mwssTransporter)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tr.sessionMutex.Lock()
+		open := 0
+		for _, s := range tr.sessions[client.transportAddr("wss://127.0.0.1:1280")] {
+			if !s.session.IsClosed() {
+				open++
+			}
+		}
+		tr.sessionMutex.Unlock()
+		if open == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d sessions still open after server stopped", open)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// startNamedBackend 每个连接先写name再关闭 用来区分连到了哪个后端
+func startNamedBackend(t *testing.T, name string) net.Listener {
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte(name))
+			c.Close()
+		}
+	}()
+	return backend
+}
+
+func TestMWSSReloadHandover(t *testing.T) {
+	oldBackend := startNamedBackend(t, "old")
+	defer oldBackend.Close()
+	newBackend := startNamedBackend(t, "new")
+	defer newBackend.Close()
+
+	serverCfg := func(remote string) *RelayConfig {
+		return &RelayConfig{
+			Listen:          "127.0.0.1:1282",
+			ListenType:      Listen_MWSS,
+			Remote:          remote,
+			TransportType:   Transport_RAW,
+			MWSSPlainListen: true,
+		}
+	}
+	start := func(cfg *RelayConfig) *Relay {
+		r, err := NewRelayWithConfig(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go r.ListenAndServe()
+		select {
+		case <-r.Ready():
+		case <-time.After(5 * time.Second):
+			t.Fatal("relay not ready")
+		}
+		return r
+	}
+	oldServer := start(serverCfg(oldBackend.Addr().String()))
+	client := start(&RelayConfig{
+		Listen:             "127.0.0.1:1283",
+		ListenType:         Listen_RAW,
+		Remote:             "wss://127.0.0.1:1282",
+		TransportType:      Transport_MWSS,
+		MWSSPlainTransport: true,
+	})
+	defer client.Shutdown(context.Background())
+	backendOf := func() string {
+		c, err := net.Dial("tcp", "127.0.0.1:1283")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		c.SetDeadline(time.Now().Add(time.Second))
+		buf, _ := io.ReadAll(c)
+		return string(buf)
+	}
+	if got := backendOf(); got != "old" {
+		t.Fatalf("expect old backend, got %q", got)
+	}
+
+	// 和reload一样 先让出listen地址再启动新的relay
+	oldServer.StopAccept()
+	newServer := start(serverCfg(newBackend.Addr().String()))
+	defer newServer.Shutdown(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := oldServer.Drain(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// 旧relay关掉空闲的session之后 client新建的session连到新的relay
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := backendOf()
+		if got == "new" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("client still not handed to new relay, got %q", got)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,80 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+var (
+	SNIPeekDeadline = 5 * time.Second
+
+	errSNIPeeked = errors.New("sni peeked")
+)
+
+// peekedConn 先返回peek时读出的原始字节 再继续读底层连接
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *peekedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errHalfCloseUnsupported
+}
+
+// recordConn 只读的连接 记录tls握手时读到的所有字节
+type recordConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *recordConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	// 不能往客户端写任何东西 否则会破坏后端的握手
+	return 0, io.ErrClosedPipe
+}
+
+// peekSNI 读取ClientHello拿到SNI 返回的conn会把读过的字节原样重放给下游
+func peekSNI(c net.Conn) (string, net.Conn, error) {
+	var buf bytes.Buffer
+	var serverName string
+
+	if err := c.SetReadDeadline(time.Now().Add(SNIPeekDeadline)); err != nil {
+		return "", nil, err
+	}
+	rc := &recordConn{Conn: c, r: io.TeeReader(c, &buf)}
+	err := tls.Server(rc, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			serverName = hello.ServerName
+			return nil, errSNIPeeked
+		},
+	}).Handshake()
+	if err := c.SetReadDeadline(time.Time{}); err != nil {
+		return "", nil, err
+	}
+
+	pc := &peekedConn{Conn: c, r: io.MultiReader(&buf, c)}
+	if serverName == "" && err != errSNIPeeked {
+		// 不是tls或者没有带SNI 读过的字节依然要原样转发
+		return "", pc, err
+	}
+	return serverName, pc, nil
+}
+
+// getRemoteBySNI 根据sni_routes选择后端 没匹配到的话返回空 由调用方使用默认的后端
+func (r *Relay) getRemoteBySNI(serverName string) string {
+	return r.cfg.SNIRoutes[serverName]
+}
@@ -0,0 +1,72 @@
+package relay
+
+import (
+	"context"
+	"crypto/tls"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTLSNamedBackend 完成tls握手之后写name再关闭
+func startTLSNamedBackend(t *testing.T, name string) net.Listener {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", DefaultTLSConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			c.Write([]byte(name))
+			c.Close()
+		}
+	}()
+	return ln
+}
+
+func TestSNIRoutePassthrough(t *testing.T) {
+	if DefaultTLSConfig == nil {
+		InitTlsCfg()
+	}
+	a := startTLSNamedBackend(t, "a")
+	defer a.Close()
+	b := startTLSNamedBackend(t, "b")
+	defer b.Close()
+
+	listen := "127.0.0.1:1288"
+	r, err := NewRelayWithConfig(&RelayConfig{
+		Listen:        listen,
+		ListenType:    Listen_RAW,
+		Remote:        b.Addr().String(),
+		TransportType: Transport_RAW,
+		SNIRoutes:     map[string]string{"a.test": a.Addr().String()},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.ListenAndServe()
+	defer r.Shutdown(context.Background())
+	select {
+	case <-r.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay not ready")
+	}
+
+	// 握手在客户端和后端之间完成 说明ClientHello被原样重放了
+	for serverName, want := range map[string]string{"a.test": "a", "other.test": "b"} {
+		c, err := tls.Dial("tcp", listen, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatalf("%s: %s", serverName, err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		got, _ := ioutil.ReadAll(c)
+		c.Close()
+		if string(got) != want {
+			t.Fatalf("%s: expect backend %q, got %q", serverName, want, got)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package relay
+
+import (
+	"net"
+	"time"
+)
+
+// tuneTCPConn 设置TCP_NODELAY和keepalive 不是*net.TCPConn时什么都不做
+func (r *Relay) tuneTCPConn(c net.Conn) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if err := tc.SetNoDelay(!r.cfg.DisableTCPNoDelay); err != nil {
+		Logger.Warnf("set nodelay on %s error: %s", tc.RemoteAddr(), err)
+	}
+	if r.cfg.TCPKeepAliveSec < 0 {
+		tc.SetKeepAlive(false)
+		return
+	}
+	if err := tc.SetKeepAlive(true); err != nil {
+		Logger.Warnf("set keepalive on %s error: %s", tc.RemoteAddr(), err)
+		return
+	}
+	tc.SetKeepAlivePeriod(time.Duration(r.cfg.TCPKeepAliveSec) * time.Second)
+}
+
+// dialRemote dial配置里的后端 可以是unix socket client指定的目标只能用dialTCP
+func (r *Relay) dialRemote(addr string) (net.Conn, error) {
+	if path, ok := unixSocketPath(addr); ok {
+		return net.DialTimeout("unix", path, r.dialTimeout())
+	}
+	return r.dialTCP(addr)
+}
+
+// dialTCP dial后端的tcp连接 并按relay的配置调整socket参数
+func (r *Relay) dialTCP(addr string) (net.Conn, error) {
+	var c net.Conn
+	var err error
+	if r.dns != nil {
+		c, err = r.dns.dial(addr, r.dialTimeout())
+	} else {
+		c, err = net.DialTimeout("tcp", addr, r.dialTimeout())
+	}
+	if err != nil {
+		return nil, err
+	}
+	r.tuneTCPConn(c)
+	return c, nil
+}
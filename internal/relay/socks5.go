@@ -0,0 +1,383 @@
+package relay
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	socks5Version = 0x05
+
+	socks5MethodNoAuth       = 0x00
+	socks5MethodUserPass     = 0x02
+	socks5MethodNoAcceptable = 0xff
+
+	// rfc1929 用户名密码认证子协商的版本和结果
+	socks5UserPassVersion = 0x01
+	socks5UserPassOK      = 0x00
+	socks5UserPassFailed  = 0x01
+
+	socks5CmdConnect = 0x01
+
+	socks5AtypIPv4   = 0x01
+	socks5AtypDomain = 0x03
+	socks5AtypIPv6   = 0x04
+
+	socks5RepSucceeded        = 0x00
+	socks5RepHostUnreachable  = 0x04
+	socks5RepCmdNotSupported  = 0x07
+	socks5RepAtypNotSupported = 0x08
+
+	// server回复给client的dial结果
+	connectTargetStatusOK        = 0x00
+	connectTargetStatusDialError = 0x01
+)
+
+var (
+	SOCKS5HandshakeDeadline = 10 * time.Second
+
+	ErrSOCKS5BadVersion     = errors.New("socks5 bad version")
+	ErrSOCKS5NoAuthMethod   = errors.New("socks5 no acceptable auth method")
+	ErrSOCKS5AuthFailed     = errors.New("socks5 username or password mismatch")
+	ErrSOCKS5CmdUnsupported = errors.New("socks5 command not supported")
+	ErrConnectTargetRefused = errors.New("remote failed to connect target")
+)
+
+// mwssConnectPath 由client指定目标地址的session使用的路径
+func (r *Relay) mwssConnectPath() string {
+	return r.cfg.WSPath + "connect/"
+}
+
+func (r *Relay) RunLocalSOCKS5Server() error {
+	return r.runLocalProxyServer(r.handleSOCKS5OverMWSS)
+}
+
+// runLocalProxyServer socks5和http connect的listener 每个连接由handle完成握手之后经过mwss转发
+func (r *Relay) runLocalProxyServer(handle func(c net.Conn) error) error {
+	var err error
+	r.TCPListener, err = r.listenStream()
+	if err != nil {
+		return err
+	}
+	defer r.TCPListener.Close()
+	r.trackListener(r.TCPListener)
+	r.listenerReady()
+	for {
+		c, err := r.TCPListener.Accept()
+		if err != nil {
+			if !r.isStopped() {
+				Logger.Warnf("accept tcp con error: %s", err)
+			}
+			return err
+		}
+		if !r.scheduleOpen() || !r.allowAddr(c.RemoteAddr()) {
+			c.Close()
+			continue
+		}
+		release, ok := r.acquireConn()
+		if !ok {
+			c.Close()
+			continue
+		}
+		r.tuneTCPConn(c)
+		go func(c net.Conn) {
+			defer release()
+			if err := handle(c); err != nil && err != io.EOF {
+				Logger.Warnf("handle %s proxy conn err %s", r.ListenType, err)
+			}
+		}(c)
+	}
+}
+
+// handleSOCKS5OverMWSS 只支持CONNECT 目标地址放在stream最开始发给server
+func (r *Relay) handleSOCKS5OverMWSS(c net.Conn) error {
+	defer c.Close()
+
+	c.SetDeadline(time.Now().Add(SOCKS5HandshakeDeadline))
+	target, err := socks5Handshake(c, r.cfg.SOCKS5Username, r.cfg.SOCKS5Password)
+	if err != nil {
+		return err
+	}
+	return r.connectTargetOverMWSS(c, target, func(err error) error {
+		if err != nil {
+			return writeSOCKS5Reply(c, socks5RepHostUnreachable)
+		}
+		return writeSOCKS5Reply(c, socks5RepSucceeded)
+	})
+}
+
+// connectTargetOverMWSS 让mwss server去dial target 结果由reply告诉客户端 成功之后双向转发
+// 调用方负责关闭c
+func (r *Relay) connectTargetOverMWSS(c net.Conn, target string, reply func(err error) error) error {
+	lc, cs := r.traceConn(c, "ehco."+r.ListenType+".client")
+	dialDone := cs.phase("mwss.dial")
+	var wsc net.Conn
+	remote, err := r.backends.try(r.cfg.MaxDialAttempts, func(remote string) (err error) {
+		wsc, err = r.tr.Dial(context.Background(), remote+r.mwssConnectPath())
+		return err
+	})
+	if err == nil {
+		defer wsc.Close()
+		wsc.SetDeadline(time.Now().Add(SOCKS5HandshakeDeadline))
+		err = requestConnectTarget(wsc, target)
+	}
+	dialDone(err)
+	if err != nil {
+		cs.end(remote, err)
+		reply(err)
+		return err
+	}
+	if err := reply(nil); err != nil {
+		cs.end(remote, err)
+		return err
+	}
+
+	r.conns.add(remote, c)
+	defer r.conns.remove(remote, c)
+	r.logAccess(cs, "connectTargetOverMWSS", "from", c.RemoteAddr(), "to", target, "listen", r.ListenType,
+		"session", mwssSessionName(wsc.LocalAddr(), wsc.RemoteAddr()))
+	if err := wsc.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
+		cs.end(remote, err)
+		return err
+	}
+	if err := c.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
+		cs.end(remote, err)
+		return err
+	}
+	r.connOpened(cs, c.RemoteAddr(), remote)
+	_, err = transport(lc, wsc, r.cfg)
+	cs.end(remote, err)
+	return nil
+}
+
+// handleMWSSConnToTarget server端先读出client指定的目标 dial成功之后回复一个字节的状态
+func (r *Relay) handleMWSSConnToTarget(c net.Conn) {
+	defer c.Close()
+	session := mwssSessionName(c.RemoteAddr(), c.LocalAddr())
+	c, cs := r.traceConn(c, "ehco.socks5.server")
+	if !r.cfg.AllowConnectTarget {
+		cs.log.Warnw("[mwss] connect target not allowed", "session", session)
+		cs.end("", nil)
+		return
+	}
+	c.SetReadDeadline(time.Now().Add(SOCKS5HandshakeDeadline))
+	target, via, err := readConnectTarget(c)
+	if err != nil {
+		cs.log.Warnw("read connect target error", "session", session, "error", err)
+		cs.end("", err)
+		return
+	}
+	dialDone := cs.phase("dial")
+	var rc net.Conn
+	if len(via) > 0 {
+		rc, err = r.dialChain(via, target)
+	} else {
+		rc, err = r.dialConnectTarget(target)
+	}
+	dialDone(err)
+	if err != nil {
+		cs.end(target, err)
+		cs.log.Warnf("dial target %s error: %s", target, err)
+		c.Write([]byte{connectTargetStatusDialError})
+		return
+	}
+	defer rc.Close()
+	if _, err := c.Write([]byte{connectTargetStatusOK}); err != nil {
+		cs.end(target, err)
+		return
+	}
+	r.conns.add(target, c)
+	defer r.conns.remove(target, c)
+	r.logAccess(cs, "handleMWSSConnToTarget", "from", c.RemoteAddr(), "to", target, "via", via, "session", session)
+	if err := c.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
+		cs.end(target, err)
+		return
+	}
+	if err := rc.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
+		cs.end(target, err)
+		return
+	}
+	r.connOpened(cs, c.RemoteAddr(), target)
+	_, err = transport(c, rc, r.cfg)
+	cs.end(target, err)
+}
+
+// socks5Handshake 完成方法协商并读出CONNECT请求的目标地址 不支持的请求会先回复客户端
+// username不为空时只接受用户名密码认证
+func socks5Handshake(rw io.ReadWriter, username, password string) (string, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(rw, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != socks5Version {
+		return "", ErrSOCKS5BadVersion
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(rw, methods); err != nil {
+		return "", err
+	}
+	want := byte(socks5MethodNoAuth)
+	if username != "" {
+		want = socks5MethodUserPass
+	}
+	method := byte(socks5MethodNoAcceptable)
+	for _, m := range methods {
+		if m == want {
+			method = want
+			break
+		}
+	}
+	if _, err := rw.Write([]byte{socks5Version, method}); err != nil {
+		return "", err
+	}
+	if method == socks5MethodNoAcceptable {
+		return "", ErrSOCKS5NoAuthMethod
+	}
+	if method == socks5MethodUserPass {
+		if err := socks5UserPassAuth(rw, username, password); err != nil {
+			return "", err
+		}
+	}
+
+	// VER CMD RSV ATYP
+	var req [4]byte
+	if _, err := io.ReadFull(rw, req[:]); err != nil {
+		return "", err
+	}
+	if req[0] != socks5Version {
+		return "", ErrSOCKS5BadVersion
+	}
+	var host string
+	switch req[3] {
+	case socks5AtypIPv4, socks5AtypIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if req[3] == socks5AtypIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(rw, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case socks5AtypDomain:
+		domain, err := readSOCKS5String(rw)
+		if err != nil {
+			return "", err
+		}
+		host = string(domain)
+	default:
+		writeSOCKS5Reply(rw, socks5RepAtypNotSupported)
+		return "", fmt.Errorf("socks5 address type not supported: %d", req[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(rw, port[:]); err != nil {
+		return "", err
+	}
+	if req[1] != socks5CmdConnect {
+		writeSOCKS5Reply(rw, socks5RepCmdNotSupported)
+		return "", ErrSOCKS5CmdUnsupported
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socks5UserPassAuth rfc1929 VER ULEN UNAME PLEN PASSWD 失败时回复之后由调用方关闭连接
+func socks5UserPassAuth(rw io.ReadWriter, username, password string) error {
+	var ver [1]byte
+	if _, err := io.ReadFull(rw, ver[:]); err != nil {
+		return err
+	}
+	if ver[0] != socks5UserPassVersion {
+		return fmt.Errorf("socks5 bad auth version: %d", ver[0])
+	}
+	user, err := readSOCKS5String(rw)
+	if err != nil {
+		return err
+	}
+	pass, err := readSOCKS5String(rw)
+	if err != nil {
+		return err
+	}
+	// 两个都比较完 不提前返回
+	ok := subtle.ConstantTimeCompare(user, []byte(username)) &
+		subtle.ConstantTimeCompare(pass, []byte(password))
+	if ok != 1 {
+		rw.Write([]byte{socks5UserPassVersion, socks5UserPassFailed})
+		return ErrSOCKS5AuthFailed
+	}
+	_, err = rw.Write([]byte{socks5UserPassVersion, socks5UserPassOK})
+	return err
+}
+
+// readSOCKS5String 一个字节的长度加上内容
+func readSOCKS5String(r io.Reader) ([]byte, error) {
+	var l [1]byte
+	if _, err := io.ReadFull(r, l[:]); err != nil {
+		return nil, err
+	}
+	b := make([]byte, l[0])
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// writeSOCKS5Reply BND.ADDR和BND.PORT固定填0.0.0.0:0
+func writeSOCKS5Reply(w io.Writer, rep byte) error {
+	_, err := w.Write([]byte{socks5Version, rep, 0x00, socks5AtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// requestConnectTarget 发送目标地址 并等待server回复dial的结果
+// via不为空时server不直接dial target 而是依次经过via里的mwss节点 见chain.go
+func requestConnectTarget(rw io.ReadWriter, target string, via ...string) error {
+	if len(via) > 0 {
+		target = strings.Join(via, chainSep) + chainSep + target
+	}
+	if len(target) > 0xffff {
+		return fmt.Errorf("connect target too long: %d", len(target))
+	}
+	frame := make([]byte, 2+len(target))
+	binary.BigEndian.PutUint16(frame, uint16(len(target)))
+	copy(frame[2:], target)
+	if _, err := rw.Write(frame); err != nil {
+		return err
+	}
+	var status [1]byte
+	if _, err := io.ReadFull(rw, status[:]); err != nil {
+		return err
+	}
+	if status[0] != connectTargetStatusOK {
+		return ErrConnectTargetRefused
+	}
+	return nil
+}
+
+// readConnectTarget 2字节长度(大端) + host:port或者wss节点 前面可能带着逗号分隔的后续mwss节点
+func readConnectTarget(r io.Reader) (target string, via []string, err error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return "", nil, err
+	}
+	b := make([]byte, binary.BigEndian.Uint16(header[:]))
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", nil, err
+	}
+	parts := strings.Split(string(b), chainSep)
+	target, via = parts[len(parts)-1], parts[:len(parts)-1]
+	if err := checkChainTarget(target); err != nil {
+		return "", nil, err
+	}
+	for _, hop := range via {
+		if err := checkChainHop(hop); err != nil {
+			return "", nil, err
+		}
+	}
+	return target, via, nil
+}
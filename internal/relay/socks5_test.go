@@ -0,0 +1,97 @@
+package relay
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+)
+
+// socks5TestClient 按methods协商 user不为空时发送用户名密码 然后请求CONNECT example.com:443
+// 返回server的每个回复 server提前断开时后面的回复为nil
+func socks5TestClient(c net.Conn, methods []byte, user, pass string) (replies [][]byte) {
+	defer c.Close()
+	read := func(n int) bool {
+		b := make([]byte, n)
+		if _, err := io.ReadFull(c, b); err != nil {
+			return false
+		}
+		replies = append(replies, b)
+		return true
+	}
+	c.Write(append([]byte{socks5Version, byte(len(methods))}, methods...))
+	if !read(2) {
+		return
+	}
+	if user != "" {
+		msg := []byte{socks5UserPassVersion, byte(len(user))}
+		msg = append(msg, user...)
+		msg = append(msg, byte(len(pass)))
+		msg = append(msg, pass...)
+		c.Write(msg)
+		if !read(2) {
+			return
+		}
+	}
+	domain := "example.com"
+	req := []byte{socks5Version, socks5CmdConnect, 0x00, socks5AtypDomain, byte(len(domain))}
+	req = append(req, domain...)
+	c.Write(append(req, 0x01, 0xbb))
+	return
+}
+
+func TestSOCKS5UserPassAuth(t *testing.T) {
+	cases := []struct {
+		name       string
+		methods    []byte
+		user, pass string
+		wantErr    error
+		wantReply  [][]byte
+	}{
+		{
+			name:      "ok",
+			methods:   []byte{socks5MethodNoAuth, socks5MethodUserPass},
+			user:      "ehco",
+			pass:      "secret",
+			wantReply: [][]byte{{socks5Version, socks5MethodUserPass}, {socks5UserPassVersion, socks5UserPassOK}},
+		},
+		{
+			name:      "wrong password",
+			methods:   []byte{socks5MethodUserPass},
+			user:      "ehco",
+			pass:      "guess",
+			wantErr:   ErrSOCKS5AuthFailed,
+			wantReply: [][]byte{{socks5Version, socks5MethodUserPass}, {socks5UserPassVersion, socks5UserPassFailed}},
+		},
+		{
+			name:      "no auth offered",
+			methods:   []byte{socks5MethodNoAuth},
+			wantErr:   ErrSOCKS5NoAuthMethod,
+			wantReply: [][]byte{{socks5Version, socks5MethodNoAcceptable}},
+		},
+	}
+	for _, tc := range cases {
+		server, client := net.Pipe()
+		done := make(chan [][]byte, 1)
+		go func() {
+			done <- socks5TestClient(client, tc.methods, tc.user, tc.pass)
+		}()
+		target, err := socks5Handshake(server, "ehco", "secret")
+		server.Close()
+		replies := <-done
+		if err != tc.wantErr {
+			t.Fatalf("%s: expect err %v, got %v", tc.name, tc.wantErr, err)
+		}
+		if err == nil && target != "example.com:443" {
+			t.Fatalf("%s: unexpected target %s", tc.name, target)
+		}
+		if len(replies) != len(tc.wantReply) {
+			t.Fatalf("%s: expect replies %v, got %v", tc.name, tc.wantReply, replies)
+		}
+		for i := range replies {
+			if !bytes.Equal(replies[i], tc.wantReply[i]) {
+				t.Fatalf("%s: expect replies %v, got %v", tc.name, tc.wantReply, replies)
+			}
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package relay
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// relayStats 不依赖prometheus的计数 给/stats用
+type relayStats struct {
+	activeConns int64
+	bytesIn     int64
+	bytesOut    int64
+	// 重启之前保存下来的流量 见RestoreTraffic 不算在/stats里
+	baseIn  int64
+	baseOut int64
+}
+
+// 按listen地址区分relay 和metrics的relay label一致
+var relayStatsMap sync.Map
+
+func statsFor(listen string) *relayStats {
+	v, _ := relayStatsMap.LoadOrStore(listen, &relayStats{})
+	return v.(*relayStats)
+}
+
+type RelayStatus struct {
+	Listen        string `json:"listen"`
+	ListenType    string `json:"listen_type"`
+	Remote        string `json:"remote"`
+	TransportType string `json:"transport_type"`
+	Ready         bool   `json:"ready"`
+	// 没有配置schedule时总是true
+	ScheduleOpen bool `json:"schedule_open"`
+
+	ActiveConns int64 `json:"active_conns"`
+	BytesIn     int64 `json:"bytes_in"`
+	BytesOut    int64 `json:"bytes_out"`
+
+	// mwss remote -> 每个session上的stream数
+	Sessions map[string][]int `json:"sessions,omitempty"`
+	// mwss remote -> 所有session的stream峰值 用来调整max_mwss_stream_cnt
+	StreamPeaks map[string]StreamPeakStats `json:"stream_peaks,omitempty"`
+	// remote -> closed/open/half_open 开启了熔断时才有
+	CircuitBreakers map[string]string `json:"circuit_breakers,omitempty"`
+	// remote -> up/down 开启了健康检查时才有
+	BackendHealth map[string]string `json:"backend_health,omitempty"`
+}
+
+// StreamPeakStats 一个remote上建立过的所有session 包括已经关闭的
+type StreamPeakStats struct {
+	Sessions int64 `json:"sessions"`
+	// 单个session同时存在过的最多stream数
+	MaxStreams int64 `json:"max_streams"`
+	// 每个session的stream峰值的平均
+	AvgStreams float64 `json:"avg_streams"`
+}
+
+func (r *Relay) isReady() bool {
+	select {
+	case <-r.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *Relay) Status() RelayStatus {
+	s := statsFor(r.cfg.Listen)
+	status := RelayStatus{
+		Listen:        r.cfg.Listen,
+		ListenType:    r.ListenType,
+		Remote:        r.RemoteTCPAddr,
+		TransportType: r.TransportType,
+		Ready:         r.isReady(),
+		ScheduleOpen:  r.scheduleOpen(),
+		ActiveConns:   atomic.LoadInt64(&s.activeConns),
+		BytesIn:       atomic.LoadInt64(&s.bytesIn),
+		BytesOut:      atomic.LoadInt64(&s.bytesOut),
+
+		CircuitBreakers: r.backends.breakerStates(),
+		BackendHealth:   r.backends.healthStates(),
+	}
+	if tr, ok := r.tr.(*mwssTransporter); ok {
+		status.Sessions = tr.sessionStreams()
+		status.StreamPeaks = tr.streamPeakStats()
+	}
+	return status
+}
+
+func (tr *mwssTransporter) sessionStreams() map[string][]int {
+	tr.sessionMutex.Lock()
+	defer tr.sessionMutex.Unlock()
+	res := make(map[string][]int, len(tr.sessions))
+	for addr, sessions := range tr.sessions {
+		streams := make([]int, 0, len(sessions))
+		for _, s := range sessions {
+			streams = append(streams, s.NumStreams())
+		}
+		res[addr] = streams
+	}
+	return res
+}
+
+// streamPeaks 已经移除的session的stream峰值汇总
+type streamPeaks struct {
+	sessions   int64
+	peakSum    int64
+	maxStreams int64
+}
+
+func (p *streamPeaks) add(peak int64) {
+	p.sessions++
+	p.peakSum += peak
+	if peak > p.maxStreams {
+		p.maxStreams = peak
+	}
+}
+
+// retireSession session从tr.sessions里移除时把峰值记下来 需要持有sessionMutex
+func (tr *mwssTransporter) retireSession(addr string, s *muxSession) {
+	p, ok := tr.retiredPeaks[addr]
+	if !ok {
+		p = &streamPeaks{}
+		tr.retiredPeaks[addr] = p
+	}
+	p.add(atomic.LoadInt64(&s.peakStreams))
+}
+
+func (tr *mwssTransporter) streamPeakStats() map[string]StreamPeakStats {
+	tr.sessionMutex.Lock()
+	defer tr.sessionMutex.Unlock()
+	all := make(map[string]*streamPeaks, len(tr.retiredPeaks))
+	for addr, p := range tr.retiredPeaks {
+		cp := *p
+		all[addr] = &cp
+	}
+	for addr, sessions := range tr.sessions {
+		p, ok := all[addr]
+		if !ok {
+			p = &streamPeaks{}
+			all[addr] = p
+		}
+		for _, s := range sessions {
+			p.add(atomic.LoadInt64(&s.peakStreams))
+		}
+	}
+	res := make(map[string]StreamPeakStats, len(all))
+	for addr, p := range all {
+		if p.sessions == 0 {
+			continue
+		}
+		res[addr] = StreamPeakStats{
+			Sessions:   p.sessions,
+			MaxStreams: p.maxStreams,
+			AvgStreams: float64(p.peakSum) / float64(p.sessions),
+		}
+	}
+	return res
+}
+
+// NewStatsHandler /health 所有relay都在serving时返回200 /stats 返回每个relay的状态
+func NewStatsHandler(relays []*Relay) http.Handler {
+	return NewStatsHandlerFunc(func() []*Relay { return relays })
+}
+
+// NewStatsHandlerFunc 和NewStatsHandler一样 每次请求时调用relays拿到当前的relay 用在reload之后relay会变的时候
+func NewStatsHandlerFunc(relays func() []*Relay) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, req *http.Request) {
+		for _, r := range relays() {
+			if !r.isReady() {
+				http.Error(w, "relay "+r.cfg.Listen+" not ready", http.StatusServiceUnavailable)
+				return
+			}
+		}
+		w.Write([]byte("ok"))
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, req *http.Request) {
+		current := relays()
+		res := make([]RelayStatus, 0, len(current))
+		for _, r := range current {
+			res = append(res, r.Status())
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			Logger.Warnf("encode stats error: %s", err)
+		}
+	})
+	return mux
+}
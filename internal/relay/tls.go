@@ -4,12 +4,18 @@ import (
 	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"math/big"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -86,7 +92,7 @@ func generateKeyPair() (rawCert, rawKey []byte, err error) {
 	if KeyFileName != "" {
 		keyOut, err := os.OpenFile(KeyFileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 		if err != nil {
-			Logger.Info("failed to open key.pem for writing:", err)
+			Logger.Warn("failed to open key.pem for writing:", err)
 		}
 		pem.Encode(keyOut, pemBlockForKey(priv))
 		keyOut.Close()
@@ -102,7 +108,7 @@ func pemBlockForKey(priv interface{}) *pem.Block {
 	case *ecdsa.PrivateKey:
 		b, err := x509.MarshalECPrivateKey(k)
 		if err != nil {
-			Logger.Infof("Unable to marshal ECDSA private key: %v", err)
+			Logger.Warnf("Unable to marshal ECDSA private key: %v", err)
 			os.Exit(2)
 		}
 		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: b}
@@ -110,3 +116,123 @@ func pemBlockForKey(priv interface{}) *pem.Block {
 		return nil
 	}
 }
+
+// normalizeFingerprint 统一成不带冒号的小写hex
+func normalizeFingerprint(fp string) string {
+	return strings.ToLower(strings.Replace(fp, ":", "", -1))
+}
+
+func certFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyClientCertFingerprint 只允许指纹在白名单里的客户端证书
+func (r *Relay) verifyClientCertFingerprint(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return errors.New("no client certificate")
+	}
+	fp := certFingerprint(rawCerts[0])
+	for _, allowed := range r.cfg.AllowedClientCertFingerprints {
+		if normalizeFingerprint(allowed) == fp {
+			return nil
+		}
+	}
+	return fmt.Errorf("client certificate %s is not allowed", fp)
+}
+
+// loadCAPool 读取PEM格式的CA证书 用来校验server证书或者client证书
+func loadCAPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in %s", file)
+	}
+	return pool, nil
+}
+
+// serverTLSConfig wss/mwss server 使用的tls配置
+// 没有配置cert_file和acme_domains时使用自签名的DefaultTLSConfig
+func (r *Relay) serverTLSConfig() *tls.Config {
+	if r.serverCert == nil && r.acme == nil && r.clientCAs == nil && len(r.cfg.AllowedClientCertFingerprints) == 0 {
+		return DefaultTLSConfig
+	}
+	var cfg *tls.Config
+	if r.acme != nil {
+		// 带上了GetCertificate和tls-alpn-01需要的NextProtos
+		cfg = r.acme.TLSConfig()
+	} else if DefaultTLSConfig != nil {
+		cfg = DefaultTLSConfig.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	if r.serverCert != nil {
+		cfg.Certificates = []tls.Certificate{*r.serverCert}
+	}
+	if len(r.cfg.AllowedClientCertFingerprints) > 0 {
+		cfg.ClientAuth = tls.RequireAnyClientCert
+		cfg.VerifyPeerCertificate = r.verifyClientCertFingerprint
+	}
+	if r.clientCAs != nil {
+		// 证书链校验通过之后才会再检查指纹
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+		cfg.ClientCAs = r.clientCAs
+	}
+	return cfg
+}
+
+// clientTLSConfig 连接远端wss/mwss server 使用的tls配置
+// 配置了server_name或者ca_file时校验server证书 否则和以前一样跳过校验
+// 配置了sni时握手发送sni 证书仍然按server_name校验 没有server_name时按sni校验
+func (r *Relay) clientTLSConfig() *tls.Config {
+	verify := r.cfg.ServerName != "" || r.rootCAs != nil
+	if r.clientCert == nil && !verify && r.cfg.SNI == "" {
+		return DefaultTLSConfig
+	}
+	var cfg *tls.Config
+	if DefaultTLSConfig != nil {
+		cfg = DefaultTLSConfig.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	if r.clientCert != nil {
+		cfg.Certificates = []tls.Certificate{*r.clientCert}
+	}
+	if verify {
+		cfg.InsecureSkipVerify = false
+		cfg.ServerName = r.cfg.ServerName
+		// 为nil时使用系统的根证书
+		cfg.RootCAs = r.rootCAs
+	}
+	if r.cfg.SNI != "" && r.cfg.SNI != cfg.ServerName {
+		if verify && r.cfg.ServerName != "" {
+			// tls只会按发送的sni校验证书 这里自己按server_name校验
+			cfg.InsecureSkipVerify = true
+			cfg.VerifyConnection = verifyServerName(r.cfg.ServerName, r.rootCAs)
+		}
+		cfg.ServerName = r.cfg.SNI
+	}
+	return cfg
+}
+
+// verifyServerName 按name和roots校验server的证书链
+func verifyServerName(name string, roots *x509.CertPool) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("tls: server did not provide a certificate")
+		}
+		opts := x509.VerifyOptions{
+			DNSName:       name,
+			Roots:         roots,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range cs.PeerCertificates[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		_, err := cs.PeerCertificates[0].Verify(opts)
+		return err
+	}
+}
@@ -0,0 +1,198 @@
+package relay
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// genTestCert parent为nil时生成自签名的CA
+func genTestCert(t *testing.T, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, tls.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{Organization: []string{"ehco-test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         parent == nil,
+
+		BasicConstraintsValid: true,
+	}
+	if parent == nil {
+		parent, parentKey = tmpl, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// tlsHandshake 用tcp而不是net.Pipe server拒绝时发送alert不会阻塞
+func tlsHandshake(server, client *tls.Config) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	errCh := make(chan error, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer c.Close()
+		errCh <- tls.Server(c, server).Handshake()
+	}()
+	cc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer cc.Close()
+	tls.Client(cc, client).Handshake()
+	return <-errCh
+}
+
+func TestClientCAFile(t *testing.T) {
+	if DefaultTLSConfig == nil {
+		InitTlsCfg()
+	}
+	ca, caKey, _ := genTestCert(t, nil, nil)
+	_, _, signed := genTestCert(t, ca, caKey)
+	_, _, selfSigned := genTestCert(t, nil, nil)
+
+	dir, err := ioutil.TempDir("", "ehco-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRelayWithConfig(&RelayConfig{
+		Listen:        "127.0.0.1:0",
+		ListenType:    Listen_MWSS,
+		Remote:        "127.0.0.1:1",
+		TransportType: Transport_RAW,
+		ClientCAFile:  caFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCfg := r.serverTLSConfig()
+	if serverCfg.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Fatalf("expect client cert required, got %v", serverCfg.ClientAuth)
+	}
+
+	client := func(certs ...tls.Certificate) *tls.Config {
+		return &tls.Config{InsecureSkipVerify: true, Certificates: certs}
+	}
+	if err := tlsHandshake(serverCfg, client(signed)); err != nil {
+		t.Fatalf("expect cert signed by client ca accepted: %v", err)
+	}
+	if err := tlsHandshake(serverCfg, client(selfSigned)); err == nil {
+		t.Fatal("expect cert not signed by client ca rejected")
+	}
+	if err := tlsHandshake(serverCfg, client()); err == nil {
+		t.Fatal("expect handshake without client cert rejected")
+	}
+}
+
+func TestAllowedClientCertFingerprints(t *testing.T) {
+	if DefaultTLSConfig == nil {
+		InitTlsCfg()
+	}
+	allowed, _, allowedCert := genTestCert(t, nil, nil)
+	_, _, other := genTestCert(t, nil, nil)
+
+	// 白名单里写成带冒号的大写也能匹配
+	fp := strings.ToUpper(certFingerprint(allowed.Raw))
+	var parts []string
+	for i := 0; i < len(fp); i += 2 {
+		parts = append(parts, fp[i:i+2])
+	}
+	r, err := NewRelayWithConfig(&RelayConfig{
+		Listen:                        "127.0.0.1:0",
+		ListenType:                    Listen_MWSS,
+		Remote:                        "127.0.0.1:1",
+		TransportType:                 Transport_RAW,
+		AllowedClientCertFingerprints: []string{strings.Join(parts, ":")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverCfg := r.serverTLSConfig()
+	if serverCfg.ClientAuth != tls.RequireAnyClientCert {
+		t.Fatalf("expect any client cert required, got %v", serverCfg.ClientAuth)
+	}
+
+	client := func(certs ...tls.Certificate) *tls.Config {
+		return &tls.Config{InsecureSkipVerify: true, Certificates: certs}
+	}
+	if err := tlsHandshake(serverCfg, client(allowedCert)); err != nil {
+		t.Fatalf("expect allowed cert accepted: %v", err)
+	}
+	if err := tlsHandshake(serverCfg, client(other)); err == nil {
+		t.Fatal("expect cert not in fingerprint list rejected")
+	}
+	if err := tlsHandshake(serverCfg, client()); err == nil {
+		t.Fatal("expect handshake without client cert rejected")
+	}
+}
+
+func TestSNIFromWSHostHeader(t *testing.T) {
+	newCfg := func() *RelayConfig {
+		return &RelayConfig{
+			Listen:        "127.0.0.1:0",
+			ListenType:    Listen_RAW,
+			Remote:        "wss://127.0.0.1:1",
+			TransportType: Transport_MWSS,
+			WSHeaders:     map[string]string{"host": "cdn.example.com:443"},
+		}
+	}
+	r, err := NewRelayWithConfig(newCfg())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.tr.Close()
+	if got := r.clientTLSConfig().ServerName; got != "cdn.example.com" {
+		t.Fatalf("expect sni from host header, got %q", got)
+	}
+
+	// 配置了sni时不覆盖
+	cfg := newCfg()
+	cfg.SNI = "edge.example.com"
+	r2, err := NewRelayWithConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r2.tr.Close()
+	if got := r2.clientTLSConfig().ServerName; got != "edge.example.com" {
+		t.Fatalf("expect configured sni, got %q", got)
+	}
+}
@@ -0,0 +1,214 @@
+package relay
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.4.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+var (
+	tracingEnabled bool
+	tracer         = otel.Tracer("github.com/Ehco1996/ehco")
+)
+
+type connIDKey struct{}
+
+// connIDGenerator 用连接的id作为trace id 方便和上下游的trace关联
+type connIDGenerator struct{}
+
+func (connIDGenerator) NewIDs(ctx context.Context) (trace.TraceID, trace.SpanID) {
+	tid, ok := ctx.Value(connIDKey{}).(trace.TraceID)
+	if !ok {
+		rand.Read(tid[:])
+	}
+	return tid, newSpanID()
+}
+
+func (connIDGenerator) NewSpanID(ctx context.Context, traceID trace.TraceID) trace.SpanID {
+	return newSpanID()
+}
+
+func newSpanID() (sid trace.SpanID) {
+	rand.Read(sid[:])
+	return
+}
+
+// InitTracing 把每个连接的span通过otlp grpc导出到endpoint
+func InitTracing(endpoint string, sampleRate float64) (func(context.Context) error, error) {
+	exporter, err := otlptracegrpc.New(context.Background(),
+		otlptracegrpc.WithEndpoint(endpoint),
+		otlptracegrpc.WithInsecure(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithIDGenerator(connIDGenerator{}),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRate))),
+		sdktrace.WithResource(resource.NewWithAttributes(
+			semconv.SchemaURL,
+			semconv.ServiceNameKey.String("ehco"),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+	tracingEnabled = true
+	Logger.Infof("init tracing endpoint: %s sample rate: %f", endpoint, sampleRate)
+	return tp.Shutdown, nil
+}
+
+// countConn 统计经过连接的字节数
+type countConn struct {
+	net.Conn
+	in  int64
+	out int64
+}
+
+func (c *countConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	atomic.AddInt64(&c.in, int64(n))
+	return n, err
+}
+
+func (c *countConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddInt64(&c.out, int64(n))
+	return n, err
+}
+
+func (c *countConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errHalfCloseUnsupported
+}
+
+// connSpan 一个转发连接 id会带在这个连接的所有日志里
+// 没开启tracing时span为nil phase和end只打日志
+type connSpan struct {
+	id  string
+	log *zap.SugaredLogger
+	// relay的listen地址 phase的metrics用它做label 为空时不记录
+	relay string
+
+	ctx  context.Context
+	span trace.Span
+	cc   *countConn
+
+	// connOpened之后不为nil end时调用OnDisconnect
+	hook *connHook
+	// connOpened之后为true 之后的错误是transport返回的
+	transporting bool
+	// connOpened之后不为nil end时从里面移除
+	live *liveConns
+
+	// 这个连接的access log是否被采样到 第一次打印时决定
+	sampleOnce sync.Once
+	sampled    bool
+}
+
+// newConnSpan 不需要trace的连接(比如udp)也用它拿到带conn_id的logger
+func newConnSpan(id string) *connSpan {
+	if id == "" {
+		var b [4]byte
+		rand.Read(b[:])
+		id = hex.EncodeToString(b[:])
+	}
+	return &connSpan{id: id, log: Logger.With("conn_id", id)}
+}
+
+// traceConn 开启tracing时为c创建span 返回的conn需要替代c参与转发才能统计流量
+// 开启tracing时conn_id是trace id的前8位 可以直接拿去查trace
+func (r *Relay) traceConn(c net.Conn, name string) (net.Conn, *connSpan) {
+	if !tracingEnabled {
+		cs := newConnSpan("")
+		cs.relay = r.cfg.Listen
+		// OnDisconnect和dashboard需要流量统计
+		if r.OnDisconnect != nil || liveConnsEnabled {
+			cs.cc = &countConn{Conn: c}
+			return cs.cc, cs
+		}
+		return c, cs
+	}
+	var tid trace.TraceID
+	rand.Read(tid[:])
+	cs := newConnSpan(tid.String()[:8])
+	cs.relay = r.cfg.Listen
+	ctx := context.WithValue(context.Background(), connIDKey{}, tid)
+	ctx, span := tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.String("ehco.relay.listen", r.cfg.Listen),
+		attribute.String("ehco.relay.listen_type", r.ListenType),
+		attribute.String("ehco.relay.transport_type", r.TransportType),
+		attribute.String("net.peer.ip", c.RemoteAddr().String()),
+	))
+	cs.ctx, cs.span, cs.cc = ctx, span, &countConn{Conn: c}
+	return cs.cc, cs
+}
+
+// phase 记录dial/handshake等阶段的子span和耗时 返回的函数在阶段结束时调用
+func (cs *connSpan) phase(name string) func(err error) {
+	start := time.Now()
+	if cs.span == nil {
+		return func(err error) {
+			observePhase(cs.relay, name, start, err)
+			if err != nil {
+				cs.log.Debugf("%s error: %s", name, err)
+			}
+		}
+	}
+	_, span := tracer.Start(cs.ctx, name)
+	return func(err error) {
+		observePhase(cs.relay, name, start, err)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+func (cs *connSpan) end(backend string, err error) {
+	// 客户端正常断开产生的eof/reset/timeout很多 只有预料之外的错误才需要warn
+	reason := closeReason(err)
+	if cs.transporting && reason == CloseReason_Error {
+		cs.log.Warnw("conn closed", "backend", backend, "reason", reason, "error", err)
+	} else {
+		cs.log.Debugw("conn closed", "backend", backend, "reason", reason, "error", err)
+	}
+	if cs.hook != nil {
+		cs.hook.disconnect(cs.cc)
+	}
+	if cs.live != nil {
+		cs.live.remove(cs.id)
+	}
+	if cs.span == nil {
+		return
+	}
+	cs.span.SetAttributes(
+		attribute.String("ehco.backend", backend),
+		attribute.Int64("ehco.bytes_in", atomic.LoadInt64(&cs.cc.in)),
+		attribute.Int64("ehco.bytes_out", atomic.LoadInt64(&cs.cc.out)),
+		attribute.String("ehco.close_reason", reason),
+	)
+	if err != nil {
+		cs.span.RecordError(err)
+		if !cs.transporting || reason == CloseReason_Error {
+			cs.span.SetStatus(codes.Error, err.Error())
+		}
+	}
+	cs.span.End()
+}
@@ -0,0 +1,159 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTraceConnID(t *testing.T) {
+	r := &Relay{cfg: &RelayConfig{Listen: "trace-test"}}
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	// 没开启tracing时conn原样返回 但每个连接还是有自己的id
+	lc, cs := r.traceConn(c1, "ehco.test")
+	if lc != c1 {
+		t.Fatal("conn should not be wrapped when tracing is disabled")
+	}
+	_, cs2 := r.traceConn(c2, "ehco.test")
+	if cs.id == "" || cs.id == cs2.id {
+		t.Fatalf("bad conn id: %q %q", cs.id, cs2.id)
+	}
+	cs.phase("dial")(errors.New("dial failed"))
+	cs2.phase("dial")(nil)
+	cs.end("backend", nil)
+
+	if n := testutil.ToFloat64(phaseErrors.WithLabelValues("trace-test", "dial")); n != 1 {
+		t.Fatalf("expect 1 dial error, got %v", n)
+	}
+	// udp之类不是traceConn来的span不记录
+	newConnSpan("").phase("dial")(errors.New("dial failed"))
+	if n := testutil.ToFloat64(phaseErrors.WithLabelValues("", "dial")); n != 0 {
+		t.Fatalf("expect no dial error without relay, got %v", n)
+	}
+}
+
+// deadlineErrConn SetDeadline总是失败
+type deadlineErrConn struct{ net.Conn }
+
+func (deadlineErrConn) SetDeadline(time.Time) error { return errors.New("set deadline failed") }
+
+var (
+	testTracerProvider     *sdktrace.TracerProvider
+	testTracerProviderOnce sync.Once
+)
+
+// enableTestTracing 开启tracing并把这个测试的span记录在内存里 结束时恢复原来的provider
+// tracer只会绑定第一次设置的provider 所以所有测试共用一个provider 每个测试注册自己的recorder
+func enableTestTracing(t *testing.T) *tracetest.SpanRecorder {
+	testTracerProviderOnce.Do(func() {
+		testTracerProvider = sdktrace.NewTracerProvider(sdktrace.WithIDGenerator(connIDGenerator{}))
+	})
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(testTracerProvider)
+	sr := tracetest.NewSpanRecorder()
+	testTracerProvider.RegisterSpanProcessor(sr)
+	tracingEnabled = true
+	t.Cleanup(func() {
+		tracingEnabled = false
+		testTracerProvider.UnregisterSpanProcessor(sr)
+		otel.SetTracerProvider(prev)
+	})
+	return sr
+}
+
+// endedSpan 找到名字是name的已经结束的span
+func endedSpan(sr *tracetest.SpanRecorder, name string) sdktrace.ReadOnlySpan {
+	for _, s := range sr.Ended() {
+		if s.Name() == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func TestTraceConnSpan(t *testing.T) {
+	sr := enableTestTracing(t)
+
+	backend := startEchoBackend(t)
+	defer backend.Close()
+	listen := "127.0.0.1:1290"
+	r, err := NewRelay(listen, Listen_RAW, backend.Addr().String(), Transport_RAW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.ListenAndServe()
+	defer r.Shutdown(context.Background())
+	select {
+	case <-r.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay not ready")
+	}
+	c, err := net.Dial("tcp", listen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("ping"))
+	if _, err := io.ReadFull(c, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+
+	var span sdktrace.ReadOnlySpan
+	deadline := time.Now().Add(5 * time.Second)
+	for span == nil && time.Now().Before(deadline) {
+		span = endedSpan(sr, "ehco.raw")
+		time.Sleep(10 * time.Millisecond)
+	}
+	if span == nil {
+		t.Fatal("conn span not exported")
+	}
+	attrs := map[string]string{}
+	for _, kv := range span.Attributes() {
+		attrs[string(kv.Key)] = kv.Value.Emit()
+	}
+	if attrs["ehco.relay.listen"] != listen || attrs["ehco.backend"] != backend.Addr().String() ||
+		attrs["ehco.bytes_in"] != "4" || attrs["ehco.bytes_out"] != "4" {
+		t.Fatalf("unexpected span attributes %v", attrs)
+	}
+	// dial阶段是同一个trace里的子span
+	dial := endedSpan(sr, "dial")
+	if dial == nil || dial.SpanContext().TraceID() != span.SpanContext().TraceID() {
+		t.Fatal("dial phase not recorded as a child span")
+	}
+}
+
+func TestSpanEndOnDeadlineError(t *testing.T) {
+	sr := enableTestTracing(t)
+
+	backend := startEchoBackend(t)
+	defer backend.Close()
+	r, err := NewRelayWithConfig(&RelayConfig{
+		Listen:        "127.0.0.1:1286",
+		ListenType:    Listen_MWSS,
+		Remote:        backend.Addr().String(),
+		TransportType: Transport_RAW,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	// 还没开始transport就返回的时候span也要结束
+	r.handleMWSSConnToTcp(deadlineErrConn{c1})
+	if endedSpan(sr, "ehco.mwss.server") == nil {
+		t.Fatal("span not ended on set deadline error")
+	}
+}
@@ -0,0 +1,105 @@
+package relay
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+)
+
+// Traffic 一个relay累计的流量 tcp和udp加在一起 Upload是客户端发给后端的 Download是后端发给客户端的
+type Traffic struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+	// quota当前周期开始时的累计流量和周期的名字 重启之后接着算
+	QuotaBase  int64  `json:"quota_base,omitempty"`
+	QuotaCycle string `json:"quota_cycle,omitempty"`
+}
+
+// TrafficStore 按listen地址保存每个relay的累计流量 重启之后接着算
+type TrafficStore interface {
+	Load() (map[string]Traffic, error)
+	Save(traffic map[string]Traffic) error
+}
+
+// FileTrafficStore 保存成json文件 先写临时文件再rename 中途退出不会把文件写坏
+type FileTrafficStore struct {
+	Path string
+}
+
+func (s *FileTrafficStore) Load() (map[string]Traffic, error) {
+	res := make(map[string]Traffic)
+	b, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func (s *FileTrafficStore) Save(traffic map[string]Traffic) error {
+	b, err := json.MarshalIndent(traffic, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.Path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Path)
+}
+
+// RestoreTraffic 读出之前保存的流量作为起点 需要在relay开始转发之前调用
+func RestoreTraffic(store TrafficStore) error {
+	traffic, err := store.Load()
+	if err != nil {
+		return err
+	}
+	for listen, t := range traffic {
+		s := statsFor(listen)
+		atomic.StoreInt64(&s.baseIn, t.Upload)
+		atomic.StoreInt64(&s.baseOut, t.Download)
+		q := quotaFor(listen)
+		q.mu.Lock()
+		q.base, q.cycle = t.QuotaBase, t.QuotaCycle
+		q.mu.Unlock()
+	}
+	return nil
+}
+
+// trafficOf 一个relay从第一次保存开始的累计流量
+func trafficOf(listen string) Traffic {
+	s := statsFor(listen)
+	return Traffic{
+		Upload:   atomic.LoadInt64(&s.baseIn) + atomic.LoadInt64(&s.bytesIn),
+		Download: atomic.LoadInt64(&s.baseOut) + atomic.LoadInt64(&s.bytesOut),
+	}
+}
+
+// TrafficSnapshot 每个relay的累计流量 已经删掉的relay也在里面
+func TrafficSnapshot() map[string]Traffic {
+	res := make(map[string]Traffic)
+	relayStatsMap.Range(func(k, v interface{}) bool {
+		listen := k.(string)
+		t := trafficOf(listen)
+		if v, ok := relayQuotaMap.Load(listen); ok {
+			q := v.(*relayQuota)
+			q.mu.Lock()
+			t.QuotaBase, t.QuotaCycle = q.base, q.cycle
+			q.mu.Unlock()
+		}
+		res[listen] = t
+		return true
+	})
+	return res
+}
+
+// SaveTraffic 把当前的累计流量写到store
+func SaveTraffic(store TrafficStore) error {
+	return store.Save(TrafficSnapshot())
+}
@@ -0,0 +1,83 @@
+package relay
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTrafficPersist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ehco-traffic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &FileTrafficStore{Path: filepath.Join(dir, "traffic.json")}
+
+	// 文件不存在时从0开始
+	if err := RestoreTraffic(store); err != nil {
+		t.Fatal(err)
+	}
+	listen := "traffic-test:1"
+	s := statsFor(listen)
+	atomic.AddInt64(&s.bytesIn, 100)
+	atomic.AddInt64(&s.bytesOut, 200)
+	if err := SaveTraffic(store); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟重启 计数清零之后从文件恢复
+	atomic.StoreInt64(&s.bytesIn, 0)
+	atomic.StoreInt64(&s.bytesOut, 0)
+	if err := RestoreTraffic(store); err != nil {
+		t.Fatal(err)
+	}
+	atomic.AddInt64(&s.bytesIn, 1)
+	want := Traffic{Upload: 101, Download: 200}
+	if got := TrafficSnapshot()[listen]; got != want {
+		t.Fatalf("expect %+v, got %+v", want, got)
+	}
+}
+
+func TestTrafficPersistUDP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ehco-traffic")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &FileTrafficStore{Path: filepath.Join(dir, "traffic.json")}
+
+	backend := startUDPEchoBackend(t)
+	defer backend.Close()
+	listen := "127.0.0.1:1277"
+	r, err := NewRelay(listen, Listen_RAW, backend.LocalAddr().String(), Transport_RAW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.ListenAndServe()
+	defer r.StopAccept()
+	select {
+	case <-r.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay not ready")
+	}
+	if got, err := udpEcho(t, listen, "hello", 5*time.Second); err != nil || got != "hello" {
+		t.Fatalf("udp echo failed: %q %v", got, err)
+	}
+	waitTraffic(t, listen, 5, 5)
+
+	// udp的流量也要保存下来
+	if err := SaveTraffic(store); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := saved[listen]; got.Upload != 5 || got.Download != 5 {
+		t.Fatalf("expect udp traffic saved, got %+v", got)
+	}
+}
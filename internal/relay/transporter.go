@@ -0,0 +1,139 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Transporter client端经过transport连到remote的方式 addr是remote加上各自需要的路径
+// 自己实现的transport只需要实现这两个方法 由newTransporter按transport_type选择
+type Transporter interface {
+	Dial(ctx context.Context, addr string) (net.Conn, error)
+	Close() error
+}
+
+// Listener server端接受连接的方式 和net.Listener一样
+// MWSSServer把ws session里的每个stream当成一个conn返回
+type Listener interface {
+	Accept() (net.Conn, error)
+	Close() error
+	Addr() net.Addr
+}
+
+var (
+	_ Transporter = (*mwssTransporter)(nil)
+	_ Transporter = (*wsTransporter)(nil)
+	_ Transporter = (*grpcTransporter)(nil)
+	_ Transporter = (*quicTransporter)(nil)
+	_ Listener    = (*MWSSServer)(nil)
+)
+
+var (
+	customTransportersMu sync.Mutex
+	customTransporters   = make(map[string]func(r *Relay) Transporter)
+)
+
+// RegisterTransporter 注册自定义的transport_type 需要在创建relay之前调用
+// 自定义transport只支持tcp 每个连接用remote Dial一次 然后双向copy
+func RegisterTransporter(name string, newFunc func(r *Relay) Transporter) {
+	customTransportersMu.Lock()
+	defer customTransportersMu.Unlock()
+	switch name {
+	case Transport_RAW, Transport_WSS, Transport_MWSS, Transport_GRPC, Transport_QUIC, Transport_MTCP:
+		panic(fmt.Sprintf("transport %s is builtin", name))
+	}
+	if _, ok := customTransporters[name]; ok {
+		panic(fmt.Sprintf("transport %s already registered", name))
+	}
+	customTransporters[name] = newFunc
+}
+
+// newTransporter raw transport直接dial后端 不需要Transporter
+// 允许connect target的mwss server可能是chain的中间节点 需要用mwss dial下一跳
+func newTransporter(r *Relay) Transporter {
+	switch {
+	case r.TransportType == Transport_MWSS || r.TransportType == Transport_MTCP || r.cfg.AllowConnectTarget:
+		tr := NewMWSSTransporter(r.cfg.Listen)
+		tr.opts = r.mwssDialOptions
+		if r.cfg.MWSSSessionIdleSec > 0 {
+			tr.idleGrace = time.Duration(r.cfg.MWSSSessionIdleSec) * time.Second
+		}
+		return tr
+	case r.TransportType == Transport_WSS:
+		return &wsTransporter{relay: r}
+	case r.TransportType == Transport_GRPC:
+		return newGRPCTransporter(r)
+	case r.TransportType == Transport_QUIC:
+		return newQUICTransporter(r)
+	}
+	customTransportersMu.Lock()
+	newFunc := customTransporters[r.TransportType]
+	customTransportersMu.Unlock()
+	if newFunc != nil {
+		return newFunc(r)
+	}
+	return nil
+}
+
+// tcpHandler raw transport直接连后端 mwss还要处理proxy protocol和chain
+// 其他transport都用handleTcpOverTransporter经过r.tr转发 新的transport只需要实现Transporter
+func (r *Relay) tcpHandler() func(c net.Conn) error {
+	switch {
+	case r.TransportType == Transport_RAW:
+		return func(c net.Conn) error {
+			defer c.Close()
+			return r.handleTCPConn(c)
+		}
+	case r.TransportType == Transport_MWSS:
+		return r.handleTcpOverMWSS
+	case r.tr != nil:
+		return r.handleTcpOverTransporter
+	}
+	return nil
+}
+
+// transportAddr Dial时传给Transporter的地址 wss/mwss的remote后面要加上ws_path
+func (r *Relay) transportAddr(remote string) string {
+	switch r.TransportType {
+	case Transport_WSS, Transport_MWSS:
+		return remote + r.cfg.WSPath
+	}
+	return remote
+}
+
+// handleTcpOverTransporter wss/grpc/quic/mtcp和自定义transport的tcp连接
+func (r *Relay) handleTcpOverTransporter(c net.Conn) error {
+	defer c.Close()
+
+	lc, cs := r.traceConn(c, "ehco."+r.TransportType+".client")
+	dialDone := cs.phase("dial")
+	var rc net.Conn
+	remote, err := r.backends.try(r.cfg.MaxDialAttempts, func(remote string) (err error) {
+		rc, err = r.tr.Dial(context.Background(), r.transportAddr(remote))
+		return err
+	})
+	dialDone(err)
+	if err != nil {
+		cs.end(remote, err)
+		return err
+	}
+	defer rc.Close()
+	r.conns.add(remote, c)
+	defer r.conns.remove(remote, c)
+	r.logAccess(cs, "handleTcpOverTransporter", "from", c.RemoteAddr(), "to", remote, "transport", r.TransportType)
+	if err := rc.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
+		cs.end(remote, err)
+		return err
+	}
+	if err := c.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
+		cs.end(remote, err)
+		return err
+	}
+	r.connOpened(cs, c.RemoteAddr(), remote)
+	_, err = transport(lc, rc, r.cfg)
+	cs.end(remote, err)
+	return nil
+}
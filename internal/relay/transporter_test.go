@@ -0,0 +1,55 @@
+package relay
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingTransporter 直接dial remote 记录dial的次数
+type countingTransporter struct {
+	dials int32
+}
+
+func (tr *countingTransporter) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	atomic.AddInt32(&tr.dials, 1)
+	var d net.Dialer
+	return d.DialContext(ctx, "tcp", addr)
+}
+
+func (tr *countingTransporter) Close() error {
+	return nil
+}
+
+func TestCustomTransporter(t *testing.T) {
+	tr := &countingTransporter{}
+	RegisterTransporter("counting", func(r *Relay) Transporter { return tr })
+
+	backend := startEchoBackend(t)
+	defer backend.Close()
+	r, err := NewRelay("127.0.0.1:1254", Listen_RAW, backend.Addr().String(), "counting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.ListenAndServe()
+	<-r.Ready()
+	defer r.StopAccept()
+
+	c, err := net.Dial("tcp", "127.0.0.1:1254")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("ping"))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo failed: %q %v", buf, err)
+	}
+	if n := atomic.LoadInt32(&tr.dials); n != 1 {
+		t.Fatalf("expect 1 dial through custom transporter, got %d", n)
+	}
+}
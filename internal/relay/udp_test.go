@@ -0,0 +1,236 @@
+package relay
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startUDPEchoBackend 把收到的datagram原样发回去
+func startUDPEchoBackend(t *testing.T) *net.UDPConn {
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, MaxUDPDatagramSize)
+		for {
+			n, addr, err := uc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			uc.WriteToUDP(buf[:n], addr)
+		}
+	}()
+	return uc
+}
+
+// udpEcho 从一个新的本地端口发送一个datagram 返回收到的回复
+func udpEcho(t *testing.T, addr, payload string, timeout time.Duration) (string, error) {
+	c, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(timeout))
+	if _, err := c.Write([]byte(payload)); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 64)
+	n, err := c.Read(buf)
+	return string(buf[:n]), err
+}
+
+// waitTraffic 回复先到客户端 计数在写完之后才加上
+func waitTraffic(t *testing.T, listen string, in, out int64) {
+	s := statsFor(listen)
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if atomic.LoadInt64(&s.bytesIn) == in && atomic.LoadInt64(&s.bytesOut) == out {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expect in=%d out=%d, got in=%d out=%d", in, out, atomic.LoadInt64(&s.bytesIn), atomic.LoadInt64(&s.bytesOut))
+}
+
+func TestRawUDPQuota(t *testing.T) {
+	backend := startUDPEchoBackend(t)
+	defer backend.Close()
+
+	listen := "127.0.0.1:1274"
+	r, err := NewRelayWithConfig(&RelayConfig{
+		Listen:        listen,
+		ListenType:    Listen_RAW,
+		Remote:        backend.LocalAddr().String(),
+		TransportType: Transport_RAW,
+		QuotaBytes:    8,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.ListenAndServe()
+	defer r.StopAccept()
+	select {
+	case <-r.Ready():
+	case <-time.After(5 * time.Second):
+		t.Fatal("relay not ready")
+	}
+
+	if got, err := udpEcho(t, listen, "ping", 5*time.Second); err != nil || got != "ping" {
+		t.Fatalf("udp echo failed: %q %v", got, err)
+	}
+	waitTraffic(t, listen, 4, 4)
+	if got := trafficOf(listen); got.Upload != 4 || got.Download != 4 {
+		t.Fatalf("unexpected traffic %+v", got)
+	}
+	// 超过限额之后新的flow被拒绝
+	if got, err := udpEcho(t, listen, "ping", 500*time.Millisecond); err == nil {
+		t.Fatalf("expect new udp flow rejected after quota exceeded, got %q", got)
+	}
+}
+
+func TestMWSSUDPCountTraffic(t *testing.T) {
+	backend := startUDPEchoBackend(t)
+	defer backend.Close()
+
+	server, err := NewRelayWithConfig(&RelayConfig{
+		Listen:          "127.0.0.1:1275",
+		ListenType:      Listen_MWSS,
+		Remote:          backend.LocalAddr().String(),
+		TransportType:   Transport_RAW,
+		MWSSPlainListen: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ListenAndServe()
+	defer server.Shutdown(context.Background())
+	client, err := NewRelayWithConfig(&RelayConfig{
+		Listen:             "127.0.0.1:1276",
+		ListenType:         Listen_RAW,
+		Remote:             "wss://127.0.0.1:1275",
+		TransportType:      Transport_MWSS,
+		MWSSPlainTransport: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go client.ListenAndServe()
+	defer client.Shutdown(context.Background())
+	for _, r := range []*Relay{server, client} {
+		select {
+		case <-r.Ready():
+		case <-time.After(5 * time.Second):
+			t.Fatal("relay not ready")
+		}
+	}
+
+	if got, err := udpEcho(t, "127.0.0.1:1276", "hello", 5*time.Second); err != nil || got != "hello" {
+		t.Fatalf("udp echo over mwss failed: %q %v", got, err)
+	}
+	// 两端都按payload计数 不算帧头
+	waitTraffic(t, "127.0.0.1:1276", 5, 5)
+	waitTraffic(t, "127.0.0.1:1275", 5, 5)
+}
+
+// waitUDPFlowsRemoved 等所有flow退出 udpCache被清空
+func waitUDPFlowsRemoved(t *testing.T, r *Relay) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.udpMu.Lock()
+		n := len(r.udpCache)
+		r.udpMu.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d udp flows left", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUDPFlowDialFailure(t *testing.T) {
+	t.Run("dial failure", func(t *testing.T) {
+		listen := "127.0.0.1:1284"
+		r, err := NewRelayWithConfig(&RelayConfig{
+			Listen:             listen,
+			ListenType:         Listen_RAW,
+			Remote:             "wss://127.0.0.1:1241",
+			TransportType:      Transport_MWSS,
+			MWSSPlainTransport: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go r.ListenAndServe()
+		defer r.Shutdown(context.Background())
+		select {
+		case <-r.Ready():
+		case <-time.After(5 * time.Second):
+			t.Fatal("relay not ready")
+		}
+
+		// dial马上失败 flow退出的同时同一个地址的datagram还在不停地到达
+		c, err := net.Dial("udp", listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		deadline := time.Now().Add(500 * time.Millisecond)
+		for time.Now().Before(deadline) {
+			if _, err := c.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+		}
+		// 所有flow退出之后udpCache被清空
+		waitUDPFlowsRemoved(t, r)
+	})
+
+	t.Run("idle raw flow", func(t *testing.T) {
+		old := UdpDeadline
+		UdpDeadline = 200 * time.Millisecond
+		defer func() { UdpDeadline = old }()
+
+		// 后端只收不回 flow在读超时之后要退出
+		backend, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer backend.Close()
+		listen := "127.0.0.1:1309"
+		r, err := NewRelayWithConfig(&RelayConfig{
+			Listen:        listen,
+			ListenType:    Listen_RAW,
+			Remote:        backend.LocalAddr().String(),
+			TransportType: Transport_RAW,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go r.ListenAndServe()
+		defer r.Shutdown(context.Background())
+		select {
+		case <-r.Ready():
+		case <-time.After(5 * time.Second):
+			t.Fatal("relay not ready")
+		}
+
+		c, err := net.Dial("udp", listen)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		if _, err := c.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		backend.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, _, err := backend.ReadFromUDP(make([]byte, 16)); err != nil {
+			t.Fatal(err)
+		}
+		waitUDPFlowsRemoved(t, r)
+	})
+}
@@ -1,23 +1,129 @@
 package relay
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
 	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
 )
 
+// RandomWSPath 生成一个随机的ws_path 两端配置成同一个值
+func RandomWSPath() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "/" + hex.EncodeToString(b) + "/", nil
+}
+
+// wsDialURL auth_token_in_query时把token加到url里
+func (r *Relay) wsDialURL(addr string) (string, error) {
+	if !r.cfg.AuthTokenInQuery {
+		return addr, nil
+	}
+	return withAuthTokenQuery(addr, r.cfg.AuthToken)
+}
+
+// wsDialHeader client升级websocket时带上的header 都没有配置时返回nil
+func (r *Relay) wsDialHeader() http.Header {
+	var h http.Header
+	if !r.cfg.AuthTokenInQuery {
+		h = authTokenHeader(r.cfg.AuthToken)
+	}
+	if len(r.cfg.WSHeaders) == 0 {
+		return h
+	}
+	if h == nil {
+		h = http.Header{}
+	}
+	for k, v := range r.cfg.WSHeaders {
+		h.Set(k, v)
+	}
+	return h
+}
+
+var ErrWSSubprotocolMismatch = errors.New("ws subprotocol mismatch")
+
+// wsSubprotocols client和server的upgrader使用 没有配置时返回nil
+func wsSubprotocols(subprotocol string) []string {
+	if subprotocol == "" {
+		return nil
+	}
+	return []string{subprotocol}
+}
+
+// checkWSSubprotocol server端 client没有提供配置的子协议时拒绝升级 而不是不带子协议继续握手
+func checkWSSubprotocol(r *http.Request, subprotocol string) bool {
+	if subprotocol == "" {
+		return true
+	}
+	for _, p := range websocket.Subprotocols(r) {
+		if p == subprotocol {
+			return true
+		}
+	}
+	return false
+}
+
+// checkNegotiatedSubprotocol client端 server选的子协议必须和配置的一致
+func checkNegotiatedSubprotocol(conn *websocket.Conn, subprotocol string) error {
+	if got := conn.Subprotocol(); got != subprotocol {
+		return fmt.Errorf("%w: want %q got %q", ErrWSSubprotocolMismatch, subprotocol, got)
+	}
+	return nil
+}
+
+// checkWSHeaders websocket握手自己的header不能被覆盖
+func checkWSHeaders(headers map[string]string) error {
+	for k := range headers {
+		switch http.CanonicalHeaderKey(k) {
+		case "Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions", "Sec-Websocket-Protocol":
+			return fmt.Errorf("ws_headers can not set %s", k)
+		}
+	}
+	return nil
+}
+
+// wsHeaderHostname ws_headers里Host去掉端口的部分 没有配置时为空
+func wsHeaderHostname(headers map[string]string) string {
+	for k, v := range headers {
+		if http.CanonicalHeaderKey(k) != "Host" {
+			continue
+		}
+		if host, _, err := net.SplitHostPort(v); err == nil {
+			return host
+		}
+		return v
+	}
+	return ""
+}
+
 type WsConn struct {
 	conn *websocket.Conn
 	rb   []byte
+
+	closeOnce sync.Once
+	closed    chan struct{}
 }
 
+// Read 出错之后ws连接就不能再用了 直接关掉 让等Done的session知道对端已经断开
 func (c *WsConn) Read(b []byte) (n int, err error) {
 	if len(c.rb) == 0 {
-		_, c.rb, err = c.conn.ReadMessage()
+		if _, c.rb, err = c.conn.ReadMessage(); err != nil {
+			c.Close()
+			return 0, err
+		}
 	}
 	n = copy(b, c.rb)
 	c.rb = c.rb[n:]
@@ -31,9 +137,47 @@ func (c *WsConn) Write(b []byte) (n int, err error) {
 }
 
 func (c *WsConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
 	return c.conn.Close()
 }
 
+// Done 在Close之后关闭 包括keepalive超时主动关闭和读出错的时候
+func (c *WsConn) Done() <-chan struct{} {
+	return c.closed
+}
+
+// keepalive 每interval发送一个ping 超过interval+timeout没有收到pong就关闭连接 interval不大于0时不开启
+// 需要在开始读之前调用 pong只在读的时候处理 smux和transport都会一直读
+func (c *WsConn) keepalive(interval, timeout time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	lastPong := time.Now().UnixNano()
+	c.conn.SetPongHandler(func(string) error {
+		atomic.StoreInt64(&lastPong, time.Now().UnixNano())
+		return nil
+	})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.closed:
+				return
+			case <-ticker.C:
+			}
+			if since := time.Since(time.Unix(0, atomic.LoadInt64(&lastPong))); since > interval+timeout {
+				Logger.Warnf("[ws] %s no pong for %s, closing", c.RemoteAddr(), since)
+				c.Close()
+				return
+			}
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(timeout)); err != nil {
+				Logger.Debugf("[ws] %s write ping error: %s", c.RemoteAddr(), err)
+			}
+		}
+	}()
+}
+
 func (c *WsConn) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
 }
@@ -57,84 +201,189 @@ func (c *WsConn) SetWriteDeadline(t time.Time) error {
 }
 
 func newWsConn(conn *websocket.Conn) *WsConn {
-	wsc := &WsConn{conn: conn}
+	wsc := &WsConn{conn: conn, closed: make(chan struct{})}
 	return wsc
 }
 
-func (relay *Relay) RunLocalWSSServer() error {
-	http.HandleFunc("/tcp/", relay.handleWsToTcp)
-	http.HandleFunc("/udp/", relay.handleWsToUdp)
-	// fake
-	http.HandleFunc("/", index)
+func (r *Relay) wsPingInterval() time.Duration {
+	return time.Duration(r.cfg.WSPingIntervalSec) * time.Second
+}
 
-	server := &http.Server{
-		Addr:              relay.LocalTCPAddr.String(),
-		TLSConfig:         DefaultTLSConfig,
+func (r *Relay) wsPongTimeout() time.Duration {
+	return time.Duration(r.cfg.WSPongTimeoutSec) * time.Second
+}
+
+// newHTTPServer wss/mwss server共用 ReadTimeout在升级成websocket之后要清掉
+func (relay *Relay) newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              relay.cfg.Listen,
+		Handler:           handler,
+		TLSConfig:         relay.serverTLSConfig(),
 		ReadHeaderTimeout: 30 * time.Second,
+		ReadTimeout:       time.Duration(relay.cfg.HTTPReadTimeoutSec) * time.Second,
+		MaxHeaderBytes:    relay.cfg.HTTPMaxHeaderBytes,
+	}
+}
+
+func (relay *Relay) RunLocalWSSServer() error {
+	// 每个relay自己的mux reload之后同一个进程里会再注册一次
+	mux := http.NewServeMux()
+	mux.HandleFunc(relay.cfg.WSPath, relay.handleWsToTcp)
+	mux.HandleFunc(relay.cfg.WSPath+"udp/", relay.handleWsToUdp)
+	if relay.cfg.WSPath == DefaultWSPath {
+		// 兼容旧版本的udp路径 自定义了ws_path时不注册
+		mux.HandleFunc("/udp/", relay.handleWsToUdp)
 	}
-	ln, err := net.Listen("tcp", relay.LocalTCPAddr.String())
+	// fake
+	mux.Handle("/", relay.fakeIndex)
+
+	server := relay.newHTTPServer(mux)
+	ln, err := relay.listenStream()
 	if err != nil {
 		return err
 	}
 	defer ln.Close()
+	relay.trackListener(server)
+	relay.listenerReady()
 	return server.Serve(tls.NewListener(ln, server.TLSConfig))
 }
 
+// 伪装成一个普通的静态页面 带上和真实静态站一样的缓存头
+var (
+	indexContent = []byte(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Welcome</title></head>
+<body><h1>It works!</h1></body>
+</html>
+`)
+	indexModTime = time.Now().UTC().Truncate(time.Second)
+	indexETag    = fmt.Sprintf(`"%x"`, sha1.Sum(indexContent))
+)
+
 func index(w http.ResponseWriter, r *http.Request) {
-	Logger.Infof("index call from %s", r.RemoteAddr)
-	fmt.Fprintf(w, "access from %s \n", r.RemoteAddr)
+	Logger.Debugf("index call from %s", r.RemoteAddr)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=3600")
+	w.Header().Set("ETag", indexETag)
+	// ServeContent 会处理If-None-Match/If-Modified-Since 返回304
+	http.ServeContent(w, r, "index.html", indexModTime, bytes.NewReader(indexContent))
 }
 
 func (relay *Relay) handleWsToTcp(w http.ResponseWriter, r *http.Request) {
-	var upgrader = websocket.Upgrader{}
+	if !websocket.IsWebSocketUpgrade(r) || !relay.scheduleOpen() {
+		relay.fakeIndex.ServeHTTP(w, r)
+		return
+	}
+	if !relay.allowAddr(r.RemoteAddr) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	release, ok := relay.acquireConn()
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+	limiter := handshakes
+	if !limiter.acquire("server") {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	if !checkAuthToken(r, relay.cfg.AuthToken) {
+		limiter.release()
+		Logger.Warnf("[wss] %s auth token mismatch", r.RemoteAddr)
+		// 和不是ws请求一样返回伪装页面 扫描的时候看不出区别
+		relay.fakeIndex.ServeHTTP(w, r)
+		return
+	}
+	if !checkWSSubprotocol(r, relay.cfg.WSSubprotocol) {
+		Logger.Warnf("[wss] %s subprotocol mismatch: %v", r.RemoteAddr, websocket.Subprotocols(r))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	var upgrader = websocket.Upgrader{Subprotocols: wsSubprotocols(relay.cfg.WSSubprotocol)}
 	conn, err := upgrader.Upgrade(w, r, nil)
+	limiter.release()
 	if err != nil {
 		return
 	}
 	wsc := newWsConn(conn)
 	defer wsc.Close()
-	rc, err := net.Dial("tcp", relay.RemoteTCPAddr)
+	// http server的ReadTimeout只管伪装页面 升级之后清掉
+	wsc.SetReadDeadline(time.Time{})
+	wsc.keepalive(relay.wsPingInterval(), relay.wsPongTimeout())
+	lc, cs := relay.traceConn(wsc, "ehco.wss.server")
+	dialDone := cs.phase("dial")
+	rc, remote, err := relay.dialBackend()
+	dialDone(err)
 	if err != nil {
-		Logger.Infof("dial error: %s", err)
+		cs.end(remote, err)
+		cs.log.Warnf("dial error: %s", err)
 		return
 	}
 	defer rc.Close()
-	Logger.Infof("handleWsToTcp from:%s to:%s", wsc.RemoteAddr(), rc.RemoteAddr())
+	relay.conns.add(remote, wsc)
+	defer relay.conns.remove(remote, wsc)
+	relay.logAccess(cs, "handleWsToTcp", "from", wsc.RemoteAddr(), "to", rc.RemoteAddr())
 	if err := wsc.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
-		Logger.Infof("set deadline error: %s", err)
+		cs.end(remote, err)
 		return
 	}
 	if err := rc.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
-		Logger.Infof("set deadline error: %s", err)
+		cs.end(remote, err)
 		return
 	}
-	transport(rc, wsc)
+	relay.connOpened(cs, wsc.RemoteAddr(), remote)
+	_, err = transport(lc, rc, relay.cfg)
+	cs.end(remote, err)
 }
 
-func (relay *Relay) handleTcpOverWs(c *net.TCPConn) error {
-	defer c.Close()
-	d := websocket.Dialer{TLSClientConfig: DefaultTLSConfig}
-	conn, resp, err := d.Dial(relay.RemoteTCPAddr+"/tcp/", nil)
+// wsTransporter 每次dial都新建一个websocket连接
+type wsTransporter struct {
+	relay *Relay
+}
+
+func (tr *wsTransporter) Dial(ctx context.Context, addr string) (net.Conn, error) {
+	limiter := handshakes
+	if !limiter.acquire("client") {
+		return nil, ErrTooManyHandshakes
+	}
+	defer limiter.release()
+	d := websocket.Dialer{
+		TLSClientConfig: tr.relay.clientTLSConfig(),
+		Subprotocols:    wsSubprotocols(tr.relay.cfg.WSSubprotocol),
+	}
+	addr, err := tr.relay.wsDialURL(addr)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	resp.Body.Close()
-	wsc := newWsConn(conn)
-	defer wsc.Close()
-	if err := wsc.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
-		return err
+	conn, resp, err := d.DialContext(ctx, addr, tr.relay.wsDialHeader())
+	if err != nil {
+		return nil, err
 	}
-	if err := c.SetDeadline(time.Now().Add(TransportDeadLine)); err != nil {
-		return err
+	resp.Body.Close()
+	if err := checkNegotiatedSubprotocol(conn, tr.relay.cfg.WSSubprotocol); err != nil {
+		conn.Close()
+		return nil, err
 	}
-	transport(c, wsc)
+	wsc := newWsConn(conn)
+	wsc.keepalive(tr.relay.wsPingInterval(), tr.relay.wsPongTimeout())
+	return wsc, nil
+}
+
+func (tr *wsTransporter) Close() error {
 	return nil
 }
 
 func (relay *Relay) handleWsToUdp(w http.ResponseWriter, r *http.Request) {
+	if !websocket.IsWebSocketUpgrade(r) {
+		relay.fakeIndex.ServeHTTP(w, r)
+		return
+	}
 	Logger.Info("not support relay udp over ws currently")
 }
 
 func (relay *Relay) handleUdpOverWs(addr string, ubc *udpBufferCh) {
+	defer relay.removeUbc(addr, ubc)
 	Logger.Info("not support relay udp over ws currently")
 }
@@ -0,0 +1,98 @@
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialTestWs server端readLoop为true时一直读 读的时候会自动回复pong
+func dialTestWs(t *testing.T, readLoop bool) (*WsConn, func()) {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if !readLoop {
+			time.Sleep(2 * time.Second)
+			return
+		}
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		srv.Close()
+		t.Fatal(err)
+	}
+	wsc := newWsConn(conn)
+	return wsc, func() {
+		wsc.Close()
+		srv.Close()
+	}
+}
+
+func TestWsKeepalive(t *testing.T) {
+	interval, timeout := 50*time.Millisecond, 50*time.Millisecond
+
+	alive, cleanup := dialTestWs(t, true)
+	defer cleanup()
+	alive.keepalive(interval, timeout)
+	go alive.Read(make([]byte, 1))
+
+	dead, cleanup2 := dialTestWs(t, false)
+	defer cleanup2()
+	dead.keepalive(interval, timeout)
+	go dead.Read(make([]byte, 1))
+
+	select {
+	case <-dead.Done():
+	case <-time.After(time.Second):
+		t.Fatal("conn without pong not closed")
+	}
+	select {
+	case <-alive.Done():
+		t.Fatal("conn with pong closed")
+	default:
+	}
+}
+
+func TestWSPath(t *testing.T) {
+	p, err := RandomWSPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(p, "/") || !strings.HasSuffix(p, "/") || len(p) != 34 {
+		t.Fatalf("bad random ws path %q", p)
+	}
+	for _, c := range []struct {
+		cfg  RelayConfig
+		want string
+	}{
+		{RelayConfig{}, DefaultWSPath},
+		{RelayConfig{WSPath: "abc"}, "/abc/"},
+		{RelayConfig{MWSSPath: "/old/"}, "/old/"},
+		{RelayConfig{WSPath: "/new/", MWSSPath: "/old/"}, "/new/"},
+	} {
+		cfg := c.cfg
+		cfg.Listen = "127.0.0.1:0"
+		cfg.ListenType = Listen_WSS
+		cfg.Remote = "127.0.0.1:1"
+		cfg.TransportType = Transport_RAW
+		if _, err := NewRelayWithConfig(&cfg); err != nil {
+			t.Fatal(err)
+		}
+		if cfg.WSPath != c.want {
+			t.Fatalf("want ws path %s got %s", c.want, cfg.WSPath)
+		}
+	}
+}
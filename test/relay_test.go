@@ -2,6 +2,8 @@ package test
 
 import (
 	"github.com/Ehco1996/ehco/internal/relay"
+	"io"
+	"net"
 	"testing"
 	"time"
 )
@@ -17,6 +19,22 @@ var wsListen = "0.0.0.0:1236"
 var wsLocal = "0.0.0.0:1235"
 var wsRemote = "wss://0.0.0.0:1236"
 
+var mwssListen = "0.0.0.0:1238"
+
+var mwssLocal = "0.0.0.0:1237"
+var mwssRemote = "wss://0.0.0.0:1238"
+
+var socks5MWSSListen = "0.0.0.0:1239"
+
+var socks5Local = "0.0.0.0:1243"
+var socks5MWSSRemote = "wss://0.0.0.0:1239"
+
+// entry -> middle -> exit -> echo
+var chainMiddleListen = "0.0.0.0:1244"
+var chainExitListen = "0.0.0.0:1245"
+var chainLocal = "0.0.0.0:1246"
+var chainBrokenLocal = "0.0.0.0:1247"
+
 func init() {
 	// Start the new echo server.
 	go RunEchoServer(echoHost, echoPort)
@@ -52,6 +70,86 @@ func init() {
 		stop := make(chan error)
 		stop <- r.ListenAndServe()
 	}()
+	// Start relay listen mwss server
+	go func() {
+		r, err := relay.NewRelay(mwssListen, relay.Listen_MWSS, rawRemote, relay.Transport_RAW)
+		if err != nil {
+			panic(err)
+		}
+		stop := make(chan error)
+		stop <- r.ListenAndServe()
+	}()
+	// Start relay over mwss server
+	go func() {
+		r, err := relay.NewRelay(mwssLocal, relay.Listen_RAW, mwssRemote, relay.Transport_MWSS)
+		if err != nil {
+			panic(err)
+		}
+		stop := make(chan error)
+		stop <- r.ListenAndServe()
+	}()
+	// Start relay listen mwss server which dials the target from socks5 client
+	go func() {
+		r, err := relay.NewRelayWithConfig(&relay.RelayConfig{
+			Listen:             socks5MWSSListen,
+			ListenType:         relay.Listen_MWSS,
+			Remote:             rawRemote,
+			TransportType:      relay.Transport_RAW,
+			AllowConnectTarget: true,
+		})
+		if err != nil {
+			panic(err)
+		}
+		stop := make(chan error)
+		stop <- r.ListenAndServe()
+	}()
+	// Start socks5 relay over mwss
+	go func() {
+		r, err := relay.NewRelay(socks5Local, relay.Listen_SOCKS5, socks5MWSSRemote, relay.Transport_MWSS)
+		if err != nil {
+			panic(err)
+		}
+		stop := make(chan error)
+		stop <- r.ListenAndServe()
+	}()
+	// Start the middle and exit nodes of the chain
+	for _, listen := range []string{chainMiddleListen, chainExitListen} {
+		go func(listen string) {
+			r, err := relay.NewRelayWithConfig(&relay.RelayConfig{
+				Listen:             listen,
+				ListenType:         relay.Listen_MWSS,
+				Remote:             rawRemote,
+				TransportType:      relay.Transport_RAW,
+				AllowConnectTarget: true,
+			})
+			if err != nil {
+				panic(err)
+			}
+			stop := make(chan error)
+			stop <- r.ListenAndServe()
+		}(listen)
+	}
+	// Start the entry of the chain, the broken one has no exit node listening
+	chains := map[string][]string{
+		chainLocal:       {"wss://" + chainMiddleListen, "wss://" + chainExitListen},
+		chainBrokenLocal: {"wss://" + chainMiddleListen, "wss://0.0.0.0:1248"},
+	}
+	for local, chain := range chains {
+		go func(local string, chain []string) {
+			r, err := relay.NewRelayWithConfig(&relay.RelayConfig{
+				Listen:        local,
+				ListenType:    relay.Listen_RAW,
+				Remote:        rawRemote,
+				TransportType: relay.Transport_MWSS,
+				Chain:         chain,
+			})
+			if err != nil {
+				panic(err)
+			}
+			stop := make(chan error)
+			stop <- r.ListenAndServe()
+		}(local, chain)
+	}
 	// wait for  init
 	time.Sleep(time.Second)
 }
@@ -84,6 +182,78 @@ func TestRelayOverWs(t *testing.T) {
 	t.Log("test tcp over ws down!")
 }
 
+func TestRelayOverMWSS(t *testing.T) {
+	msg := []byte("hello")
+	// test tcp
+	res := SendTcpMsg(msg, mwssLocal)
+	if string(res) != string(msg) {
+		t.Fatal(res)
+	}
+	t.Log("test tcp over mwss down!")
+
+	// test udp
+	res = SendUdpMsg(msg, mwssLocal)
+	if string(res) != string(msg) {
+		t.Fatal(res)
+	}
+	t.Log("test udp over mwss down!")
+}
+
+func TestRelaySOCKS5OverMWSS(t *testing.T) {
+	conn, err := net.Dial("tcp", socks5Local)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// no auth
+	conn.Write([]byte{0x05, 0x01, 0x00})
+	buf := make([]byte, 10)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil || buf[1] != 0x00 {
+		t.Fatalf("method reply %v err %v", buf[:2], err)
+	}
+	// CONNECT 127.0.0.1:echoPort
+	conn.Write([]byte{0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, byte(echoPort >> 8), byte(echoPort)})
+	if _, err := io.ReadFull(conn, buf); err != nil || buf[1] != 0x00 {
+		t.Fatalf("connect reply %v err %v", buf, err)
+	}
+
+	msg := []byte("hello")
+	conn.Write(msg)
+	res := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, res); err != nil {
+		t.Fatal(err)
+	}
+	if string(res) != string(msg) {
+		t.Fatal(res)
+	}
+	t.Log("test socks5 over mwss down!")
+}
+
+func TestRelayOverMWSSChain(t *testing.T) {
+	msg := []byte("hello")
+	res := SendTcpMsg(msg, chainLocal)
+	if string(res) != string(msg) {
+		t.Fatal(res)
+	}
+	t.Log("test tcp over mwss chain down!")
+
+	// exit节点不可用时entry上的连接直接被关闭
+	conn, err := net.Dial("tcp", chainBrokenLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(msg)
+	if n, err := conn.Read(make([]byte, len(msg))); err == nil {
+		t.Fatalf("broken chain should close the conn, read %d bytes", n)
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("broken chain conn not closed")
+	}
+}
+
 func BenchmarkTcpRelay(b *testing.B) {
 	msg := []byte("hello")
 	for i := 0; i <= b.N; i++ {